@@ -0,0 +1,80 @@
+package helm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/helmpath"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// latestChartVersion returns the latest version of the chart published in its
+// repository, including the development versions if `devel` is set. Charts
+// referenced by a URL repository are looked up in its latest index, the others
+// in the cached index of the repository. An empty version is returned for
+// local charts.
+func latestChartVersion(d resourceGetter, m *Meta) (string, error) {
+	repositoryURL, name, err := resolveChartName(d.Get("repository").(string), strings.TrimSpace(d.Get("chart").(string)))
+	if err != nil {
+		return "", err
+	}
+
+	var index *repo.IndexFile
+	if repositoryURL != "" {
+		index, err = downloadRepositoryIndex(d, m, repositoryURL)
+	} else {
+		if _, err := os.Stat(name); err == nil {
+			return "", nil
+		}
+
+		parts := strings.SplitN(name, "/", 2)
+		if len(parts) != 2 {
+			return "", nil
+		}
+
+		name = parts[1]
+		index, err = repo.LoadIndexFile(filepath.Join(m.Settings.RepositoryCache, helmpath.CacheIndexFile(parts[0])))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	constraint := ""
+	if d.Get("devel").(bool) {
+		constraint = ">0.0.0-0"
+	}
+
+	cv, err := index.Get(name, constraint)
+	if err != nil {
+		return "", err
+	}
+
+	return cv.Version, nil
+}
+
+func downloadRepositoryIndex(d resourceGetter, m *Meta, repositoryURL string) (*repo.IndexFile, error) {
+	if err := checkRepositoryURL(m, repositoryURL); err != nil {
+		return nil, err
+	}
+
+	username, password, err := repositoryCredentials(d, m)
+	if err != nil {
+		return nil, err
+	}
+
+	// the index is cached under a name derived from the URL, and downloaded
+	// again only when the repository reports that it changed
+	sum := sha256.Sum256([]byte(repositoryURL))
+	return downloadIndexFile(m, &repo.Entry{
+		Name:     "url-" + hex.EncodeToString(sum[:8]),
+		URL:      repositoryURL,
+		Username: username,
+		Password: password,
+		CertFile: d.Get("repository_cert_file").(string),
+		KeyFile:  d.Get("repository_key_file").(string),
+		CAFile:   d.Get("repository_ca_file").(string),
+	}, m.Settings.RepositoryCache)
+}
@@ -0,0 +1,67 @@
+package helm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"helm.sh/helm/v3/pkg/cli"
+)
+
+func TestLatestChartVersion(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/index.yaml" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`apiVersion: v1
+entries:
+  test-chart:
+  - name: test-chart
+    version: 1.2.3
+  - name: test-chart
+    version: 2.1.0-rc.1
+  - name: test-chart
+    version: 2.0.0
+`))
+	}))
+	defer server.Close()
+
+	m := &Meta{Settings: cli.New(), RepositoryPlainHTTP: true}
+	m.Settings.RepositoryCache = t.TempDir()
+	for devel, expected := range map[bool]string{false: "2.0.0", true: "2.1.0-rc.1"} {
+		d := schema.TestResourceDataRaw(t, resourceRelease().Schema, map[string]interface{}{
+			"name":       "test",
+			"repository": server.URL,
+			"chart":      "test-chart",
+			"devel":      devel,
+		})
+
+		version, err := latestChartVersion(d, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != expected {
+			t.Errorf("devel %t: expected version %q, got %q", devel, expected, version)
+		}
+	}
+
+	m.RepositoryPlainHTTP = false
+	d := schema.TestResourceDataRaw(t, resourceRelease().Schema, map[string]interface{}{
+		"name":       "test",
+		"repository": server.URL,
+		"chart":      "test-chart",
+	})
+	if _, err := latestChartVersion(d, m); err == nil {
+		t.Error("expected the plain HTTP repository to be refused without repository_plain_http")
+	}
+
+	d = schema.TestResourceDataRaw(t, resourceRelease().Schema, map[string]interface{}{
+		"name":  "test",
+		"chart": "testdata/charts/test-chart",
+	})
+	if version, err := latestChartVersion(d, m); err != nil || version != "" {
+		t.Errorf("expected no version for a local chart, got %q, %v", version, err)
+	}
+}
@@ -0,0 +1,70 @@
+package helm
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/kube"
+	"helm.sh/helm/v3/pkg/release"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+)
+
+// maxCreatedResources bounds the number of objects reported in
+// `created_resources`
+const maxCreatedResources = 500
+
+// setCreatedResources sets `created_resources` to the objects of the release
+// read from the cluster if `record_created_resources` is set, and clears it
+// otherwise
+func setCreatedResources(d *schema.ResourceData, cfg *action.Configuration, r *release.Release) error {
+	if !d.Get("record_created_resources").(bool) {
+		return d.Set("created_resources", []map[string]interface{}{})
+	}
+
+	resources, err := cfg.KubeClient.Build(bytes.NewBufferString(r.Manifest), false)
+	if err != nil {
+		return fmt.Errorf("unable to build kubernetes objects from the release manifest: %w", err)
+	}
+
+	if len(resources) > maxCreatedResources {
+		log.Printf("[WARN] Release %s has %d objects, only the first %d are reported", r.Name, len(resources), maxCreatedResources)
+		resources = resources[:maxCreatedResources]
+	}
+
+	for _, info := range resources {
+		if err := info.Get(); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return fmt.Errorf("unable to get %s %s/%s: %w", info.Mapping.GroupVersionKind.Kind, info.Namespace, info.Name, err)
+			}
+			log.Printf("[WARN] %s %s/%s of release %s not found", info.Mapping.GroupVersionKind.Kind, info.Namespace, info.Name, r.Name)
+		}
+	}
+
+	return d.Set("created_resources", createdResources(resources))
+}
+
+// createdResources returns the attributes of the objects read from the
+// cluster, leaving out the ones that were not found
+func createdResources(resources kube.ResourceList) []map[string]interface{} {
+	results := make([]map[string]interface{}, 0, len(resources))
+	for _, info := range resources {
+		accessor, err := meta.Accessor(info.Object)
+		if err != nil || accessor.GetUID() == "" {
+			continue
+		}
+
+		gvk := info.Object.GetObjectKind().GroupVersionKind()
+		results = append(results, map[string]interface{}{
+			"api_version": gvk.GroupVersion().String(),
+			"kind":        gvk.Kind,
+			"namespace":   accessor.GetNamespace(),
+			"name":        accessor.GetName(),
+			"uid":         string(accessor.GetUID()),
+		})
+	}
+	return results
+}
@@ -0,0 +1,52 @@
+package helm
+
+import (
+	"reflect"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/kube"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/cli-runtime/pkg/resource"
+)
+
+func TestCreatedResources(t *testing.T) {
+	object := func(apiVersion, kind, namespace, name, uid string) *resource.Info {
+		obj := &unstructured.Unstructured{}
+		obj.SetAPIVersion(apiVersion)
+		obj.SetKind(kind)
+		obj.SetNamespace(namespace)
+		obj.SetName(name)
+		if uid != "" {
+			obj.SetUID(types.UID(uid))
+		}
+		return &resource.Info{Namespace: namespace, Name: name, Object: obj}
+	}
+
+	resources := kube.ResourceList{
+		object("v1", "ServiceAccount", "default", "test", "0b7bd3a5-9e7d-4c1e-9d3c-7cbd2f6f1c11"),
+		object("rbac.authorization.k8s.io/v1", "ClusterRole", "", "test", "5c0f6e52-3f39-4a8e-bb0a-0a4b7f0e9d22"),
+		// not found in the cluster, so without UID
+		object("apps/v1", "Deployment", "default", "test", ""),
+	}
+
+	expected := []map[string]interface{}{
+		{
+			"api_version": "v1",
+			"kind":        "ServiceAccount",
+			"namespace":   "default",
+			"name":        "test",
+			"uid":         "0b7bd3a5-9e7d-4c1e-9d3c-7cbd2f6f1c11",
+		},
+		{
+			"api_version": "rbac.authorization.k8s.io/v1",
+			"kind":        "ClusterRole",
+			"namespace":   "",
+			"name":        "test",
+			"uid":         "5c0f6e52-3f39-4a8e-bb0a-0a4b7f0e9d22",
+		},
+	}
+	if actual := createdResources(resources); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %#v, got %#v", expected, actual)
+	}
+}
@@ -0,0 +1,250 @@
+package helm
+
+import (
+	"context"
+	"os"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+func dataChartDependencies() *schema.Resource {
+	return &schema.Resource{
+		ReadContext: dataChartDependenciesRead,
+		Schema: mergeSchemas(repositorySchema(), map[string]*schema.Schema{
+			"chart": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "Chart name to be inspected. A path may be used.",
+			},
+			"version": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				Description: "Specify the exact chart version to inspect. If this is not specified, the latest version is used.",
+			},
+			"devel": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Use chart development versions, too. Equivalent to version '>0.0.0-0'. If `version` is set, this is ignored",
+			},
+			"verify": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     defaultAttributes["verify"],
+				Description: "Verify the package before using it.",
+			},
+			"keyring": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     os.ExpandEnv("$HOME/.gnupg/pubring.gpg"),
+				Description: "Location of public keys used for verification. Used only if `verify` is true",
+			},
+			"keyring_url": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "HTTPS URL of the public keys used for verification. The keys are fetched and cached, and take precedence over `keyring`. Used only if `verify` is true",
+			},
+			"values": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "List of values in raw yaml format used to evaluate the conditions and tags of the dependencies.",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+			"set_map": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Description: "Map of values to be merged with the values, keyed by the dotted path of the value as in `set`.",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+			"set": {
+				Type:        schema.TypeSet,
+				Optional:    true,
+				Description: "Custom values to be merged with the values.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+						"value": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+						"type": {
+							Type:     schema.TypeString,
+							Optional: true,
+							ValidateFunc: validation.StringInSlice([]string{
+								"auto", "string",
+							}, false),
+						},
+					},
+				},
+			},
+			"set_sensitive": {
+				Type:        schema.TypeSet,
+				Optional:    true,
+				Description: "Custom sensitive values to be merged with the values.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+						"value": {
+							Type:      schema.TypeString,
+							Required:  true,
+							Sensitive: true,
+						},
+						"type": {
+							Type:     schema.TypeString,
+							Optional: true,
+							ValidateFunc: validation.StringInSlice([]string{
+								"auto", "string",
+							}, false),
+						},
+					},
+				},
+			},
+			"dependencies": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "The dependencies of the chart and of its subcharts, in depth-first order.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "Name of the dependency.",
+						},
+						"alias": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "Alias of the dependency.",
+						},
+						"version": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "Version constraint of the dependency.",
+						},
+						"repository": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "Repository of the dependency.",
+						},
+						"condition": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "Condition enabling the dependency.",
+						},
+						"enabled": {
+							Type:        schema.TypeBool,
+							Computed:    true,
+							Description: "Whether the dependency is enabled with the given values.",
+						},
+						"parent": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "Path of the chart declaring the dependency, with the chart names separated by `/`.",
+						},
+					},
+				},
+			},
+		}),
+	}
+}
+
+func dataChartDependenciesRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	m := meta.(*Meta)
+
+	cpo, chartName, err := chartPathOptions(d, m)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	c, _, err := getChart(d, m, chartName, cpo)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	values, err := getValues(d)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	dependencies, err := chartDependencies(c, values)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	d.SetId(c.Metadata.Name)
+
+	if err := d.Set("version", c.Metadata.Version); err != nil {
+		return diag.FromErr(err)
+	}
+
+	if err := d.Set("dependencies", dependencies); err != nil {
+		return diag.FromErr(err)
+	}
+
+	return nil
+}
+
+type chartDependency struct {
+	dependency *chart.Dependency
+	name       string
+	parent     string
+}
+
+// chartDependencies returns the dependency tree of the chart flattened in
+// depth-first order, flagging the dependencies enabled by the given values
+func chartDependencies(c *chart.Chart, values map[string]interface{}) ([]map[string]interface{}, error) {
+	dependencies := collectDependencies(c, c.Name())
+
+	// ProcessDependencies sets the enabled state of the dependencies, it
+	// removes the disabled ones from the chart, so they are collected first
+	if err := chartutil.ProcessDependencies(c, values); err != nil {
+		return nil, err
+	}
+
+	out := make([]map[string]interface{}, 0, len(dependencies))
+	for _, dep := range dependencies {
+		out = append(out, map[string]interface{}{
+			"name":       dep.name,
+			"alias":      dep.dependency.Alias,
+			"version":    dep.dependency.Version,
+			"repository": dep.dependency.Repository,
+			"condition":  dep.dependency.Condition,
+			"enabled":    dep.dependency.Enabled,
+			"parent":     dep.parent,
+		})
+	}
+
+	return out, nil
+}
+
+func collectDependencies(c *chart.Chart, path string) []chartDependency {
+	dependencies := []chartDependency{}
+	for _, req := range c.Metadata.Dependencies {
+		dependencies = append(dependencies, chartDependency{
+			dependency: req,
+			name:       req.Name,
+			parent:     path,
+		})
+
+		for _, sub := range c.Dependencies() {
+			if sub.Name() == req.Name && chartutil.IsCompatibleRange(req.Version, sub.Metadata.Version) {
+				name := req.Name
+				if req.Alias != "" {
+					name = req.Alias
+				}
+				dependencies = append(dependencies, collectDependencies(sub, path+"/"+name)...)
+				break
+			}
+		}
+	}
+	return dependencies
+}
@@ -0,0 +1,90 @@
+package helm
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+	"helm.sh/helm/v3/pkg/chart/loader"
+)
+
+const testNestedUmbrellaChartPath = "./testdata/dependency-charts/nested-umbrella-chart"
+
+func TestChartDependencies(t *testing.T) {
+	c, err := loader.Load(testNestedUmbrellaChartPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dependencies, err := chartDependencies(c, map[string]interface{}{
+		"standalone": map[string]interface{}{"enabled": false},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []map[string]interface{}{
+		{
+			"name":       "middle",
+			"alias":      "",
+			"version":    "0.1.0",
+			"repository": "file://charts/middle",
+			"condition":  "middle.enabled",
+			"enabled":    true,
+			"parent":     "nested-umbrella-chart",
+		},
+		{
+			"name":       "leaf",
+			"alias":      "",
+			"version":    "0.1.0",
+			"repository": "file://charts/leaf",
+			"condition":  "leaf.enabled",
+			"enabled":    false,
+			"parent":     "nested-umbrella-chart/middle",
+		},
+		{
+			"name":       "leaf",
+			"alias":      "standalone",
+			"version":    "0.1.0",
+			"repository": "https://charts.example.com",
+			"condition":  "standalone.enabled",
+			"enabled":    false,
+			"parent":     "nested-umbrella-chart",
+		},
+	}
+
+	if !reflect.DeepEqual(dependencies, expected) {
+		t.Fatalf("expected %v, got %v", expected, dependencies)
+	}
+}
+
+func TestAccDataChartDependencies_basic(t *testing.T) {
+	datasourceAddress := fmt.Sprintf("data.helm_chart_dependencies.%s", testResourceName)
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:  func() { testAccPreCheck(t) },
+		Providers: testAccProviders,
+		Steps: []resource.TestStep{{
+			Config: testAccDataHelmChartDependenciesConfigBasic(testResourceName),
+			Check: resource.ComposeAggregateTestCheckFunc(
+				resource.TestCheckResourceAttr(datasourceAddress, "version", "0.1.0"),
+				resource.TestCheckResourceAttr(datasourceAddress, "dependencies.#", "3"),
+				resource.TestCheckResourceAttr(datasourceAddress, "dependencies.0.name", "middle"),
+				resource.TestCheckResourceAttr(datasourceAddress, "dependencies.0.enabled", "true"),
+				resource.TestCheckResourceAttr(datasourceAddress, "dependencies.1.parent", "nested-umbrella-chart/middle"),
+				resource.TestCheckResourceAttr(datasourceAddress, "dependencies.1.enabled", "false"),
+				resource.TestCheckResourceAttr(datasourceAddress, "dependencies.2.alias", "standalone"),
+				resource.TestCheckResourceAttr(datasourceAddress, "dependencies.2.enabled", "true"),
+			),
+		}},
+	})
+}
+
+func testAccDataHelmChartDependenciesConfigBasic(resource string) string {
+	return fmt.Sprintf(`
+		data "helm_chart_dependencies" "%s" {
+			chart = %q
+		}
+	`, resource, testNestedUmbrellaChartPath)
+}
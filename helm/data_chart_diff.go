@@ -0,0 +1,360 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+	"github.com/pmezard/go-difflib/difflib"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"sigs.k8s.io/yaml"
+)
+
+func dataChartDiff() *schema.Resource {
+	return &schema.Resource{
+		ReadContext: dataChartDiffRead,
+		Schema: mergeSchemas(repositorySchema(), map[string]*schema.Schema{
+			"name": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "release-name",
+				Description: "Release name the chart is rendered with.",
+			},
+			"namespace": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "default",
+				Description: "Namespace the chart is rendered for.",
+			},
+			"chart": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "Chart name to be rendered.",
+			},
+			"from_version": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "Version of the chart the diff is computed from.",
+			},
+			"to_version": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "Version of the chart the diff is computed to.",
+			},
+			"devel": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Use chart development versions, too, when resolving version constraints.",
+			},
+			"verify": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     defaultAttributes["verify"],
+				Description: "Verify the packages before using them.",
+			},
+			"keyring": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     os.ExpandEnv("$HOME/.gnupg/pubring.gpg"),
+				Description: "Location of public keys used for verification. Used only if `verify` is true",
+			},
+			"keyring_url": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "HTTPS URL of the public keys used for verification. The keys are fetched and cached, and take precedence over `keyring`. Used only if `verify` is true",
+			},
+			"api_versions": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "Kubernetes api versions used for Capabilities.APIVersions",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+			"values": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "List of values in raw yaml format both versions are rendered with.",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+			"set_map": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Description: "Map of values to be merged with the values, keyed by the dotted path of the value as in `set`.",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+			"set": {
+				Type:        schema.TypeSet,
+				Optional:    true,
+				Description: "Custom values to be merged with the values.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+						"value": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+						"type": {
+							Type:     schema.TypeString,
+							Optional: true,
+							ValidateFunc: validation.StringInSlice([]string{
+								"auto", "string",
+							}, false),
+						},
+					},
+				},
+			},
+			"set_sensitive": {
+				Type:        schema.TypeSet,
+				Optional:    true,
+				Description: "Custom sensitive values to be merged with the values.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+						"value": {
+							Type:      schema.TypeString,
+							Required:  true,
+							Sensitive: true,
+						},
+						"type": {
+							Type:     schema.TypeString,
+							Optional: true,
+							ValidateFunc: validation.StringInSlice([]string{
+								"auto", "string",
+							}, false),
+						},
+					},
+				},
+			},
+			"diff": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Unified diff of the objects rendered by the two versions.",
+			},
+			"added": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "Objects only rendered by `to_version`.",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+			"removed": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "Objects only rendered by `from_version`.",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+			"changed": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "Objects rendered by both versions that differ.",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+		}),
+	}
+}
+
+// dataChartDiffRead renders the chart at two versions with the same values,
+// client side like helm template, and diffs the rendered objects. Nothing is
+// sent to the cluster.
+func dataChartDiffRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	m := meta.(*Meta)
+
+	values, err := getValues(d)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	from, err := renderChartVersion(d, m, d.Get("from_version").(string), values)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	to, err := renderChartVersion(d, m, d.Get("to_version").(string), values)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	diff, added, removed, changed, err := diffManifests(from, to, d.Get("from_version").(string), d.Get("to_version").(string))
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	attributes := map[string]interface{}{
+		"diff":    sensitiveReplacer(d, from+"\n---\n"+to).Replace(diff),
+		"added":   added,
+		"removed": removed,
+		"changed": changed,
+	}
+	for k, v := range attributes {
+		if err := d.Set(k, v); err != nil {
+			return diag.FromErr(err)
+		}
+	}
+
+	d.SetId(fmt.Sprintf("%s:%s:%s", d.Get("chart").(string), d.Get("from_version").(string), d.Get("to_version").(string)))
+	return nil
+}
+
+// versionOverride is a resourceGetter returning the given version for the
+// `version` attribute, so that chartPathOptions locates the chart at that
+// version
+type versionOverride struct {
+	resourceGetter
+	version string
+}
+
+func (v versionOverride) Get(key string) interface{} {
+	if key == "version" {
+		return v.version
+	}
+	return v.resourceGetter.Get(key)
+}
+
+// renderChartVersion renders the manifests and hooks of the chart at the
+// given version
+func renderChartVersion(d *schema.ResourceData, m *Meta, version string, values map[string]interface{}) (string, error) {
+	cpo, chartName, err := chartPathOptions(versionOverride{resourceGetter: d, version: version}, m)
+	if err != nil {
+		return "", err
+	}
+
+	c, _, err := getChart(d, m, chartName, cpo)
+	if err != nil {
+		return "", err
+	}
+
+	if err := isChartInstallable(c); err != nil {
+		return "", err
+	}
+
+	apiVersions := []string{}
+	for _, raw := range d.Get("api_versions").([]interface{}) {
+		apiVersions = append(apiVersions, raw.(string))
+	}
+
+	client := action.NewInstall(&action.Configuration{Log: debug})
+	client.ChartPathOptions = *cpo
+	client.DryRun = true
+	client.ClientOnly = true
+	client.Replace = true
+	client.IncludeCRDs = true
+	client.ReleaseName = d.Get("name").(string)
+	client.Namespace = d.Get("namespace").(string)
+	client.APIVersions = chartutil.VersionSet(apiVersions)
+
+	rel, err := client.Run(c, values)
+	if err != nil {
+		return "", fmt.Errorf("error rendering version %s of chart %s: %v", version, chartName, err)
+	}
+
+	manifests := rel.Manifest
+	for _, h := range rel.Hooks {
+		manifests += fmt.Sprintf("\n---\n# Source: %s\n%s", h.Path, h.Manifest)
+	}
+	return manifests, nil
+}
+
+// manifestObjects splits the manifests into their objects, keyed by kind,
+// namespace and name
+func manifestObjects(manifests string) (map[string]string, error) {
+	objects := map[string]string{}
+	for _, m := range releaseutil.SplitManifests(manifests) {
+		head := struct {
+			Kind     string `json:"kind"`
+			Metadata struct {
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+			} `json:"metadata"`
+		}{}
+		if err := yaml.Unmarshal([]byte(m), &head); err != nil {
+			return nil, err
+		}
+		if head.Kind == "" {
+			continue
+		}
+
+		id := head.Kind + "/" + head.Metadata.Name
+		if head.Metadata.Namespace != "" {
+			id = head.Kind + "/" + head.Metadata.Namespace + "/" + head.Metadata.Name
+		}
+		objects[id] = strings.TrimSpace(m) + "\n"
+	}
+	return objects, nil
+}
+
+// diffManifests returns the unified diff of the objects of the manifests, in
+// the order of their identifiers, with the identifiers of the added, removed
+// and changed objects
+func diffManifests(from, to, fromVersion, toVersion string) (string, []string, []string, []string, error) {
+	fromObjects, err := manifestObjects(from)
+	if err != nil {
+		return "", nil, nil, nil, fmt.Errorf("error parsing the manifests of version %s: %v", fromVersion, err)
+	}
+	toObjects, err := manifestObjects(to)
+	if err != nil {
+		return "", nil, nil, nil, fmt.Errorf("error parsing the manifests of version %s: %v", toVersion, err)
+	}
+
+	ids := []string{}
+	for id := range fromObjects {
+		ids = append(ids, id)
+	}
+	for id := range toObjects {
+		if _, ok := fromObjects[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	added, removed, changed := []string{}, []string{}, []string{}
+	var diff strings.Builder
+	for _, id := range ids {
+		a, inFrom := fromObjects[id]
+		b, inTo := toObjects[id]
+		switch {
+		case !inFrom:
+			added = append(added, id)
+		case !inTo:
+			removed = append(removed, id)
+		case a != b:
+			changed = append(changed, id)
+		default:
+			continue
+		}
+
+		text, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        splitLines(a),
+			B:        splitLines(b),
+			FromFile: fmt.Sprintf("%s (%s)", id, fromVersion),
+			ToFile:   fmt.Sprintf("%s (%s)", id, toVersion),
+			Context:  3,
+		})
+		if err != nil {
+			return "", nil, nil, nil, err
+		}
+		diff.WriteString(text)
+	}
+
+	return diff.String(), added, removed, changed, nil
+}
+
+// splitLines splits the text into lines keeping their line feed, an empty
+// text having no lines
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
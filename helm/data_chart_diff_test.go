@@ -0,0 +1,141 @@
+package helm
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/cli"
+)
+
+func TestDataChartDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chart-diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configMap := &chart.File{Name: "templates/configmap.yaml", Data: []byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}
+data:
+  greeting: {{ .Values.greeting }}
+  version: {{ .Chart.Version }}
+`)}
+	service := &chart.File{Name: "templates/service.yaml", Data: []byte(`apiVersion: v1
+kind: Service
+metadata:
+  name: {{ .Release.Name }}
+spec:
+  ports:
+  - port: 80
+`)}
+
+	for version, templates := range map[string][]*chart.File{
+		"1.0.0": {configMap},
+		"2.0.0": {configMap, service},
+	} {
+		_, err := chartutil.Save(&chart.Chart{
+			Metadata:  &chart.Metadata{APIVersion: "v2", Name: "test-chart", Version: version},
+			Templates: templates,
+			Values:    map[string]interface{}{"greeting": "hello"},
+		}, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/index.yaml" {
+			w.Write([]byte(`apiVersion: v1
+entries:
+  test-chart:
+  - name: test-chart
+    version: 2.0.0
+    urls: [test-chart-2.0.0.tgz]
+  - name: test-chart
+    version: 1.0.0
+    urls: [test-chart-1.0.0.tgz]
+`))
+			return
+		}
+		http.ServeFile(w, r, filepath.Join(dir, strings.TrimPrefix(r.URL.Path, "/")))
+	}))
+	defer server.Close()
+
+	settings := cli.New()
+	settings.RepositoryConfig = filepath.Join(dir, "repositories.yaml")
+	settings.RepositoryCache = filepath.Join(dir, "cache")
+	m := &Meta{Settings: settings, RepositoryPlainHTTP: true}
+
+	d := schema.TestResourceDataRaw(t, dataChartDiff().Schema, map[string]interface{}{
+		"name":         "web",
+		"repository":   server.URL,
+		"chart":        "test-chart",
+		"from_version": "1.0.0",
+		"to_version":   "2.0.0",
+		"set": []interface{}{
+			map[string]interface{}{"name": "greeting", "value": "hi"},
+		},
+	})
+
+	if diags := dataChartDiffRead(context.Background(), d, m); diags.HasError() {
+		t.Fatalf("error diffing the chart versions: %v", diags)
+	}
+
+	if added := d.Get("added").([]interface{}); !reflect.DeepEqual(added, []interface{}{"Service/web"}) {
+		t.Errorf("expected the Service to be added, got %v", added)
+	}
+	if removed := d.Get("removed").([]interface{}); len(removed) != 0 {
+		t.Errorf("expected no object to be removed, got %v", removed)
+	}
+	if changed := d.Get("changed").([]interface{}); !reflect.DeepEqual(changed, []interface{}{"ConfigMap/web"}) {
+		t.Errorf("expected the ConfigMap to be changed, got %v", changed)
+	}
+
+	diff := d.Get("diff").(string)
+	for _, line := range []string{
+		"--- ConfigMap/web (1.0.0)",
+		"+++ ConfigMap/web (2.0.0)",
+		"-  version: 1.0.0",
+		"+  version: 2.0.0",
+		"+++ Service/web (2.0.0)",
+		"+kind: Service",
+	} {
+		if !strings.Contains(diff, line+"\n") {
+			t.Errorf("expected the diff to contain %q, got:\n%s", line, diff)
+		}
+	}
+	if !strings.Contains(diff, "   greeting: hi\n") {
+		t.Errorf("expected both versions to be rendered with the values, got:\n%s", diff)
+	}
+}
+
+func TestDiffManifests(t *testing.T) {
+	from := "---\n# Source: chart/templates/a.yaml\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n---\napiVersion: v1\nkind: Secret\nmetadata:\n  name: b\n  namespace: other\n"
+	to := "---\n# Source: chart/templates/a.yaml\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n"
+
+	diff, added, removed, changed, err := diffManifests(from, to, "1.0.0", "1.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 0 || len(changed) != 0 || !reflect.DeepEqual(removed, []string{"Secret/other/b"}) {
+		t.Errorf("expected only the Secret to be removed, got added %v, removed %v, changed %v", added, removed, changed)
+	}
+	if !strings.Contains(diff, "--- Secret/other/b (1.0.0)\n") || !strings.Contains(diff, "-kind: Secret\n") {
+		t.Errorf("expected the diff of the removed Secret, got:\n%s", diff)
+	}
+	if strings.Contains(diff, "ConfigMap") {
+		t.Errorf("expected the unchanged ConfigMap not to be part of the diff, got:\n%s", diff)
+	}
+}
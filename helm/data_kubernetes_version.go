@@ -0,0 +1,109 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"k8s.io/apimachinery/pkg/version"
+)
+
+func dataKubernetesVersion() *schema.Resource {
+	return &schema.Resource{
+		ReadContext: dataKubernetesVersionRead,
+		Schema: map[string]*schema.Schema{
+			"version": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The version of the Kubernetes API server as major.minor.patch, e.g. 1.21.2",
+			},
+			"major": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The major version of the Kubernetes API server",
+			},
+			"minor": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The minor version of the Kubernetes API server, without the suffix some providers add, e.g. 21 for 21+",
+			},
+			"git_version": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The version reported by the Kubernetes API server, e.g. v1.21.2-eks-0389ca3",
+			},
+		},
+	}
+}
+
+func dataKubernetesVersionRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	m := meta.(*Meta)
+
+	kc, err := m.newKubeConfig(nil)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	dc, err := kc.ToDiscoveryClient()
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	info, err := dc.ServerVersion()
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	v, err := parseServerVersion(info)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	for k, value := range v {
+		if err := d.Set(k, value); err != nil {
+			return diag.FromErr(err)
+		}
+	}
+
+	d.SetId(info.GitVersion)
+	return nil
+}
+
+var (
+	// gitVersionRegex matches the major, minor and patch versions of a git
+	// version such as v1.21.2-eks-0389ca3
+	gitVersionRegex = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)`)
+
+	// leadingDigitsRegex matches the number of a version component that may
+	// be followed by a suffix, such as the + of the minor version of GKE and
+	// EKS clusters
+	leadingDigitsRegex = regexp.MustCompile(`^\d+`)
+)
+
+// parseServerVersion returns the attributes of the version reported by the
+// API server. The major and minor versions fall back to the ones of the git
+// version when they are not reported.
+func parseServerVersion(info *version.Info) (map[string]string, error) {
+	parts := gitVersionRegex.FindStringSubmatch(info.GitVersion)
+	if parts == nil {
+		return nil, fmt.Errorf("unable to parse the Kubernetes server version %q", info.GitVersion)
+	}
+
+	major := leadingDigitsRegex.FindString(info.Major)
+	if major == "" {
+		major = parts[1]
+	}
+	minor := leadingDigitsRegex.FindString(info.Minor)
+	if minor == "" {
+		minor = parts[2]
+	}
+
+	return map[string]string{
+		"version":     fmt.Sprintf("%s.%s.%s", parts[1], parts[2], parts[3]),
+		"major":       major,
+		"minor":       minor,
+		"git_version": info.GitVersion,
+	}, nil
+}
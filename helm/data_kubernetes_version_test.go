@@ -0,0 +1,46 @@
+package helm
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/version"
+)
+
+func TestParseServerVersion(t *testing.T) {
+	cases := []struct {
+		info     version.Info
+		expected map[string]string
+	}{
+		{
+			version.Info{Major: "1", Minor: "20", GitVersion: "v1.20.2"},
+			map[string]string{"version": "1.20.2", "major": "1", "minor": "20", "git_version": "v1.20.2"},
+		},
+		{
+			version.Info{Major: "1", Minor: "21+", GitVersion: "v1.21.2-eks-0389ca3"},
+			map[string]string{"version": "1.21.2", "major": "1", "minor": "21", "git_version": "v1.21.2-eks-0389ca3"},
+		},
+		{
+			version.Info{Major: "1", Minor: "19+", GitVersion: "v1.19.9-gke.1900"},
+			map[string]string{"version": "1.19.9", "major": "1", "minor": "19", "git_version": "v1.19.9-gke.1900"},
+		},
+		{
+			version.Info{GitVersion: "v1.18.3+k3s1"},
+			map[string]string{"version": "1.18.3", "major": "1", "minor": "18", "git_version": "v1.18.3+k3s1"},
+		},
+	}
+
+	for _, tc := range cases {
+		v, err := parseServerVersion(&tc.info)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.info.GitVersion, err)
+		}
+		if !reflect.DeepEqual(v, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.info.GitVersion, tc.expected, v)
+		}
+	}
+
+	if _, err := parseServerVersion(&version.Info{Major: "1", Minor: "20", GitVersion: "unknown"}); err == nil {
+		t.Error("expected an error for an invalid git version")
+	}
+}
@@ -0,0 +1,99 @@
+package helm
+
+import (
+	"context"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"k8s.io/client-go/rest"
+)
+
+func dataProviderConfig() *schema.Resource {
+	return &schema.Resource{
+		ReadContext: dataProviderConfigRead,
+		Schema: map[string]*schema.Schema{
+			"host": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The host set in the kubernetes block of the provider, empty if not set",
+			},
+			"server": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The address of the Kubernetes API server the provider connects to",
+			},
+			"context": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The kubeconfig context in use, empty if no kubeconfig file is loaded",
+			},
+			"auth_method": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The method used to authenticate to the cluster: exec, auth_provider, client_certificate, token, basic or none",
+			},
+			"insecure": {
+				Type:        schema.TypeBool,
+				Computed:    true,
+				Description: "Whether the server certificate is not verified",
+			},
+		},
+	}
+}
+
+// dataProviderConfigRead reports the Kubernetes configuration the provider
+// resolved from its settings and kubeconfig files. No credentials are set.
+func dataProviderConfigRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	m := meta.(*Meta)
+
+	kc, err := newKubeConfig(m.data, nil)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	// the config is not built with ToRESTConfig, which hides the client
+	// certificate files behind a custom transport
+	config, err := kc.ToRawKubeConfigLoader().ClientConfig()
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	host := ""
+	if v, ok := k8sGetOk(m.data, "host"); ok {
+		host = v.(string)
+	}
+
+	attributes := map[string]interface{}{
+		"host":        host,
+		"server":      config.Host,
+		"context":     kc.Context,
+		"auth_method": restConfigAuthMethod(config),
+		"insecure":    config.Insecure,
+	}
+	for k, v := range attributes {
+		if err := d.Set(k, v); err != nil {
+			return diag.FromErr(err)
+		}
+	}
+
+	d.SetId(config.Host)
+	return nil
+}
+
+// restConfigAuthMethod returns the method used by the config to authenticate,
+// in the order of precedence of client-go
+func restConfigAuthMethod(config *rest.Config) string {
+	switch {
+	case config.ExecProvider != nil:
+		return "exec"
+	case config.AuthProvider != nil:
+		return "auth_provider"
+	case len(config.CertData) > 0 || config.CertFile != "":
+		return "client_certificate"
+	case config.BearerToken != "" || config.BearerTokenFile != "":
+		return "token"
+	case config.Username != "":
+		return "basic"
+	}
+	return "none"
+}
@@ -0,0 +1,91 @@
+package helm
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+func TestDataProviderConfigRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config")
+	kubeconfig := `apiVersion: v1
+kind: Config
+current-context: prod
+clusters:
+- name: prod
+  cluster:
+    server: https://prod.example.com
+- name: staging
+  cluster:
+    server: https://staging.example.com
+    insecure-skip-tls-verify: true
+users:
+- name: admin
+  user:
+    token: secret-token
+contexts:
+- name: prod
+  context:
+    cluster: prod
+    user: admin
+- name: staging
+  context:
+    cluster: staging
+    user: admin
+`
+	if err := ioutil.WriteFile(path, []byte(kubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		kubernetes map[string]interface{}
+		expected   map[string]string
+	}{
+		{
+			map[string]interface{}{"config_path": path},
+			map[string]string{"host": "", "server": "https://prod.example.com", "context": "prod", "auth_method": "token", "insecure": "false"},
+		},
+		{
+			map[string]interface{}{"config_path": path, "config_context": "staging"},
+			map[string]string{"host": "", "server": "https://staging.example.com", "context": "staging", "auth_method": "token", "insecure": "true"},
+		},
+		{
+			map[string]interface{}{"host": "https://static.example.com", "username": "admin", "password": "secret-password"},
+			map[string]string{"host": "https://static.example.com", "server": "https://static.example.com", "context": "", "auth_method": "basic", "insecure": "false"},
+		},
+	}
+
+	for _, tc := range cases {
+		m := &Meta{data: schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+			"kubernetes": []interface{}{tc.kubernetes},
+		})}
+
+		d := schema.TestResourceDataRaw(t, dataProviderConfig().Schema, map[string]interface{}{})
+		if diags := dataProviderConfigRead(context.Background(), d, m); diags.HasError() {
+			t.Fatalf("%v: %v", tc.kubernetes, diags)
+		}
+
+		state := d.State()
+		for k, expected := range tc.expected {
+			if v := state.Attributes[k]; v != expected {
+				t.Errorf("%v: expected %s %q, got %q", tc.kubernetes, k, expected, v)
+			}
+		}
+		for k, v := range state.Attributes {
+			if strings.Contains(v, "secret") {
+				t.Errorf("%v: credentials exposed in %s", tc.kubernetes, k)
+			}
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"helm.sh/helm/v3/pkg/release"
+)
+
+func dataReleaseDryRun() *schema.Resource {
+	return &schema.Resource{
+		ReadContext: dataReleaseDryRunRead,
+		Schema: mergeSchemas(dataTemplate().Schema, map[string]*schema.Schema{
+			"validate": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     true,
+				Description: "Validate the manifests against the Kubernetes cluster, as an install does.",
+			},
+			"status": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Status of the release.",
+			},
+			"revision": {
+				Type:        schema.TypeInt,
+				Computed:    true,
+				Description: "Version number of the release.",
+			},
+			"chart_version": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The version of the chart.",
+			},
+			"app_version": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The version number of the application being deployed.",
+			},
+			"info_description": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Description of the release.",
+			},
+			"hooks": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "Rendered hooks of the release.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "Name of the hook resource.",
+						},
+						"kind": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "Kind of the hook resource.",
+						},
+						"path": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "Template path of the hook.",
+						},
+						"events": {
+							Type:        schema.TypeList,
+							Computed:    true,
+							Description: "Events the hook runs on.",
+							Elem:        &schema.Schema{Type: schema.TypeString},
+						},
+						"weight": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "Weight of the hook.",
+						},
+						"manifest": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "Rendered manifest of the hook.",
+						},
+					},
+				},
+			},
+		}),
+	}
+}
+
+// dataReleaseDryRunRead simulates the install of the release with the dry run
+// of helm_template, and returns the resulting release. The manifests are
+// validated by the cluster unless `validate` is false, but nothing is created
+// and the release is not stored.
+func dataReleaseDryRunRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	rel, err := renderTemplate(d, meta.(*Meta))
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	if err := setTemplateAttributes(d, rel); err != nil {
+		return diag.FromErr(err)
+	}
+	if err := setDryRunAttributes(d, rel); err != nil {
+		return diag.FromErr(err)
+	}
+
+	d.SetId(fmt.Sprintf("%s/%s", rel.Namespace, rel.Name))
+	return nil
+}
+
+// setDryRunAttributes sets the attributes of the release of the dry run, and
+// masks the sensitive values in the manifests set by setTemplateAttributes
+func setDryRunAttributes(d *schema.ResourceData, rel *release.Release) error {
+	manifests := rel.Manifest
+	for _, h := range rel.Hooks {
+		manifests += "\n---\n" + h.Manifest
+	}
+	replacer := sensitiveReplacer(d, manifests)
+
+	hooks := make([]map[string]interface{}, 0, len(rel.Hooks))
+	for _, h := range rel.Hooks {
+		events := make([]string, 0, len(h.Events))
+		for _, e := range h.Events {
+			events = append(events, e.String())
+		}
+		hooks = append(hooks, map[string]interface{}{
+			"name":     h.Name,
+			"kind":     h.Kind,
+			"path":     h.Path,
+			"events":   events,
+			"weight":   h.Weight,
+			"manifest": replacer.Replace(h.Manifest),
+		})
+	}
+
+	rendered := map[string]interface{}{}
+	for k, v := range d.Get("manifests").(map[string]interface{}) {
+		rendered[k] = replacer.Replace(v.(string))
+	}
+
+	attributes := map[string]interface{}{
+		"status":           rel.Info.Status.String(),
+		"revision":         rel.Version,
+		"chart_version":    rel.Chart.Metadata.Version,
+		"app_version":      rel.Chart.Metadata.AppVersion,
+		"info_description": rel.Info.Description,
+		"manifests":        rendered,
+		"manifest":         replacer.Replace(d.Get("manifest").(string)),
+		"hooks":            hooks,
+	}
+	for k, v := range attributes {
+		if err := d.Set(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package helm
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+func TestDryRunInstall(t *testing.T) {
+	recorder := &recordingKubeClient{Interface: &kubefake.PrintingKubeClient{Out: ioutil.Discard}}
+	cfg := &action.Configuration{
+		Releases:     storage.Init(driver.NewMemory()),
+		KubeClient:   recorder,
+		Capabilities: chartutil.DefaultCapabilities,
+		Log:          debug,
+	}
+
+	d := schema.TestResourceDataRaw(t, dataReleaseDryRun().Schema, map[string]interface{}{
+		"name":      "test",
+		"namespace": "apps",
+		"chart":     "./testdata/charts/install-hook",
+	})
+
+	c, err := loader.Load("./testdata/charts/install-hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rel, err := templateInstall(d, cfg, c, &action.ChartPathOptions{}, map[string]interface{}{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setTemplateAttributes(d, rel); err != nil {
+		t.Fatal(err)
+	}
+	if err := setDryRunAttributes(d, rel); err != nil {
+		t.Fatal(err)
+	}
+
+	if manifest := d.Get("manifest").(string); !strings.Contains(manifest, "kind: ConfigMap") || !strings.Contains(manifest, "kind: Job") {
+		t.Fatalf("expected the manifest to contain the ConfigMap and the hook, got:\n%s", manifest)
+	}
+	if d.Get("hooks.#").(int) != 1 || d.Get("hooks.0.name") != "test-setup" || d.Get("hooks.0.kind") != "Job" || d.Get("hooks.0.events.0") != "pre-install" {
+		t.Fatalf("expected the pre-install Job hook, got %v", d.Get("hooks"))
+	}
+	if !strings.Contains(d.Get("hooks.0.manifest").(string), "name: test-setup") {
+		t.Fatalf("expected the rendered manifest of the hook, got %s", d.Get("hooks.0.manifest"))
+	}
+	if d.Get("revision") != 1 || d.Get("chart_version") != "1.2.3" || d.Get("info_description") != "Dry run complete" {
+		t.Fatalf("expected the first revision of the dry run, got revision %v of chart version %v: %v", d.Get("revision"), d.Get("chart_version"), d.Get("info_description"))
+	}
+
+	// the dry run neither creates the resources nor stores the release
+	if len(recorder.created) != 0 {
+		t.Fatalf("expected no resources to be created, got %v", recorder.created)
+	}
+	releases, err := cfg.Releases.ListReleases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(releases) != 0 {
+		t.Fatalf("expected the release not to be stored, got %d releases", len(releases))
+	}
+}
@@ -8,10 +8,17 @@ import (
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
 	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chart/loader"
 	"helm.sh/helm/v3/pkg/chartutil"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
 	"helm.sh/helm/v3/pkg/release"
 	"helm.sh/helm/v3/pkg/releaseutil"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	"io/ioutil"
+	"k8s.io/client-go/discovery"
+	"log"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -22,53 +29,23 @@ import (
 
 // defaultTemplateAttributes template attribute values
 var defaultTemplateAttributes = map[string]interface{}{
-	"validate":     false,
-	"include_crds": false,
-	"is_upgrade":   false,
-	"skip_tests":   false,
+	"validate":                 false,
+	"use_cluster_capabilities": false,
+	"include_crds":             false,
+	"is_upgrade":               false,
+	"skip_tests":               false,
 }
 
 func dataTemplate() *schema.Resource {
 	return &schema.Resource{
 		ReadContext: dataTemplateRead,
-		Schema: map[string]*schema.Schema{
+		Schema: mergeSchemas(repositorySchema(), map[string]*schema.Schema{
 			"name": {
 				Type:        schema.TypeString,
 				Required:    true,
 				ForceNew:    true,
 				Description: "Release name.",
 			},
-			"repository": {
-				Type:        schema.TypeString,
-				Optional:    true,
-				Description: "Repository where to locate the requested chart. If is a URL the chart is installed without installing the repository.",
-			},
-			"repository_key_file": {
-				Type:        schema.TypeString,
-				Optional:    true,
-				Description: "The repositories cert key file",
-			},
-			"repository_cert_file": {
-				Type:        schema.TypeString,
-				Optional:    true,
-				Description: "The repositories cert file",
-			},
-			"repository_ca_file": {
-				Type:        schema.TypeString,
-				Optional:    true,
-				Description: "The Repositories CA File",
-			},
-			"repository_username": {
-				Type:        schema.TypeString,
-				Optional:    true,
-				Description: "Username for HTTP basic authentication",
-			},
-			"repository_password": {
-				Type:        schema.TypeString,
-				Optional:    true,
-				Sensitive:   true,
-				Description: "Password for HTTP basic authentication",
-			},
 			"chart": {
 				Type:        schema.TypeString,
 				Required:    true,
@@ -95,6 +72,52 @@ func dataTemplate() *schema.Resource {
 				Description: "List of values in raw yaml format to pass to helm.",
 				Elem:        &schema.Schema{Type: schema.TypeString},
 			},
+			"values_by_workspace": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Description: "Map of values in raw yaml format keyed by Terraform workspace, the values of the current workspace, or else of the `default` key, being merged after `values`.",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+			"set_map": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Description: "Map of values to pass to helm, keyed by the dotted path of the value as in `set`.",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+			"resources": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "Resource requests and limits to pass to helm, at the `requests` and `limits` keys of the values path `path_prefix.path`.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"path_prefix": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Values path prefixed to `path`, such as the name of a subchart.",
+						},
+						"path": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Default:     "resources",
+							Description: "Values path of the resources, as in `set`.",
+						},
+						"requests": {
+							Type:        schema.TypeList,
+							Optional:    true,
+							MaxItems:    1,
+							Description: "Resource requests.",
+							Elem:        resourceQuantitiesSchema(),
+						},
+						"limits": {
+							Type:        schema.TypeList,
+							Optional:    true,
+							MaxItems:    1,
+							Description: "Resource limits.",
+							Elem:        resourceQuantitiesSchema(),
+						},
+					},
+				},
+			},
 			"set": {
 				Type:        schema.TypeSet,
 				Optional:    true,
@@ -188,6 +211,15 @@ func dataTemplate() *schema.Resource {
 					return !d.Get("verify").(bool)
 				},
 			},
+			"keyring_url": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "HTTPS URL of the public keys used for verification. The keys are fetched and cached, and take precedence over `keyring`. Used only if `verify` is true",
+				// Suppress changes of this attribute if `verify` is false
+				DiffSuppressFunc: func(k, old, new string, d *schema.ResourceData) bool {
+					return !d.Get("verify").(bool)
+				},
+			},
 			"timeout": {
 				Type:        schema.TypeInt,
 				Optional:    true,
@@ -224,12 +256,30 @@ func dataTemplate() *schema.Resource {
 				Default:     defaultAttributes["skip_crds"],
 				Description: "If set, no CRDs will be installed. By default, CRDs are installed if not already present",
 			},
+			"skip_kube_version_check": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     defaultAttributes["skip_kube_version_check"],
+				Description: "If set, the kubeVersion constraint of the chart is not checked against the Kubernetes version",
+			},
+			"render_time": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Time returned by the `now` template function, in RFC 3339 format, to render the chart deterministically",
+				ValidateFunc: validation.IsRFC3339Time,
+			},
 			"skip_tests": {
 				Type:        schema.TypeBool,
 				Optional:    true,
 				Default:     defaultAttributes["skip_tests"],
 				Description: "If set, tests will not be rendered. By default, tests are rendered",
 			},
+			"strict": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     defaultAttributes["strict"],
+				Description: "Fail when the templates of the chart reference missing values, rather than rendering them empty",
+			},
 			"render_subchart_notes": {
 				Type:        schema.TypeBool,
 				Optional:    true,
@@ -295,6 +345,12 @@ func dataTemplate() *schema.Resource {
 				Description: "Kubernetes api versions used for Capabilities.APIVersions",
 				Elem:        &schema.Schema{Type: schema.TypeString},
 			},
+			"use_cluster_capabilities": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     defaultTemplateAttributes["use_cluster_capabilities"],
+				Description: "Add the API versions discovered from the Kubernetes cluster to Capabilities.APIVersions and use its version as Capabilities.KubeVersion. Falls back to `api_versions` if the cluster cannot be reached",
+			},
 			"include_crds": {
 				Type:        schema.TypeBool,
 				Optional:    true,
@@ -340,17 +396,30 @@ func dataTemplate() *schema.Resource {
 				Computed:    true,
 				Description: "Rendered notes if the chart contains a `NOTES.txt`.",
 			},
-		},
+		}),
 	}
 }
 
 func dataTemplateRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	rel, err := renderTemplate(d, meta.(*Meta))
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	if err := setTemplateAttributes(d, rel); err != nil {
+		return diag.FromErr(err)
+	}
+
+	d.SetId(d.Get("name").(string))
+	return nil
+}
+
+// renderTemplate resolves the chart and its values and renders it with a dry
+// run install, like helm template
+func renderTemplate(d *schema.ResourceData, m *Meta) (*release.Release, error) {
 	logID := fmt.Sprintf("[dataTemplateRead: %s]", d.Get("name").(string))
 	debug("%s Started", logID)
 
-	m := meta.(*Meta)
-
-	name := d.Get("name").(string)
 	n := d.Get("namespace").(string)
 
 	var apiVersions []string
@@ -363,43 +432,46 @@ func dataTemplateRead(ctx context.Context, d *schema.ResourceData, meta interfac
 		}
 	}
 
-	var showFiles []string
-
-	if showOnlyAttr, ok := d.GetOk("show_only"); ok {
-		showOnlyAttrValue := showOnlyAttr.([]interface{})
-
-		for _, showFile := range showOnlyAttrValue {
-			showFiles = append(showFiles, showFile.(string))
-		}
-	}
-
 	debug("%s Getting Config", logID)
 
 	actionConfig, err := m.GetHelmConfiguration(n)
 	if err != nil {
-		return diag.FromErr(err)
+		return nil, err
+	}
+
+	var kubeVersion *chartutil.KubeVersion
+
+	if d.Get("use_cluster_capabilities").(bool) {
+		debug("%s Discovering cluster capabilities", logID)
+		caps, err := getClusterCapabilities(actionConfig)
+		if err != nil {
+			log.Printf("[WARN] Could not discover the capabilities of the cluster, only api_versions will be used: %v", err)
+		} else {
+			apiVersions = append(apiVersions, caps.APIVersions...)
+			kubeVersion = &caps.KubeVersion
+		}
 	}
 
 	cpo, chartName, err := chartPathOptions(d, m)
 	if err != nil {
-		return diag.FromErr(err)
+		return nil, err
 	}
 
 	debug("%s Getting chart", logID)
 	c, path, err := getChart(d, m, chartName, cpo)
 	if err != nil {
-		return diag.FromErr(err)
+		return nil, err
 	}
 
 	// check and update the chart's dependencies if needed
 	updated, err := checkChartDependencies(d, c, path, m)
 	if err != nil {
-		return diag.FromErr(err)
+		return nil, err
 	} else if updated {
 		// load the chart again if its dependencies have been updated
 		c, err = loader.Load(path)
 		if err != nil {
-			return diag.FromErr(err)
+			return nil, err
 		}
 	}
 
@@ -407,15 +479,32 @@ func dataTemplateRead(ctx context.Context, d *schema.ResourceData, meta interfac
 
 	values, err := getValues(d)
 	if err != nil {
-		return diag.FromErr(err)
+		return nil, err
+	}
+
+	if err := checkStrictRendering(d, c, d.Get("name").(string), values); err != nil {
+		return nil, err
 	}
 
 	err = isChartInstallable(c)
 	if err != nil {
-		return diag.FromErr(err)
+		return nil, err
 	}
 
-	client := action.NewInstall(actionConfig)
+	debug("%s Rendering Chart", logID)
+
+	start := time.Now()
+	rel, err := templateInstall(d, actionConfig, c, cpo, values, apiVersions, kubeVersion)
+	m.logHelmCall("template", n, d.Get("name").(string), start, err)
+	return rel, err
+}
+
+// templateInstall runs the dry run install of the chart rendering the
+// template, validated by the cluster when `validate` is set. Without
+// validation the template is rendered with the given Kubernetes version, or
+// the Helm default if it is nil.
+func templateInstall(d resourceGetter, cfg *action.Configuration, c *chart.Chart, cpo *action.ChartPathOptions, values map[string]interface{}, apiVersions []string, kubeVersion *chartutil.KubeVersion) (*release.Release, error) {
+	client := action.NewInstall(cfg)
 	client.ChartPathOptions = *cpo
 	client.ClientOnly = false
 	client.DryRun = true
@@ -434,7 +523,12 @@ func dataTemplateRead(ctx context.Context, d *schema.ResourceData, meta interfac
 	client.SubNotes = d.Get("render_subchart_notes").(bool)
 	client.DisableOpenAPIValidation = d.Get("disable_openapi_validation").(bool)
 	client.Replace = d.Get("replace").(bool)
-	client.Description = d.Get("description").(string)
+
+	var err error
+	client.Description, err = releaseDescription(d.Get("description").(string), c)
+	if err != nil {
+		return nil, err
+	}
 	client.CreateNamespace = d.Get("create_namespace").(bool)
 
 	// The following source has been adapted from the source of the helm template command
@@ -446,21 +540,55 @@ func dataTemplateRead(ctx context.Context, d *schema.ResourceData, meta interfac
 	client.APIVersions = chartutil.VersionSet(apiVersions)
 	client.IncludeCRDs = d.Get("include_crds").(bool)
 
-	skipTests := d.Get("skip_tests").(bool)
+	if client.ClientOnly && kubeVersion != nil {
+		// The client only mode of Install always renders with the default
+		// capabilities, so it is set up here with the Kubernetes version
+		// instead, like Install does it
+		// https://github.com/helm/helm/blob/v3.5.3/pkg/action/install.go#L216
+		cfg.Capabilities = &chartutil.Capabilities{
+			APIVersions: append(chartutil.VersionSet{}, chartutil.DefaultVersionSet...),
+			KubeVersion: *kubeVersion,
+			HelmVersion: chartutil.DefaultCapabilities.HelmVersion,
+		}
+		cfg.Capabilities.APIVersions = append(cfg.Capabilities.APIVersions, client.APIVersions...)
+		cfg.KubeClient = &kubefake.PrintingKubeClient{Out: ioutil.Discard}
 
-	debug("%s Rendering Chart", logID)
+		mem := driver.NewMemory()
+		mem.SetNamespace(client.Namespace)
+		cfg.Releases = storage.Init(mem)
 
-	rel, err := client.Run(c, values)
+		client.ClientOnly = false
+		client.APIVersions = nil
+	}
 
-	if err != nil {
-		return diag.FromErr(err)
+	skipKubeVersionCheck(d, c)
+	if err := pinRenderTime(d, c); err != nil {
+		return nil, err
+	}
+
+	return client.Run(c, values)
+}
+
+// setTemplateAttributes sets the rendered manifests and notes of the release
+// rendering the template, limited to the templates listed in `show_only`
+func setTemplateAttributes(d *schema.ResourceData, rel *release.Release) error {
+	var showFiles []string
+
+	if showOnlyAttr, ok := d.GetOk("show_only"); ok {
+		showOnlyAttrValue := showOnlyAttr.([]interface{})
+
+		for _, showFile := range showOnlyAttrValue {
+			showFiles = append(showFiles, showFile.(string))
+		}
 	}
 
+	skipTests := d.Get("skip_tests").(bool)
+
 	var manifests bytes.Buffer
 
 	fmt.Fprintln(&manifests, strings.TrimSpace(rel.Manifest))
 
-	if !client.DisableHooks {
+	if !d.Get("disable_webhooks").(bool) {
 		for _, m := range rel.Hooks {
 			if skipTests && isTestHook(m) {
 				continue
@@ -522,7 +650,7 @@ func dataTemplateRead(ctx context.Context, d *schema.ResourceData, meta interfac
 			}
 
 			if missing {
-				return diag.Errorf("could not find template %q in chart", f)
+				return fmt.Errorf("could not find template %q in chart", f)
 			}
 		}
 	} else {
@@ -546,24 +674,43 @@ func dataTemplateRead(ctx context.Context, d *schema.ResourceData, meta interfac
 
 	computedNotes := rel.Info.Notes
 
-	d.SetId(name)
+	if err := d.Set("manifests", computedManifests); err != nil {
+		return err
+	}
 
-	err = d.Set("manifests", computedManifests)
-	if err != nil {
-		return diag.FromErr(err)
+	if err := d.Set("manifest", computedManifest.String()); err != nil {
+		return err
 	}
 
-	err = d.Set("manifest", computedManifest.String())
+	return d.Set("notes", computedNotes)
+}
+
+// getClusterCapabilities returns the Kubernetes version of the cluster and
+// the API versions it serves
+func getClusterCapabilities(cfg *action.Configuration) (*chartutil.Capabilities, error) {
+	dc, err := cfg.RESTClientGetter.ToDiscoveryClient()
 	if err != nil {
-		return diag.FromErr(err)
+		return nil, err
 	}
 
-	err = d.Set("notes", computedNotes)
+	info, err := dc.ServerVersion()
 	if err != nil {
-		return diag.FromErr(err)
+		return nil, err
 	}
 
-	return nil
+	versions, err := action.GetVersionSet(dc)
+	if err != nil && !discovery.IsGroupDiscoveryFailedError(err) {
+		return nil, err
+	}
+
+	return &chartutil.Capabilities{
+		APIVersions: versions,
+		KubeVersion: chartutil.KubeVersion{
+			Version: info.GitVersion,
+			Major:   info.Major,
+			Minor:   info.Minor,
+		},
+	}, nil
 }
 
 func isTestHook(h *release.Hook) bool {
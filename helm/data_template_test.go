@@ -2,9 +2,19 @@ package helm
 
 import (
 	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
 )
 
 func TestAccDataTemplate_basic(t *testing.T) {
@@ -52,6 +62,76 @@ func TestAccDataTemplate_templates(t *testing.T) {
 	})
 }
 
+func TestAccDataTemplate_clusterCapabilities(t *testing.T) {
+	name := randName("capabilities")
+	namespace := randName(testNamespacePrefix)
+
+	datasourceAddress := fmt.Sprintf("data.helm_template.%s", testResourceName)
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:  func() { testAccPreCheck(t) },
+		Providers: testAccProviders,
+		Steps: []resource.TestStep{{
+			Config: testAccDataHelmTemplateConfigCapabilities(testResourceName, namespace, name, false),
+			Check: resource.ComposeAggregateTestCheckFunc(
+				resource.TestMatchResourceAttr(datasourceAddress, "manifest", regexp.MustCompile("crds: unsupported")),
+				resource.TestMatchResourceAttr(datasourceAddress, "manifest", regexp.MustCompile("cronjob: batch/v1beta1")),
+			),
+		}, {
+			Config: testAccDataHelmTemplateConfigCapabilities(testResourceName, namespace, name, true),
+			Check: resource.ComposeAggregateTestCheckFunc(
+				resource.TestMatchResourceAttr(datasourceAddress, "manifest", regexp.MustCompile("crds: supported")),
+			),
+		}},
+	})
+}
+
+func testAccDataHelmTemplateConfigCapabilities(resource, ns, name string, useClusterCapabilities bool) string {
+	return fmt.Sprintf(`
+		data "helm_template" "%s" {
+			name                     = %q
+			namespace                = %q
+			repository               = %q
+			chart                    = "capabilities-chart"
+			use_cluster_capabilities = %t
+		}
+	`, resource, name, ns, testRepositoryURL, useClusterCapabilities)
+}
+
+func TestTemplateInstallKubeVersion(t *testing.T) {
+	c, err := loader.Load("./testdata/charts/capabilities-chart")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		kubeVersion *chartutil.KubeVersion
+		expected    string
+	}{
+		{nil, "cronjob: batch/v1beta1"},
+		{&chartutil.KubeVersion{Version: "v1.21.2", Major: "1", Minor: "21"}, "cronjob: batch/v1"},
+	} {
+		cfg := &action.Configuration{
+			Releases:   storage.Init(driver.NewMemory()),
+			KubeClient: &kubefake.PrintingKubeClient{Out: ioutil.Discard},
+			Log:        debug,
+		}
+		d := schema.TestResourceDataRaw(t, dataTemplate().Schema, map[string]interface{}{
+			"name":      "test",
+			"namespace": "apps",
+			"chart":     "./testdata/charts/capabilities-chart",
+		})
+
+		rel, err := templateInstall(d, cfg, c, &action.ChartPathOptions{}, map[string]interface{}{}, []string{"apiextensions.k8s.io/v1"}, tc.kubeVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(rel.Manifest, tc.expected+"\n") || !strings.Contains(rel.Manifest, "crds: supported") {
+			t.Fatalf("expected the manifest rendered for %v to contain %q and the API versions, got:\n%s", tc.kubeVersion, tc.expected, rel.Manifest)
+		}
+	}
+}
+
 func testAccDataHelmTemplateConfigBasic(resource, ns, name, version string) string {
 	return fmt.Sprintf(`
 		data "helm_template" "%s" {
@@ -0,0 +1,208 @@
+package helm
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"sigs.k8s.io/yaml"
+)
+
+// deprecatedAPI is a Kubernetes API version deprecated in, and removed from,
+// minor versions of Kubernetes 1.x
+type deprecatedAPI struct {
+	deprecatedIn int
+	removedIn    int
+	replacement  string
+}
+
+// deprecatedAPIs are the deprecated API versions of the built-in kinds
+var deprecatedAPIs = map[schema.GroupVersionKind]deprecatedAPI{
+	{Group: "extensions", Version: "v1beta1", Kind: "DaemonSet"}:                                        {deprecatedIn: 8, removedIn: 16, replacement: "apps/v1"},
+	{Group: "extensions", Version: "v1beta1", Kind: "Deployment"}:                                       {deprecatedIn: 8, removedIn: 16, replacement: "apps/v1"},
+	{Group: "extensions", Version: "v1beta1", Kind: "ReplicaSet"}:                                       {deprecatedIn: 8, removedIn: 16, replacement: "apps/v1"},
+	{Group: "extensions", Version: "v1beta1", Kind: "NetworkPolicy"}:                                    {deprecatedIn: 9, removedIn: 16, replacement: "networking.k8s.io/v1"},
+	{Group: "extensions", Version: "v1beta1", Kind: "PodSecurityPolicy"}:                                {deprecatedIn: 10, removedIn: 16, replacement: "policy/v1beta1"},
+	{Group: "extensions", Version: "v1beta1", Kind: "Ingress"}:                                          {deprecatedIn: 14, removedIn: 22, replacement: "networking.k8s.io/v1"},
+	{Group: "apps", Version: "v1beta1", Kind: "Deployment"}:                                             {deprecatedIn: 9, removedIn: 16, replacement: "apps/v1"},
+	{Group: "apps", Version: "v1beta1", Kind: "StatefulSet"}:                                            {deprecatedIn: 9, removedIn: 16, replacement: "apps/v1"},
+	{Group: "apps", Version: "v1beta2", Kind: "DaemonSet"}:                                              {deprecatedIn: 9, removedIn: 16, replacement: "apps/v1"},
+	{Group: "apps", Version: "v1beta2", Kind: "Deployment"}:                                             {deprecatedIn: 9, removedIn: 16, replacement: "apps/v1"},
+	{Group: "apps", Version: "v1beta2", Kind: "ReplicaSet"}:                                             {deprecatedIn: 9, removedIn: 16, replacement: "apps/v1"},
+	{Group: "apps", Version: "v1beta2", Kind: "StatefulSet"}:                                            {deprecatedIn: 9, removedIn: 16, replacement: "apps/v1"},
+	{Group: "networking.k8s.io", Version: "v1beta1", Kind: "Ingress"}:                                   {deprecatedIn: 19, removedIn: 22, replacement: "networking.k8s.io/v1"},
+	{Group: "networking.k8s.io", Version: "v1beta1", Kind: "IngressClass"}:                              {deprecatedIn: 19, removedIn: 22, replacement: "networking.k8s.io/v1"},
+	{Group: "apiextensions.k8s.io", Version: "v1beta1", Kind: "CustomResourceDefinition"}:               {deprecatedIn: 16, removedIn: 22, replacement: "apiextensions.k8s.io/v1"},
+	{Group: "apiregistration.k8s.io", Version: "v1beta1", Kind: "APIService"}:                           {deprecatedIn: 19, removedIn: 22, replacement: "apiregistration.k8s.io/v1"},
+	{Group: "admissionregistration.k8s.io", Version: "v1beta1", Kind: "MutatingWebhookConfiguration"}:   {deprecatedIn: 16, removedIn: 22, replacement: "admissionregistration.k8s.io/v1"},
+	{Group: "admissionregistration.k8s.io", Version: "v1beta1", Kind: "ValidatingWebhookConfiguration"}: {deprecatedIn: 16, removedIn: 22, replacement: "admissionregistration.k8s.io/v1"},
+	{Group: "rbac.authorization.k8s.io", Version: "v1beta1", Kind: "ClusterRole"}:                       {deprecatedIn: 17, removedIn: 22, replacement: "rbac.authorization.k8s.io/v1"},
+	{Group: "rbac.authorization.k8s.io", Version: "v1beta1", Kind: "ClusterRoleBinding"}:                {deprecatedIn: 17, removedIn: 22, replacement: "rbac.authorization.k8s.io/v1"},
+	{Group: "rbac.authorization.k8s.io", Version: "v1beta1", Kind: "Role"}:                              {deprecatedIn: 17, removedIn: 22, replacement: "rbac.authorization.k8s.io/v1"},
+	{Group: "rbac.authorization.k8s.io", Version: "v1beta1", Kind: "RoleBinding"}:                       {deprecatedIn: 17, removedIn: 22, replacement: "rbac.authorization.k8s.io/v1"},
+	{Group: "scheduling.k8s.io", Version: "v1beta1", Kind: "PriorityClass"}:                             {deprecatedIn: 14, removedIn: 22, replacement: "scheduling.k8s.io/v1"},
+	{Group: "storage.k8s.io", Version: "v1beta1", Kind: "CSIDriver"}:                                    {deprecatedIn: 19, removedIn: 22, replacement: "storage.k8s.io/v1"},
+	{Group: "storage.k8s.io", Version: "v1beta1", Kind: "StorageClass"}:                                 {deprecatedIn: 19, removedIn: 22, replacement: "storage.k8s.io/v1"},
+	{Group: "storage.k8s.io", Version: "v1beta1", Kind: "VolumeAttachment"}:                             {deprecatedIn: 19, removedIn: 22, replacement: "storage.k8s.io/v1"},
+	{Group: "coordination.k8s.io", Version: "v1beta1", Kind: "Lease"}:                                   {deprecatedIn: 19, removedIn: 22, replacement: "coordination.k8s.io/v1"},
+	{Group: "certificates.k8s.io", Version: "v1beta1", Kind: "CertificateSigningRequest"}:               {deprecatedIn: 19, removedIn: 22, replacement: "certificates.k8s.io/v1"},
+	{Group: "batch", Version: "v1beta1", Kind: "CronJob"}:                                               {deprecatedIn: 21, removedIn: 25, replacement: "batch/v1"},
+	{Group: "discovery.k8s.io", Version: "v1beta1", Kind: "EndpointSlice"}:                              {deprecatedIn: 21, removedIn: 25, replacement: "discovery.k8s.io/v1"},
+	{Group: "events.k8s.io", Version: "v1beta1", Kind: "Event"}:                                         {deprecatedIn: 19, removedIn: 25, replacement: "events.k8s.io/v1"},
+	{Group: "node.k8s.io", Version: "v1beta1", Kind: "RuntimeClass"}:                                    {deprecatedIn: 20, removedIn: 25, replacement: "node.k8s.io/v1"},
+	{Group: "policy", Version: "v1beta1", Kind: "PodDisruptionBudget"}:                                  {deprecatedIn: 21, removedIn: 25, replacement: "policy/v1"},
+	{Group: "policy", Version: "v1beta1", Kind: "PodSecurityPolicy"}:                                    {deprecatedIn: 21, removedIn: 25},
+	{Group: "autoscaling", Version: "v2beta1", Kind: "HorizontalPodAutoscaler"}:                         {deprecatedIn: 22, removedIn: 25, replacement: "autoscaling/v2"},
+	{Group: "autoscaling", Version: "v2beta2", Kind: "HorizontalPodAutoscaler"}:                         {deprecatedIn: 23, removedIn: 26, replacement: "autoscaling/v2"},
+}
+
+// kubeMinorVersionRegex matches the major and minor versions of a Kubernetes
+// version such as 1.22, 1.22.3 or v1.22.3-eks-0389ca3
+var kubeMinorVersionRegex = regexp.MustCompile(`^v?(\d+)\.(\d+)`)
+
+// parseKubeMinorVersion returns the minor version of a Kubernetes 1.x version
+func parseKubeMinorVersion(v string) (int, error) {
+	parts := kubeMinorVersionRegex.FindStringSubmatch(v)
+	if parts == nil || parts[1] != "1" {
+		return 0, fmt.Errorf("unable to parse the Kubernetes version %q, expected 1.x", v)
+	}
+	return strconv.Atoi(parts[2])
+}
+
+// apiVersionChecker is a post-renderer checking the API versions of the
+// resources of the manifests against the deprecated API versions, failing on
+// the API versions removed from the Kubernetes version checked against, if
+// fail is set. The manifests are returned unchanged.
+type apiVersionChecker struct {
+	minor int
+	// served returns whether the cluster serves an API version, nil when
+	// checking against a target Kubernetes version
+	served func(gvk schema.GroupVersionKind) bool
+	fail   bool
+}
+
+// newAPIVersionChecker returns the API version checker configured by
+// `deprecated_api_check`, or nil if the block is not set. Without
+// `kube_version` the API versions are checked against the version and the API
+// versions discovered from the cluster.
+func newAPIVersionChecker(d resourceGetter, cfg *action.Configuration) (*apiVersionChecker, error) {
+	if len(d.Get("deprecated_api_check").([]interface{})) == 0 {
+		return nil, nil
+	}
+
+	c := &apiVersionChecker{fail: d.Get("deprecated_api_check.0.fail_on_removed").(bool)}
+
+	if v := d.Get("deprecated_api_check.0.kube_version").(string); v != "" {
+		minor, err := parseKubeMinorVersion(v)
+		if err != nil {
+			return nil, err
+		}
+		c.minor = minor
+		return c, nil
+	}
+
+	dc, err := cfg.RESTClientGetter.ToDiscoveryClient()
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := dc.ServerVersion()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the Kubernetes version of the cluster: %w", err)
+	}
+	c.minor, err = parseKubeMinorVersion(info.GitVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	c.served = servedAPIs(dc)
+	return c, nil
+}
+
+// servedAPIs returns a function reporting whether the cluster serves the kind
+// in the API version, caching the discovered resources of each API version
+func servedAPIs(dc discovery.DiscoveryInterface) func(gvk schema.GroupVersionKind) bool {
+	kinds := map[string]map[string]bool{}
+	return func(gvk schema.GroupVersionKind) bool {
+		gv := gvk.GroupVersion().String()
+		if _, ok := kinds[gv]; !ok {
+			kinds[gv] = map[string]bool{}
+			resources, err := dc.ServerResourcesForGroupVersion(gv)
+			if err != nil {
+				log.Printf("[DEBUG] API version %s not discovered: %s", gv, err)
+			} else {
+				for _, r := range resources.APIResources {
+					kinds[gv][r.Kind] = true
+				}
+			}
+		}
+		return kinds[gv][gvk.Kind]
+	}
+}
+
+func (c *apiVersionChecker) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	removed := []string{}
+	for _, m := range releaseutil.SplitManifests(renderedManifests.String()) {
+		r := resourceMeta{}
+		if err := yaml.Unmarshal([]byte(m), &r); err != nil {
+			return nil, err
+		}
+
+		gvk := r.GroupVersionKind()
+		api, ok := deprecatedAPIs[gvk]
+		if !ok {
+			continue
+		}
+
+		object := fmt.Sprintf("%s %s (%s)", gvk.Kind, r.Metadata.Name, r.APIVersion)
+		if r.Metadata.Namespace != "" {
+			object = fmt.Sprintf("%s %s/%s (%s)", gvk.Kind, r.Metadata.Namespace, r.Metadata.Name, r.APIVersion)
+		}
+		replacement := "no replacement"
+		if api.replacement != "" {
+			replacement = "use " + api.replacement
+		}
+
+		isRemoved := c.minor >= api.removedIn
+		if c.served != nil {
+			isRemoved = !c.served(gvk)
+		}
+
+		switch {
+		case isRemoved:
+			removed = append(removed, fmt.Sprintf("%s: removed in Kubernetes 1.%d, %s", object, api.removedIn, replacement))
+		case c.minor >= api.deprecatedIn:
+			log.Printf("[WARN] %s: deprecated in Kubernetes 1.%d and removed in 1.%d, %s", object, api.deprecatedIn, api.removedIn, replacement)
+		}
+	}
+
+	if len(removed) == 0 {
+		return renderedManifests, nil
+	}
+
+	msg := fmt.Sprintf("the release uses API versions not available in Kubernetes 1.%d:\n  - %s", c.minor, strings.Join(removed, "\n  - "))
+	if c.fail {
+		return nil, fmt.Errorf("%s", msg)
+	}
+	log.Printf("[WARN] %s", msg)
+	return renderedManifests, nil
+}
+
+// checkDeprecatedAPIs renders the chart and checks the API versions of its
+// resources if `deprecated_api_check` is set
+func checkDeprecatedAPIs(d resourceGetter, cfg *action.Configuration, c *chart.Chart, cpo *action.ChartPathOptions, values map[string]interface{}) error {
+	checker, err := newAPIVersionChecker(d, cfg)
+	if err != nil || checker == nil {
+		return err
+	}
+
+	return dryRunChecks(d, cfg, c, cpo, values, checker)
+}
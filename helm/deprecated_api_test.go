@@ -0,0 +1,104 @@
+package helm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sschema "k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAPIVersionChecker(t *testing.T) {
+	c, err := loader.Load("./testdata/charts/removed-api-chart")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	render := func(checker *apiVersionChecker) error {
+		client := action.NewInstall(&action.Configuration{Log: debug})
+		client.DryRun = true
+		client.ClientOnly = true
+		client.ReleaseName = "test"
+		client.Namespace = "default"
+		client.PostRenderer = checker
+
+		_, err := client.Run(c, map[string]interface{}{})
+		return err
+	}
+
+	d := schema.TestResourceDataRaw(t, resourceRelease().Schema, map[string]interface{}{
+		"deprecated_api_check": []interface{}{map[string]interface{}{
+			"kube_version": "1.22",
+		}},
+	})
+	checker, err := newAPIVersionChecker(d, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checker.minor != 22 || !checker.fail {
+		t.Fatalf("expected to fail on the APIs removed from 1.22, got %+v", checker)
+	}
+
+	// the Deployment was removed in 1.16, the CronJob is only deprecated
+	err = render(checker)
+	expected := "the release uses API versions not available in Kubernetes 1.22:\n  - Deployment default/test (extensions/v1beta1): removed in Kubernetes 1.16, use apps/v1"
+	if err == nil || !strings.Contains(err.Error(), expected) {
+		t.Fatalf("expected the removed API to be reported, got %v", err)
+	}
+
+	checker.minor = 15
+	if err := render(checker); err != nil {
+		t.Fatalf("expected no API to be removed from 1.15, got %v", err)
+	}
+
+	checker.minor = 25
+	checker.fail = false
+	if err := render(checker); err != nil {
+		t.Fatalf("expected the removed APIs to be logged only, got %v", err)
+	}
+}
+
+func TestAPIVersionCheckerDiscovery(t *testing.T) {
+	dc := fake.NewSimpleClientset().Discovery().(*fakediscovery.FakeDiscovery)
+	dc.FakedServerVersion = &version.Info{GitVersion: "v1.21.2-eks-0389ca3"}
+	dc.Resources = []*metav1.APIResourceList{
+		{GroupVersion: "batch/v1beta1", APIResources: []metav1.APIResource{{Name: "cronjobs", Kind: "CronJob"}}},
+	}
+
+	checker := &apiVersionChecker{minor: 21, served: servedAPIs(dc), fail: true}
+	if !checker.served(k8sschema.GroupVersionKind{Group: "batch", Version: "v1beta1", Kind: "CronJob"}) {
+		t.Fatal("expected batch/v1beta1 CronJob to be served")
+	}
+
+	manifests := "apiVersion: extensions/v1beta1\nkind: Ingress\nmetadata:\n  name: web\n"
+	_, err := checker.Run(bytes.NewBufferString(manifests))
+	expected := "the release uses API versions not available in Kubernetes 1.21:\n  - Ingress web (extensions/v1beta1): removed in Kubernetes 1.22, use networking.k8s.io/v1"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected the API not served by the cluster to be reported, got %v", err)
+	}
+}
+
+func TestParseKubeMinorVersion(t *testing.T) {
+	for v, expected := range map[string]int{"1.22": 22, "1.16.3": 16, "v1.21.2-eks-0389ca3": 21} {
+		minor, err := parseKubeMinorVersion(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if minor != expected {
+			t.Fatalf("expected %s to have the minor version %d, got %d", v, expected, minor)
+		}
+	}
+
+	for _, v := range []string{"", "latest", "2.0"} {
+		if _, err := parseKubeMinorVersion(v); err == nil {
+			t.Fatalf("expected %q to be rejected", v)
+		}
+	}
+}
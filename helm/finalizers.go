@@ -0,0 +1,150 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/yaml"
+)
+
+// removeFinalizersPatch clears the finalizers of an object
+var removeFinalizersPatch = []byte(`{"metadata":{"finalizers":null}}`)
+
+// removeReleaseFinalizers removes the finalizers of the objects of the
+// uninstalled release that are still terminating after `timeout`, when
+// `remove_finalizers_on_destroy` is set, so that the destroy completes
+func removeReleaseFinalizers(ctx context.Context, d resourceGetter, cfg *action.Configuration, r *release.Release) error {
+	if !d.Get("remove_finalizers_on_destroy").(bool) || r == nil {
+		return nil
+	}
+
+	config, err := cfg.RESTClientGetter.ToRESTConfig()
+	if err != nil {
+		return err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	mapper, err := cfg.RESTClientGetter.ToRESTMapper()
+	if err != nil {
+		return err
+	}
+
+	timeout := time.Duration(d.Get("timeout").(int)) * time.Second
+	return removeFinalizers(ctx, client, mapper, r, timeout)
+}
+
+// releaseObject is an object of the manifest of a release with the client of
+// its resource
+type releaseObject struct {
+	id     string
+	name   string
+	client dynamic.ResourceInterface
+}
+
+// removeFinalizers waits for the objects of the manifest of the release to be
+// deleted, and removes the finalizers of the ones still terminating once the
+// timeout expires, giving their controllers a chance to finalize them first.
+// Only objects annotated as owned by the release are patched.
+func removeFinalizers(ctx context.Context, client dynamic.Interface, mapper meta.RESTMapper, r *release.Release, timeout time.Duration) error {
+	objects, err := releaseObjects(client, mapper, r)
+	if err != nil {
+		return err
+	}
+
+	terminating := map[string]*unstructured.Unstructured{}
+	err = wait.PollImmediate(waitPollInterval, timeout, func() (bool, error) {
+		terminating = map[string]*unstructured.Unstructured{}
+		for _, o := range objects {
+			live, err := o.client.Get(ctx, o.name, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				continue
+			} else if err != nil {
+				return false, err
+			}
+
+			// objects kept by the resource policy of the chart are not
+			// being deleted
+			if live.GetDeletionTimestamp() != nil && len(live.GetFinalizers()) > 0 {
+				terminating[o.id] = live
+			}
+		}
+		return len(terminating) == 0, nil
+	})
+	if err != wait.ErrWaitTimeout {
+		return err
+	}
+
+	for _, o := range objects {
+		live, ok := terminating[o.id]
+		if !ok {
+			continue
+		}
+		if !isOwnedByRelease(live, r.Name, r.Namespace) {
+			log.Printf("[WARN] %s is still terminating but not owned by release %s, leaving its finalizers", o.id, r.Name)
+			continue
+		}
+
+		for _, f := range live.GetFinalizers() {
+			log.Printf("[WARN] Removing finalizer %q of %s, still terminating after the uninstall of release %s", f, o.id, r.Name)
+		}
+		_, err := o.client.Patch(ctx, o.name, types.MergePatchType, removeFinalizersPatch, metav1.PatchOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("unable to remove the finalizers of %s: %w", o.id, err)
+		}
+	}
+	return nil
+}
+
+// releaseObjects returns the objects of the manifest of the release, in the
+// namespace of the release unless they set theirs. Objects whose kind is not
+// served anymore are left out.
+func releaseObjects(client dynamic.Interface, mapper meta.RESTMapper, r *release.Release) ([]releaseObject, error) {
+	objects := []releaseObject{}
+	for _, m := range releaseutil.SplitManifests(r.Manifest) {
+		obj := &unstructured.Unstructured{}
+		if err := yaml.Unmarshal([]byte(m), &obj.Object); err != nil {
+			return nil, err
+		}
+		if obj.GetKind() == "" || obj.GetName() == "" {
+			continue
+		}
+
+		gvk := obj.GroupVersionKind()
+		mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			log.Printf("[WARN] Unable to map %s %s of release %s, leaving its finalizers: %s", gvk.Kind, obj.GetName(), r.Name, err)
+			continue
+		}
+
+		o := releaseObject{
+			id:     fmt.Sprintf("%s %s", gvk.Kind, obj.GetName()),
+			name:   obj.GetName(),
+			client: client.Resource(mapping.Resource),
+		}
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			namespace := obj.GetNamespace()
+			if namespace == "" {
+				namespace = r.Namespace
+			}
+			o.id = fmt.Sprintf("%s %s/%s", gvk.Kind, namespace, obj.GetName())
+			o.client = client.Resource(mapping.Resource).Namespace(namespace)
+		}
+		objects = append(objects, o)
+	}
+	return objects, nil
+}
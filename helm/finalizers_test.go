@@ -0,0 +1,100 @@
+package helm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"helm.sh/helm/v3/pkg/release"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestRemoveFinalizers(t *testing.T) {
+	interval := waitPollInterval
+	waitPollInterval = 10 * time.Millisecond
+	defer func() { waitPollInterval = interval }()
+
+	gvk := schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}
+	gvr := schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "widgets"}
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{gvk.GroupVersion()})
+	mapper.AddSpecific(gvk, gvr, gvr.GroupVersion().WithResource("widget"), meta.RESTScopeNamespace)
+
+	now := metav1.Now()
+	widget := func(name string, owner string, terminating bool) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(gvk)
+		obj.SetNamespace("default")
+		obj.SetName(name)
+		obj.SetFinalizers([]string{"example.com/cleanup"})
+		obj.SetAnnotations(map[string]string{
+			helmReleaseNameAnnotation:      owner,
+			helmReleaseNamespaceAnnotation: "default",
+		})
+		if terminating {
+			obj.SetDeletionTimestamp(&now)
+		}
+		return obj
+	}
+
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{gvr: "WidgetList"},
+		widget("stuck", "test", true),
+		widget("adopted", "other", true),
+		widget("kept", "test", false),
+	)
+
+	r := &release.Release{
+		Name:      "test",
+		Namespace: "default",
+		Manifest: `---
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: stuck
+---
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: adopted
+---
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: kept
+---
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: deleted
+`,
+	}
+
+	if err := removeFinalizers(context.Background(), client, mapper, r, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	finalizers := func(name string) []string {
+		obj, err := client.Resource(gvr).Namespace("default").Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return obj.GetFinalizers()
+	}
+
+	// the destroy is unblocked by removing the finalizers of the terminating
+	// object of the release
+	if f := finalizers("stuck"); len(f) != 0 {
+		t.Fatalf("expected the finalizers of the terminating object to be removed, got %v", f)
+	}
+	if f := finalizers("adopted"); len(f) != 1 {
+		t.Fatalf("expected the finalizers of an object of another release to be left, got %v", f)
+	}
+	if f := finalizers("kept"); len(f) != 1 {
+		t.Fatalf("expected the finalizers of an object that is not deleted to be left, got %v", f)
+	}
+}
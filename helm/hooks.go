@@ -0,0 +1,413 @@
+package helm
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/kube"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/cli-runtime/pkg/resource"
+	"sigs.k8s.io/yaml"
+)
+
+// nonFatalHookFailure returns the failed hooks of a failed release when all of
+// them are listed in nonFatalHooks. Only post-install and post-upgrade hooks
+// can be non-fatal, since the resources of the release have already been
+// deployed when they run.
+func nonFatalHookFailure(rel *release.Release, nonFatalHooks []string) ([]*release.Hook, bool) {
+	if rel == nil || rel.Info == nil || rel.Info.Status != release.StatusFailed {
+		return nil, false
+	}
+
+	failed := []*release.Hook{}
+	for _, h := range rel.Hooks {
+		if h.LastRun.Phase != release.HookPhaseFailed {
+			continue
+		}
+		if !isPostDeployHook(h) || !hookMatches(h, nonFatalHooks) {
+			return nil, false
+		}
+		failed = append(failed, h)
+	}
+
+	return failed, len(failed) > 0
+}
+
+// skippedHooks returns the hooks that Helm did not run because they come after
+// one of the failed hooks, as Helm stops running the hooks of an event at the
+// first failure
+func skippedHooks(rel *release.Release, failed []*release.Hook) []*release.Hook {
+	events := map[release.HookEvent]bool{}
+	for _, h := range failed {
+		for _, e := range h.Events {
+			if e == release.HookPostInstall || e == release.HookPostUpgrade {
+				events[e] = true
+			}
+		}
+	}
+
+	skipped := []*release.Hook{}
+	for _, h := range rel.Hooks {
+		if h.LastRun.Phase != "" {
+			continue
+		}
+		for _, e := range h.Events {
+			if events[e] {
+				skipped = append(skipped, h)
+				break
+			}
+		}
+	}
+	return skipped
+}
+
+// hookMatches returns true if the name or the template path of the hook is
+// contained in names
+func hookMatches(h *release.Hook, names []string) bool {
+	for _, n := range names {
+		if n == h.Name || n == h.Path {
+			return true
+		}
+	}
+	return false
+}
+
+func isPostDeployHook(h *release.Hook) bool {
+	for _, e := range h.Events {
+		if e == release.HookPostInstall || e == release.HookPostUpgrade {
+			return true
+		}
+	}
+	return false
+}
+
+// markReleaseDeployed records a release that failed on non-fatal hooks as
+// deployed, superseding the previously deployed revision as Helm does after a
+// successful upgrade.
+func markReleaseDeployed(cfg *action.Configuration, rel *release.Release, hooks []*release.Hook) error {
+	deployed, err := cfg.Releases.DeployedAll(rel.Name)
+	if err != nil && !errors.Is(err, driver.ErrNoDeployedReleases) {
+		return err
+	}
+
+	for _, r := range deployed {
+		if r.Version == rel.Version {
+			continue
+		}
+		r.Info.Status = release.StatusSuperseded
+		if err := cfg.Releases.Update(r); err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(hooks))
+	for _, h := range hooks {
+		names = append(names, h.Name)
+	}
+
+	rel.SetStatus(release.StatusDeployed, fmt.Sprintf("Deployed with failed non-fatal hooks: %s", strings.Join(names, ", ")))
+	return cfg.Releases.Update(rel)
+}
+
+// hookEvents are the hook events that can be disabled with `disable_hooks`
+var hookEvents = []string{
+	release.HookPreInstall.String(),
+	release.HookPostInstall.String(),
+	release.HookPreUpgrade.String(),
+	release.HookPostUpgrade.String(),
+	release.HookPreDelete.String(),
+	release.HookPostDelete.String(),
+	release.HookPreRollback.String(),
+	release.HookPostRollback.String(),
+}
+
+// disableHooks makes the Kubernetes client of cfg skip the hooks of the
+// events listed in `disable_hooks` among the events of the running operation
+func disableHooks(cfg *action.Configuration, d resourceGetter, events ...release.HookEvent) {
+	disabled := []release.HookEvent{}
+	for _, raw := range d.Get("disable_hooks").(*schema.Set).List() {
+		for _, e := range events {
+			if raw.(string) == e.String() {
+				disabled = append(disabled, e)
+			}
+		}
+	}
+
+	if len(disabled) == 0 {
+		return
+	}
+
+	cfg.KubeClient = &hookFilteringKubeClient{Interface: cfg.KubeClient, disabled: disabled}
+}
+
+// hookFilteringKubeClient is a kube.Interface that skips the resources of the
+// hooks annotated with one of the disabled events, so that they are neither
+// created, waited for nor deleted by Helm. The event a hook is run for is not
+// known to the client, so a hook with several events is skipped for all of them.
+type hookFilteringKubeClient struct {
+	kube.Interface
+	disabled []release.HookEvent
+}
+
+func (c *hookFilteringKubeClient) Create(resources kube.ResourceList) (*kube.Result, error) {
+	resources = c.filter(resources)
+	if len(resources) == 0 {
+		return &kube.Result{}, nil
+	}
+	return c.Interface.Create(resources)
+}
+
+func (c *hookFilteringKubeClient) WatchUntilReady(resources kube.ResourceList, timeout time.Duration) error {
+	resources = c.filter(resources)
+	if len(resources) == 0 {
+		return nil
+	}
+	return c.Interface.WatchUntilReady(resources, timeout)
+}
+
+func (c *hookFilteringKubeClient) Delete(resources kube.ResourceList) (*kube.Result, []error) {
+	resources = c.filter(resources)
+	if len(resources) == 0 {
+		return &kube.Result{}, nil
+	}
+	return c.Interface.Delete(resources)
+}
+
+func (c *hookFilteringKubeClient) filter(resources kube.ResourceList) kube.ResourceList {
+	return resources.Filter(func(info *resource.Info) bool {
+		if c.isDisabledHook(info) {
+			log.Printf("[INFO] Skipping disabled hook %s %s", info.Mapping.GroupVersionKind.Kind, info.Name)
+			return false
+		}
+		return true
+	})
+}
+
+func (c *hookFilteringKubeClient) isDisabledHook(info *resource.Info) bool {
+	accessor, err := meta.Accessor(info.Object)
+	if err != nil {
+		return false
+	}
+
+	annotation, ok := accessor.GetAnnotations()[release.HookAnnotation]
+	if !ok {
+		return false
+	}
+
+	for _, e := range strings.Split(annotation, ",") {
+		for _, d := range c.disabled {
+			if strings.TrimSpace(e) == d.String() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reweightHooks makes cfg store the releases with the weights of their hooks
+// overridden by `hook_weights`. Helm runs the hooks of a release after storing
+// it, in the order of their weights, and the hooks are not passed to the
+// post-renderers, so the weights are rewritten when the release is stored.
+func reweightHooks(cfg *action.Configuration, d resourceGetter) {
+	weights := map[string]int{}
+	for name, weight := range d.Get("hook_weights").(map[string]interface{}) {
+		weights[name] = weight.(int)
+	}
+
+	if len(weights) == 0 {
+		return
+	}
+
+	cfg.Releases.Driver = &hookWeightDriver{Driver: cfg.Releases.Driver, weights: weights}
+}
+
+// hookWeightDriver is a storage driver overriding the weights of the hooks of
+// the releases it creates, keyed by the name or the template path of the hook
+type hookWeightDriver struct {
+	driver.Driver
+	weights map[string]int
+}
+
+func (s *hookWeightDriver) Create(key string, rls *release.Release) error {
+	for _, h := range rls.Hooks {
+		weight, ok := s.weights[h.Name]
+		if !ok {
+			weight, ok = s.weights[h.Path]
+		}
+		if !ok || weight == h.Weight {
+			continue
+		}
+
+		log.Printf("[INFO] Overriding the weight of hook %s from %d to %d", h.Name, h.Weight, weight)
+		if err := setHookWeight(h, weight); err != nil {
+			return errors.Wrapf(err, "unable to override the weight of hook %s", h.Name)
+		}
+	}
+	return s.Driver.Create(key, rls)
+}
+
+// setHookWeight sets the weight of the hook and its helm.sh/hook-weight
+// annotation, so that the stored manifest of the hook matches the order it
+// was run in
+func setHookWeight(h *release.Hook, weight int) error {
+	obj := &unstructured.Unstructured{}
+	if err := yaml.Unmarshal([]byte(h.Manifest), &obj.Object); err != nil {
+		return err
+	}
+
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[release.HookWeightAnnotation] = strconv.Itoa(weight)
+	obj.SetAnnotations(annotations)
+
+	manifest, err := yaml.Marshal(obj.Object)
+	if err != nil {
+		return err
+	}
+
+	h.Manifest = string(manifest)
+	h.Weight = weight
+	return nil
+}
+
+// hookProgressInterval is the interval at which the hooks still running are
+// logged while waiting for them
+var hookProgressInterval = 30 * time.Second
+
+// waitForDeleteHooks makes the uninstall wait for its hooks to complete for at
+// most `timeout` if `wait_for_delete_hooks` is set, reporting the hooks still
+// running
+func waitForDeleteHooks(cfg *action.Configuration, d resourceGetter, client *action.Uninstall) {
+	if !d.Get("wait_for_delete_hooks").(bool) {
+		return
+	}
+
+	client.Timeout = time.Duration(d.Get("timeout").(int)) * time.Second
+	cfg.KubeClient = &hookWaitingKubeClient{Interface: cfg.KubeClient}
+}
+
+// hookWaitingKubeClient is a kube.Interface logging the hooks Helm waits for
+// until they complete, and naming them in the error when they do not
+type hookWaitingKubeClient struct {
+	kube.Interface
+}
+
+func (c *hookWaitingKubeClient) WatchUntilReady(resources kube.ResourceList, timeout time.Duration) error {
+	names := make([]string, 0, len(resources))
+	for _, info := range resources {
+		names = append(names, fmt.Sprintf("%s %s/%s", info.Mapping.GroupVersionKind.Kind, info.Namespace, info.Name))
+	}
+	hooks := strings.Join(names, ", ")
+
+	log.Printf("[INFO] Waiting up to %s for hook %s to complete", timeout, hooks)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(hookProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				log.Printf("[INFO] Hook %s is still running", hooks)
+			}
+		}
+	}()
+
+	if err := c.Interface.WatchUntilReady(resources, timeout); err != nil {
+		return errors.Wrapf(err, "hook %s did not complete", hooks)
+	}
+	return nil
+}
+
+// maxHookResults bounds the number of hooks reported in `hook_results`
+const maxHookResults = 100
+
+// hookResults returns the outcome of the hooks run by the last operation on
+// the release, in execution order. Test hooks are left out.
+func hookResults(r *release.Release) []map[string]interface{} {
+	hooks := []*release.Hook{}
+	for _, h := range r.Hooks {
+		if h.LastRun.StartedAt.IsZero() || isTestHook(h) {
+			continue
+		}
+		hooks = append(hooks, h)
+	}
+
+	sort.SliceStable(hooks, func(i, j int) bool {
+		return hooks[i].LastRun.StartedAt.Before(hooks[j].LastRun.StartedAt)
+	})
+
+	if len(hooks) > maxHookResults {
+		log.Printf("[WARN] Release %s ran %d hooks, only the first %d are reported", r.Name, len(hooks), maxHookResults)
+		hooks = hooks[:maxHookResults]
+	}
+
+	results := make([]map[string]interface{}, 0, len(hooks))
+	for _, h := range hooks {
+		events := make([]string, 0, len(h.Events))
+		for _, e := range h.Events {
+			events = append(events, e.String())
+		}
+
+		lastRun := h.LastRun.CompletedAt
+		if lastRun.IsZero() {
+			lastRun = h.LastRun.StartedAt
+		}
+
+		results = append(results, map[string]interface{}{
+			"name":     h.Name,
+			"kind":     h.Kind,
+			"events":   events,
+			"phase":    h.LastRun.Phase.String(),
+			"last_run": lastRun.UTC().Format(time.RFC3339),
+		})
+	}
+	return results
+}
+
+// renderedHooks returns the manifests of the hooks of the release keyed by
+// hook event, in the order Helm runs them: by weight, then by name. A hook
+// with several events is listed under each of them.
+func renderedHooks(r *release.Release) map[string]interface{} {
+	hooks := make([]*release.Hook, len(r.Hooks))
+	copy(hooks, r.Hooks)
+	sort.SliceStable(hooks, func(i, j int) bool {
+		if hooks[i].Weight == hooks[j].Weight {
+			return hooks[i].Name < hooks[j].Name
+		}
+		return hooks[i].Weight < hooks[j].Weight
+	})
+
+	manifests := map[string]*strings.Builder{}
+	for _, h := range hooks {
+		for _, e := range h.Events {
+			b, ok := manifests[e.String()]
+			if !ok {
+				b = &strings.Builder{}
+				manifests[e.String()] = b
+			}
+			fmt.Fprintf(b, "---\n# Source: %s\n%s\n", h.Path, strings.TrimSpace(h.Manifest))
+		}
+	}
+
+	results := make(map[string]interface{}, len(manifests))
+	for e, b := range manifests {
+		results[e] = b.String()
+	}
+	return results
+}
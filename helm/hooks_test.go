@@ -0,0 +1,489 @@
+package helm
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/kube"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	helmtime "helm.sh/helm/v3/pkg/time"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/cli-runtime/pkg/resource"
+	"sigs.k8s.io/yaml"
+)
+
+func TestNonFatalHookFailure(t *testing.T) {
+	hook := func(name string, event release.HookEvent, phase release.HookPhase) *release.Hook {
+		return &release.Hook{
+			Name:    name,
+			Path:    "failing-hook/templates/" + name + ".yaml",
+			Events:  []release.HookEvent{event},
+			LastRun: release.HookExecution{Phase: phase},
+		}
+	}
+
+	tests := []struct {
+		name          string
+		status        release.Status
+		hooks         []*release.Hook
+		nonFatalHooks []string
+		expected      bool
+	}{
+		{
+			name:          "failed non-fatal post-install hook",
+			status:        release.StatusFailed,
+			hooks:         []*release.Hook{hook("register", release.HookPostInstall, release.HookPhaseFailed)},
+			nonFatalHooks: []string{"register"},
+			expected:      true,
+		},
+		{
+			name:          "matched by template path",
+			status:        release.StatusFailed,
+			hooks:         []*release.Hook{hook("register", release.HookPostUpgrade, release.HookPhaseFailed)},
+			nonFatalHooks: []string{"failing-hook/templates/register.yaml"},
+			expected:      true,
+		},
+		{
+			name:   "other failed hook",
+			status: release.StatusFailed,
+			hooks: []*release.Hook{
+				hook("register", release.HookPostInstall, release.HookPhaseFailed),
+				hook("migrate", release.HookPostInstall, release.HookPhaseFailed),
+			},
+			nonFatalHooks: []string{"register"},
+			expected:      false,
+		},
+		{
+			name:          "pre-install hooks are always fatal",
+			status:        release.StatusFailed,
+			hooks:         []*release.Hook{hook("register", release.HookPreInstall, release.HookPhaseFailed)},
+			nonFatalHooks: []string{"register"},
+			expected:      false,
+		},
+		{
+			name:          "failure not caused by a hook",
+			status:        release.StatusFailed,
+			hooks:         []*release.Hook{hook("register", release.HookPostInstall, release.HookPhaseSucceeded)},
+			nonFatalHooks: []string{"register"},
+			expected:      false,
+		},
+		{
+			name:          "deployed release",
+			status:        release.StatusDeployed,
+			hooks:         []*release.Hook{hook("register", release.HookPostInstall, release.HookPhaseFailed)},
+			nonFatalHooks: []string{"register"},
+			expected:      false,
+		},
+	}
+
+	for _, tt := range tests {
+		rel := &release.Release{
+			Name:  "test",
+			Info:  &release.Info{Status: tt.status},
+			Hooks: tt.hooks,
+		}
+		if _, actual := nonFatalHookFailure(rel, tt.nonFatalHooks); actual != tt.expected {
+			t.Errorf("%s: expected %t, got %t", tt.name, tt.expected, actual)
+		}
+	}
+}
+
+func TestIgnoreNonFatalHookFailureSkippedHooks(t *testing.T) {
+	hook := func(name string, weight int, phase release.HookPhase) *release.Hook {
+		return &release.Hook{
+			Name:    name,
+			Kind:    "Job",
+			Weight:  weight,
+			Events:  []release.HookEvent{release.HookPostInstall},
+			LastRun: release.HookExecution{Phase: phase},
+		}
+	}
+
+	rel := &release.Release{
+		Name:      "test",
+		Namespace: "default",
+		Version:   1,
+		Info:      &release.Info{Status: release.StatusFailed},
+		Hooks: []*release.Hook{
+			hook("migrate", 0, release.HookPhaseSucceeded),
+			hook("register", 1, release.HookPhaseFailed),
+			hook("notify", 2, ""),
+			hook("cleanup", 3, ""),
+			{Name: "backup", Events: []release.HookEvent{release.HookPreDelete}},
+		},
+	}
+
+	cfg := &action.Configuration{Releases: storage.Init(driver.NewMemory())}
+	if err := cfg.Releases.Create(rel); err != nil {
+		t.Fatal(err)
+	}
+
+	d := fakeResourceChangeGetter{values: map[string]interface{}{
+		"atomic":          false,
+		"cleanup_on_fail": false,
+		"non_fatal_hooks": []interface{}{"register"},
+	}}
+	diags, err := ignoreNonFatalHookFailure(d, cfg, rel, fmt.Errorf("post-install hook register failed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summaries := []string{}
+	for _, d := range diags {
+		summaries = append(summaries, d.Summary)
+	}
+	expected := []string{
+		`Non-fatal hook "register" of release "test" failed`,
+		`Hook "notify" of release "test" was not run`,
+		`Hook "cleanup" of release "test" was not run`,
+	}
+	if !reflect.DeepEqual(summaries, expected) {
+		t.Fatalf("expected the warnings %q, got %q", expected, summaries)
+	}
+
+	if rel.Info.Status != release.StatusDeployed {
+		t.Fatalf("expected the release to be marked as deployed, got %s", rel.Info.Status)
+	}
+}
+
+// recordingKubeClient records the names of the resources passed to it
+type recordingKubeClient struct {
+	kube.Interface
+	created, watched, deleted []string
+}
+
+func resourceNames(resources kube.ResourceList) []string {
+	names := []string{}
+	for _, r := range resources {
+		names = append(names, r.Name)
+	}
+	return names
+}
+
+func (c *recordingKubeClient) Create(resources kube.ResourceList) (*kube.Result, error) {
+	c.created = append(c.created, resourceNames(resources)...)
+	return &kube.Result{}, nil
+}
+
+func (c *recordingKubeClient) WatchUntilReady(resources kube.ResourceList, timeout time.Duration) error {
+	c.watched = append(c.watched, resourceNames(resources)...)
+	return nil
+}
+
+func (c *recordingKubeClient) Delete(resources kube.ResourceList) (*kube.Result, []error) {
+	c.deleted = append(c.deleted, resourceNames(resources)...)
+	return &kube.Result{}, nil
+}
+
+func TestHookFilteringKubeClient(t *testing.T) {
+	info := func(name, hook string) *resource.Info {
+		obj := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		if hook != "" {
+			obj.Annotations = map[string]string{release.HookAnnotation: hook}
+		}
+		return &resource.Info{
+			Name:    name,
+			Object:  obj,
+			Mapping: &meta.RESTMapping{GroupVersionKind: v1.SchemeGroupVersion.WithKind("ConfigMap")},
+		}
+	}
+
+	recorder := &recordingKubeClient{}
+	client := &hookFilteringKubeClient{Interface: recorder, disabled: []release.HookEvent{release.HookPreDelete}}
+
+	resources := kube.ResourceList{
+		info("app", ""),
+		info("cleanup", "pre-delete"),
+		info("notify", "post-delete"),
+		info("both", "pre-install, pre-delete"),
+	}
+
+	client.Create(resources)
+	client.WatchUntilReady(resources, time.Second)
+	client.Delete(resources)
+
+	// only the resources of disabled hooks are left out
+	for _, names := range [][]string{recorder.created, recorder.watched, recorder.deleted} {
+		if len(names) != 2 || names[0] != "app" || names[1] != "notify" {
+			t.Fatalf("expected app and notify to be passed through, got %v", names)
+		}
+	}
+
+	recorder.created = nil
+	if _, err := client.Create(kube.ResourceList{info("cleanup", "pre-delete")}); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.created != nil {
+		t.Fatalf("expected the client not to be called for disabled hooks only, got %v", recorder.created)
+	}
+}
+
+// runningJobKubeClient simulates hook Jobs running past the timeout
+type runningJobKubeClient struct {
+	kube.Interface
+}
+
+func (c *runningJobKubeClient) WatchUntilReady(resources kube.ResourceList, timeout time.Duration) error {
+	time.Sleep(timeout)
+	return wait.ErrWaitTimeout
+}
+
+func TestWaitForDeleteHooks(t *testing.T) {
+	interval := hookProgressInterval
+	hookProgressInterval = 10 * time.Millisecond
+	defer func() { hookProgressInterval = interval }()
+
+	cfg := &action.Configuration{KubeClient: &runningJobKubeClient{}}
+	d := schema.TestResourceDataRaw(t, resourceRelease().Schema, map[string]interface{}{
+		"name":                  "test",
+		"chart":                 "test-chart",
+		"timeout":               1,
+		"wait_for_delete_hooks": true,
+	})
+
+	client := action.NewUninstall(cfg)
+	waitForDeleteHooks(cfg, d, client)
+	if client.Timeout != time.Second {
+		t.Fatalf("expected the uninstall to wait for the timeout, got %s", client.Timeout)
+	}
+
+	job := &resource.Info{
+		Name:      "export",
+		Namespace: "default",
+		Mapping:   &meta.RESTMapping{GroupVersionKind: batchv1.SchemeGroupVersion.WithKind("Job")},
+	}
+	err := cfg.KubeClient.WatchUntilReady(kube.ResourceList{job}, 50*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "hook Job default/export did not complete") {
+		t.Fatalf("expected the running hook to be reported, got %v", err)
+	}
+}
+
+// manifestKubeClient builds a resource named after the object of a manifest,
+// so that the hooks run by Helm are recorded
+type manifestKubeClient struct {
+	recordingKubeClient
+}
+
+func (c *manifestKubeClient) Build(reader io.Reader, validate bool) (kube.ResourceList, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &unstructured.Unstructured{}
+	if err := yaml.Unmarshal(data, &obj.Object); err != nil {
+		return nil, err
+	}
+	if obj.GetName() == "" {
+		return kube.ResourceList{}, nil
+	}
+	return kube.ResourceList{{Name: obj.GetName()}}, nil
+}
+
+func TestReweightHooks(t *testing.T) {
+	hook := func(name, weight string) *chart.File {
+		return &chart.File{
+			Name: "templates/" + name + ".yaml",
+			Data: []byte(fmt.Sprintf(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %s
+  annotations:
+    helm.sh/hook: pre-install
+    helm.sh/hook-weight: "%s"
+`, name, weight)),
+		}
+	}
+	ch := &chart.Chart{
+		Metadata:  &chart.Metadata{APIVersion: "v2", Name: "hooks", Version: "1.0.0"},
+		Templates: []*chart.File{hook("migrate", "1"), hook("backup", "2")},
+	}
+
+	install := func(weights map[string]interface{}) (*manifestKubeClient, *release.Release) {
+		client := &manifestKubeClient{recordingKubeClient{Interface: &kubefake.PrintingKubeClient{Out: ioutil.Discard}}}
+		cfg := &action.Configuration{
+			Releases:     storage.Init(driver.NewMemory()),
+			KubeClient:   client,
+			Capabilities: chartutil.DefaultCapabilities,
+			Log:          func(string, ...interface{}) {},
+		}
+		d := &fakeResourceChangeGetter{values: map[string]interface{}{"hook_weights": weights}}
+		reweightHooks(cfg, d)
+
+		i := action.NewInstall(cfg)
+		i.ReleaseName = "test"
+		i.Namespace = "default"
+		rel, err := i.Run(ch, map[string]interface{}{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client, rel
+	}
+
+	client, _ := install(map[string]interface{}{})
+	if expected := []string{"migrate", "backup"}; !reflect.DeepEqual(client.created, expected) {
+		t.Fatalf("expected the hooks to run in the order %v, got %v", expected, client.created)
+	}
+
+	// overriding the weight of migrate runs it after backup
+	client, rel := install(map[string]interface{}{"migrate": 5})
+	if expected := []string{"backup", "migrate"}; !reflect.DeepEqual(client.created, expected) {
+		t.Fatalf("expected the hooks to run in the order %v, got %v", expected, client.created)
+	}
+
+	for _, h := range rel.Hooks {
+		if h.Name != "migrate" {
+			continue
+		}
+		if h.Weight != 5 || !strings.Contains(h.Manifest, `helm.sh/hook-weight: "5"`) {
+			t.Fatalf("expected the weight of the hook to be overridden, got %d:\n%s", h.Weight, h.Manifest)
+		}
+	}
+
+	// hooks can also be matched by template path
+	client, _ = install(map[string]interface{}{"hooks/templates/backup.yaml": -1})
+	if expected := []string{"backup", "migrate"}; !reflect.DeepEqual(client.created, expected) {
+		t.Fatalf("expected the hooks to run in the order %v, got %v", expected, client.created)
+	}
+}
+
+func TestHookResults(t *testing.T) {
+	start := helmtime.Date(2021, time.March, 1, 10, 0, 0, 0, time.UTC)
+	run := func(offset time.Duration, phase release.HookPhase) release.HookExecution {
+		return release.HookExecution{
+			StartedAt:   start.Add(offset),
+			CompletedAt: start.Add(offset + time.Second),
+			Phase:       phase,
+		}
+	}
+
+	r := &release.Release{
+		Name: "test",
+		Hooks: []*release.Hook{
+			{Name: "migrate", Kind: "Job", Events: []release.HookEvent{release.HookPostInstall}, LastRun: run(time.Minute, release.HookPhaseFailed)},
+			{Name: "setup", Kind: "Job", Events: []release.HookEvent{release.HookPreInstall, release.HookPreUpgrade}, LastRun: run(0, release.HookPhaseSucceeded)},
+			{Name: "test-connection", Kind: "Pod", Events: []release.HookEvent{release.HookTest}, LastRun: run(time.Hour, release.HookPhaseSucceeded)},
+			{Name: "cleanup", Kind: "Job", Events: []release.HookEvent{release.HookPreDelete}},
+		},
+	}
+
+	expected := []map[string]interface{}{
+		{
+			"name":     "setup",
+			"kind":     "Job",
+			"events":   []string{"pre-install", "pre-upgrade"},
+			"phase":    "Succeeded",
+			"last_run": "2021-03-01T10:00:01Z",
+		},
+		{
+			"name":     "migrate",
+			"kind":     "Job",
+			"events":   []string{"post-install"},
+			"phase":    "Failed",
+			"last_run": "2021-03-01T10:01:01Z",
+		},
+	}
+
+	if results := hookResults(r); !reflect.DeepEqual(results, expected) {
+		t.Fatalf("expected %v, got %v", expected, results)
+	}
+}
+
+func TestRenderedHooks(t *testing.T) {
+	template := func(name, annotations string) *chart.File {
+		return &chart.File{
+			Name: "templates/" + name + ".yaml",
+			Data: []byte(fmt.Sprintf(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %s
+  annotations:
+%s`, name, annotations)),
+		}
+	}
+	ch := &chart.Chart{
+		Metadata: &chart.Metadata{APIVersion: "v2", Name: "hooks", Version: "1.0.0"},
+		Templates: []*chart.File{
+			template("migrate", "    helm.sh/hook: pre-install,pre-upgrade\n    helm.sh/hook-weight: \"1\"\n"),
+			template("backup", "    helm.sh/hook: pre-install\n"),
+			template("notify", "    helm.sh/hook: post-install\n"),
+		},
+	}
+
+	client := &manifestKubeClient{recordingKubeClient{Interface: &kubefake.PrintingKubeClient{Out: ioutil.Discard}}}
+	cfg := &action.Configuration{
+		Releases:     storage.Init(driver.NewMemory()),
+		KubeClient:   client,
+		Capabilities: chartutil.DefaultCapabilities,
+		Log:          func(string, ...interface{}) {},
+	}
+	d := schema.TestResourceDataRaw(t, resourceRelease().Schema, map[string]interface{}{
+		"name":         "test",
+		"chart":        "hooks",
+		"export_hooks": true,
+	})
+
+	i := action.NewInstall(cfg)
+	i.ReleaseName = "test"
+	i.Namespace = "default"
+	i.DisableHooks = d.Get("disable_webhooks").(bool) || d.Get("export_hooks").(bool)
+	rel, err := i.Run(ch, map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the hooks are rendered but not run
+	if len(client.created) != 0 {
+		t.Fatalf("expected no hook to be run, got %v", client.created)
+	}
+	if len(rel.Hooks) != 3 {
+		t.Fatalf("expected the 3 hooks to be stored with the release, got %d", len(rel.Hooks))
+	}
+
+	if err := setReleaseAttributes(d, rel, &Meta{}); err != nil {
+		t.Fatal(err)
+	}
+	rendered := d.Get("rendered_hooks").(map[string]interface{})
+	if len(rendered) != 3 {
+		t.Fatalf("expected the hooks of 3 events, got %v", rendered)
+	}
+
+	// the hooks of an event are listed in the order Helm runs them
+	preInstall := rendered["pre-install"].(string)
+	backup, migrate := strings.Index(preInstall, "name: backup"), strings.Index(preInstall, "name: migrate")
+	if backup < 0 || migrate < backup {
+		t.Fatalf("expected backup to be listed before migrate, got:\n%s", preInstall)
+	}
+	if !strings.Contains(preInstall, "# Source: hooks/templates/migrate.yaml") {
+		t.Fatalf("expected the template path of the hooks, got:\n%s", preInstall)
+	}
+	if !strings.Contains(rendered["pre-upgrade"].(string), "name: migrate") || !strings.Contains(rendered["post-install"].(string), "name: notify") {
+		t.Fatalf("expected the hooks to be listed under each of their events, got %v", rendered)
+	}
+
+	// the hooks are not exported by default
+	d.Set("export_hooks", false)
+	if err := setReleaseAttributes(d, rel, &Meta{}); err != nil {
+		t.Fatal(err)
+	}
+	if rendered := d.Get("rendered_hooks").(map[string]interface{}); len(rendered) != 0 {
+		t.Fatalf("expected no rendered hooks, got %v", rendered)
+	}
+}
@@ -0,0 +1,188 @@
+package helm
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/helmpath"
+	"helm.sh/helm/v3/pkg/repo"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/client-go/rest"
+)
+
+// indexCacheLock serializes the downloads of the repository indexes, so that
+// a cached index and its validators are always written together
+var indexCacheLock sync.Mutex
+
+// cacheValidators are the validators of the response a cached repository
+// index or keyring was read from, stored next to the cached file
+type cacheValidators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// downloadIndexFile downloads the index of the repository to the cache
+// directory, like ChartRepository.DownloadIndexFile, and returns it. Indexes
+// served over HTTP are requested with the ETag and Last-Modified of the cached
+// copy, so that an unchanged index is answered with 304 Not Modified and read
+// from the cache instead of being downloaded again.
+func downloadIndexFile(m *Meta, entry *repo.Entry, cachePath string) (*repo.IndexFile, error) {
+	u, err := url.Parse(entry.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if scheme := strings.ToLower(u.Scheme); scheme != "http" && scheme != "https" {
+		// the index of the repositories served by getter plugins, e.g. s3, is
+		// always downloaded
+		r, err := repo.NewChartRepository(entry, getter.All(m.Settings))
+		if err != nil {
+			return nil, err
+		}
+		r.CachePath = cachePath
+
+		indexPath, err := r.DownloadIndexFile()
+		if err != nil {
+			return nil, err
+		}
+		return repo.LoadIndexFile(indexPath)
+	}
+
+	u.RawPath = path.Join(u.RawPath, "index.yaml")
+	u.Path = path.Join(u.Path, "index.yaml")
+
+	indexCacheLock.Lock()
+	defer indexCacheLock.Unlock()
+
+	indexPath := filepath.Join(cachePath, helmpath.CacheIndexFile(entry.Name))
+	validatorsPath := indexPath + ".validators"
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Username != "" || entry.Password != "" {
+		req.SetBasicAuth(entry.Username, entry.Password)
+	}
+
+	validators := cacheValidators{}
+	if _, err := os.Stat(indexPath); err == nil {
+		if data, err := ioutil.ReadFile(validatorsPath); err == nil && json.Unmarshal(data, &validators) == nil {
+			if validators.ETag != "" {
+				req.Header.Set("If-None-Match", validators.ETag)
+			}
+			if validators.LastModified != "" {
+				req.Header.Set("If-Modified-Since", validators.LastModified)
+			}
+		}
+	}
+
+	client, err := indexHTTPClient(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNotModified:
+		log.Printf("[DEBUG] Index of repository %s not modified, using the cached index", entry.URL)
+		return repo.LoadIndexFile(indexPath)
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("failed to fetch %s : %s", u.String(), res.Status)
+	}
+
+	if err := os.MkdirAll(cachePath, 0755); err != nil {
+		return nil, err
+	}
+
+	// the index is written to a temporary file first, so that a truncated or
+	// invalid index never replaces the cached one
+	tmp, err := ioutil.TempFile(cachePath, helmpath.CacheIndexFile(entry.Name))
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, res.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := repo.LoadIndexFile(tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	var charts strings.Builder
+	for name := range index.Entries {
+		fmt.Fprintln(&charts, name)
+	}
+	if err := ioutil.WriteFile(filepath.Join(cachePath, helmpath.CacheChartsFile(entry.Name)), []byte(charts.String()), 0644); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(tmp.Name(), indexPath); err != nil {
+		return nil, err
+	}
+
+	validators = cacheValidators{ETag: res.Header.Get("ETag"), LastModified: res.Header.Get("Last-Modified")}
+	if validators.ETag == "" && validators.LastModified == "" {
+		os.Remove(validatorsPath)
+		return index, nil
+	}
+
+	data, err := json.Marshal(validators)
+	if err != nil {
+		return nil, err
+	}
+	return index, ioutil.WriteFile(validatorsPath, data, 0644)
+}
+
+// indexHTTPClient returns the HTTP client downloading the index of the
+// repository, with its client certificate and CA
+func indexHTTPClient(entry *repo.Entry) (*http.Client, error) {
+	tlsConfig, err := rest.TLSConfigFor(&rest.Config{
+		TLSClientConfig: rest.TLSClientConfig{
+			CertFile: entry.CertFile,
+			KeyFile:  entry.KeyFile,
+			CAFile:   entry.CAFile,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if entry.InsecureSkipTLSverify {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	return &http.Client{
+		Transport: utilnet.SetTransportDefaults(&http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		}),
+	}, nil
+}
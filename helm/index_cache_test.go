@@ -0,0 +1,93 @@
+package helm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/helmpath"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+func TestDownloadIndexFileNotModified(t *testing.T) {
+	index := `apiVersion: v1
+entries:
+  test-chart:
+  - name: test-chart
+    version: 1.2.3
+`
+	etag := `"v1"`
+	statuses := []int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/charts/index.yaml" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if user, password, _ := r.BasicAuth(); user != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			statuses = append(statuses, http.StatusNotModified)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		statuses = append(statuses, http.StatusOK)
+		w.Write([]byte(index))
+	}))
+	defer server.Close()
+
+	m := &Meta{Settings: cli.New()}
+	cachePath := t.TempDir()
+	entry := &repo.Entry{Name: "test", URL: server.URL + "/charts", Username: "user", Password: "secret"}
+
+	version := func() string {
+		i, err := downloadIndexFile(m, entry, cachePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cv, err := i.Get("test-chart", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cv.Version
+	}
+
+	if v := version(); v != "1.2.3" {
+		t.Errorf("expected version 1.2.3, got %s", v)
+	}
+	if v := version(); v != "1.2.3" {
+		t.Errorf("expected the cached index with version 1.2.3, got %s", v)
+	}
+	if len(statuses) != 2 || statuses[1] != http.StatusNotModified {
+		t.Fatalf("expected the second download to be answered with 304, got %v", statuses)
+	}
+
+	index = `apiVersion: v1
+entries:
+  test-chart:
+  - name: test-chart
+    version: 1.2.4
+`
+	etag = `"v2"`
+	if v := version(); v != "1.2.4" {
+		t.Errorf("expected the changed index with version 1.2.4, got %s", v)
+	}
+
+	if _, err := os.Stat(filepath.Join(cachePath, helmpath.CacheChartsFile("test"))); err != nil {
+		t.Errorf("expected the charts file to be written: %v", err)
+	}
+
+	// a missing cached index is downloaded again whatever its validators
+	if err := os.Remove(filepath.Join(cachePath, helmpath.CacheIndexFile("test"))); err != nil {
+		t.Fatal(err)
+	}
+	if v := version(); v != "1.2.4" || statuses[len(statuses)-1] != http.StatusOK {
+		t.Errorf("expected the missing index to be downloaded, got version %s and statuses %v", v, statuses)
+	}
+}
@@ -0,0 +1,140 @@
+package helm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// keyringCacheDir is the directory, relative to the repository cache, where
+// keyrings fetched from a keyserver are stored
+const keyringCacheDir = "keyrings"
+
+// keyringCacheTTL is the time a fetched keyring is used before it is
+// revalidated against the keyserver, so that rotated or revoked keys are
+// picked up
+const keyringCacheTTL = 24 * time.Hour
+
+// keyringHTTPClient fetches the keyrings, a keyserver that does not answer
+// fails the verification instead of blocking the run
+var keyringHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// fetchKeyring downloads the public keys published at keyringURL and stores
+// them as a binary keyring in cacheDir, returning the path of the keyring file.
+// A keyring fetched less than keyringCacheTTL ago is used as is, an older one
+// is requested again with the ETag and Last-Modified of the cached copy, and
+// only downloaded if it changed. Any failure to retrieve or parse the keys is
+// returned as an error so that verification fails closed.
+func fetchKeyring(client *http.Client, keyringURL, cacheDir string) (string, error) {
+	u, err := url.Parse(keyringURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid keyring URL %q: %v", keyringURL, err)
+	}
+	if u.Scheme != "https" {
+		return "", fmt.Errorf("keyring URL %q must use https", keyringURL)
+	}
+
+	path := filepath.Join(cacheDir, keyringCacheDir, fmt.Sprintf("%x.gpg", sha256.Sum256([]byte(keyringURL))))
+	validatorsPath := path + ".validators"
+
+	req, err := http.NewRequest(http.MethodGet, keyringURL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		if time.Since(info.ModTime()) < keyringCacheTTL {
+			log.Printf("[DEBUG] Using cached keyring for %s: %s", keyringURL, path)
+			return path, nil
+		}
+
+		validators := cacheValidators{}
+		if data, err := ioutil.ReadFile(validatorsPath); err == nil && json.Unmarshal(data, &validators) == nil {
+			if validators.ETag != "" {
+				req.Header.Set("If-None-Match", validators.ETag)
+			}
+			if validators.LastModified != "" {
+				req.Header.Set("If-Modified-Since", validators.LastModified)
+			}
+		}
+	}
+
+	log.Printf("[DEBUG] Fetching keyring from %s", keyringURL)
+	res, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not fetch keyring from %q: %v", keyringURL, err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNotModified:
+		log.Printf("[DEBUG] Keyring %s not modified, using the cached keyring", keyringURL)
+		now := time.Now()
+		return path, os.Chtimes(path, now, now)
+	case http.StatusOK:
+	default:
+		return "", fmt.Errorf("could not fetch keyring from %q: %s", keyringURL, res.Status)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", fmt.Errorf("could not read keyring from %q: %v", keyringURL, err)
+	}
+
+	keys, err := readKeyring(body)
+	if err != nil {
+		return "", fmt.Errorf("could not parse keyring from %q: %v", keyringURL, err)
+	}
+
+	// Helm only reads binary keyrings, so keys are always stored serialized
+	var buf bytes.Buffer
+	for _, e := range keys {
+		if err := e.Serialize(&buf); err != nil {
+			return "", err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return "", err
+	}
+
+	validators := cacheValidators{ETag: res.Header.Get("ETag"), LastModified: res.Header.Get("Last-Modified")}
+	if validators.ETag == "" && validators.LastModified == "" {
+		os.Remove(validatorsPath)
+		return path, nil
+	}
+
+	data, err := json.Marshal(validators)
+	if err != nil {
+		return "", err
+	}
+	return path, ioutil.WriteFile(validatorsPath, data, 0644)
+}
+
+// readKeyring parses either an ASCII armored or a binary keyring
+func readKeyring(b []byte) (openpgp.EntityList, error) {
+	keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+	if err != nil {
+		keys, err = openpgp.ReadKeyRing(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys found")
+	}
+	return keys, nil
+}
@@ -0,0 +1,97 @@
+package helm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func TestFetchKeyring(t *testing.T) {
+	entity, err := openpgp.NewEntity("Test Signer", "", "signer@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var armored bytes.Buffer
+	w, err := armor.Encode(&armored, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	requests, revalidations := 0, 0
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/signer.asc" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			revalidations++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(armored.Bytes())
+	}))
+	defer ts.Close()
+
+	cacheDir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	path, err := fetchKeyring(ts.Client(), ts.URL+"/signer.asc", cacheDir)
+	assert.NoError(t, err)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	keys, err := openpgp.ReadKeyRing(f)
+	assert.NoError(t, err)
+	if assert.Len(t, keys, 1) {
+		assert.Equal(t, entity.PrimaryKey.KeyId, keys[0].PrimaryKey.KeyId)
+	}
+
+	// the second fetch must be served from the cache
+	cached, err := fetchKeyring(ts.Client(), ts.URL+"/signer.asc", cacheDir)
+	assert.NoError(t, err)
+	assert.Equal(t, path, cached)
+	assert.Equal(t, 1, requests)
+
+	// an expired keyring is revalidated and kept when it did not change
+	expired := time.Now().Add(-keyringCacheTTL - time.Minute)
+	if err := os.Chtimes(path, expired, expired); err != nil {
+		t.Fatal(err)
+	}
+	cached, err = fetchKeyring(ts.Client(), ts.URL+"/signer.asc", cacheDir)
+	assert.NoError(t, err)
+	assert.Equal(t, path, cached)
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, 1, revalidations)
+
+	// and is used as is again until the TTL expires
+	_, err = fetchKeyring(ts.Client(), ts.URL+"/signer.asc", cacheDir)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, requests)
+
+	_, err = fetchKeyring(ts.Client(), ts.URL+"/missing.asc", cacheDir)
+	assert.Error(t, err)
+
+	_, err = fetchKeyring(ts.Client(), "http://example.com/signer.asc", cacheDir)
+	assert.Error(t, err)
+}
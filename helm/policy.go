@@ -0,0 +1,148 @@
+package helm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/postrender"
+	"helm.sh/helm/v3/pkg/release"
+)
+
+// policyChecker is a post-renderer evaluating the manifests against the Rego
+// policies of `policy` with conftest, failing on violations. The manifests
+// are returned unchanged.
+type policyChecker struct {
+	binaryPath string
+	path       string
+	namespace  string
+	timeout    time.Duration
+}
+
+// newPolicyChecker returns the policy checker configured by `policy`, or nil
+// if the block is not set
+func newPolicyChecker(d resourceGetter) *policyChecker {
+	path := d.Get("policy.0.path").(string)
+	if path == "" {
+		return nil
+	}
+
+	return &policyChecker{
+		binaryPath: d.Get("policy.0.binary_path").(string),
+		path:       path,
+		namespace:  d.Get("policy.0.namespace").(string),
+		timeout:    time.Duration(d.Get("policy.0.timeout").(int)) * time.Second,
+	}
+}
+
+func (p *policyChecker) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, p.binaryPath, "test",
+		"--policy", p.path,
+		"--namespace", p.namespace,
+		"--output", "json",
+		"--no-color",
+		"-")
+	cmd.Stdin = bytes.NewReader(renderedManifests.Bytes())
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	out, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("the evaluation of the policies of %s did not complete within %s", p.path, p.timeout)
+	}
+
+	// conftest exits with an error when there are violations, the violations
+	// are reported rather than the exit status then
+	violations, parseErr := policyViolations(out)
+	if len(violations) > 0 {
+		return nil, fmt.Errorf("the manifests violate the policies of %s:\n  - %s", p.path, strings.Join(violations, "\n  - "))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error evaluating the policies of %s with %s: %v: %s", p.path, p.binaryPath, err, strings.TrimSpace(stderr.String()))
+	}
+	if parseErr != nil {
+		return nil, fmt.Errorf("error reading the result of %s: %v", p.binaryPath, parseErr)
+	}
+
+	return renderedManifests, nil
+}
+
+// policyViolations returns the messages of the failures in the JSON output of
+// conftest test
+func policyViolations(out []byte) ([]string, error) {
+	results := []struct {
+		Failures []struct {
+			Msg string `json:"msg"`
+		} `json:"failures"`
+	}{}
+	if err := json.Unmarshal(out, &results); err != nil {
+		return nil, err
+	}
+
+	violations := []string{}
+	for _, r := range results {
+		for _, f := range r.Failures {
+			violations = append(violations, f.Msg)
+		}
+	}
+	return violations, nil
+}
+
+// checkPolicy renders the chart and evaluates the manifests against the
+// policies of `policy`, so that violations fail the plan
+func checkPolicy(d resourceGetter, cfg *action.Configuration, c *chart.Chart, cpo *action.ChartPathOptions, values map[string]interface{}) error {
+	pc := newPolicyChecker(d)
+	if pc == nil {
+		return nil
+	}
+
+	return dryRunChecks(d, cfg, c, cpo, values, pc)
+}
+
+// dryRunChecks renders the chart with a dry run install, like helm template
+// with validation, and passes the manifests to the check post-renderer after
+// the post-renderers of the release
+func dryRunChecks(d resourceGetter, cfg *action.Configuration, c *chart.Chart, cpo *action.ChartPathOptions, values map[string]interface{}, check postrender.PostRenderer) error {
+	pr, err := releasePostRenderer(d)
+	if err != nil {
+		return err
+	}
+
+	_, err = dryRunRender(d, cfg, c, cpo, values, chainPostRenderers(pr, check), false)
+	return err
+}
+
+// dryRunRender renders the chart of the release with a dry run install, like
+// helm template with validation, passing the manifests to the post-renderer.
+// With clientOnly the manifests are not validated against the cluster, so
+// that custom resources whose CRDs are not installed yet can be rendered.
+func dryRunRender(d resourceGetter, cfg *action.Configuration, c *chart.Chart, cpo *action.ChartPathOptions, values map[string]interface{}, pr postrender.PostRenderer, clientOnly bool) (*release.Release, error) {
+	if clientOnly {
+		// a client only install replaces the clients of the configuration
+		copied := *cfg
+		cfg = &copied
+	}
+
+	client := action.NewInstall(cfg)
+	client.ClientOnly = clientOnly
+	client.ChartPathOptions = *cpo
+	client.DryRun = true
+	client.Replace = true // skip the name check, the release can exist
+	client.ReleaseName = releaseName(d)
+	client.Namespace = d.Get("namespace").(string)
+	client.DisableHooks = d.Get("disable_webhooks").(bool)
+	client.DisableOpenAPIValidation = d.Get("disable_openapi_validation").(bool)
+	client.SkipCRDs = d.Get("skip_crds").(bool)
+	client.PostRenderer = pr
+
+	return client.Run(c, values)
+}
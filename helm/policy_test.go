@@ -0,0 +1,66 @@
+package helm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPolicyChecker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the fake conftest fails the Deployments running a single replica, the
+	// way testdata/policy/replicas.rego does
+	conftest := filepath.Join(dir, "conftest")
+	script := `#!/bin/sh
+[ "$1" = "test" ] && [ "$3" = "testdata/policy" ] && [ "$5" = "main" ] || { echo "unexpected arguments: $*" >&2; exit 2; }
+if grep -q "replicas: 1$"; then
+  echo '[{"filename":"","namespace":"main","successes":0,"failures":[{"msg":"Deployment web must run at least 2 replicas"}]}]'
+  exit 1
+fi
+echo '[{"filename":"","namespace":"main","successes":1}]'
+`
+	if err := ioutil.WriteFile(conftest, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	pc := &policyChecker{binaryPath: conftest, path: "testdata/policy", namespace: "main", timeout: 10 * time.Second}
+
+	violating := "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\nspec:\n  replicas: 1\n"
+	_, err = pc.Run(bytes.NewBufferString(violating))
+	expected := "the manifests violate the policies of testdata/policy:\n  - Deployment web must run at least 2 replicas"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected the violation to be reported, got %v", err)
+	}
+
+	compliant := "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\nspec:\n  replicas: 3\n"
+	out, err := pc.Run(bytes.NewBufferString(compliant))
+	if err != nil {
+		t.Fatalf("expected the compliant manifests to pass, got %s", err)
+	}
+	if out.String() != compliant {
+		t.Errorf("expected the manifests to be unchanged, got %q", out.String())
+	}
+
+	pc.namespace = "other"
+	if _, err := pc.Run(bytes.NewBufferString(compliant)); err == nil || !strings.Contains(err.Error(), "unexpected arguments") {
+		t.Errorf("expected the error of conftest to be reported, got %v", err)
+	}
+
+	slow := filepath.Join(dir, "slow")
+	if err := ioutil.WriteFile(slow, []byte("#!/bin/sh\nexec sleep 10\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	pc = &policyChecker{binaryPath: slow, path: "testdata/policy", namespace: "main", timeout: 100 * time.Millisecond}
+	if _, err := pc.Run(bytes.NewBufferString(compliant)); err == nil || !strings.Contains(err.Error(), "did not complete within 100ms") {
+		t.Errorf("expected the evaluation to time out, got %v", err)
+	}
+}
@@ -0,0 +1,489 @@
+package helm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/postrender"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// postRendererChain runs post-renderers in order, each one receiving the
+// manifests returned by the previous one
+type postRendererChain []postrender.PostRenderer
+
+// chainPostRenderers returns a post-renderer running the given post-renderers
+// in order, ignoring the nil ones
+func chainPostRenderers(renderers ...postrender.PostRenderer) postrender.PostRenderer {
+	chain := postRendererChain{}
+	for _, r := range renderers {
+		if r != nil {
+			chain = append(chain, r)
+		}
+	}
+
+	switch len(chain) {
+	case 0:
+		return nil
+	case 1:
+		return chain[0]
+	}
+	return chain
+}
+
+func (c postRendererChain) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	var err error
+	for _, r := range c {
+		renderedManifests, err = r.Run(renderedManifests)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return renderedManifests, nil
+}
+
+// releasePostRenderer returns the post-renderers of the release changing its
+// manifests: the `postrender` binary, `resource_selector`, `change_cause` and
+// `patch_image_pull_secrets`
+func releasePostRenderer(d resourceGetter) (postrender.PostRenderer, error) {
+	var pr postrender.PostRenderer
+	if cmd := d.Get("postrender.0.binary_path").(string); cmd != "" {
+		exec, err := postrender.NewExec(cmd)
+		if err != nil {
+			return nil, err
+		}
+		pr = exec
+	}
+
+	rs, err := newResourceSelector(d)
+	if err != nil {
+		return nil, err
+	}
+	if rs != nil {
+		pr = chainPostRenderers(pr, rs)
+	}
+
+	if cause := d.Get("change_cause").(string); cause != "" {
+		pr = chainPostRenderers(pr, &changeCauseAnnotator{cause: cause})
+	}
+
+	if ps := newPullSecretsPatcher(d); ps != nil {
+		pr = chainPostRenderers(pr, ps)
+	}
+
+	return pr, nil
+}
+
+// namespaceCreator creates the namespaces referenced by the namespaced
+// resources of a manifest, so that charts deploying to several namespaces can
+// be installed with `create_namespace`. The namespaces listed in
+// `protected_namespaces` are never created.
+type namespaceCreator struct {
+	ctx       context.Context
+	client    kubernetes.Interface
+	mapper    meta.RESTMapper
+	protected map[string]bool
+}
+
+func newNamespaceCreator(ctx context.Context, cfg *action.Configuration, protected map[string]bool) (*namespaceCreator, error) {
+	client, err := cfg.KubernetesClientSet()
+	if err != nil {
+		return nil, err
+	}
+
+	mapper, err := cfg.RESTClientGetter.ToRESTMapper()
+	if err != nil {
+		return nil, err
+	}
+
+	return &namespaceCreator{ctx: ctx, client: client, mapper: mapper, protected: protected}, nil
+}
+
+// create creates the namespaces of the manifest that do not exist yet
+func (n *namespaceCreator) create(manifest string) error {
+	namespaces, err := n.namespaces(manifest)
+	if err != nil {
+		return err
+	}
+
+	for _, ns := range namespaces {
+		if n.protected[ns] {
+			if err := n.checkProtected(ns); err != nil {
+				return err
+			}
+			continue
+		}
+
+		_, err := n.client.CoreV1().Namespaces().Create(n.ctx, &v1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{Name: ns},
+		}, metav1.CreateOptions{})
+		if err == nil {
+			log.Printf("[INFO] Created namespace %q referenced by the chart", ns)
+		} else if !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// createChartNamespaces creates the namespaces of the resources of the chart
+// before it is installed or upgraded with `create_namespace`. The manifests
+// are rendered client side, as the custom resources of the chart cannot be
+// validated before its CRDs are installed. The namespace of the release must
+// not be protected, it is created by the install.
+func createChartNamespaces(ctx context.Context, d resourceGetter, cfg *action.Configuration, protected map[string]bool, c *chart.Chart, cpo *action.ChartPathOptions, values map[string]interface{}) error {
+	nc, err := newNamespaceCreator(ctx, cfg, protected)
+	if err != nil {
+		return err
+	}
+	if err := nc.checkProtected(d.Get("namespace").(string)); err != nil {
+		return err
+	}
+
+	pr, err := releasePostRenderer(d)
+	if err != nil {
+		return err
+	}
+	rel, err := dryRunRender(d, cfg, c, cpo, values, pr, true)
+	if err != nil {
+		return err
+	}
+	return nc.create(rel.Manifest)
+}
+
+// checkProtected returns an error if the namespace is protected and does not
+// exist, so that it is not created. Existing protected namespaces are left
+// untouched.
+func (n *namespaceCreator) checkProtected(ns string) error {
+	if !n.protected[ns] {
+		return nil
+	}
+
+	_, err := n.client.CoreV1().Namespaces().Get(n.ctx, ns, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return fmt.Errorf("refusing to create the protected namespace %q, remove it from protected_namespaces in the provider configuration to allow it", ns)
+	}
+	return err
+}
+
+// namespaces returns the sorted namespaces set on the namespaced resources of
+// the manifest. Resources of unknown kinds, such as the custom resources of
+// CRDs not installed yet, are considered namespaced.
+func (n *namespaceCreator) namespaces(manifest string) ([]string, error) {
+	seen := map[string]bool{}
+	for _, m := range releaseutil.SplitManifests(manifest) {
+		r := resourceMeta{}
+		if err := yaml.Unmarshal([]byte(m), &r); err != nil {
+			return nil, err
+		}
+
+		ns := r.Metadata.Namespace
+		if ns == "" || seen[ns] {
+			continue
+		}
+
+		gvk := r.GroupVersionKind()
+		mapping, err := n.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err == nil && mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+			continue
+		}
+
+		seen[ns] = true
+	}
+
+	namespaces := make([]string, 0, len(seen))
+	for ns := range seen {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+
+	return namespaces, nil
+}
+
+// changeCauseAnnotation is the annotation `kubectl rollout history` shows as the
+// cause of each revision of a workload
+const changeCauseAnnotation = "kubernetes.io/change-cause"
+
+// rolloutKinds are the kinds of the workloads `kubectl rollout history` supports
+var rolloutKinds = map[string]bool{
+	"apps/Deployment":  true,
+	"apps/StatefulSet": true,
+	"apps/DaemonSet":   true,
+}
+
+// mapManifests returns the manifests of the rendered manifests, in the order
+// Helm installs them, replaced by the result of f. The manifests for which f
+// returns an empty string are left out.
+func mapManifests(renderedManifests *bytes.Buffer, f func(manifest string) (string, error)) (*bytes.Buffer, error) {
+	manifests := releaseutil.SplitManifests(renderedManifests.String())
+	keys := make([]string, 0, len(manifests))
+	for k := range manifests {
+		keys = append(keys, k)
+	}
+	sort.Sort(releaseutil.BySplitManifestsOrder(keys))
+
+	out := &bytes.Buffer{}
+	for _, k := range keys {
+		m, err := f(manifests[k])
+		if err != nil {
+			return nil, err
+		}
+		if m == "" {
+			continue
+		}
+		fmt.Fprintf(out, "---\n%s\n", m)
+	}
+	return out, nil
+}
+
+// changeCauseAnnotator is a post-renderer setting the change-cause annotation
+// on the workloads of the manifests. The other resources are returned
+// unchanged.
+type changeCauseAnnotator struct {
+	cause string
+}
+
+func (a *changeCauseAnnotator) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	return mapManifests(renderedManifests, a.annotate)
+}
+
+func (a *changeCauseAnnotator) annotate(manifest string) (string, error) {
+	r := resourceMeta{}
+	if err := yaml.Unmarshal([]byte(manifest), &r); err != nil {
+		return "", err
+	}
+
+	gvk := r.GroupVersionKind()
+	if !rolloutKinds[gvk.Group+"/"+gvk.Kind] {
+		return manifest, nil
+	}
+
+	obj := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(manifest), &obj); err != nil {
+		return "", err
+	}
+
+	metadata, _ := obj["metadata"].(map[string]interface{})
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+		obj["metadata"] = metadata
+	}
+	annotations, _ := metadata["annotations"].(map[string]interface{})
+	if annotations == nil {
+		annotations = map[string]interface{}{}
+		metadata["annotations"] = annotations
+	}
+	annotations[changeCauseAnnotation] = a.cause
+
+	return marshalManifest(manifest, obj)
+}
+
+// marshalManifest returns the modified object of the manifest as YAML, keeping
+// the comments heading the manifest, such as the template source
+func marshalManifest(manifest string, obj map[string]interface{}) (string, error) {
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+
+	comments := []string{}
+	for _, line := range strings.Split(manifest, "\n") {
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		comments = append(comments, line+"\n")
+	}
+	return strings.Join(comments, "") + strings.TrimSuffix(string(data), "\n"), nil
+}
+
+// podSpecPaths are the paths of the pod specs of the kinds running pods
+var podSpecPaths = map[string][]string{
+	"/Pod":             {"spec"},
+	"apps/Deployment":  {"spec", "template", "spec"},
+	"apps/StatefulSet": {"spec", "template", "spec"},
+	"apps/DaemonSet":   {"spec", "template", "spec"},
+	"apps/ReplicaSet":  {"spec", "template", "spec"},
+	"batch/Job":        {"spec", "template", "spec"},
+	"batch/CronJob":    {"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+// pullSecretsPatcher is a post-renderer adding the image pull secrets to the
+// pod specs and the ServiceAccounts of the manifests that do not set
+// imagePullSecrets. The other resources are returned unchanged.
+type pullSecretsPatcher struct {
+	secrets []interface{}
+}
+
+// newPullSecretsPatcher returns the patcher of the `image_pull_secrets`, or
+// nil if they are not set or `patch_image_pull_secrets` is not set
+func newPullSecretsPatcher(d resourceGetter) *pullSecretsPatcher {
+	secrets := imagePullSecrets(d)
+	if len(secrets) == 0 || !d.Get("patch_image_pull_secrets").(bool) {
+		return nil
+	}
+	return &pullSecretsPatcher{secrets: secrets}
+}
+
+func (p *pullSecretsPatcher) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	return mapManifests(renderedManifests, p.patch)
+}
+
+func (p *pullSecretsPatcher) patch(manifest string) (string, error) {
+	r := resourceMeta{}
+	if err := yaml.Unmarshal([]byte(manifest), &r); err != nil {
+		return "", err
+	}
+
+	gvk := r.GroupVersionKind()
+	path, ok := podSpecPaths[gvk.Group+"/"+gvk.Kind]
+	if gvk.Group == "" && gvk.Kind == "ServiceAccount" {
+		path, ok = []string{}, true
+	}
+	if !ok {
+		return manifest, nil
+	}
+
+	obj := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(manifest), &obj); err != nil {
+		return "", err
+	}
+
+	if _, found, _ := unstructured.NestedFieldNoCopy(obj, append(path, "imagePullSecrets")...); found {
+		return manifest, nil
+	}
+	if err := unstructured.SetNestedField(obj, runtime.DeepCopyJSONValue(p.secrets), append(path, "imagePullSecrets")...); err != nil {
+		return "", err
+	}
+
+	return marshalManifest(manifest, obj)
+}
+
+// resourceSelectorSchema returns the schema of the `include` and `exclude`
+// selectors of the rendered resources
+func resourceSelectorSchema(description string) *schema.Schema {
+	return &schema.Schema{
+		Type:        schema.TypeList,
+		Optional:    true,
+		MaxItems:    1,
+		Description: description,
+		Elem: &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"kinds": {
+					Type:        schema.TypeList,
+					Optional:    true,
+					Description: "Kinds of the selected resources, e.g. Deployment, or group/Kind to select the kind of a single API group",
+					Elem:        &schema.Schema{Type: schema.TypeString},
+				},
+				"label_selector": {
+					Type:        schema.TypeString,
+					Optional:    true,
+					Description: "Label selector of the selected resources, in the syntax of kubectl --selector",
+				},
+			},
+		},
+	}
+}
+
+// resourceMatcher matches the resources of the given kinds with labels
+// matching the selector. Empty criteria match all the resources.
+type resourceMatcher struct {
+	kinds    map[string]bool
+	selector labels.Selector
+}
+
+func newResourceMatcher(d resourceGetter, key string) (*resourceMatcher, error) {
+	if len(d.Get(key).([]interface{})) == 0 {
+		return nil, nil
+	}
+
+	m := &resourceMatcher{kinds: map[string]bool{}, selector: labels.Everything()}
+	for _, raw := range d.Get(key + ".0.kinds").([]interface{}) {
+		m.kinds[raw.(string)] = true
+	}
+
+	if s := d.Get(key + ".0.label_selector").(string); s != "" {
+		selector, err := labels.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label_selector of %s: %v", key, err)
+		}
+		m.selector = selector
+	}
+	return m, nil
+}
+
+func (m *resourceMatcher) matches(r resourceMeta) bool {
+	gvk := r.GroupVersionKind()
+	if len(m.kinds) > 0 && !m.kinds[gvk.Kind] && !m.kinds[gvk.Group+"/"+gvk.Kind] {
+		return false
+	}
+	return m.selector.Matches(labels.Set(r.Metadata.Labels))
+}
+
+// resourceSelector is a post-renderer dropping the resources of the manifests
+// not matching `include` or matching `exclude`, so that only a subset of the
+// resources of the chart are managed by the release. The hooks are not
+// post-rendered and so are kept.
+type resourceSelector struct {
+	include *resourceMatcher
+	exclude *resourceMatcher
+}
+
+// newResourceSelector returns the resource selector configured by `include`
+// and `exclude`, or nil if neither is set
+func newResourceSelector(d resourceGetter) (*resourceSelector, error) {
+	include, err := newResourceMatcher(d, "include")
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := newResourceMatcher(d, "exclude")
+	if err != nil {
+		return nil, err
+	}
+
+	if include == nil && exclude == nil {
+		return nil, nil
+	}
+	return &resourceSelector{include: include, exclude: exclude}, nil
+}
+
+func (s *resourceSelector) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	return mapManifests(renderedManifests, s.selectManifest)
+}
+
+// selectManifest returns the manifest if its resource is selected, or an
+// empty string otherwise
+func (s *resourceSelector) selectManifest(manifest string) (string, error) {
+	r := resourceMeta{}
+	if err := yaml.Unmarshal([]byte(manifest), &r); err != nil {
+		return "", err
+	}
+	if r.Kind == "" {
+		return "", nil
+	}
+
+	if s.include != nil && !s.include.matches(r) {
+		log.Printf("[DEBUG] Leaving out %s %q not matching include", r.Kind, r.Metadata.Name)
+		return "", nil
+	}
+	if s.exclude != nil && s.exclude.matches(r) {
+		log.Printf("[DEBUG] Leaving out %s %q matching exclude", r.Kind, r.Metadata.Name)
+		return "", nil
+	}
+	return manifest, nil
+}
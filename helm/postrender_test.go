@@ -0,0 +1,407 @@
+package helm
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/postrender"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/yaml"
+)
+
+type appendingPostRenderer string
+
+func (a appendingPostRenderer) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	return bytes.NewBufferString(renderedManifests.String() + string(a)), nil
+}
+
+func TestChainPostRenderers(t *testing.T) {
+	if pr := chainPostRenderers(nil, nil); pr != nil {
+		t.Fatalf("expected no post-renderer, got %v", pr)
+	}
+
+	single := appendingPostRenderer("a")
+	if pr := chainPostRenderers(nil, single); pr != postrender.PostRenderer(single) {
+		t.Fatalf("expected the single post-renderer to be returned, got %v", pr)
+	}
+
+	out, err := chainPostRenderers(appendingPostRenderer("a"), nil, appendingPostRenderer("b")).Run(bytes.NewBufferString("-"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "-ab" {
+		t.Fatalf("expected the post-renderers to run in order, got %q", out.String())
+	}
+}
+
+func TestNamespaceCreator(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(v1.SchemeGroupVersion.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+	mapper.Add(rbacv1.SchemeGroupVersion.WithKind("ClusterRole"), meta.RESTScopeRoot)
+
+	client := fake.NewSimpleClientset(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "existing"}})
+	n := &namespaceCreator{ctx: context.Background(), client: client, mapper: mapper}
+
+	manifest := strings.Join([]string{
+		"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n",
+		"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: b\n  namespace: other\n",
+		"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: c\n  namespace: existing\n",
+		"apiVersion: rbac.authorization.k8s.io/v1\nkind: ClusterRole\nmetadata:\n  name: d\n  namespace: cluster\n",
+		"apiVersion: example.com/v1\nkind: Widget\nmetadata:\n  name: e\n  namespace: custom\n",
+	}, "---\n")
+
+	if err := n.create(manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := client.CoreV1().Namespaces().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, ns := range list.Items {
+		names = append(names, ns.Name)
+	}
+
+	expected := []string{"custom", "existing", "other"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected namespaces %v, got %v", expected, names)
+	}
+}
+
+func TestNamespaceCreatorProtected(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(v1.SchemeGroupVersion.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+
+	client := fake.NewSimpleClientset(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system"}})
+	protected := map[string]bool{"kube-system": true, "kube-public": true}
+	n := &namespaceCreator{ctx: context.Background(), client: client, mapper: mapper, protected: protected}
+
+	// an existing protected namespace is used as is
+	manifest := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n  namespace: kube-system\n"
+	if err := n.create(manifest); err != nil {
+		t.Fatalf("expected the existing protected namespace to be accepted, got %s", err)
+	}
+	if err := n.checkProtected("kube-system"); err != nil {
+		t.Fatalf("expected the existing protected namespace to be accepted, got %s", err)
+	}
+
+	manifest = "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n  namespace: kube-public\n"
+	err := n.create(manifest)
+	if err == nil || !strings.Contains(err.Error(), `protected namespace "kube-public"`) {
+		t.Fatalf("expected the creation of the protected namespace to be refused, got %v", err)
+	}
+	if err := n.checkProtected("kube-public"); err == nil {
+		t.Fatal("expected the creation of the protected release namespace to be refused")
+	}
+
+	if _, err := client.CoreV1().Namespaces().Get(context.Background(), "kube-public", metav1.GetOptions{}); err == nil {
+		t.Fatal("expected the protected namespace not to be created")
+	}
+	if err := n.checkProtected("other"); err != nil {
+		t.Fatalf("expected an unprotected namespace to be accepted, got %s", err)
+	}
+}
+
+func TestChangeCauseAnnotator(t *testing.T) {
+	manifests := `---
+# Source: test-chart/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: test
+---
+# Source: test-chart/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: test
+  annotations:
+    owner: team
+spec:
+  replicas: 1
+---
+# Source: test-chart/templates/statefulset.yaml
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: test
+`
+
+	out, err := (&changeCauseAnnotator{cause: "bump to 1.2.3"}).Run(bytes.NewBufferString(manifests))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `---
+# Source: test-chart/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: test
+---
+# Source: test-chart/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  annotations:
+    kubernetes.io/change-cause: bump to 1.2.3
+    owner: team
+  name: test
+spec:
+  replicas: 1
+---
+# Source: test-chart/templates/statefulset.yaml
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  annotations:
+    kubernetes.io/change-cause: bump to 1.2.3
+  name: test
+`
+	if out.String() != expected {
+		t.Errorf("expected manifests:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+func TestResourceSelector(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceRelease().Schema, map[string]interface{}{
+		"include": []interface{}{map[string]interface{}{
+			"kinds": []interface{}{"Deployment"},
+		}},
+	})
+	rs, err := newResourceSelector(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := loader.Load("./testdata/charts/test-chart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := action.NewInstall(&action.Configuration{Log: debug})
+	client.DryRun = true
+	client.ClientOnly = true
+	client.ReleaseName = "test"
+	client.Namespace = "default"
+	client.PostRenderer = rs
+
+	rel, err := client.Run(c, map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kinds := []string{}
+	for _, m := range releaseutil.SplitManifests(rel.Manifest) {
+		r := resourceMeta{}
+		if err := yaml.Unmarshal([]byte(m), &r); err != nil {
+			t.Fatal(err)
+		}
+		kinds = append(kinds, r.Kind)
+	}
+	if !reflect.DeepEqual(kinds, []string{"Deployment"}) {
+		t.Errorf("expected only the Deployment to be rendered, got %v", kinds)
+	}
+
+	manifests := `---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  labels:
+    tier: web
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  labels:
+    tier: web
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: worker
+  labels:
+    tier: worker
+`
+	d = schema.TestResourceDataRaw(t, resourceRelease().Schema, map[string]interface{}{
+		"include": []interface{}{map[string]interface{}{
+			"kinds": []interface{}{"apps/Deployment", "Service"},
+		}},
+		"exclude": []interface{}{map[string]interface{}{
+			"kinds":          []interface{}{"Deployment"},
+			"label_selector": "tier in (worker)",
+		}},
+	})
+	rs, err = newResourceSelector(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := rs.Run(bytes.NewBufferString(manifests))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "name: worker") || strings.Count(out.String(), "name: web") != 2 {
+		t.Errorf("expected the worker Deployment to be excluded, got:\n%s", out.String())
+	}
+
+	d = schema.TestResourceDataRaw(t, resourceRelease().Schema, map[string]interface{}{
+		"exclude": []interface{}{map[string]interface{}{
+			"label_selector": "tier in (",
+		}},
+	})
+	if _, err := newResourceSelector(d); err == nil {
+		t.Error("expected an invalid label selector to fail")
+	}
+
+	d = schema.TestResourceDataRaw(t, resourceRelease().Schema, map[string]interface{}{})
+	if rs, err := newResourceSelector(d); err != nil || rs != nil {
+		t.Errorf("expected no selector by default, got %v and %v", rs, err)
+	}
+}
+
+func TestImagePullSecrets(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceRelease().Schema, map[string]interface{}{
+		"image_pull_secrets":       []interface{}{"registry"},
+		"patch_image_pull_secrets": true,
+	})
+
+	values, err := getValues(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := loader.Load("./testdata/charts/test-chart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := action.NewInstall(&action.Configuration{Log: debug})
+	client.DryRun = true
+	client.ClientOnly = true
+	client.ReleaseName = "test"
+	client.Namespace = "default"
+	client.PostRenderer = newPullSecretsPatcher(d)
+
+	rel, err := client.Run(c, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []v1.LocalObjectReference{{Name: "registry"}}
+	found := map[string]bool{}
+	for _, m := range releaseutil.SplitManifests(rel.Manifest) {
+		r := resourceMeta{}
+		if err := yaml.Unmarshal([]byte(m), &r); err != nil {
+			t.Fatal(err)
+		}
+
+		switch r.Kind {
+		case "Deployment":
+			// set by the chart from the imagePullSecrets value
+			deployment := struct {
+				Spec struct {
+					Template v1.PodTemplateSpec
+				}
+			}{}
+			if err := yaml.Unmarshal([]byte(m), &deployment); err != nil {
+				t.Fatal(err)
+			}
+			if secrets := deployment.Spec.Template.Spec.ImagePullSecrets; !reflect.DeepEqual(secrets, expected) {
+				t.Errorf("expected the pull secrets %v on the pod spec of the Deployment, got %v", expected, secrets)
+			}
+			found[r.Kind] = true
+		case "ServiceAccount":
+			// added by the post-renderer
+			sa := v1.ServiceAccount{}
+			if err := yaml.Unmarshal([]byte(m), &sa); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(sa.ImagePullSecrets, expected) {
+				t.Errorf("expected the pull secrets %v on the ServiceAccount, got %v", expected, sa.ImagePullSecrets)
+			}
+			found[r.Kind] = true
+		}
+	}
+	if !found["Deployment"] || !found["ServiceAccount"] {
+		t.Fatalf("expected a Deployment and a ServiceAccount to be rendered, got %v", found)
+	}
+}
+
+func TestPullSecretsPatcher(t *testing.T) {
+	p := &pullSecretsPatcher{secrets: []interface{}{map[string]interface{}{"name": "registry"}}}
+
+	manifests := `---
+# Source: app/templates/cronjob.yaml
+apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: cleanup
+spec:
+  schedule: "@daily"
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+          - name: cleanup
+            image: busybox
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      imagePullSecrets:
+      - name: other
+      containers:
+      - name: web
+        image: nginx
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+`
+	out, err := p.Run(bytes.NewBufferString(manifests))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rendered := releaseutil.SplitManifests(out.String())
+	if len(rendered) != 3 {
+		t.Fatalf("expected 3 manifests, got %d", len(rendered))
+	}
+	for _, m := range rendered {
+		switch {
+		case strings.Contains(m, "kind: CronJob"):
+			if !strings.HasPrefix(m, "# Source: app/templates/cronjob.yaml") {
+				t.Errorf("expected the comments of the manifest to be kept, got:\n%s", m)
+			}
+			if !strings.Contains(m, "          imagePullSecrets:\n          - name: registry") {
+				t.Errorf("expected the pull secrets to be added to the pod spec of the CronJob, got:\n%s", m)
+			}
+		case strings.Contains(m, "kind: Deployment"):
+			if strings.Contains(m, "registry") {
+				t.Errorf("expected the pull secrets of the Deployment to be kept, got:\n%s", m)
+			}
+		case strings.Contains(m, "kind: ConfigMap"):
+			if strings.Contains(m, "imagePullSecrets") {
+				t.Errorf("expected the ConfigMap to be unchanged, got:\n%s", m)
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package helm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// rbacPreflight is a post-renderer checking with SelfSubjectAccessReviews that
+// the current user is allowed to deploy the resources of the manifests, so that
+// an install or upgrade lacking permissions fails before anything is changed.
+// The manifests are returned unchanged.
+type rbacPreflight struct {
+	ctx       context.Context
+	client    kubernetes.Interface
+	mapper    meta.RESTMapper
+	namespace string
+	verbs     []string
+}
+
+func newRBACPreflight(ctx context.Context, cfg *action.Configuration, namespace string, verbs ...string) (*rbacPreflight, error) {
+	client, err := cfg.KubernetesClientSet()
+	if err != nil {
+		return nil, err
+	}
+
+	mapper, err := cfg.RESTClientGetter.ToRESTMapper()
+	if err != nil {
+		return nil, err
+	}
+
+	return &rbacPreflight{ctx: ctx, client: client, mapper: mapper, namespace: namespace, verbs: verbs}, nil
+}
+
+func (p *rbacPreflight) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	attributes, err := p.resourceAttributes(renderedManifests.String())
+	if err != nil {
+		return nil, err
+	}
+
+	missing := []string{}
+	for _, attr := range attributes {
+		review, err := p.client.AuthorizationV1().SelfSubjectAccessReviews().Create(p.ctx, &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: attr},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("unable to check the permissions of the release: %w", err)
+		}
+
+		if !review.Status.Allowed {
+			missing = append(missing, describeResourceAttributes(attr))
+		}
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing permissions to deploy the release:\n  - %s", strings.Join(missing, "\n  - "))
+	}
+
+	return renderedManifests, nil
+}
+
+// resourceAttributes returns the sorted and deduplicated attributes to review
+// for the resources of the manifest. Resources of unknown kinds, such as the
+// custom resources of CRDs not installed yet, are not reviewed.
+func (p *rbacPreflight) resourceAttributes(manifest string) ([]*authorizationv1.ResourceAttributes, error) {
+	seen := map[string]*authorizationv1.ResourceAttributes{}
+	for _, m := range releaseutil.SplitManifests(manifest) {
+		r := resourceMeta{}
+		if err := yaml.Unmarshal([]byte(m), &r); err != nil {
+			return nil, err
+		}
+
+		gvk := r.GroupVersionKind()
+		mapping, err := p.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			log.Printf("[WARN] Unable to map %s, skipping its permission check: %s", gvk, err)
+			continue
+		}
+
+		namespace := ""
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			namespace = r.Metadata.Namespace
+			if namespace == "" {
+				namespace = p.namespace
+			}
+		}
+
+		for _, verb := range p.verbs {
+			attr := &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      verb,
+				Group:     mapping.Resource.Group,
+				Resource:  mapping.Resource.Resource,
+			}
+			seen[describeResourceAttributes(attr)] = attr
+		}
+	}
+
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	attributes := make([]*authorizationv1.ResourceAttributes, 0, len(keys))
+	for _, k := range keys {
+		attributes = append(attributes, seen[k])
+	}
+
+	return attributes, nil
+}
+
+func describeResourceAttributes(attr *authorizationv1.ResourceAttributes) string {
+	resource := attr.Resource
+	if attr.Group != "" {
+		resource = resource + "." + attr.Group
+	}
+
+	if attr.Namespace == "" {
+		return fmt.Sprintf("%s %s (cluster-wide)", attr.Verb, resource)
+	}
+	return fmt.Sprintf("%s %s in namespace %q", attr.Verb, resource, attr.Namespace)
+}
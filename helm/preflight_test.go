@@ -0,0 +1,77 @@
+package helm
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestRBACPreflight(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(v1.SchemeGroupVersion.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+	mapper.Add(appsv1.SchemeGroupVersion.WithKind("Deployment"), meta.RESTScopeNamespace)
+	mapper.Add(rbacv1.SchemeGroupVersion.WithKind("ClusterRole"), meta.RESTScopeRoot)
+
+	// a service account restricted to configmaps and deployments of its namespace
+	client := fake.NewSimpleClientset()
+	reviews := 0
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		reviews++
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attr := review.Spec.ResourceAttributes
+		review.Status.Allowed = attr.Namespace == "restricted" && (attr.Resource == "configmaps" || attr.Resource == "deployments")
+		return true, review, nil
+	})
+
+	p := &rbacPreflight{ctx: context.Background(), client: client, mapper: mapper, namespace: "restricted", verbs: []string{"create"}}
+
+	allowed := strings.Join([]string{
+		"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n",
+		"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: b\n",
+		"apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: c\n  namespace: restricted\n",
+		"apiVersion: example.com/v1\nkind: Widget\nmetadata:\n  name: d\n",
+	}, "---\n")
+
+	out, err := p.Run(bytes.NewBufferString(allowed))
+	if err != nil {
+		t.Fatalf("expected the preflight to pass, got %s", err)
+	}
+	if out.String() != allowed {
+		t.Fatalf("expected the manifests to be unchanged, got %q", out.String())
+	}
+	if reviews != 2 {
+		t.Fatalf("expected one review per resource and namespace, got %d", reviews)
+	}
+
+	denied := strings.Join([]string{
+		allowed,
+		"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: e\n  namespace: other\n",
+		"apiVersion: rbac.authorization.k8s.io/v1\nkind: ClusterRole\nmetadata:\n  name: f\n",
+	}, "---\n")
+
+	_, err = p.Run(bytes.NewBufferString(denied))
+	if err == nil {
+		t.Fatal("expected the preflight to fail")
+	}
+	for _, missing := range []string{
+		`create clusterroles.rbac.authorization.k8s.io (cluster-wide)`,
+		`create configmaps in namespace "other"`,
+	} {
+		if !strings.Contains(err.Error(), missing) {
+			t.Errorf("expected %q to be reported, got %s", missing, err)
+		}
+	}
+	if strings.Contains(err.Error(), "deployments") {
+		t.Errorf("expected only the missing permissions to be reported, got %s", err)
+	}
+}
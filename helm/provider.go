@@ -4,30 +4,66 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/go-cty/cty"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
 
 	"helm.sh/helm/v3/pkg/action"
 	"helm.sh/helm/v3/pkg/cli"
 	"helm.sh/helm/v3/pkg/helmpath"
+	"helm.sh/helm/v3/pkg/repo"
 	"helm.sh/helm/v3/pkg/storage/driver"
 
 	// Import to initialize client auth plugins.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 )
 
+// defaultProtectedNamespaces are the namespaces `create_namespace` refuses to
+// create when `protected_namespaces` is not set
+var defaultProtectedNamespaces = []string{"kube-system", "kube-public", "kube-node-lease"}
+
 // Meta is the meta information structure for the provider
 type Meta struct {
 	data       *schema.ResourceData
 	Settings   *cli.EnvSettings
 	HelmDriver string
 
+	// Label required on a release to import it, as key=value
+	ImportRequiredLabel string
+
+	// Allow fetching charts from plain HTTP repositories
+	RepositoryPlainHTTP bool
+
+	// Namespaces `create_namespace` never creates
+	ProtectedNamespaces map[string]bool
+
+	// Require the releases to set the version of their chart
+	RequirePinnedVersion bool
+
+	// Check that the repositories of the releases are reachable when planning
+	CheckRepositories bool
+
+	// Outcome of the repository checks keyed by URL, guarded by the lock
+	checkedRepositories map[string]error
+
+	// Minimum interval between the release operations
+	OperationStagger time.Duration
+
+	// Time reserved for the last release operation, guarded by the lock
+	lastOperation time.Time
+
+	// Discovery of the cluster API shared by the operations
+	discovery *sharedDiscovery
+
 	// Used to lock some operations
 	sync.Mutex
 
@@ -51,6 +87,12 @@ func Provider() *schema.Provider {
 				Description: "The path to the helm plugins directory",
 				DefaultFunc: schema.EnvDefaultFunc("HELM_PLUGINS", helmpath.DataPath("plugins")),
 			},
+			"plugins_disable": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Disable the helm plugins, skipping their discovery in the plugins directory",
+				DefaultFunc: schema.EnvDefaultFunc("HELM_PLUGINS_DISABLE", false),
+			},
 			"registry_config_path": {
 				Type:        schema.TypeString,
 				Optional:    true,
@@ -69,6 +111,43 @@ func Provider() *schema.Provider {
 				Description: "The path to the file containing cached repository indexes",
 				DefaultFunc: schema.EnvDefaultFunc("HELM_REPOSITORY_CACHE", helmpath.CachePath("repository")),
 			},
+			"repository_plain_http": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Allow fetching charts and repository indexes over plain HTTP",
+				DefaultFunc: schema.EnvDefaultFunc("HELM_REPOSITORY_PLAIN_HTTP", false),
+			},
+			"protected_namespaces": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "Namespaces `create_namespace` refuses to create. Defaults to kube-system, kube-public and kube-node-lease.",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+			"require_pinned_version": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Fail the plan of releases installing a chart from a repository without an explicit version",
+				DefaultFunc: schema.EnvDefaultFunc("HELM_REQUIRE_PINNED_VERSION", false),
+			},
+			"operation_stagger": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Minimum interval, e.g. 500ms, between the start of the release operations, with a small random jitter added to each, to spread the load of large applies on the Kubernetes API. Defaults to 0, no stagger.",
+				DefaultFunc:  schema.EnvDefaultFunc("HELM_OPERATION_STAGGER", ""),
+				ValidateFunc: validateDuration,
+			},
+			"check_repositories": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Check that the chart repositories of the releases are reachable when planning, rather than failing during the apply",
+				DefaultFunc: schema.EnvDefaultFunc("HELM_CHECK_REPOSITORIES", false),
+			},
+			"skip_home_init": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Do not create the repositories file and the repository cache when they are missing",
+				DefaultFunc: schema.EnvDefaultFunc("HELM_SKIP_HOME_INIT", false),
+			},
 			"helm_driver": {
 				Type:        schema.TypeString,
 				Optional:    true,
@@ -98,6 +177,17 @@ func Provider() *schema.Provider {
 					}
 				},
 			},
+			"import_required_label": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Label, as key=value, that a release must have in the Helm storage backend to be imported",
+				ValidateDiagFunc: func(val interface{}, key cty.Path) diag.Diagnostics {
+					if _, _, err := parseLabel(val.(string)); err != nil {
+						return diag.FromErr(err)
+					}
+					return nil
+				},
+			},
 			"kubernetes": {
 				Type:        schema.TypeList,
 				MaxItems:    1,
@@ -135,7 +225,12 @@ func Provider() *schema.Provider {
 			"helm_release": resourceRelease(),
 		},
 		DataSourcesMap: map[string]*schema.Resource{
-			"helm_template": dataTemplate(),
+			"helm_template":           dataTemplate(),
+			"helm_chart_dependencies": dataChartDependencies(),
+			"helm_provider_config":    dataProviderConfig(),
+			"helm_kubernetes_version": dataKubernetesVersion(),
+			"helm_chart_diff":         dataChartDiff(),
+			"helm_release_dry_run":    dataReleaseDryRun(),
 		},
 	}
 	p.ConfigureContextFunc = func(ctx context.Context, d *schema.ResourceData) (interface{}, diag.Diagnostics) {
@@ -189,6 +284,12 @@ func kubernetesResource() *schema.Resource {
 				DefaultFunc: schema.EnvDefaultFunc("KUBE_CLUSTER_CA_CERT_DATA", ""),
 				Description: "PEM-encoded root certificates bundle for TLS authentication.",
 			},
+			"in_cluster": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("KUBE_IN_CLUSTER", false),
+				Description: "Use the service account of the pod the provider runs in, with the host, insecure, tls_server_name, cluster_ca_certificate and token overrides applied.",
+			},
 			"config_paths": {
 				Type:        schema.TypeList,
 				Elem:        &schema.Schema{Type: schema.TypeString},
@@ -219,6 +320,60 @@ func kubernetesResource() *schema.Resource {
 				DefaultFunc: schema.EnvDefaultFunc("KUBE_CTX_CLUSTER", ""),
 				Description: "",
 			},
+			"discovery_timeout": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ValidateFunc: validation.IntAtLeast(1),
+				Description:  "Time in seconds during which the discovery of the Kubernetes API is retried. Defaults to 30.",
+			},
+			"discovery_cache_dir": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("KUBE_DISCOVERY_CACHE_DIR", ""),
+				Description: "Directory caching the discovery of the Kubernetes API on disk across runs, like the ~/.kube/cache directory of kubectl. The discovery is only cached in memory when not set.",
+			},
+			"discovery_cache_ttl": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ValidateFunc: validation.IntAtLeast(1),
+				Description:  "Time in seconds the discovery cached in discovery_cache_dir is used before it is refreshed. Defaults to 600.",
+			},
+			"dial_timeout": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ValidateFunc: validation.IntAtLeast(1),
+				Description:  "Time in seconds after which establishing a connection to the Kubernetes API fails. Defaults to 30.",
+			},
+			"keepalive": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ValidateFunc: validation.IntAtLeast(1),
+				Description:  "Interval in seconds between the TCP keepalive probes of the connections to the Kubernetes API. Defaults to 30.",
+			},
+			"qps": {
+				Type:         schema.TypeFloat,
+				Optional:     true,
+				ValidateFunc: validation.FloatAtLeast(1),
+				Description:  "Maximum queries per second to the Kubernetes API. Defaults to the client default of 5.",
+			},
+			"burst": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ValidateFunc: validation.IntAtLeast(1),
+				Description:  "Maximum burst of queries to the Kubernetes API. Defaults to the client default of 10.",
+			},
+			"preferred_versions": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Map of kinds to the group/version, e.g. networking.k8s.io/v1, preferred when a kind is resolved without a version or a resource is ambiguous.",
+			},
+			"tls_server_name": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("KUBE_TLS_SERVER_NAME", ""),
+				Description: "Server name used to verify the certificate of the Kubernetes master, when it differs from the host.",
+			},
 			"token": {
 				Type:        schema.TypeString,
 				Optional:    true,
@@ -249,6 +404,12 @@ func kubernetesResource() *schema.Resource {
 							Optional: true,
 							Elem:     &schema.Schema{Type: schema.TypeString},
 						},
+						"provide_cluster_info": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Default:     false,
+							Description: "Provide the server, CA certificate and TLS settings of the cluster to the exec plugin in the KUBERNETES_EXEC_INFO environment variable.",
+						},
 					},
 				},
 				Description: "",
@@ -259,7 +420,8 @@ func kubernetesResource() *schema.Resource {
 
 func providerConfigure(d *schema.ResourceData, terraformVersion string) (interface{}, diag.Diagnostics) {
 	m := &Meta{
-		data: d,
+		data:      d,
+		discovery: &sharedDiscovery{},
 		experiments: map[string]bool{
 			"manifest": d.Get("experiments.0.manifest").(bool),
 		},
@@ -274,6 +436,12 @@ func providerConfigure(d *schema.ResourceData, terraformVersion string) (interfa
 		settings.PluginsDirectory = v.(string)
 	}
 
+	// Helm looks for plugins in the directories listed in PluginsDirectory
+	// every time it fetches a chart, an empty list skips the discovery
+	if d.Get("plugins_disable").(bool) {
+		settings.PluginsDirectory = ""
+	}
+
 	if v, ok := d.GetOk("registry_config_path"); ok {
 		settings.RegistryConfig = v.(string)
 	}
@@ -286,15 +454,66 @@ func providerConfigure(d *schema.ResourceData, terraformVersion string) (interfa
 		settings.RepositoryCache = v.(string)
 	}
 
+	// a Helm home that cannot be written, e.g. in a read-only environment,
+	// only breaks the operations reading the repositories file
+	if !d.Get("skip_home_init").(bool) {
+		if err := initHelmHome(settings); err != nil {
+			log.Printf("[WARN] Unable to initialize the Helm home: %v", err)
+		}
+	}
+
 	m.Settings = settings
 
 	if v, ok := d.GetOk("helm_driver"); ok {
 		m.HelmDriver = v.(string)
 	}
 
+	if v, ok := d.GetOk("import_required_label"); ok {
+		m.ImportRequiredLabel = v.(string)
+	}
+
+	m.RepositoryPlainHTTP = d.Get("repository_plain_http").(bool)
+	m.RequirePinnedVersion = d.Get("require_pinned_version").(bool)
+	m.CheckRepositories = d.Get("check_repositories").(bool)
+
+	if v, ok := d.GetOk("operation_stagger"); ok {
+		stagger, err := time.ParseDuration(v.(string))
+		if err != nil {
+			return nil, diag.Errorf("invalid operation_stagger: %v", err)
+		}
+		m.OperationStagger = stagger
+	}
+
+	protected := defaultProtectedNamespaces
+	if v, ok := d.GetOk("protected_namespaces"); ok {
+		protected = expandStringSlice(v.([]interface{}))
+	}
+	m.ProtectedNamespaces = map[string]bool{}
+	for _, ns := range protected {
+		m.ProtectedNamespaces[ns] = true
+	}
+
 	return m, nil
 }
 
+// initHelmHome creates the repository cache and an empty repositories file
+// when they are missing, as `helm repo add` does, so that operations reading
+// them such as `dependency_update` do not fail on a fresh machine
+func initHelmHome(settings *cli.EnvSettings) error {
+	for _, dir := range []string{settings.RepositoryCache, filepath.Dir(settings.RepositoryConfig), filepath.Dir(settings.RegistryConfig)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(settings.RepositoryConfig); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+
+	log.Printf("[DEBUG] Creating the repositories file %s", settings.RepositoryConfig)
+	return repo.NewFile().WriteFile(settings.RepositoryConfig, 0644)
+}
+
 var k8sPrefix = "kubernetes.0."
 
 func k8sGetOk(d *schema.ResourceData, key string) (interface{}, bool) {
@@ -360,23 +579,123 @@ func (m *Meta) GetEnabledExperiments() []string {
 
 // GetHelmConfiguration will return a new Helm configuration
 func (m *Meta) GetHelmConfiguration(namespace string) (*action.Configuration, error) {
+	return m.GetHelmConfigurationWithStorage(namespace, namespace)
+}
+
+// GetHelmConfigurationWithStorage will return a new Helm configuration
+// deploying into namespace and storing the releases in storageNamespace
+func (m *Meta) GetHelmConfigurationWithStorage(namespace, storageNamespace string) (*action.Configuration, error) {
+	return m.GetHelmConfigurationWithLimits(namespace, storageNamespace, 0, 0)
+}
+
+// GetHelmConfigurationWithLimits will return a new Helm configuration like
+// GetHelmConfigurationWithStorage, whose client of the Kubernetes API is rate
+// limited to qps and burst instead of the limits of the provider when they are
+// not zero
+func (m *Meta) GetHelmConfigurationWithLimits(namespace, storageNamespace string, qps float32, burst int) (*action.Configuration, error) {
 	m.Lock()
 	defer m.Unlock()
 	debug("[INFO] GetHelmConfiguration start")
 	actionConfig := new(action.Configuration)
 
-	kc, err := newKubeConfig(m.data, &namespace)
+	kc, err := m.newKubeConfig(&namespace)
 	if err != nil {
 		return nil, err
 	}
+	if qps != 0 {
+		kc.QPS = qps
+	}
+	if burst != 0 {
+		kc.Burst = burst
+	}
 
-	if err := actionConfig.Init(kc, namespace, m.HelmDriver, debug); err != nil {
+	if err := actionConfig.Init(kc, storageNamespace, m.HelmDriver, debug); err != nil {
 		return nil, err
 	}
 	debug("[INFO] GetHelmConfiguration success")
 	return actionConfig, nil
 }
 
+// newKubeConfig returns the Kubernetes configuration of the provider for the
+// namespace, discovering the cluster API once for all the operations
+func (m *Meta) newKubeConfig(namespace *string) (*KubeConfig, error) {
+	kc, err := newKubeConfig(m.data, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if m.discovery != nil {
+		kc.discovery = m.discovery
+	}
+	return kc, nil
+}
+
+// validateDuration checks that the attribute is a positive duration, as
+// parsed by time.ParseDuration
+func validateDuration(v interface{}, k string) ([]string, []error) {
+	d, err := time.ParseDuration(v.(string))
+	if err != nil {
+		return nil, []error{fmt.Errorf("%q must be a duration, e.g. 500ms: %v", k, err)}
+	}
+	if d < 0 {
+		return nil, []error{fmt.Errorf("%q must not be negative", k)}
+	}
+	return nil, nil
+}
+
+// stagger delays the release operation so that it starts at least
+// `operation_stagger` after the previous one, plus a random jitter of up to a
+// quarter of the interval. The slot is reserved under the lock, but the wait
+// happens outside of it so that the other operations are not blocked.
+func (m *Meta) stagger(ctx context.Context) error {
+	if m.OperationStagger <= 0 {
+		return nil
+	}
+
+	m.Lock()
+	now := time.Now()
+	slot := m.lastOperation.Add(m.OperationStagger)
+	if slot.Before(now) {
+		slot = now
+	}
+	if jitter := int64(m.OperationStagger / 4); jitter > 0 {
+		slot = slot.Add(time.Duration(rand.Int63n(jitter)))
+	}
+	m.lastOperation = slot
+	m.Unlock()
+
+	delay := time.Until(slot)
+	if delay <= 0 {
+		return nil
+	}
+	debug("[INFO] Staggering the release operation by %s", delay.Round(time.Millisecond))
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func debug(format string, a ...interface{}) {
 	log.Printf("[DEBUG] %s", fmt.Sprintf(format, a...))
 }
+
+// logHelmCall logs the duration of a call to the Helm client when debug is
+// enabled. Only the operation, release and outcome are logged so that no
+// values end up in the logs.
+func (m *Meta) logHelmCall(op, namespace, name string, start time.Time, err error) {
+	if m.Settings == nil || !m.Settings.Debug {
+		return
+	}
+
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+
+	log.Printf("[DEBUG] helm-call op=%s namespace=%s release=%s duration=%s status=%s",
+		op, namespace, name, time.Since(start).Round(time.Millisecond), status)
+}
@@ -1,7 +1,9 @@
 package helm
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -10,12 +12,21 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/acctest"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/repo"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -77,6 +88,12 @@ func TestMain(m *testing.M) {
 		panic(err)
 	}
 
+	// the test repository is served over plain HTTP
+	err = os.Setenv("HELM_REPOSITORY_PLAIN_HTTP", "true")
+	if err != nil {
+		panic(err)
+	}
+
 	accTest = os.Getenv("TF_ACC") == "1"
 
 	var stopRepositoryServer func()
@@ -120,6 +137,243 @@ func TestProvider(t *testing.T) {
 	}
 }
 
+func TestLogHelmCall(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	m := &Meta{Settings: cli.New()}
+	m.logHelmCall("install", "default", "test", time.Now(), nil)
+	if buf.Len() != 0 {
+		t.Fatalf("expected no output when debug is disabled, got %q", buf.String())
+	}
+
+	m.Settings.Debug = true
+	m.logHelmCall("install", "default", "test", time.Now(), nil)
+	m.logHelmCall("upgrade", "default", "test", time.Now(), errors.New("failed"))
+
+	out := buf.String()
+	if !regexp.MustCompile(`\[DEBUG\] helm-call op=install namespace=default release=test duration=\S+ status=ok`).MatchString(out) {
+		t.Fatalf("unexpected output: %q", out)
+	}
+	if !regexp.MustCompile(`\[DEBUG\] helm-call op=upgrade namespace=default release=test duration=\S+ status=error`).MatchString(out) {
+		t.Fatalf("unexpected output: %q", out)
+	}
+	if strings.Contains(out, "failed") {
+		t.Fatalf("error details must not be logged: %q", out)
+	}
+}
+
+func TestProviderPluginsDisable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a downloader plugin, found when the plugins directory is walked
+	if err := os.Mkdir(filepath.Join(dir, "s3"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	plugin := "name: s3\nversion: 0.1.0\ncommand: s3\ndownloaders:\n- command: s3\n  protocols: [s3]\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "s3", "plugin.yaml"), []byte(plugin), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for disable, expected := range map[bool]int{false: 3, true: 2} {
+		d := schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+			"plugins_path":    dir,
+			"plugins_disable": disable,
+		})
+		m, diags := providerConfigure(d, "")
+		if diags.HasError() {
+			t.Fatal(diags)
+		}
+
+		if providers := getter.All(m.(*Meta).Settings); len(providers) != expected {
+			t.Errorf("plugins_disable %t: expected %d getters, got %d", disable, expected, len(providers))
+		}
+	}
+}
+
+func TestProviderProtectedNamespaces(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{})
+	m, diags := providerConfigure(d, "")
+	if diags.HasError() {
+		t.Fatal(diags)
+	}
+	expected := map[string]bool{"kube-system": true, "kube-public": true, "kube-node-lease": true}
+	if actual := m.(*Meta).ProtectedNamespaces; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected the default protected namespaces %v, got %v", expected, actual)
+	}
+
+	d = schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+		"protected_namespaces": []interface{}{"kube-system", "platform"},
+	})
+	m, diags = providerConfigure(d, "")
+	if diags.HasError() {
+		t.Fatal(diags)
+	}
+	expected = map[string]bool{"kube-system": true, "platform": true}
+	if actual := m.(*Meta).ProtectedNamespaces; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected the protected namespaces %v, got %v", expected, actual)
+	}
+}
+
+func TestProviderRequirePinnedVersion(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{})
+	m, diags := providerConfigure(d, "")
+	if diags.HasError() {
+		t.Fatal(diags)
+	}
+	if m.(*Meta).RequirePinnedVersion {
+		t.Error("expected unpinned versions to be allowed by default")
+	}
+
+	d = schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+		"require_pinned_version": true,
+	})
+	m, diags = providerConfigure(d, "")
+	if diags.HasError() {
+		t.Fatal(diags)
+	}
+	if !m.(*Meta).RequirePinnedVersion {
+		t.Error("expected pinned versions to be required")
+	}
+}
+
+func TestProviderHomeInit(t *testing.T) {
+	home, err := ioutil.TempDir("", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	configure := func(skip bool) *Meta {
+		d := schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+			"repository_config_path": filepath.Join(home, "config/repositories.yaml"),
+			"repository_cache":       filepath.Join(home, "cache/repository"),
+			"registry_config_path":   filepath.Join(home, "config/registry.json"),
+			"skip_home_init":         skip,
+		})
+		m, diags := providerConfigure(d, "")
+		if diags.HasError() {
+			t.Fatal(diags)
+		}
+		return m.(*Meta)
+	}
+
+	configure(true)
+	if entries, _ := ioutil.ReadDir(home); len(entries) != 0 {
+		t.Fatalf("expected the home to be left empty with skip_home_init, got %d entries", len(entries))
+	}
+
+	m := configure(false)
+	if _, err := repo.LoadFile(m.Settings.RepositoryConfig); err != nil {
+		t.Fatalf("expected an empty repositories file, got %s", err)
+	}
+	if _, err := os.Stat(m.Settings.RepositoryCache); err != nil {
+		t.Fatalf("expected the repository cache to be created, got %s", err)
+	}
+
+	// the dependencies are updated from the empty home
+	defer removeSubcharts("umbrella-chart")
+	if err := removeSubcharts("umbrella-chart"); err != nil {
+		t.Fatal(err)
+	}
+	path := "testdata/charts/umbrella-chart"
+	c, err := loader.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := fakeResourceChangeGetter{values: map[string]interface{}{"dependency_update": true, "keyring": ""}}
+	if _, err := checkChartDependencies(d, c, path, m); err != nil {
+		t.Fatalf("expected the dependencies to be updated, got %s", err)
+	}
+
+	// an existing repositories file is kept
+	if err := ioutil.WriteFile(m.Settings.RepositoryConfig, []byte("apiVersion: v1\nrepositories:\n- name: test\n  url: https://example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m = configure(false)
+	if f, err := repo.LoadFile(m.Settings.RepositoryConfig); err != nil || !f.Has("test") {
+		t.Fatalf("expected the repositories file to be kept, got %v", err)
+	}
+
+	// a home that cannot be written does not fail the configuration
+	readOnly := filepath.Join(home, "file")
+	if err := ioutil.WriteFile(readOnly, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rd := schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+		"repository_config_path": filepath.Join(readOnly, "config/repositories.yaml"),
+		"repository_cache":       filepath.Join(readOnly, "cache/repository"),
+		"registry_config_path":   filepath.Join(readOnly, "config/registry.json"),
+	})
+	if _, diags := providerConfigure(rd, ""); diags.HasError() {
+		t.Fatalf("expected the provider to be configured without a writable home, got %v", diags)
+	}
+}
+
+func TestCheckChartDependenciesUnknownRepository(t *testing.T) {
+	home, err := ioutil.TempDir("", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	d := schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+		"repository_config_path": filepath.Join(home, "config/repositories.yaml"),
+		"repository_cache":       filepath.Join(home, "cache/repository"),
+		"registry_config_path":   filepath.Join(home, "config/registry.json"),
+	})
+	m, diags := providerConfigure(d, "")
+	if diags.HasError() {
+		t.Fatal(diags)
+	}
+
+	path := filepath.Join(home, "chart")
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	chartYAML := `apiVersion: v2
+name: unknown-repository
+version: 0.1.0
+dependencies:
+- name: dependency-foo
+  version: 0.x.x
+  repository: "@unknown"
+`
+	if err := ioutil.WriteFile(filepath.Join(path, "Chart.yaml"), []byte(chartYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loader.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := fakeResourceChangeGetter{values: map[string]interface{}{"dependency_update": true, "keyring": ""}}
+	_, err = checkChartDependencies(r, c, path, m.(*Meta))
+	if err == nil {
+		t.Fatal("expected the dependencies of an unknown repository to fail to update")
+	}
+	for _, s := range []string{`no repository definition for @unknown`, "repository_config_path", filepath.Join(home, "config/repositories.yaml")} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("expected the error to contain %q, got %s", s, err)
+		}
+	}
+
+	// the repositories defined in the repositories file are known
+	f := repo.NewFile()
+	f.Add(&repo.Entry{Name: "unknown", URL: "https://charts.example.com"})
+	if err := f.WriteFile(filepath.Join(home, "config/repositories.yaml"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDependencyRepositories(c, m.(*Meta)); err != nil {
+		t.Fatalf("expected the repository of the dependency to be known, got %s", err)
+	}
+}
+
 // buildChartRepository packages all the test charts and builds the repository index
 func buildChartRepository() {
 	log.Println("Building chart repository...")
@@ -272,3 +526,65 @@ func deleteNamespace(t *testing.T, namespace string) {
 func randName(prefix string) string {
 	return fmt.Sprintf("%s-%s", prefix, acctest.RandString(10))
 }
+
+func TestProviderOperationStagger(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{})
+	m, diags := providerConfigure(d, "")
+	if diags.HasError() {
+		t.Fatal(diags)
+	}
+	if m.(*Meta).OperationStagger != 0 {
+		t.Errorf("expected no stagger by default, got %s", m.(*Meta).OperationStagger)
+	}
+
+	d = schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+		"operation_stagger": "200ms",
+	})
+	m, diags = providerConfigure(d, "")
+	if diags.HasError() {
+		t.Fatal(diags)
+	}
+	if m.(*Meta).OperationStagger != 200*time.Millisecond {
+		t.Errorf("expected a stagger of 200ms, got %s", m.(*Meta).OperationStagger)
+	}
+}
+
+func TestMetaStagger(t *testing.T) {
+	interval := 100 * time.Millisecond
+	m := &Meta{OperationStagger: interval}
+
+	var lock sync.Mutex
+	starts := []time.Time{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m.stagger(context.Background()); err != nil {
+				t.Error(err)
+				return
+			}
+			lock.Lock()
+			starts = append(starts, time.Now())
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	for i := 1; i < len(starts); i++ {
+		gap := starts[i].Sub(starts[i-1])
+		// the jitter adds up to a quarter of the interval, and the timers
+		// may fire slightly late
+		if gap < interval-10*time.Millisecond || gap > interval*2 {
+			t.Errorf("expected operations %d and %d to be about %s apart, got %s", i-1, i, interval, gap)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.stagger(ctx); err != context.Canceled {
+		t.Errorf("expected the stagger to be canceled with the context, got %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package helm
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/cli-runtime/pkg/resource"
+)
+
+const (
+	helmReleaseNameAnnotation      = "meta.helm.sh/release-name"
+	helmReleaseNamespaceAnnotation = "meta.helm.sh/release-namespace"
+)
+
+// pruneOrphans deletes the objects of the previous manifest that are not part
+// of the manifest of rel anymore. Only objects still annotated as owned by the
+// release are deleted.
+func pruneOrphans(cfg *action.Configuration, previousManifest string, rel *release.Release) error {
+	previous, err := cfg.KubeClient.Build(bytes.NewBufferString(previousManifest), false)
+	if err != nil {
+		return fmt.Errorf("unable to build kubernetes objects from the previous release manifest: %w", err)
+	}
+
+	current, err := cfg.KubeClient.Build(bytes.NewBufferString(rel.Manifest), false)
+	if err != nil {
+		return fmt.Errorf("unable to build kubernetes objects from the release manifest: %w", err)
+	}
+
+	orphans := previous.Difference(current).Filter(func(info *resource.Info) bool {
+		if err := info.Get(); err != nil {
+			if !apierrors.IsNotFound(err) {
+				log.Printf("[WARN] Unable to get %s %s/%s, not pruning it: %s", info.Mapping.GroupVersionKind.Kind, info.Namespace, info.Name, err)
+			}
+			return false
+		}
+		return isOwnedByRelease(info.Object, rel.Name, rel.Namespace)
+	})
+
+	if len(orphans) == 0 {
+		return nil
+	}
+
+	for _, info := range orphans {
+		log.Printf("[INFO] Pruning %s %s/%s removed from release %s", info.Mapping.GroupVersionKind.Kind, info.Namespace, info.Name, rel.Name)
+	}
+
+	if _, errs := cfg.KubeClient.Delete(orphans); len(errs) > 0 {
+		return fmt.Errorf("failed to prune orphaned resources of release %s: %v", rel.Name, errs)
+	}
+
+	return nil
+}
+
+// isOwnedByRelease returns true if the object carries the ownership annotations
+// Helm sets for the given release
+func isOwnedByRelease(obj runtime.Object, name, namespace string) bool {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return false
+	}
+
+	annotations := accessor.GetAnnotations()
+	return annotations[helmReleaseNameAnnotation] == name &&
+		annotations[helmReleaseNamespaceAnnotation] == namespace
+}
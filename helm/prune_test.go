@@ -0,0 +1,31 @@
+package helm
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIsOwnedByRelease(t *testing.T) {
+	object := func(annotations map[string]string) *v1.ConfigMap {
+		return &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "test", Annotations: annotations}}
+	}
+
+	tests := []struct {
+		name     string
+		obj      *v1.ConfigMap
+		expected bool
+	}{
+		{"owned", object(map[string]string{helmReleaseNameAnnotation: "foo", helmReleaseNamespaceAnnotation: "bar"}), true},
+		{"other release", object(map[string]string{helmReleaseNameAnnotation: "baz", helmReleaseNamespaceAnnotation: "bar"}), false},
+		{"other namespace", object(map[string]string{helmReleaseNameAnnotation: "foo", helmReleaseNamespaceAnnotation: "baz"}), false},
+		{"not annotated", object(nil), false},
+	}
+
+	for _, tt := range tests {
+		if actual := isOwnedByRelease(tt.obj, "foo", "bar"); actual != tt.expected {
+			t.Errorf("%s: expected %t, got %t", tt.name, tt.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package helm
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/kube"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"sigs.k8s.io/yaml"
+)
+
+// minSecretDataLength is the length below which the data of the Secrets of
+// the manifest is not masked, since short values such as "true" or "admin"
+// would mask unrelated parts of the messages
+const minSecretDataLength = 8
+
+// sensitiveReplacer returns a replacer masking the sensitive values of the
+// resource: the values of `set_sensitive`, as is and base64 encoded as in the
+// data of a Secret, and the data of the Secrets of the manifest
+func sensitiveReplacer(d resourceGetter, manifest string) *strings.Replacer {
+	values := map[string]bool{}
+	add := func(v string) {
+		if v != "" {
+			values[v] = true
+		}
+	}
+
+	for _, raw := range d.Get("set_sensitive").(*schema.Set).List() {
+		v := raw.(map[string]interface{})["value"].(string)
+		add(v)
+		add(base64.StdEncoding.EncodeToString([]byte(v)))
+	}
+
+	for _, v := range secretData(manifest) {
+		add(v)
+	}
+
+	// longer values first, so that a value containing another one is masked
+	// as a whole
+	sorted := make([]string, 0, len(values))
+	for v := range values {
+		sorted = append(sorted, v)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i]) != len(sorted[j]) {
+			return len(sorted[i]) > len(sorted[j])
+		}
+		return sorted[i] < sorted[j]
+	})
+
+	pairs := make([]string, 0, 2*len(sorted))
+	for _, v := range sorted {
+		pairs = append(pairs, v, sensitiveContentValue)
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// secretData returns the values of the data and stringData of the Secrets of
+// the manifest, the data being returned both encoded and decoded. Values
+// shorter than minSecretDataLength are left out.
+func secretData(manifest string) []string {
+	values := []string{}
+	for _, m := range releaseutil.SplitManifests(manifest) {
+		secret := struct {
+			Kind       string            `json:"kind"`
+			Data       map[string]string `json:"data"`
+			StringData map[string]string `json:"stringData"`
+		}{}
+		if err := yaml.Unmarshal([]byte(m), &secret); err != nil || secret.Kind != "Secret" {
+			continue
+		}
+
+		for _, v := range secret.Data {
+			decoded, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				if len(v) >= minSecretDataLength {
+					values = append(values, v)
+				}
+				continue
+			}
+			if len(decoded) >= minSecretDataLength {
+				values = append(values, v, string(decoded))
+			}
+		}
+		for _, v := range secret.StringData {
+			if len(v) >= minSecretDataLength {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+// redactError masks the sensitive values of the resource and of the release,
+// if any, in the message of the error
+func redactError(d resourceGetter, rel *release.Release, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	manifest := ""
+	if rel != nil {
+		manifest = rel.Manifest
+	}
+
+	msg := sensitiveReplacer(d, manifest).Replace(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+	return errors.New(msg)
+}
+
+// redactLogs masks the sensitive values of the resource in the logs of the
+// Helm actions and of the Kubernetes client
+func redactLogs(cfg *action.Configuration, d resourceGetter) {
+	r := sensitiveReplacer(d, "")
+	cfg.Log = func(format string, v ...interface{}) {
+		debug("%s", r.Replace(fmt.Sprintf(format, v...)))
+	}
+
+	if kc, ok := cfg.KubeClient.(*kube.Client); ok {
+		kc.Log = cfg.Log
+	}
+}
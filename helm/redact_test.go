@@ -0,0 +1,89 @@
+package helm
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/kube"
+	"helm.sh/helm/v3/pkg/release"
+)
+
+func TestRedactError(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceRelease().Schema, map[string]interface{}{
+		"name":  "test",
+		"chart": "test-chart",
+		"set_sensitive": []interface{}{
+			map[string]interface{}{"name": "auth.password", "value": "hunter22"},
+		},
+	})
+
+	rel := &release.Release{Manifest: `---
+# Source: test-chart/templates/secret.yaml
+apiVersion: v1
+kind: Secret
+metadata:
+  name: test
+data:
+  token: czNjcjN0LXRva2Vu
+  enabled: dHJ1ZQ==
+stringData:
+  apiKey: key-0123456789
+  user: admin
+`}
+
+	runErr := errors.New(`Secret "test" is invalid: data[password]: aHVudGVyMjI= (hunter22), token s3cr3t-token, apiKey key-0123456789, admin: true`)
+	err := redactError(d, rel, runErr)
+	for _, secret := range []string{"hunter22", "aHVudGVyMjI=", "s3cr3t-token", "czNjcjN0LXRva2Vu", "key-0123456789"} {
+		if strings.Contains(err.Error(), secret) {
+			t.Errorf("expected %q to be redacted from %q", secret, err)
+		}
+	}
+	if !strings.Contains(err.Error(), `Secret "test" is invalid: data[password]: (sensitive value) ((sensitive value))`) {
+		t.Errorf("expected the rest of the error to be kept, got %q", err)
+	}
+	// short values are not masked
+	if !strings.HasSuffix(err.Error(), "admin: true") {
+		t.Errorf("expected the short values to be kept, got %q", err)
+	}
+
+	if err := redactError(d, nil, nil); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	// errors without sensitive values are returned as is
+	if err := redactError(d, nil, errReleaseNotFound); err != errReleaseNotFound {
+		t.Errorf("expected the error to be returned unchanged, got %v", err)
+	}
+}
+
+func TestRedactLogs(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceRelease().Schema, map[string]interface{}{
+		"name":  "test",
+		"chart": "test-chart",
+		"set_sensitive": []interface{}{
+			map[string]interface{}{"name": "auth.password", "value": "hunter22"},
+		},
+	})
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := &action.Configuration{KubeClient: kube.New(nil)}
+	redactLogs(cfg, d)
+	cfg.Log("creating secret with password %s", "hunter22")
+	cfg.KubeClient.(*kube.Client).Log("error updating secret: %s", "aHVudGVyMjI=")
+
+	if strings.Contains(buf.String(), "hunter22") || strings.Contains(buf.String(), "aHVudGVyMjI=") {
+		t.Errorf("expected the sensitive value to be redacted from the logs, got %q", buf.String())
+	}
+	if strings.Count(buf.String(), sensitiveContentValue) != 2 {
+		t.Errorf("expected the messages to be logged redacted, got %q", buf.String())
+	}
+}
@@ -0,0 +1,144 @@
+package helm
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"text/template/parse"
+	"time"
+
+	"github.com/Masterminds/sprig/v3"
+	"helm.sh/helm/v3/pkg/chart"
+)
+
+// helmTemplateFuncs are the template functions available to charts besides the
+// sprig ones: the text/template builtins and the functions added by Helm
+var helmTemplateFuncs = []string{
+	"and", "call", "html", "index", "slice", "js", "len", "not", "or", "print", "printf", "println", "urlquery",
+	"eq", "ge", "gt", "le", "lt", "ne",
+	"toToml", "toYaml", "fromYaml", "fromYamlArray", "toJson", "fromJson", "fromJsonArray",
+	"include", "tpl", "required", "lookup",
+}
+
+// pinRenderTime makes the `now` template function of the chart and of its
+// subcharts return the time set in `render_time`, so that rendering the chart
+// is deterministic. Each call of `now` is replaced with an equivalent call of
+// `toDate` on the pinned time.
+func pinRenderTime(d resourceGetter, c *chart.Chart) error {
+	v := d.Get("render_time").(string)
+	if v == "" {
+		return nil
+	}
+
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return fmt.Errorf("invalid render_time %q: %v", v, err)
+	}
+
+	// the pinned time is in UTC, whatever the offset of `render_time` and the
+	// time zone of the machine
+	pinned := fmt.Sprintf("(toDate %q %q)", time.RFC3339Nano, t.UTC().Format(time.RFC3339Nano))
+	return pinChartTime(c, pinned)
+}
+
+func pinChartTime(c *chart.Chart, pinned string) error {
+	for _, f := range c.Templates {
+		if !strings.Contains(string(f.Data), "now") {
+			continue
+		}
+
+		data, err := replaceNowCalls(f.Name, string(f.Data), pinned)
+		if err != nil {
+			return fmt.Errorf("unable to pin the render time of %s/%s: %v", c.Name(), f.Name, err)
+		}
+		f.Data = []byte(data)
+	}
+
+	for _, dep := range c.Dependencies() {
+		if err := pinChartTime(dep, pinned); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceNowCalls replaces the calls of the `now` function in the template
+// text with pinned. The calls are located in the parse tree of the template, so
+// that `now` in text, strings or field names is left untouched.
+func replaceNowCalls(name, text, pinned string) (string, error) {
+	funcs := sprig.TxtFuncMap()
+	// only the names of the functions matter to the parser
+	for _, f := range helmTemplateFuncs {
+		funcs[f] = fmt.Sprint
+	}
+
+	trees, err := parse.Parse(name, text, "", "", funcs)
+	if err != nil {
+		return "", err
+	}
+
+	positions := []int{}
+	for _, tree := range trees {
+		positions = append(positions, nowCallPositions(tree.Root)...)
+	}
+	if len(positions) == 0 {
+		return text, nil
+	}
+
+	// replace from the end so that the positions left stay valid
+	sort.Sort(sort.Reverse(sort.IntSlice(positions)))
+	for _, pos := range positions {
+		text = text[:pos] + pinned + text[pos+len("now"):]
+	}
+
+	log.Printf("[DEBUG] Pinned %d calls of now in template %s", len(positions), name)
+	return text, nil
+}
+
+func nowCallPositions(node parse.Node) []int {
+	positions := []int{}
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return positions
+		}
+		for _, c := range n.Nodes {
+			positions = append(positions, nowCallPositions(c)...)
+		}
+	case *parse.ActionNode:
+		positions = append(positions, nowCallPositions(n.Pipe)...)
+	case *parse.IfNode:
+		positions = append(positions, branchNowCallPositions(&n.BranchNode)...)
+	case *parse.RangeNode:
+		positions = append(positions, branchNowCallPositions(&n.BranchNode)...)
+	case *parse.WithNode:
+		positions = append(positions, branchNowCallPositions(&n.BranchNode)...)
+	case *parse.TemplateNode:
+		positions = append(positions, nowCallPositions(n.Pipe)...)
+	case *parse.PipeNode:
+		if n == nil {
+			return positions
+		}
+		for _, c := range n.Cmds {
+			positions = append(positions, nowCallPositions(c)...)
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			positions = append(positions, nowCallPositions(a)...)
+		}
+	case *parse.ChainNode:
+		positions = append(positions, nowCallPositions(n.Node)...)
+	case *parse.IdentifierNode:
+		if n.Ident == "now" {
+			positions = append(positions, int(n.Pos))
+		}
+	}
+	return positions
+}
+
+func branchNowCallPositions(n *parse.BranchNode) []int {
+	positions := nowCallPositions(n.Pipe)
+	positions = append(positions, nowCallPositions(n.List)...)
+	return append(positions, nowCallPositions(n.ElseList)...)
+}
@@ -0,0 +1,104 @@
+package helm
+
+import (
+	"testing"
+	"time"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
+)
+
+func TestReplaceNowCalls(t *testing.T) {
+	pinned := `(toDate "2006-01-02" "2021-06-01")`
+	tests := []struct {
+		text, expected string
+	}{
+		{
+			`created: {{ now | date "2006-01-02" }}`,
+			`created: {{ (toDate "2006-01-02" "2021-06-01") | date "2006-01-02" }}`,
+		},
+		{
+			`{{- if gt (now | unixEpoch) 0 }}{{ dateInZone "2006" (now) "UTC" }}{{ end }}`,
+			`{{- if gt ((toDate "2006-01-02" "2021-06-01") | unixEpoch) 0 }}{{ dateInZone "2006" ((toDate "2006-01-02" "2021-06-01")) "UTC" }}{{ end }}`,
+		},
+		{
+			`{{ define "t" }}{{ now }}{{ end }}now: {{ .Values.now }} {{ "now" }} {{ include "t" . }}`,
+			`{{ define "t" }}{{ (toDate "2006-01-02" "2021-06-01") }}{{ end }}now: {{ .Values.now }} {{ "now" }} {{ include "t" . }}`,
+		},
+		{
+			`{{ toYaml .Values.now }}`,
+			`{{ toYaml .Values.now }}`,
+		},
+	}
+
+	for _, tt := range tests {
+		out, err := replaceNowCalls("test", tt.text, pinned)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, out)
+		}
+	}
+}
+
+func TestPinRenderTime(t *testing.T) {
+	newChart := func() *chart.Chart {
+		c := &chart.Chart{
+			Metadata: &chart.Metadata{APIVersion: "v2", Name: "parent", Version: "1.0.0"},
+			Templates: []*chart.File{
+				{Name: "templates/configmap.yaml", Data: []byte(`created: {{ now | date "2006-01-02T15:04:05.000000Z07:00" }}`)},
+				{Name: "templates/zone.yaml", Data: []byte(`zone: {{ (now).Location }}`)},
+			},
+		}
+		sub := &chart.Chart{
+			Metadata: &chart.Metadata{APIVersion: "v2", Name: "sub", Version: "1.0.0"},
+			Templates: []*chart.File{
+				{Name: "templates/configmap.yaml", Data: []byte(`created: {{ now | unixEpoch }}`)},
+			},
+		}
+		c.AddDependency(sub)
+		return c
+	}
+
+	render := func(c *chart.Chart) map[string]string {
+		values, err := chartutil.ToRenderValues(c, map[string]interface{}{}, chartutil.ReleaseOptions{Name: "test"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := engine.Render(c, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	d := fakeResourceChangeGetter{values: map[string]interface{}{"render_time": "2021-06-01T12:00:00+02:00"}}
+
+	var first map[string]string
+	for i := 0; i < 2; i++ {
+		c := newChart()
+		if err := pinRenderTime(d, c); err != nil {
+			t.Fatal(err)
+		}
+		out := render(c)
+		if i == 0 {
+			first = out
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		for name, manifest := range out {
+			if first[name] != manifest {
+				t.Errorf("expected %s to render deterministically, got %q and %q", name, first[name], manifest)
+			}
+		}
+	}
+
+	if out := first["parent/charts/sub/templates/configmap.yaml"]; out != "created: 1622541600" {
+		t.Errorf("unexpected subchart output %q", out)
+	}
+	if out := first["parent/templates/zone.yaml"]; out != "zone: UTC" {
+		t.Errorf("expected the pinned time to be in UTC, got %q", out)
+	}
+}
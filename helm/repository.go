@@ -0,0 +1,366 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/helmpath"
+	"helm.sh/helm/v3/pkg/repo"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// repositorySchema returns the attributes locating the repository of the chart
+// and authenticating to it, shared by the release and the data sources
+// fetching charts
+func repositorySchema() map[string]*schema.Schema {
+	return map[string]*schema.Schema{
+		"repository": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "Repository where to locate the requested chart. If is a URL the chart is fetched without installing the repository.",
+		},
+		"repository_key_file": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "The repositories cert key file",
+		},
+		"repository_cert_file": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "The repositories cert file",
+		},
+		"repository_ca_file": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "The Repositories CA File",
+		},
+		"repository_username": {
+			Type:         schema.TypeString,
+			Optional:     true,
+			RequiredWith: []string{"repository_password"},
+			Description:  "Username for HTTP basic authentication",
+		},
+		"repository_password": {
+			Type:         schema.TypeString,
+			Optional:     true,
+			Sensitive:    true,
+			RequiredWith: []string{"repository_username"},
+			Description:  "Password for HTTP basic authentication",
+		},
+		"repository_credentials_secret": {
+			Type:          schema.TypeList,
+			Optional:      true,
+			MaxItems:      1,
+			ConflictsWith: []string{"repository_username", "repository_password"},
+			Description:   "Secret holding the credentials for HTTP basic authentication in its username and password keys",
+			Elem: &schema.Resource{
+				Schema: map[string]*schema.Schema{
+					"name": {
+						Type:        schema.TypeString,
+						Required:    true,
+						Description: "Name of the Secret",
+					},
+					"namespace": {
+						Type:        schema.TypeString,
+						Optional:    true,
+						Default:     "default",
+						Description: "Namespace of the Secret",
+					},
+				},
+			},
+		},
+	}
+}
+
+// mergeSchemas returns the attributes of all the schemas
+func mergeSchemas(schemas ...map[string]*schema.Schema) map[string]*schema.Schema {
+	merged := map[string]*schema.Schema{}
+	for _, s := range schemas {
+		for k, v := range s {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// checkChartRepository returns an error if the chart would be fetched from a
+// plain HTTP repository while `repository_plain_http` is not set. The chart can
+// come from the repository URL, from a chart URL, or from a named repository
+// configured in the repositories file.
+func checkChartRepository(m *Meta, repositoryURL, chartName string) error {
+	if repositoryURL != "" {
+		return checkRepositoryURL(m, repositoryURL)
+	}
+
+	if u, err := url.Parse(chartName); err == nil && u.Scheme != "" {
+		return checkRepositoryURL(m, chartName)
+	}
+
+	if _, err := os.Stat(chartName); err == nil {
+		return nil
+	}
+
+	parts := strings.SplitN(chartName, "/", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+
+	f, err := repo.LoadFile(m.Settings.RepositoryConfig)
+	if err != nil {
+		// a missing repositories file fails later when locating the chart
+		return nil
+	}
+	if entry := f.Get(parts[0]); entry != nil {
+		return checkRepositoryURL(m, entry.URL)
+	}
+	return nil
+}
+
+// checkRepositoryURL returns an error for a plain HTTP URL unless
+// `repository_plain_http` is set
+func checkRepositoryURL(m *Meta, repositoryURL string) error {
+	u, err := url.Parse(repositoryURL)
+	if err != nil {
+		return fmt.Errorf("invalid repository URL %q: %v", repositoryURL, err)
+	}
+
+	if strings.ToLower(u.Scheme) == "http" && !m.RepositoryPlainHTTP {
+		return fmt.Errorf("repository %q uses plain HTTP, set repository_plain_http in the provider configuration to allow it", repositoryURL)
+	}
+	return nil
+}
+
+// locateChart locates the chart like cpo.LocateChart. When the chart version
+// cannot be found in the cached index of a named repository, which happens
+// when it was published after the last refresh of the index, the index is
+// downloaded again once before locating the chart.
+func locateChart(m *Meta, name string, cpo *action.ChartPathOptions) (string, error) {
+	if repoName, chartName, ok := repositoryChartName(name, cpo); ok && !isInCachedIndex(m, repoName, chartName, cpo.Version) {
+		log.Printf("[DEBUG] Chart %s version %q not found in the cached index, refreshing the index of repository %q", name, cpo.Version, repoName)
+		if err := refreshRepositoryIndex(m, repoName); err != nil {
+			log.Printf("[WARN] Unable to refresh the index of repository %q: %s", repoName, err)
+		}
+	}
+
+	return cpo.LocateChart(name, m.Settings)
+}
+
+// repositoryChartName splits a chart referenced as repo/chart, returning false
+// for local charts and charts referenced by a URL
+func repositoryChartName(name string, cpo *action.ChartPathOptions) (string, string, bool) {
+	if cpo.RepoURL != "" {
+		return "", "", false
+	}
+
+	if u, err := url.Parse(name); err == nil && u.Scheme != "" {
+		return "", "", false
+	}
+
+	if _, err := os.Stat(name); err == nil {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// isInCachedIndex returns true if the chart version is listed in the cached
+// index of the repository
+func isInCachedIndex(m *Meta, repoName, chartName, version string) bool {
+	index, err := repo.LoadIndexFile(filepath.Join(m.Settings.RepositoryCache, helmpath.CacheIndexFile(repoName)))
+	if err != nil {
+		return false
+	}
+
+	_, err = index.Get(chartName, version)
+	return err == nil
+}
+
+// refreshRepositoryIndex downloads the index of the named repository to the
+// repository cache, like `helm repo update`, unless it did not change
+func refreshRepositoryIndex(m *Meta, name string) error {
+	f, err := repo.LoadFile(m.Settings.RepositoryConfig)
+	if err != nil {
+		return err
+	}
+
+	entry := f.Get(name)
+	if entry == nil {
+		return fmt.Errorf("repository %q not found in %s", name, m.Settings.RepositoryConfig)
+	}
+
+	_, err = downloadIndexFile(m, entry, m.Settings.RepositoryCache)
+	return err
+}
+
+// repositoryCheckTimeout bounds the request checking that a repository is
+// reachable
+const repositoryCheckTimeout = 10 * time.Second
+
+// checkRepositoryReachable returns an error naming the URL of the repository
+// the chart is fetched from when it cannot be reached, requesting the head of
+// its index, or of the chart itself for a chart URL. Local charts and charts
+// served by getter plugins, e.g. OCI registries or S3, are not checked. The
+// outcome is remembered for each URL, so that a repository shared by several
+// releases is only checked once per run.
+func checkRepositoryReachable(m *Meta, cpo *action.ChartPathOptions, chartName string) error {
+	entry, target := repositoryEntry(m, cpo, chartName)
+	if entry == nil {
+		return nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid repository URL %q: %v", target, err)
+	}
+	if scheme := strings.ToLower(u.Scheme); scheme != "http" && scheme != "https" {
+		return nil
+	}
+
+	m.Lock()
+	err, checked := m.checkedRepositories[target]
+	m.Unlock()
+	if checked {
+		return err
+	}
+
+	log.Printf("[DEBUG] Checking that repository %s is reachable", entry.URL)
+	err = headRepositoryURL(entry, target)
+	if err != nil {
+		err = fmt.Errorf("repository %s is unreachable: %v", entry.URL, err)
+	}
+
+	m.Lock()
+	if m.checkedRepositories == nil {
+		m.checkedRepositories = map[string]error{}
+	}
+	m.checkedRepositories[target] = err
+	m.Unlock()
+	return err
+}
+
+// repositoryEntry returns the repository the chart is fetched from and the URL
+// checking it is reachable, or nil for a local chart
+func repositoryEntry(m *Meta, cpo *action.ChartPathOptions, chartName string) (*repo.Entry, string) {
+	entry := &repo.Entry{
+		URL:      cpo.RepoURL,
+		Username: cpo.Username,
+		Password: cpo.Password,
+		CertFile: cpo.CertFile,
+		KeyFile:  cpo.KeyFile,
+		CAFile:   cpo.CaFile,
+	}
+
+	if cpo.RepoURL != "" {
+		return entry, strings.TrimSuffix(cpo.RepoURL, "/") + "/index.yaml"
+	}
+
+	if u, err := url.Parse(chartName); err == nil && u.Scheme != "" {
+		entry.URL = chartName
+		return entry, chartName
+	}
+
+	repoName, _, ok := repositoryChartName(chartName, cpo)
+	if !ok {
+		return nil, ""
+	}
+
+	f, err := repo.LoadFile(m.Settings.RepositoryConfig)
+	if err != nil {
+		return nil, ""
+	}
+	if entry = f.Get(repoName); entry == nil {
+		// an unknown repository fails later when locating the chart
+		return nil, ""
+	}
+	return entry, strings.TrimSuffix(entry.URL, "/") + "/index.yaml"
+}
+
+// headRepositoryURL sends a HEAD request to the URL with the credentials of
+// the repository. Servers not implementing HEAD are considered reachable.
+func headRepositoryURL(entry *repo.Entry, target string) error {
+	req, err := http.NewRequest(http.MethodHead, target, nil)
+	if err != nil {
+		return err
+	}
+	if entry.Username != "" || entry.Password != "" {
+		req.SetBasicAuth(entry.Username, entry.Password)
+	}
+
+	client, err := indexHTTPClient(entry)
+	if err != nil {
+		return err
+	}
+	client.Timeout = repositoryCheckTimeout
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 400 && res.StatusCode != http.StatusMethodNotAllowed && res.StatusCode != http.StatusNotImplemented {
+		return fmt.Errorf("HEAD %s: %s", target, res.Status)
+	}
+	return nil
+}
+
+// repositoryCredentials returns the username and password for the repository,
+// read from the Secret referenced by `repository_credentials_secret` when set.
+// The credentials read from the Secret are only used to access the repository
+// and are never stored in the state.
+func repositoryCredentials(d resourceGetter, m *Meta) (string, string, error) {
+	refs := d.Get("repository_credentials_secret").([]interface{})
+	if len(refs) == 0 || refs[0] == nil {
+		return d.Get("repository_username").(string), d.Get("repository_password").(string), nil
+	}
+
+	ref := refs[0].(map[string]interface{})
+	namespace := ref["namespace"].(string)
+
+	cfg, err := m.GetHelmConfiguration(namespace)
+	if err != nil {
+		return "", "", err
+	}
+
+	client, err := cfg.KubernetesClientSet()
+	if err != nil {
+		return "", "", err
+	}
+
+	return secretCredentials(client, namespace, ref["name"].(string))
+}
+
+// secretCredentials returns the values of the username and password keys of
+// the Secret
+func secretCredentials(client kubernetes.Interface, namespace, name string) (string, string, error) {
+	secret, err := client.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return "", "", fmt.Errorf("unable to read the repository credentials from Secret %s/%s: %v", namespace, name, err)
+	}
+
+	missing := []string{}
+	for _, key := range []string{"username", "password"} {
+		if _, ok := secret.Data[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return "", "", fmt.Errorf("the Secret %s/%s holding the repository credentials is missing the keys: %s", namespace, name, strings.Join(missing, ", "))
+	}
+
+	return string(secret.Data["username"]), string(secret.Data["password"]), nil
+}
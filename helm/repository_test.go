@@ -0,0 +1,239 @@
+package helm
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/helmpath"
+	"helm.sh/helm/v3/pkg/repo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCheckChartRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repositories")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	settings := cli.New()
+	settings.RepositoryConfig = filepath.Join(dir, "repositories.yaml")
+	f := repo.NewFile()
+	f.Add(&repo.Entry{Name: "plain", URL: "http://charts.example.com"}, &repo.Entry{Name: "secure", URL: "https://charts.example.com"})
+	if err := f.WriteFile(settings.RepositoryConfig, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		repositoryURL, chartName string
+		plainHTTP                bool
+	}{
+		{"http://charts.example.com", "test-chart", true},
+		{"", "http://charts.example.com/test-chart-1.2.3.tgz", true},
+		{"", "plain/test-chart", true},
+		{"https://charts.example.com", "test-chart", false},
+		{"", "https://charts.example.com/test-chart-1.2.3.tgz", false},
+		{"", "secure/test-chart", false},
+		{"", "unknown/test-chart", false},
+		{"", "testdata/charts/test-chart", false},
+	}
+
+	for _, c := range cases {
+		m := &Meta{Settings: settings}
+		err := checkChartRepository(m, c.repositoryURL, c.chartName)
+		if c.plainHTTP && err == nil {
+			t.Errorf("expected %q %q to be refused without repository_plain_http", c.repositoryURL, c.chartName)
+		}
+		if !c.plainHTTP && err != nil {
+			t.Errorf("expected %q %q to be allowed, got %s", c.repositoryURL, c.chartName, err)
+		}
+
+		m.RepositoryPlainHTTP = true
+		if err := checkChartRepository(m, c.repositoryURL, c.chartName); err != nil {
+			t.Errorf("expected %q %q to be allowed with repository_plain_http, got %s", c.repositoryURL, c.chartName, err)
+		}
+	}
+}
+
+func TestLocateChartStaleIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repositories")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive, err := chartutil.Save(&chart.Chart{
+		Metadata: &chart.Metadata{APIVersion: "v2", Name: "test-chart", Version: "2.0.0"},
+	}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	published := true
+	indexRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.yaml":
+			indexRequests++
+			index := "apiVersion: v1\nentries:\n  test-chart:\n  - name: test-chart\n    version: 1.0.0\n    urls: [test-chart-1.0.0.tgz]\n"
+			if published {
+				index += "  - name: test-chart\n    version: 2.0.0\n    urls: [test-chart-2.0.0.tgz]\n"
+			}
+			w.Write([]byte(index))
+		case "/test-chart-2.0.0.tgz":
+			http.ServeFile(w, r, archive)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	settings := cli.New()
+	settings.RepositoryConfig = filepath.Join(dir, "repositories.yaml")
+	settings.RepositoryCache = filepath.Join(dir, "cache")
+	f := repo.NewFile()
+	f.Add(&repo.Entry{Name: "test", URL: server.URL})
+	if err := f.WriteFile(settings.RepositoryConfig, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the cached index predates the publication of version 2.0.0
+	stale := "apiVersion: v1\nentries:\n  test-chart:\n  - name: test-chart\n    version: 1.0.0\n    urls: [test-chart-1.0.0.tgz]\n"
+	if err := os.MkdirAll(settings.RepositoryCache, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(settings.RepositoryCache, helmpath.CacheIndexFile("test")), []byte(stale), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Meta{Settings: settings, RepositoryPlainHTTP: true}
+	path, err := locateChart(m, "test/test-chart", &action.ChartPathOptions{Version: "2.0.0"})
+	if err != nil {
+		t.Fatalf("expected the chart to be found after refreshing the index, got %s", err)
+	}
+	if filepath.Base(path) != "test-chart-2.0.0.tgz" {
+		t.Errorf("expected version 2.0.0 to be located, got %s", path)
+	}
+	if indexRequests != 1 {
+		t.Errorf("expected the index to be refreshed once, got %d requests", indexRequests)
+	}
+
+	// a version missing from the repository is refreshed only once
+	published = false
+	indexRequests = 0
+	if _, err := locateChart(m, "test/test-chart", &action.ChartPathOptions{Version: "3.0.0"}); err == nil {
+		t.Error("expected an error for a version missing from the repository")
+	}
+	if indexRequests != 1 {
+		t.Errorf("expected the index to be refreshed once, got %d requests", indexRequests)
+	}
+}
+
+func TestSecretCredentials(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "repository", Namespace: "charts"},
+			Data:       map[string][]byte{"username": []byte("admin"), "password": []byte("s3cr3t")},
+		},
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "token", Namespace: "charts"},
+			Data:       map[string][]byte{"token": []byte("abc")},
+		},
+	)
+
+	username, password, err := secretCredentials(client, "charts", "repository")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "admin" || password != "s3cr3t" {
+		t.Errorf("expected the credentials of the Secret, got %q, %q", username, password)
+	}
+
+	_, _, err = secretCredentials(client, "charts", "token")
+	if err == nil || err.Error() != "the Secret charts/token holding the repository credentials is missing the keys: username, password" {
+		t.Errorf("expected the missing keys to be reported, got %v", err)
+	}
+
+	if _, _, err := secretCredentials(client, "charts", "missing"); err == nil {
+		t.Error("expected a missing Secret to be reported")
+	}
+}
+
+func TestCheckRepositoryReachable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repositories")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var heads int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			heads++
+		}
+		if r.URL.Path != "/index.yaml" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	settings := cli.New()
+	settings.RepositoryConfig = filepath.Join(dir, "repositories.yaml")
+	f := repo.NewFile()
+	f.Add(&repo.Entry{Name: "up", URL: server.URL}, &repo.Entry{Name: "down", URL: unreachable.URL})
+	if err := f.WriteFile(settings.RepositoryConfig, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		repositoryURL, chartName string
+		unreachableURL           string
+	}{
+		{server.URL, "test-chart", ""},
+		{"", "up/test-chart", ""},
+		{unreachable.URL, "test-chart", unreachable.URL},
+		{"", "down/test-chart", unreachable.URL},
+		{"", unreachable.URL + "/test-chart-1.2.3.tgz", unreachable.URL},
+		{"", server.URL + "/test-chart-1.2.3.tgz", server.URL},
+		{"", "testdata/charts/test-chart", ""},
+		{"", "unknown/test-chart", ""},
+		{"", "oci://registry.example.com/charts/test-chart", ""},
+	}
+
+	for _, c := range cases {
+		m := &Meta{Settings: settings}
+		err := checkRepositoryReachable(m, &action.ChartPathOptions{RepoURL: c.repositoryURL}, c.chartName)
+		if c.unreachableURL == "" && err != nil {
+			t.Errorf("expected %q %q to be reachable, got %s", c.repositoryURL, c.chartName, err)
+		}
+		if c.unreachableURL != "" && (err == nil || !strings.Contains(err.Error(), "repository "+c.unreachableURL)) {
+			t.Errorf("expected %q %q to be reported unreachable at %s, got %v", c.repositoryURL, c.chartName, c.unreachableURL, err)
+		}
+	}
+
+	// a repository is only checked once per run
+	heads = 0
+	m := &Meta{Settings: settings}
+	for i := 0; i < 3; i++ {
+		if err := checkRepositoryReachable(m, &action.ChartPathOptions{}, "up/test-chart"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if heads != 1 {
+		t.Fatalf("expected the repository to be checked once, got %d requests", heads)
+	}
+}
@@ -2,14 +2,21 @@ package helm
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"text/template"
 	"time"
 
+	"github.com/hashicorp/go-cty/cty"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
@@ -17,39 +24,81 @@ import (
 	"helm.sh/helm/v3/pkg/action"
 	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
 	"helm.sh/helm/v3/pkg/downloader"
+	"helm.sh/helm/v3/pkg/engine"
 	"helm.sh/helm/v3/pkg/getter"
-	"helm.sh/helm/v3/pkg/postrender"
+	"helm.sh/helm/v3/pkg/kube"
 	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/repo"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
 	"helm.sh/helm/v3/pkg/strvals"
+	k8sresource "k8s.io/apimachinery/pkg/api/resource"
+	k8svalidation "k8s.io/apimachinery/pkg/util/validation"
 	"sigs.k8s.io/yaml"
 )
 
 // errReleaseNotFound is the error when a Helm release is not found
 var errReleaseNotFound = errors.New("release not found")
 
+// maxReleaseNameLength is the maximum length of a release name enforced by
+// Helm, so that the names of the objects derived from it remain valid
+const maxReleaseNameLength = 53
+
+// the values of the pending_recovery attribute
+const (
+	pendingRecoveryNone     = "none"
+	pendingRecoveryUpgrade  = "upgrade"
+	pendingRecoveryRollback = "rollback"
+)
+
+// the values of the last_action attribute
+const (
+	lastActionInstall  = "install"
+	lastActionUpgrade  = "upgrade"
+	lastActionRollback = "rollback"
+)
+
 // defaultAttributes release attribute values
 var defaultAttributes = map[string]interface{}{
-	"verify":                     false,
-	"timeout":                    300,
-	"wait":                       true,
-	"wait_for_jobs":              false,
-	"disable_webhooks":           false,
-	"atomic":                     false,
-	"render_subchart_notes":      true,
-	"disable_openapi_validation": false,
-	"disable_crd_hooks":          false,
-	"force_update":               false,
-	"reset_values":               false,
-	"reuse_values":               false,
-	"recreate_pods":              false,
-	"max_history":                0,
-	"skip_crds":                  false,
-	"cleanup_on_fail":            false,
-	"dependency_update":          false,
-	"replace":                    false,
-	"create_namespace":           false,
-	"lint":                       false,
+	"verify":                       false,
+	"timeout":                      300,
+	"wait":                         true,
+	"wait_for_jobs":                false,
+	"readiness_percentage":         100,
+	"disable_webhooks":             false,
+	"atomic":                       false,
+	"render_subchart_notes":        true,
+	"disable_openapi_validation":   false,
+	"disable_crd_hooks":            false,
+	"force_update":                 false,
+	"reset_values":                 false,
+	"reuse_values":                 false,
+	"recreate_pods":                false,
+	"max_history":                  0,
+	"skip_crds":                    false,
+	"skip_kube_version_check":      false,
+	"fail_on_deprecated":           false,
+	"name_max_length":              maxReleaseNameLength,
+	"name_hash_suffix":             false,
+	"strict_value_types":           false,
+	"prune_orphans":                false,
+	"rbac_preflight":               false,
+	"patch_image_pull_secrets":     false,
+	"export_hooks":                 false,
+	"expand_env_in_values":         false,
+	"wait_for_delete_hooks":        false,
+	"force_destroy":                false,
+	"remove_finalizers_on_destroy": false,
+	"cleanup_on_fail":              false,
+	"dependency_update":            false,
+	"replace":                      false,
+	"create_namespace":             false,
+	"lint":                         false,
+	"strict":                       false,
+	"record_created_resources":     false,
+	"check_version_available":      false,
 }
 
 func resourceRelease() *schema.Resource {
@@ -62,43 +111,25 @@ func resourceRelease() *schema.Resource {
 			StateContext: resourceHelmReleaseImportState,
 		},
 		CustomizeDiff: resourceDiff,
-		Schema: map[string]*schema.Schema{
+		Schema: mergeSchemas(repositorySchema(), map[string]*schema.Schema{
 			"name": {
 				Type:        schema.TypeString,
 				Required:    true,
 				ForceNew:    true,
 				Description: "Release name.",
 			},
-			"repository": {
-				Type:        schema.TypeString,
-				Optional:    true,
-				Description: "Repository where to locate the requested chart. If is a URL the chart is installed without installing the repository.",
-			},
-			"repository_key_file": {
-				Type:        schema.TypeString,
-				Optional:    true,
-				Description: "The repositories cert key file",
-			},
-			"repository_cert_file": {
-				Type:        schema.TypeString,
-				Optional:    true,
-				Description: "The repositories cert file",
-			},
-			"repository_ca_file": {
-				Type:        schema.TypeString,
-				Optional:    true,
-				Description: "The Repositories CA File",
-			},
-			"repository_username": {
-				Type:        schema.TypeString,
-				Optional:    true,
-				Description: "Username for HTTP basic authentication",
+			"name_max_length": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      defaultAttributes["name_max_length"],
+				ValidateFunc: validation.IntBetween(10, maxReleaseNameLength),
+				Description:  "Maximum length of the release name, at most 53 characters as enforced by Helm",
 			},
-			"repository_password": {
-				Type:        schema.TypeString,
+			"name_hash_suffix": {
+				Type:        schema.TypeBool,
 				Optional:    true,
-				Sensitive:   true,
-				Description: "Password for HTTP basic authentication",
+				Default:     defaultAttributes["name_hash_suffix"],
+				Description: "Shorten a release name longer than `name_max_length` to fit, replacing its end by a hash of the name",
 			},
 			"chart": {
 				Type:        schema.TypeString,
@@ -126,6 +157,76 @@ func resourceRelease() *schema.Resource {
 				Description: "List of values in raw yaml format to pass to helm.",
 				Elem:        &schema.Schema{Type: schema.TypeString},
 			},
+			"image_pull_secrets": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "Names of the image pull secrets set in the imagePullSecrets and global.imagePullSecrets values",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+			"patch_image_pull_secrets": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     defaultAttributes["patch_image_pull_secrets"],
+				Description: "Add image_pull_secrets to the pods and ServiceAccounts of the rendered manifests that do not set imagePullSecrets",
+			},
+			"expand_env_in_values": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     defaultAttributes["expand_env_in_values"],
+				Description: "Expand the ${VAR} references to environment variables of the provider in values, values_by_workspace, set and set_sensitive. Only the variables listed in expand_env_allowlist can be referenced",
+			},
+			"expand_env_allowlist": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "Names of the environment variables values can reference when expand_env_in_values is set",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+			"values_by_workspace": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Description: "Map of values in raw yaml format keyed by Terraform workspace, the values of the current workspace, or else of the `default` key, being merged after `values`.",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+			"set_map": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Description: "Map of values to pass to helm, keyed by the dotted path of the value as in `set`.",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+			"resources": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "Resource requests and limits to pass to helm, at the `requests` and `limits` keys of the values path `path_prefix.path`.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"path_prefix": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Values path prefixed to `path`, such as the name of a subchart.",
+						},
+						"path": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Default:     "resources",
+							Description: "Values path of the resources, as in `set`.",
+						},
+						"requests": {
+							Type:        schema.TypeList,
+							Optional:    true,
+							MaxItems:    1,
+							Description: "Resource requests.",
+							Elem:        resourceQuantitiesSchema(),
+						},
+						"limits": {
+							Type:        schema.TypeList,
+							Optional:    true,
+							MaxItems:    1,
+							Description: "Resource limits.",
+							Elem:        resourceQuantitiesSchema(),
+						},
+					},
+				},
+			},
 			"set": {
 				Type:        schema.TypeSet,
 				Optional:    true,
@@ -178,11 +279,12 @@ func resourceRelease() *schema.Resource {
 				},
 			},
 			"namespace": {
-				Type:        schema.TypeString,
-				Optional:    true,
-				ForceNew:    true,
-				Description: "Namespace to install the release into.",
-				DefaultFunc: schema.EnvDefaultFunc("HELM_NAMESPACE", "default"),
+				Type:             schema.TypeString,
+				Optional:         true,
+				ForceNew:         true,
+				Description:      "Namespace to install the release into.",
+				DefaultFunc:      schema.EnvDefaultFunc("HELM_NAMESPACE", "default"),
+				ValidateDiagFunc: validateNamespace,
 			},
 			"verify": {
 				Type:        schema.TypeBool,
@@ -200,6 +302,15 @@ func resourceRelease() *schema.Resource {
 					return !d.Get("verify").(bool)
 				},
 			},
+			"keyring_url": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "HTTPS URL of the public keys used for verification. The keys are fetched and cached, and take precedence over `keyring`. Used only if `verify` is true",
+				// Suppress changes of this attribute if `verify` is false
+				DiffSuppressFunc: func(k, old, new string, d *schema.ResourceData) bool {
+					return !d.Get("verify").(bool)
+				},
+			},
 			"timeout": {
 				Type:        schema.TypeInt,
 				Optional:    true,
@@ -218,16 +329,40 @@ func resourceRelease() *schema.Resource {
 				Default:     defaultAttributes["disable_crd_hooks"],
 				Description: "Prevent CRD hooks from, running, but run other hooks.  See helm install --no-crd-hook",
 			},
+			"non_fatal_hooks": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "Names or template paths of post-install and post-upgrade hooks whose failure does not fail the release",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+			"hook_weights": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Description: "Weights overriding the helm.sh/hook-weight annotation of hooks, keyed by the name or the template path of the hook",
+				Elem:        &schema.Schema{Type: schema.TypeInt},
+			},
+			"export_hooks": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     defaultAttributes["export_hooks"],
+				Description: "Do not run the hooks of the chart, only install its other resources, and export the rendered hooks in rendered_hooks to run them externally",
+			},
+			"rendered_hooks": {
+				Type:        schema.TypeMap,
+				Computed:    true,
+				Description: "The rendered manifests of the hooks of the release keyed by hook event, e.g. pre-install, when export_hooks is set",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
 			"reuse_values": {
 				Type:        schema.TypeBool,
 				Optional:    true,
-				Description: "When upgrading, reuse the last release's values and merge in any overrides. If 'reset_values' is specified, this is ignored",
+				Description: "When upgrading, reuse the last release's values and merge in any overrides. Cannot be set with 'reset_values'",
 				Default:     defaultAttributes["reuse_values"],
 			},
 			"reset_values": {
 				Type:        schema.TypeBool,
 				Optional:    true,
-				Description: "When upgrading, reset the values to the ones built into the chart",
+				Description: "When upgrading, reset the values to the ones built into the chart. Cannot be set with 'reuse_values'",
 				Default:     defaultAttributes["reset_values"],
 			},
 			"force_update": {
@@ -248,6 +383,13 @@ func resourceRelease() *schema.Resource {
 				Default:     defaultAttributes["cleanup_on_fail"],
 				Description: "Allow deletion of new resources created in this upgrade when upgrade fails",
 			},
+			"pending_recovery": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      pendingRecoveryNone,
+				ValidateFunc: validation.StringInSlice([]string{pendingRecoveryNone, pendingRecoveryUpgrade, pendingRecoveryRollback}, false),
+				Description:  "How to recover a release left in a pending state by an interrupted operation before upgrading it: none, upgrade or rollback",
+			},
 			"max_history": {
 				Type:        schema.TypeInt,
 				Optional:    true,
@@ -266,6 +408,36 @@ func resourceRelease() *schema.Resource {
 				Default:     defaultAttributes["skip_crds"],
 				Description: "If set, no CRDs will be installed. By default, CRDs are installed if not already present",
 			},
+			"skip_kube_version_check": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     defaultAttributes["skip_kube_version_check"],
+				Description: "If set, the kubeVersion constraint of the chart is not checked against the Kubernetes version",
+			},
+			"render_time": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Time returned by the `now` template function, in RFC 3339 format, to render the chart deterministically",
+				ValidateFunc: validation.IsRFC3339Time,
+			},
+			"fail_on_deprecated": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     defaultAttributes["fail_on_deprecated"],
+				Description: "Fail if the chart is marked as deprecated",
+			},
+			"strict_value_types": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     defaultAttributes["strict_value_types"],
+				Description: "Fail if the type of a value set on the release differs from the type of the default value of the chart",
+			},
+			"strict": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     defaultAttributes["strict"],
+				Description: "Fail when the templates of the chart reference missing values, rather than rendering them empty",
+			},
 			"render_subchart_notes": {
 				Type:        schema.TypeBool,
 				Optional:    true,
@@ -290,11 +462,92 @@ func resourceRelease() *schema.Resource {
 				Default:     defaultAttributes["wait_for_jobs"],
 				Description: "If wait is enabled, will wait until all Jobs have been completed before marking the release as successful.",
 			},
+			"readiness_percentage": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      defaultAttributes["readiness_percentage"],
+				Description:  "If wait is enabled and this is below 100, only wait until this percentage of the replicas of each Deployment is available.",
+				ValidateFunc: validation.IntBetween(1, 100),
+			},
+			"qps": {
+				Type:         schema.TypeFloat,
+				Optional:     true,
+				Description:  "Maximum queries per second to the Kubernetes API of the operations on the release, overriding the client default",
+				ValidateFunc: validation.FloatAtLeast(1),
+			},
+			"burst": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Description:  "Maximum burst of queries to the Kubernetes API of the operations on the release, overriding the client default",
+				ValidateFunc: validation.IntAtLeast(1),
+			},
+			"wait_for_crds": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "Names of CRDs, e.g. installed by another release, to wait for, for at most `timeout` seconds, until they are established before the install or upgrade",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+			"wait_for_condition": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Description: "Wait, for at most `timeout` seconds after the install or upgrade, until a resource reports a condition with the given status, such as a custom resource reconciled by an operator.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"api_version": {
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "API version of the resource, e.g. example.com/v1",
+						},
+						"kind": {
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "Kind of the resource",
+						},
+						"name": {
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "Name of the resource",
+						},
+						"namespace": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Namespace of the resource. Defaults to the namespace of the release for namespaced resources.",
+						},
+						"condition_type": {
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "Type of the condition in status.conditions, e.g. Ready",
+						},
+						"status": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Default:     "True",
+							Description: "Status of the condition to wait for",
+						},
+					},
+				},
+			},
 			"status": {
 				Type:        schema.TypeString,
 				Computed:    true,
 				Description: "Status of the release.",
 			},
+			"version_current": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The version of the chart deployed by the release.",
+			},
+			"version_available": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The latest version of the chart published in its repository, when `check_version_available` is set. Informational only, it does not trigger upgrades.",
+			},
+			"check_version_available": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     defaultAttributes["check_version_available"],
+				Description: "Look up the latest version of the chart in the index of its repository on every refresh, to report it in `version_available`",
+			},
 			"dependency_update": {
 				Type:        schema.TypeBool,
 				Optional:    true,
@@ -315,6 +568,11 @@ func resourceRelease() *schema.Resource {
 					return new == ""
 				},
 			},
+			"change_cause": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Value of the kubernetes.io/change-cause annotation set on the Deployments, StatefulSets and DaemonSets of the release, shown by `kubectl rollout history`",
+			},
 			"create_namespace": {
 				Type:        schema.TypeBool,
 				Optional:    true,
@@ -336,6 +594,63 @@ func resourceRelease() *schema.Resource {
 					},
 				},
 			},
+			"include": resourceSelectorSchema("Only the rendered resources matching the selector are managed by the release"),
+			"exclude": resourceSelectorSchema("The rendered resources matching the selector are not managed by the release"),
+			"policy": {
+				Type:        schema.TypeList,
+				MaxItems:    1,
+				Optional:    true,
+				Description: "Rego policies the rendered manifests are evaluated against with conftest during the plan, install and upgrade",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"path": {
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "Path to the policy file or directory.",
+						},
+						"namespace": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Default:     "main",
+							Description: "Rego package of the policies.",
+						},
+						"binary_path": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Default:     "conftest",
+							Description: "The conftest binary path.",
+						},
+						"timeout": {
+							Type:         schema.TypeInt,
+							Optional:     true,
+							Default:      30,
+							ValidateFunc: validation.IntAtLeast(1),
+							Description:  "Time in seconds the evaluation of the policies can take.",
+						},
+					},
+				},
+			},
+			"deprecated_api_check": {
+				Type:        schema.TypeList,
+				MaxItems:    1,
+				Optional:    true,
+				Description: "Check the API versions of the rendered manifests for deprecated and removed Kubernetes APIs during the plan",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"kube_version": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Kubernetes version to check against, e.g. 1.22. Defaults to the version and the API versions of the cluster.",
+						},
+						"fail_on_removed": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Default:     true,
+							Description: "Fail the plan on API versions removed from the Kubernetes version, instead of logging a warning.",
+						},
+					},
+				},
+			},
 			"lint": {
 				Type:        schema.TypeBool,
 				Optional:    true,
@@ -347,57 +662,272 @@ func resourceRelease() *schema.Resource {
 				Description: "The rendered manifest as JSON.",
 				Computed:    true,
 			},
-			"metadata": {
+			"disable_hooks": {
+				Type:        schema.TypeSet,
+				Optional:    true,
+				Description: "Hook events whose hooks are not run, e.g. pre-delete. Finer grained than disable_webhooks",
+				Elem: &schema.Schema{
+					Type:         schema.TypeString,
+					ValidateFunc: validation.StringInSlice(hookEvents, false),
+				},
+			},
+			"release_storage_namespace": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				ForceNew:         true,
+				Description:      "Namespace to store the release in, defaults to the namespace of the release",
+				ValidateDiagFunc: validateNamespace,
+			},
+			"rbac_preflight": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     defaultAttributes["rbac_preflight"],
+				Description: "Check that the current user is allowed to create and update the resources of the release before installing or upgrading it",
+			},
+			"wait_for_delete_hooks": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     defaultAttributes["wait_for_delete_hooks"],
+				Description: "On destroy, wait for the delete hooks, such as pre-delete Jobs, to complete for at most `timeout` seconds before removing the resources of the release",
+			},
+			"force_destroy": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     defaultAttributes["force_destroy"],
+				Description: "On destroy, retry a failed uninstall without running the hooks, and uninstall a release left uninstalling by a previous destroy without running the hooks",
+			},
+			"remove_finalizers_on_destroy": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     defaultAttributes["remove_finalizers_on_destroy"],
+				Description: "On destroy, remove the finalizers of the objects of the release still terminating after timeout seconds, so that the destroy completes",
+			},
+			"prune_orphans": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     defaultAttributes["prune_orphans"],
+				Description: "After a successful upgrade, delete the resources of the previous revision that are no longer part of the release",
+			},
+			"values_json": {
+				Type:        schema.TypeString,
+				Description: "The values applied to the release as JSON.",
+				Computed:    true,
+				Sensitive:   true,
+			},
+			"coalesced_values": {
+				Type:        schema.TypeString,
+				Description: "The values of the release coalesced with the default values of the chart and its subcharts, as JSON.",
+				Computed:    true,
+				Sensitive:   true,
+			},
+			"storage": {
 				Type:        schema.TypeList,
 				Computed:    true,
-				Description: "Status of the deployed release.",
+				Description: "Location of the release record in the Helm storage backend.",
 				Elem: &schema.Resource{
 					Schema: map[string]*schema.Schema{
+						"driver": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The Helm storage driver.",
+						},
+						"namespace": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The namespace of the release record.",
+						},
 						"name": {
 							Type:        schema.TypeString,
 							Computed:    true,
-							Description: "Name is the name of the release.",
+							Description: "The name of the object storing the current revision of the release.",
 						},
-						"revision": {
-							Type:        schema.TypeInt,
+					},
+				},
+			},
+			"last_action": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "The last action Terraform performed on the release: install, upgrade or rollback",
+			},
+			"record_created_resources": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     defaultAttributes["record_created_resources"],
+				Description: "Read the objects of the release from the cluster after each install and upgrade to report them in `created_resources`",
+			},
+			"created_resources": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "The objects of the release as read from the cluster after the last install or upgrade, when `record_created_resources` is set.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"api_version": {
+							Type:        schema.TypeString,
 							Computed:    true,
-							Description: "Version is an int32 which represents the version of the release.",
+							Description: "The API version of the object.",
+						},
+						"kind": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The kind of the object.",
 						},
 						"namespace": {
 							Type:        schema.TypeString,
 							Computed:    true,
-							Description: "Namespace is the kubernetes namespace of the release.",
+							Description: "The namespace of the object, empty for cluster scoped objects.",
 						},
-						"chart": {
+						"name": {
 							Type:        schema.TypeString,
 							Computed:    true,
-							Description: "The name of the chart.",
+							Description: "The name of the object.",
 						},
-						"version": {
+						"uid": {
 							Type:        schema.TypeString,
 							Computed:    true,
-							Description: "A SemVer 2 conformant version string of the chart.",
+							Description: "The UID of the object.",
 						},
-						"app_version": {
+					},
+				},
+			},
+			"hook_results": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "The hooks run by the last operation on the release, test hooks excluded.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": {
 							Type:        schema.TypeString,
 							Computed:    true,
-							Description: "The version number of the application being deployed.",
+							Description: "The name of the hook resource.",
 						},
-						"values": {
+						"kind": {
 							Type:        schema.TypeString,
 							Computed:    true,
-							Description: "Set of extra values, added to the chart. The sensitive data is cloaked. JSON encoded.",
+							Description: "The kind of the hook resource.",
+						},
+						"events": {
+							Type:        schema.TypeList,
+							Computed:    true,
+							Description: "The events the hook runs on.",
+							Elem:        &schema.Schema{Type: schema.TypeString},
+						},
+						"phase": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The outcome of the last run of the hook.",
+						},
+						"last_run": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The time the last run of the hook completed, in RFC 3339 format.",
 						},
 					},
 				},
 			},
-		},
-	}
-}
-
-func resourceReleaseRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
-	exists, err := resourceReleaseExists(d, meta)
-	if err != nil {
+			"dependencies": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "The dependencies of the deployed chart, with their resolved versions.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The name of the dependency.",
+						},
+						"version": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The resolved version of the dependency.",
+						},
+						"repository": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The repository of the dependency.",
+						},
+					},
+				},
+			},
+			"get": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "Information of the deployed release, as returned by helm get.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"hooks": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The hooks of the release.",
+						},
+						"manifest": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The rendered manifest of the release.",
+						},
+						"values": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Sensitive:   true,
+							Description: "The values supplied to the release as YAML.",
+						},
+					},
+				},
+			},
+			"metadata": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "Status of the deployed release.",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "Name is the name of the release.",
+						},
+						"revision": {
+							Type:        schema.TypeInt,
+							Computed:    true,
+							Description: "Version is an int32 which represents the version of the release.",
+						},
+						"namespace": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "Namespace is the kubernetes namespace of the release.",
+						},
+						"chart": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The name of the chart.",
+						},
+						"version": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "A SemVer 2 conformant version string of the chart.",
+						},
+						"app_version": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "The version number of the application being deployed.",
+						},
+						"values": {
+							Type:        schema.TypeString,
+							Computed:    true,
+							Description: "Set of extra values, added to the chart. The sensitive data is cloaked. JSON encoded.",
+						},
+					},
+				},
+			},
+		}),
+	}
+}
+
+func resourceReleaseRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	if err := meta.(*Meta).stagger(ctx); err != nil {
+		return diag.FromErr(err)
+	}
+
+	exists, err := resourceReleaseExists(d, meta)
+	if err != nil {
 		return diag.FromErr(err)
 	}
 
@@ -412,12 +942,12 @@ func resourceReleaseRead(ctx context.Context, d *schema.ResourceData, meta inter
 	m := meta.(*Meta)
 	n := d.Get("namespace").(string)
 
-	c, err := m.GetHelmConfiguration(n)
+	c, err := getReleaseHelmConfiguration(m, d, n)
 	if err != nil {
 		return diag.FromErr(err)
 	}
 
-	name := d.Get("name").(string)
+	name := releaseName(d)
 	r, err := getRelease(m, c, name)
 	if err != nil {
 		return diag.FromErr(err)
@@ -430,6 +960,16 @@ func resourceReleaseRead(ctx context.Context, d *schema.ResourceData, meta inter
 
 	debug("%s Done", logID)
 
+	if r.Info.Status.IsPending() {
+		return diag.Diagnostics{
+			{
+				Severity: diag.Warning,
+				Summary:  fmt.Sprintf("Helm release %q is in state %s", name, r.Info.Status),
+				Detail:   "The release was left pending by an interrupted or concurrent operation, and Helm refuses to upgrade it. Set pending_recovery to recover it on the next apply.",
+			},
+		}
+	}
+
 	return nil
 }
 
@@ -450,6 +990,9 @@ func checkChartDependencies(d resourceGetter, c *chart.Chart, path string, m *Me
 					RepositoryCache:  m.Settings.RepositoryCache,
 					Debug:            m.Settings.Debug,
 				}
+				if err := checkDependencyRepositories(c, m); err != nil {
+					return false, err
+				}
 				log.Println("[DEBUG] Downloading chart dependencies...")
 				return true, man.Update()
 			}
@@ -461,7 +1004,40 @@ func checkChartDependencies(d resourceGetter, c *chart.Chart, path string, m *Me
 	return false, nil
 }
 
+// checkDependencyRepositories returns an error explaining how to make the
+// repositories of the dependencies referenced by name, e.g. "@example", known
+// to the provider when they are not defined in its repositories file, since
+// the error of Helm refers to `helm repo add`
+func checkDependencyRepositories(c *chart.Chart, m *Meta) error {
+	f, err := repo.LoadFile(m.Settings.RepositoryConfig)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return err
+	}
+
+	missing := []string{}
+	for _, dep := range c.Metadata.Dependencies {
+		name := ""
+		if strings.HasPrefix(dep.Repository, "@") {
+			name = strings.TrimPrefix(dep.Repository, "@")
+		} else if strings.HasPrefix(dep.Repository, "alias:") {
+			name = strings.TrimPrefix(dep.Repository, "alias:")
+		}
+		if name != "" && (f == nil || !f.Has(name)) {
+			missing = append(missing, dep.Repository)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	return errors.Errorf("unable to update the dependencies of chart %q, no repository definition for %s: the repositories of dependencies referenced by name, e.g. \"@example\", must be defined in the repositories file of the provider, %s, set by repository_config_path, otherwise the dependencies must use the URL of their repository", c.Name(), strings.Join(missing, ", "), m.Settings.RepositoryConfig)
+}
+
 func resourceReleaseCreate(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	if err := meta.(*Meta).stagger(ctx); err != nil {
+		return diag.FromErr(err)
+	}
+
 	logID := fmt.Sprintf("[resourceReleaseCreate: %s]", d.Get("name").(string))
 	debug("%s Started", logID)
 
@@ -469,10 +1045,14 @@ func resourceReleaseCreate(ctx context.Context, d *schema.ResourceData, meta int
 	n := d.Get("namespace").(string)
 
 	debug("%s Getting helm configuration", logID)
-	actionConfig, err := m.GetHelmConfiguration(n)
+	actionConfig, err := getReleaseHelmConfiguration(m, d, n)
 	if err != nil {
 		return diag.FromErr(err)
 	}
+	// the logger is set on the Kubernetes client before it is wrapped
+	redactLogs(actionConfig, d)
+	disableHooks(actionConfig, d, release.HookPreInstall, release.HookPostInstall)
+	reweightHooks(actionConfig, d)
 
 	cpo, chartName, err := chartPathOptions(d, m)
 	if err != nil {
@@ -508,18 +1088,37 @@ func resourceReleaseCreate(ctx context.Context, d *schema.ResourceData, meta int
 		return diag.FromErr(err)
 	}
 
+	if err := checkChartDeprecated(d, c); err != nil {
+		return diag.FromErr(err)
+	}
+
+	if err := checkValueTypes(d, c, values); err != nil {
+		return diag.FromErr(err)
+	}
+
+	if err := checkStrictRendering(d, c, releaseName(d), values); err != nil {
+		return diag.FromErr(err)
+	}
+
+	if err := checkReleaseNameLength(d); err != nil {
+		return diag.FromErr(err)
+	}
+
 	client := action.NewInstall(actionConfig)
 	client.ChartPathOptions = *cpo
 	client.ClientOnly = false
 	client.DryRun = false
-	client.DisableHooks = d.Get("disable_webhooks").(bool)
+	client.DisableHooks = d.Get("disable_webhooks").(bool) || d.Get("export_hooks").(bool)
 	client.Wait = d.Get("wait").(bool)
+	if isPartialReadinessWait(d) {
+		skipDeploymentsWait(actionConfig)
+	}
 	client.WaitForJobs = d.Get("wait_for_jobs").(bool)
 	client.Devel = d.Get("devel").(bool)
 	client.DependencyUpdate = d.Get("dependency_update").(bool)
 	client.Timeout = time.Duration(d.Get("timeout").(int)) * time.Second
 	client.Namespace = d.Get("namespace").(string)
-	client.ReleaseName = d.Get("name").(string)
+	client.ReleaseName = releaseName(d)
 	client.GenerateName = false
 	client.NameTemplate = ""
 	client.OutputDir = ""
@@ -531,19 +1130,55 @@ func resourceReleaseCreate(ctx context.Context, d *schema.ResourceData, meta int
 	client.Description = d.Get("description").(string)
 	client.CreateNamespace = d.Get("create_namespace").(bool)
 
-	if cmd := d.Get("postrender.0.binary_path").(string); cmd != "" {
-		pr, err := postrender.NewExec(cmd)
+	client.Description, err = releaseDescription(client.Description, c)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	client.PostRenderer, err = releasePostRenderer(d)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	if pc := newPolicyChecker(d); pc != nil {
+		client.PostRenderer = chainPostRenderers(client.PostRenderer, pc)
+	}
 
+	if d.Get("rbac_preflight").(bool) {
+		p, err := newRBACPreflight(ctx, actionConfig, client.Namespace, "create")
 		if err != nil {
 			return diag.FromErr(err)
 		}
+		client.PostRenderer = chainPostRenderers(client.PostRenderer, p)
+	}
 
-		client.PostRenderer = pr
+	if err := waitForCRDs(ctx, d, actionConfig); err != nil {
+		return diag.FromErr(err)
 	}
 
 	debug("%s Installing chart", logID)
 
+	skipKubeVersionCheck(d, c)
+	if err := pinRenderTime(d, c); err != nil {
+		return diag.FromErr(err)
+	}
+
+	if d.Get("create_namespace").(bool) {
+		if err := createChartNamespaces(ctx, d, actionConfig, m.ProtectedNamespaces, c, cpo, values); err != nil {
+			return diag.FromErr(err)
+		}
+	}
+
+	start := time.Now()
 	rel, err := client.Run(c, values)
+	m.logHelmCall("install", client.Namespace, client.ReleaseName, start, err)
+	err = describeWaitTimeout(ctx, d, actionConfig, rel, err)
+	err = redactError(d, rel, err)
+
+	var diags diag.Diagnostics
+	if err != nil && rel != nil {
+		diags, err = ignoreNonFatalHookFailure(d, actionConfig, rel, err)
+	}
 
 	if err != nil && rel == nil {
 		return diag.FromErr(err)
@@ -566,6 +1201,10 @@ func resourceReleaseCreate(ctx context.Context, d *schema.ResourceData, meta int
 			return diag.FromErr(err)
 		}
 
+		if err := d.Set("last_action", lastActionInstall); err != nil {
+			return diag.FromErr(err)
+		}
+
 		return diag.Diagnostics{
 			{
 				Severity: diag.Warning,
@@ -583,37 +1222,47 @@ func resourceReleaseCreate(ctx context.Context, d *schema.ResourceData, meta int
 	if err != nil {
 		return diag.FromErr(err)
 	}
-	return nil
-}
 
-func resourceReleaseUpdate(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
-	m := meta.(*Meta)
-	n := d.Get("namespace").(string)
-	actionConfig, err := m.GetHelmConfiguration(n)
-	if err != nil {
+	if err := d.Set("last_action", lastActionInstall); err != nil {
 		return diag.FromErr(err)
 	}
 
-	cpo, chartName, err := chartPathOptions(d, m)
-	if err != nil {
+	if err := setCreatedResources(d, actionConfig, rel); err != nil {
 		return diag.FromErr(err)
 	}
 
-	c, path, err := getChart(d, m, chartName, cpo)
+	if isPartialReadinessWait(d) {
+		if err := waitForPartialReadiness(ctx, d, actionConfig, rel); err != nil {
+			return append(diags, diag.FromErr(err)...)
+		}
+	}
+
+	if err := waitForReleaseConditions(ctx, d, actionConfig, rel); err != nil {
+		return append(diags, diag.FromErr(err)...)
+	}
+
+	return diags
+}
+
+func resourceReleaseUpdate(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	if err := meta.(*Meta).stagger(ctx); err != nil {
+		return diag.FromErr(err)
+	}
+
+	m := meta.(*Meta)
+	n := d.Get("namespace").(string)
+	actionConfig, err := getReleaseHelmConfiguration(m, d, n)
 	if err != nil {
 		return diag.FromErr(err)
 	}
+	// the logger is set on the Kubernetes client before it is wrapped
+	redactLogs(actionConfig, d)
+	disableHooks(actionConfig, d, release.HookPreUpgrade, release.HookPostUpgrade, release.HookPreRollback, release.HookPostRollback)
+	reweightHooks(actionConfig, d)
 
-	// check and update the chart's dependencies if needed
-	updated, err := checkChartDependencies(d, c, path, m)
+	c, cpo, err := upgradeChart(d, m, actionConfig)
 	if err != nil {
 		return diag.FromErr(err)
-	} else if updated {
-		// load the chart again if its dependencies have been updated
-		c, err = loader.Load(path)
-		if err != nil {
-			return diag.FromErr(err)
-		}
 	}
 
 	client := action.NewUpgrade(actionConfig)
@@ -622,9 +1271,12 @@ func resourceReleaseUpdate(ctx context.Context, d *schema.ResourceData, meta int
 	client.Namespace = d.Get("namespace").(string)
 	client.Timeout = time.Duration(d.Get("timeout").(int)) * time.Second
 	client.Wait = d.Get("wait").(bool)
+	if isPartialReadinessWait(d) {
+		skipDeploymentsWait(actionConfig)
+	}
 	client.WaitForJobs = d.Get("wait_for_jobs").(bool)
 	client.DryRun = false
-	client.DisableHooks = d.Get("disable_webhooks").(bool)
+	client.DisableHooks = d.Get("disable_webhooks").(bool) || d.Get("export_hooks").(bool)
 	client.Atomic = d.Get("atomic").(bool)
 	client.SkipCRDs = d.Get("skip_crds").(bool)
 	client.SubNotes = d.Get("render_subchart_notes").(bool)
@@ -636,14 +1288,26 @@ func resourceReleaseUpdate(ctx context.Context, d *schema.ResourceData, meta int
 	client.CleanupOnFail = d.Get("cleanup_on_fail").(bool)
 	client.Description = d.Get("description").(string)
 
-	if cmd := d.Get("postrender.0.binary_path").(string); cmd != "" {
-		pr, err := postrender.NewExec(cmd)
+	client.Description, err = releaseDescription(client.Description, c)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	client.PostRenderer, err = releasePostRenderer(d)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	if pc := newPolicyChecker(d); pc != nil {
+		client.PostRenderer = chainPostRenderers(client.PostRenderer, pc)
+	}
 
+	if d.Get("rbac_preflight").(bool) {
+		p, err := newRBACPreflight(ctx, actionConfig, client.Namespace, "create", "patch")
 		if err != nil {
 			return diag.FromErr(err)
 		}
-
-		client.PostRenderer = pr
+		client.PostRenderer = chainPostRenderers(client.PostRenderer, p)
 	}
 
 	values, err := getValues(d)
@@ -651,9 +1315,63 @@ func resourceReleaseUpdate(ctx context.Context, d *schema.ResourceData, meta int
 		return diag.FromErr(err)
 	}
 
-	name := d.Get("name").(string)
+	if err := checkChartDeprecated(d, c); err != nil {
+		return diag.FromErr(err)
+	}
+
+	if err := checkValueTypes(d, c, values); err != nil {
+		return diag.FromErr(err)
+	}
+
+	if err := checkStrictRendering(d, c, releaseName(d), values); err != nil {
+		return diag.FromErr(err)
+	}
+
+	name := releaseName(d)
+	skipKubeVersionCheck(d, c)
+	if err := pinRenderTime(d, c); err != nil {
+		return diag.FromErr(err)
+	}
+
+	// keep the manifest of the last revision, since it is the one that can
+	// have left orphans behind if its upgrade was interrupted
+	var previousManifest string
+	if d.Get("prune_orphans").(bool) {
+		last, err := actionConfig.Releases.Last(name)
+		if err != nil {
+			return diag.FromErr(err)
+		}
+		previousManifest = last.Manifest
+	}
+
+	if err := recoverPendingRelease(d, actionConfig, name); err != nil {
+		return diag.FromErr(err)
+	}
+
+	if err := waitForCRDs(ctx, d, actionConfig); err != nil {
+		return diag.FromErr(err)
+	}
+
+	if d.Get("create_namespace").(bool) {
+		if err := createChartNamespaces(ctx, d, actionConfig, m.ProtectedNamespaces, c, cpo, values); err != nil {
+			return diag.FromErr(err)
+		}
+	}
+
+	start := time.Now()
 	r, err := client.Run(name, c, values)
+	m.logHelmCall("upgrade", client.Namespace, name, start, err)
+	err = describeWaitTimeout(ctx, d, actionConfig, r, err)
+	err = redactError(d, r, err)
+
+	var diags diag.Diagnostics
+	if err != nil && r != nil {
+		diags, err = ignoreNonFatalHookFailure(d, actionConfig, r, err)
+	}
 	if err != nil {
+		if client.Atomic && isRolledBack(actionConfig, name) {
+			d.Set("last_action", lastActionRollback)
+		}
 		return diag.FromErr(err)
 	}
 
@@ -661,22 +1379,160 @@ func resourceReleaseUpdate(ctx context.Context, d *schema.ResourceData, meta int
 	if err != nil {
 		return diag.FromErr(err)
 	}
-	return nil
+
+	if err := d.Set("last_action", lastActionUpgrade); err != nil {
+		return diag.FromErr(err)
+	}
+
+	if err := setCreatedResources(d, actionConfig, r); err != nil {
+		return diag.FromErr(err)
+	}
+
+	if d.Get("prune_orphans").(bool) {
+		if err := pruneOrphans(actionConfig, previousManifest, r); err != nil {
+			return append(diags, diag.FromErr(err)...)
+		}
+	}
+
+	if isPartialReadinessWait(d) {
+		if err := waitForPartialReadiness(ctx, d, actionConfig, r); err != nil {
+			return append(diags, diag.FromErr(err)...)
+		}
+	}
+
+	if err := waitForReleaseConditions(ctx, d, actionConfig, r); err != nil {
+		return append(diags, diag.FromErr(err)...)
+	}
+
+	return diags
+}
+
+// isPartialReadinessWait returns true if the release should be considered
+// ready when only a percentage of the replicas of its Deployments are available,
+// in which case its Deployments are waited for by the provider instead of by
+// Helm
+func isPartialReadinessWait(d resourceGetter) bool {
+	return d.Get("wait").(bool) && !d.Get("atomic").(bool) && d.Get("readiness_percentage").(int) < 100
+}
+
+func waitForPartialReadiness(ctx context.Context, d resourceGetter, cfg *action.Configuration, r *release.Release) error {
+	client, err := cfg.KubernetesClientSet()
+	if err != nil {
+		return err
+	}
+
+	timeout := time.Duration(d.Get("timeout").(int)) * time.Second
+	return waitForDeploymentsAvailable(ctx, client, r.Namespace, r.Manifest, d.Get("readiness_percentage").(int), timeout)
+}
+
+// upgradeChart returns the chart the release is upgraded to. When only the
+// values change, the chart stored with the deployed release is reused instead
+// of resolving and downloading it from the repository again.
+func upgradeChart(d resourceChangeGetter, m *Meta, cfg *action.Configuration) (*chart.Chart, *action.ChartPathOptions, error) {
+	if isValuesOnlyUpdate(d) {
+		debug("[resourceReleaseUpdate: %s] Reusing the installed chart", d.Get("name").(string))
+		r, err := getRelease(m, cfg, releaseName(d))
+		if err != nil {
+			return nil, nil, err
+		}
+		return r.Chart, &action.ChartPathOptions{}, nil
+	}
+
+	cpo, chartName, err := chartPathOptions(d, m)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, path, err := getChart(d, m, chartName, cpo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// check and update the chart's dependencies if needed
+	updated, err := checkChartDependencies(d, c, path, m)
+	if err != nil {
+		return nil, nil, err
+	} else if updated {
+		// load the chart again if its dependencies have been updated
+		c, err = loader.Load(path)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return c, cpo, nil
+}
+
+// ignoreNonFatalHookFailure marks the release as deployed when the error
+// returned by an install or upgrade was only caused by hooks listed in
+// `non_fatal_hooks`, returning a warning for each of the failed hooks and for
+// each of the hooks Helm skipped after them. Otherwise the original error is
+// returned.
+func ignoreNonFatalHookFailure(d resourceGetter, cfg *action.Configuration, rel *release.Release, runErr error) (diag.Diagnostics, error) {
+	// with atomic or cleanup_on_fail Helm has already reverted the release
+	if d.Get("atomic").(bool) || d.Get("cleanup_on_fail").(bool) {
+		return nil, runErr
+	}
+
+	hooks, ok := nonFatalHookFailure(rel, expandStringSlice(d.Get("non_fatal_hooks").([]interface{})))
+	if !ok {
+		return nil, runErr
+	}
+
+	if err := markReleaseDeployed(cfg, rel, hooks); err != nil {
+		return nil, err
+	}
+
+	diags := diag.Diagnostics{}
+	for _, h := range hooks {
+		log.Printf("[WARN] Ignoring failure of non-fatal hook %q of release %q", h.Name, rel.Name)
+		diags = append(diags, diag.Diagnostic{
+			Severity: diag.Warning,
+			Summary:  fmt.Sprintf("Non-fatal hook %q of release %q failed", h.Name, rel.Name),
+			Detail:   runErr.Error(),
+		})
+	}
+
+	for _, h := range skippedHooks(rel, hooks) {
+		log.Printf("[WARN] Hook %q of release %q was skipped after the failure of a non-fatal hook", h.Name, rel.Name)
+		diags = append(diags, diag.Diagnostic{
+			Severity: diag.Warning,
+			Summary:  fmt.Sprintf("Hook %q of release %q was not run", h.Name, rel.Name),
+			Detail:   "Helm stops running the hooks of an event at the first failure, the hooks following a failed non-fatal hook are skipped.",
+		})
+	}
+	return diags, nil
 }
 
 func resourceReleaseDelete(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	if err := meta.(*Meta).stagger(ctx); err != nil {
+		return diag.FromErr(err)
+	}
+
 	m := meta.(*Meta)
 	n := d.Get("namespace").(string)
-	actionConfig, err := m.GetHelmConfiguration(n)
+	actionConfig, err := getReleaseHelmConfiguration(m, d, n)
 	if err != nil {
 		return diag.FromErr(err)
 	}
+	disableHooks(actionConfig, d, release.HookPreDelete, release.HookPostDelete)
 
-	name := d.Get("name").(string)
+	name := releaseName(d)
 
-	res, err := action.NewUninstall(actionConfig).Run(name)
+	start := time.Now()
+	res, err := uninstallRelease(actionConfig, d, name)
+	m.logHelmCall("uninstall", n, name, start, err)
 
 	if err != nil {
+		return diag.Diagnostics{
+			{
+				Severity: diag.Error,
+				Summary:  fmt.Sprintf("Uninstall of release %q failed", name),
+				Detail:   fmt.Sprintf("%s\n\n%s", err, uninstallRemediation(actionConfig, d, name)),
+			},
+		}
+	}
+
+	if err := removeReleaseFinalizers(ctx, d, actionConfig, res.Release); err != nil {
 		return diag.FromErr(err)
 	}
 
@@ -694,6 +1550,55 @@ func resourceReleaseDelete(ctx context.Context, d *schema.ResourceData, meta int
 	return nil
 }
 
+// uninstallRelease uninstalls the release. With force_destroy, an uninstall
+// that fails is retried without the hooks, and a release left uninstalling by
+// a previous destroy is uninstalled without the hooks right away.
+func uninstallRelease(cfg *action.Configuration, d resourceGetter, name string) (*release.UninstallReleaseResponse, error) {
+	client := action.NewUninstall(cfg)
+	client.DisableHooks = d.Get("export_hooks").(bool)
+	waitForDeleteHooks(cfg, d, client)
+
+	if !d.Get("force_destroy").(bool) {
+		return client.Run(name)
+	}
+
+	if rel, err := cfg.Releases.Last(name); err == nil && rel.Info.Status == release.StatusUninstalling {
+		log.Printf("[WARN] Release %q was left uninstalling, uninstalling it without hooks", name)
+		client.DisableHooks = true
+		return client.Run(name)
+	}
+
+	res, err := client.Run(name)
+	if err == nil {
+		return res, nil
+	}
+
+	// the release is purged even when the uninstall fails after its
+	// resources are deleted, there is nothing left to retry then
+	if _, lerr := cfg.Releases.Last(name); lerr != nil {
+		return res, err
+	}
+
+	log.Printf("[WARN] Uninstall of release %q failed, retrying without hooks: %s", name, err)
+	client.DisableHooks = true
+	return client.Run(name)
+}
+
+// uninstallRemediation describes the state a failed uninstall left the
+// release in, and how to complete it
+func uninstallRemediation(cfg *action.Configuration, d resourceGetter, name string) string {
+	rel, err := cfg.Releases.Last(name)
+	if err != nil {
+		return "The release record was removed, its remaining resources must be deleted manually."
+	}
+
+	msg := fmt.Sprintf("The release was left in the %s state and is kept in the Terraform state, so that it can be destroyed again once the cause of the failure is fixed.", rel.Info.Status)
+	if d.Get("force_destroy").(bool) {
+		return msg + " Remove the finalizers blocking the deletion of its resources, if any, before destroying it again."
+	}
+	return msg + " If the uninstall is blocked by the hooks of the release, set force_destroy to retry it without the hooks, or run `helm uninstall --no-hooks`."
+}
+
 func resourceDiff(ctx context.Context, d *schema.ResourceDiff, meta interface{}) error {
 	logID := fmt.Sprintf("[resourceDiff: %s]", d.Get("name").(string))
 	debug("%s Start", logID)
@@ -706,11 +1611,67 @@ func resourceDiff(ctx context.Context, d *schema.ResourceDiff, meta interface{})
 		return err
 	}
 
+	if err := checkReleaseNameLength(d); err != nil {
+		return err
+	}
+
+	if err := checkValuesReuse(d); err != nil {
+		return err
+	}
+
+	// the release is replaced when the name it is installed with changes,
+	// including when it is shortened differently
+	if d.Id() != "" && d.NewValueKnown("name") && releaseName(d) != d.Id() {
+		for _, key := range []string{"name_max_length", "name_hash_suffix"} {
+			if d.HasChange(key) {
+				if err := d.ForceNew(key); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// the action an update performs is only known once it is applied
+	if d.Id() != "" && len(d.GetChangedKeysPrefix("")) > 0 {
+		if err := d.SetNewComputed("last_action"); err != nil {
+			return err
+		}
+		if err := d.SetNewComputed("coalesced_values"); err != nil {
+			return err
+		}
+		if d.Get("record_created_resources").(bool) {
+			if err := d.SetNewComputed("created_resources"); err != nil {
+				return err
+			}
+		}
+		if d.Get("export_hooks").(bool) || d.HasChange("export_hooks") {
+			if err := d.SetNewComputed("rendered_hooks"); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the version is computed from the chart once installed, so an unpinned
+	// version is only known when the release is created
+	if d.Id() == "" && d.NewValueKnown("chart") && d.NewValueKnown("version") {
+		if err := checkPinnedVersion(d, m); err != nil {
+			return err
+		}
+	}
+
 	cpo, chartName, err := chartPathOptions(d, m)
 	if err != nil {
 		return err
 	}
 
+	// the chart is not fetched when planning if the repository is
+	// unreachable, so the apply would fail without this check
+	if m.CheckRepositories && d.NewValueKnown("chart") && d.NewValueKnown("repository") {
+		if err := checkRepositoryReachable(m, cpo, chartName); err != nil {
+			return err
+		}
+	}
+
 	// Get Chart metadata, if we fail - we're done
 	chart, _, err := getChart(d, meta.(*Meta), chartName, cpo)
 	if err != nil {
@@ -718,6 +1679,10 @@ func resourceDiff(ctx context.Context, d *schema.ResourceDiff, meta interface{})
 	}
 	debug("%s Got chart", logID)
 
+	if err := checkChartDeprecated(d, chart); err != nil {
+		return err
+	}
+
 	// Validates the resource configuration, the values, the chart itself, and
 	// the combination of both.
 	//
@@ -730,6 +1695,37 @@ func resourceDiff(ctx context.Context, d *schema.ResourceDiff, meta interface{})
 	}
 	debug("%s Release validated", logID)
 
+	// the policies and the API versions are checked once the values are
+	// known. The policies are evaluated at the latest when the release is
+	// installed or upgraded.
+	_, checkPolicies := d.GetOk("policy")
+	_, checkAPIs := d.GetOk("deprecated_api_check")
+	if (checkPolicies || checkAPIs) && valuesKnown(d) {
+		actionConfig, err := getReleaseHelmConfiguration(m, d, d.Get("namespace").(string))
+		if err != nil {
+			return err
+		}
+		redactLogs(actionConfig, d)
+
+		values, err := getValues(d)
+		if err != nil {
+			return err
+		}
+
+		skipKubeVersionCheck(d, chart)
+		if err := pinRenderTime(d, chart); err != nil {
+			return err
+		}
+
+		if err := checkPolicy(d, actionConfig, chart, cpo, values); err != nil {
+			return redactError(d, nil, err)
+		}
+
+		if err := checkDeprecatedAPIs(d, actionConfig, chart, cpo, values); err != nil {
+			return redactError(d, nil, err)
+		}
+	}
+
 	if m.ExperimentEnabled("manifest") {
 		// we don't need a custom diff if the release hasn't been created yet
 		oldStatus, _ := d.GetChange("status")
@@ -737,17 +1733,19 @@ func resourceDiff(ctx context.Context, d *schema.ResourceDiff, meta interface{})
 			return nil
 		}
 
-		name := d.Get("name").(string)
+		name := releaseName(d)
 		namespace := d.Get("namespace").(string)
 
-		actionConfig, err := m.GetHelmConfiguration(namespace)
+		actionConfig, err := getReleaseHelmConfiguration(m, d, namespace)
 		if err != nil {
 			return err
 		}
+		redactLogs(actionConfig, d)
 
-		// check if release exists
+		// check if release exists. A release moving to another namespace is
+		// recreated rather than upgraded, as namespace forces a new resource.
 		_, err = getRelease(m, actionConfig, name)
-		if err == errReleaseNotFound {
+		if err == errReleaseNotFound || d.HasChange("namespace") {
 			if len(chart.Metadata.Version) > 0 {
 				return d.SetNew("version", chart.Metadata.Version)
 			}
@@ -766,7 +1764,7 @@ func resourceDiff(ctx context.Context, d *schema.ResourceDiff, meta interface{})
 		client.Timeout = time.Duration(d.Get("timeout").(int)) * time.Second
 		client.Wait = d.Get("wait").(bool)
 		client.DryRun = true // do not apply changes
-		client.DisableHooks = d.Get("disable_webhooks").(bool)
+		client.DisableHooks = d.Get("disable_webhooks").(bool) || d.Get("export_hooks").(bool)
 		client.Atomic = d.Get("atomic").(bool)
 		client.SubNotes = d.Get("render_subchart_notes").(bool)
 		client.WaitForJobs = d.Get("wait_for_jobs").(bool)
@@ -778,12 +1776,14 @@ func resourceDiff(ctx context.Context, d *schema.ResourceDiff, meta interface{})
 		client.CleanupOnFail = d.Get("cleanup_on_fail").(bool)
 		client.Description = d.Get("description").(string)
 
-		if cmd := d.Get("postrender.0.binary_path").(string); cmd != "" {
-			pr, err := postrender.NewExec(cmd)
-			if err != nil {
-				return err
-			}
-			client.PostRenderer = pr
+		client.Description, err = releaseDescription(client.Description, chart)
+		if err != nil {
+			return err
+		}
+
+		client.PostRenderer, err = releasePostRenderer(d)
+		if err != nil {
+			return err
 		}
 
 		values, err := getValues(d)
@@ -791,7 +1791,15 @@ func resourceDiff(ctx context.Context, d *schema.ResourceDiff, meta interface{})
 			return fmt.Errorf("error getting values for a diff: %v", err)
 		}
 
+		skipKubeVersionCheck(d, chart)
+		if err := pinRenderTime(d, chart); err != nil {
+			return err
+		}
+
+		start := time.Now()
 		dry, err := client.Run(name, chart, values)
+		m.logHelmCall("upgrade-dry-run", namespace, name, start, err)
+		err = redactError(d, dry, err)
 		if err != nil && strings.Contains(err.Error(), "has no deployed releases") {
 			if len(chart.Metadata.Version) > 0 {
 				return d.SetNew("version", chart.Metadata.Version)
@@ -824,6 +1832,17 @@ func resourceDiff(ctx context.Context, d *schema.ResourceDiff, meta interface{})
 	return d.SetNewComputed("version")
 }
 
+// valuesKnown returns whether the values of the release are known during the
+// plan
+func valuesKnown(d *schema.ResourceDiff) bool {
+	for _, key := range []string{"values", "set", "set_sensitive", "set_map"} {
+		if !d.NewValueKnown(key) {
+			return false
+		}
+	}
+	return true
+}
+
 func setReleaseAttributes(d *schema.ResourceData, r *release.Release, meta interface{}) error {
 	d.SetId(r.Name)
 
@@ -839,6 +1858,36 @@ func setReleaseAttributes(d *schema.ResourceData, r *release.Release, meta inter
 		return err
 	}
 
+	// values_json is sensitive, so it is set before the sensitive values are
+	// cloaked in the release config
+	valuesJSON, err := json.Marshal(r.Config)
+	if err != nil {
+		return err
+	}
+	if err := d.Set("values_json", string(valuesJSON)); err != nil {
+		return err
+	}
+
+	coalesced, err := coalescedValues(r)
+	if err != nil {
+		return err
+	}
+	if err := d.Set("coalesced_values", coalesced); err != nil {
+		return err
+	}
+
+	valuesYAML, err := yaml.Marshal(r.Config)
+	if err != nil {
+		return err
+	}
+	if err := d.Set("get", []map[string]interface{}{{
+		"hooks":    redactSensitiveValues(releaseHooks(r), d),
+		"manifest": redactSensitiveValues(r.Manifest, d),
+		"values":   string(valuesYAML),
+	}}); err != nil {
+		return err
+	}
+
 	cloakSetValues(r.Config, d)
 	values, err := json.Marshal(r.Config)
 	if err != nil {
@@ -846,6 +1895,46 @@ func setReleaseAttributes(d *schema.ResourceData, r *release.Release, meta inter
 	}
 
 	m := meta.(*Meta)
+	if err := d.Set("version_current", r.Chart.Metadata.Version); err != nil {
+		return err
+	}
+
+	// looking up the latest version downloads the index of the repository,
+	// which refreshes do not otherwise need
+	if !d.Get("check_version_available").(bool) {
+		if err := d.Set("version_available", ""); err != nil {
+			return err
+		}
+	} else if v, err := latestChartVersion(d, m); err != nil {
+		log.Printf("[WARN] Unable to find the latest version of chart %s: %s", r.Chart.Metadata.Name, err)
+	} else if err := d.Set("version_available", v); err != nil {
+		return err
+	}
+
+	if err := d.Set("hook_results", hookResults(r)); err != nil {
+		return err
+	}
+
+	rendered := map[string]interface{}{}
+	if d.Get("export_hooks").(bool) {
+		rendered = renderedHooks(r)
+	}
+	if err := d.Set("rendered_hooks", rendered); err != nil {
+		return err
+	}
+
+	if err := d.Set("dependencies", resolvedDependencies(r.Chart)); err != nil {
+		return err
+	}
+
+	if err := d.Set("storage", []map[string]interface{}{{
+		"driver":    strings.ToLower(m.HelmDriver),
+		"namespace": releaseStorageNamespace(d),
+		"name":      releaseStorageKey(r),
+	}}); err != nil {
+		return err
+	}
+
 	if m.ExperimentEnabled("manifest") {
 		jsonManifest, err := convertYAMLManifestToJSON(r.Manifest)
 		if err != nil {
@@ -866,6 +1955,54 @@ func setReleaseAttributes(d *schema.ResourceData, r *release.Release, meta inter
 	}})
 }
 
+// releaseStorageNamespace returns the namespace the release is stored in
+func releaseStorageNamespace(d resourceGetter) string {
+	if ns := d.Get("release_storage_namespace").(string); ns != "" {
+		return ns
+	}
+	return d.Get("namespace").(string)
+}
+
+// getReleaseHelmConfiguration returns the Helm configuration of the release
+// deploying into namespace, with the `qps` and `burst` of the release applied
+// to its client of the Kubernetes API
+func getReleaseHelmConfiguration(m *Meta, d resourceGetter, namespace string) (*action.Configuration, error) {
+	qps, _ := d.Get("qps").(float64)
+	burst, _ := d.Get("burst").(int)
+	return m.GetHelmConfigurationWithLimits(namespace, releaseStorageNamespace(d), float32(qps), burst)
+}
+
+// releaseStorageKey returns the key of the revision of the release in the Helm
+// storage, which is the name of the Secret or ConfigMap storing it
+func releaseStorageKey(r *release.Release) string {
+	return fmt.Sprintf("%s.%s.v%d", storage.HelmStorageType, r.Name, r.Version)
+}
+
+// releaseHooks returns the hooks of the release in the format of helm get hooks
+func releaseHooks(r *release.Release) string {
+	var b strings.Builder
+	for _, h := range r.Hooks {
+		fmt.Fprintf(&b, "---\n# Source: %s\n%s\n", h.Path, h.Manifest)
+	}
+	return b.String()
+}
+
+// coalescedValues returns the values of the release coalesced with the
+// default values of its chart and subcharts as JSON, like helm get values
+// --all
+func coalescedValues(r *release.Release) (string, error) {
+	values, err := chartutil.CoalesceValues(r.Chart, r.Config)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
 func cloakSetValues(config map[string]interface{}, d resourceGetter) {
 	for _, raw := range d.Get("set_sensitive").(*schema.Set).List() {
 		set := raw.(map[string]interface{})
@@ -899,12 +2036,12 @@ func resourceReleaseExists(d *schema.ResourceData, meta interface{}) (bool, erro
 	m := meta.(*Meta)
 	n := d.Get("namespace").(string)
 
-	c, err := m.GetHelmConfiguration(n)
+	c, err := getReleaseHelmConfiguration(m, d, n)
 	if err != nil {
 		return false, err
 	}
 
-	name := d.Get("name").(string)
+	name := releaseName(d)
 	_, err = getRelease(m, c, name)
 
 	debug("%s Done", logID)
@@ -924,6 +2061,45 @@ type resourceGetter interface {
 	Get(string) interface{}
 }
 
+type resourceChangeGetter interface {
+	resourceGetter
+	HasChange(string) bool
+}
+
+// chartAttributes are the attributes that determine which chart is installed
+var chartAttributes = []string{
+	"chart",
+	"repository",
+	"version",
+	"devel",
+	"verify",
+	"keyring",
+	"keyring_url",
+	"dependency_update",
+	"render_time",
+	"skip_kube_version_check",
+}
+
+// isValuesOnlyUpdate returns true when none of the attributes that determine
+// the chart have changed, so the chart of the deployed release can be reused.
+// Local charts are always loaded again since their contents can change without
+// a version bump.
+func isValuesOnlyUpdate(d resourceChangeGetter) bool {
+	for _, k := range chartAttributes {
+		if d.HasChange(k) {
+			return false
+		}
+	}
+
+	if d.Get("repository").(string) == "" {
+		if _, err := os.Stat(d.Get("chart").(string)); err == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
 func getVersion(d resourceGetter, m *Meta) (version string) {
 	version = d.Get("version").(string)
 
@@ -942,7 +2118,7 @@ func getChart(d resourceGetter, m *Meta, name string, cpo *action.ChartPathOptio
 	m.Lock()
 	defer m.Unlock()
 
-	path, err := cpo.LocateChart(name, m.Settings)
+	path, err := locateChart(m, name, cpo)
 	if err != nil {
 		return nil, "", err
 	}
@@ -976,6 +2152,19 @@ func mergeMaps(a, b map[string]interface{}) map[string]interface{} {
 	return out
 }
 
+// imagePullSecrets returns the `image_pull_secrets` as the references of a pod
+// spec, e.g. [{name: registry}]
+func imagePullSecrets(d resourceGetter) []interface{} {
+	// the data sources have no image pull secrets
+	raw, _ := d.Get("image_pull_secrets").([]interface{})
+
+	secrets := make([]interface{}, 0, len(raw))
+	for _, name := range expandStringSlice(raw) {
+		secrets = append(secrets, map[string]interface{}{"name": name})
+	}
+	return secrets
+}
+
 func getValues(d resourceGetter) (map[string]interface{}, error) {
 	base := map[string]interface{}{}
 
@@ -989,31 +2178,263 @@ func getValues(d resourceGetter) (map[string]interface{}, error) {
 			continue
 		}
 
+		values, err := expandEnvInValues(d, values)
+		if err != nil {
+			return nil, err
+		}
+
 		currentMap := map[string]interface{}{}
 		if err := yaml.Unmarshal([]byte(values), &currentMap); err != nil {
+			if path, ok := valuesFilePath(values); ok {
+				return nil, fmt.Errorf("values entry %q is a string rather than YAML values, values files are read with file(), e.g. values = [file(%q)]", path, path)
+			}
 			return nil, fmt.Errorf("---> %v %s", err, values)
 		}
 
 		base = mergeMaps(base, currentMap)
 	}
 
-	for _, raw := range d.Get("set").(*schema.Set).List() {
-		set := raw.(map[string]interface{})
-		if err := getValue(base, set); err != nil {
+	// helm_chart_dependencies and helm_chart_diff have no values by workspace
+	byWorkspace, _ := d.Get("values_by_workspace").(map[string]interface{})
+	if values, ok := workspaceValues(byWorkspace, terraformWorkspace()); ok {
+		values, err := expandEnvInValues(d, values)
+		if err != nil {
 			return nil, err
 		}
+
+		currentMap := map[string]interface{}{}
+		if err := yaml.Unmarshal([]byte(values), &currentMap); err != nil {
+			return nil, fmt.Errorf("---> %v %s", err, values)
+		}
+
+		base = mergeMaps(base, currentMap)
 	}
 
-	for _, raw := range d.Get("set_sensitive").(*schema.Set).List() {
-		set := raw.(map[string]interface{})
-		if err := getValue(base, set); err != nil {
-			return nil, err
+	if secrets := imagePullSecrets(d); len(secrets) > 0 {
+		base = mergeMaps(base, map[string]interface{}{
+			"imagePullSecrets": secrets,
+			"global":           map[string]interface{}{"imagePullSecrets": secrets},
+		})
+	}
+
+	if err := getMapValues(base, d.Get("set_map").(map[string]interface{})); err != nil {
+		return nil, err
+	}
+
+	// helm_chart_dependencies has no resources, they cannot change its
+	// dependencies
+	resources, _ := d.Get("resources").([]interface{})
+	if err := getResourcesValues(base, resources); err != nil {
+		return nil, err
+	}
+
+	for _, key := range []string{"set", "set_sensitive"} {
+		for _, raw := range d.Get(key).(*schema.Set).List() {
+			set, err := expandEnvInSet(d, raw.(map[string]interface{}))
+			if err != nil {
+				return nil, err
+			}
+			if err := getValue(base, set); err != nil {
+				return nil, err
+			}
 		}
 	}
 
 	return base, logValues(base, d)
 }
 
+// terraformWorkspace returns the Terraform workspace of the run: TF_WORKSPACE
+// when set, otherwise the workspace selected with `terraform workspace select`
+// in the data directory of the working directory, which Terraform runs the
+// provider in
+func terraformWorkspace() string {
+	if ws := os.Getenv("TF_WORKSPACE"); ws != "" {
+		return ws
+	}
+
+	dataDir := os.Getenv("TF_DATA_DIR")
+	if dataDir == "" {
+		dataDir = ".terraform"
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dataDir, "environment")); err == nil {
+		if ws := strings.TrimSpace(string(data)); ws != "" {
+			return ws
+		}
+	}
+	return "default"
+}
+
+// valuesFilePath returns the values when they are a single line string
+// rather than a map, which is what a path to a values file passed to
+// `values` instead of its content looks like
+func valuesFilePath(values string) (string, bool) {
+	var scalar interface{}
+	if err := yaml.Unmarshal([]byte(values), &scalar); err != nil {
+		return "", false
+	}
+
+	path, ok := scalar.(string)
+	return path, ok && !strings.Contains(path, "\n")
+}
+
+// expandEnvInValues expands the references to environment variables in the
+// values when `expand_env_in_values` is set, like os.Expand. A variable not
+// listed in `expand_env_allowlist` is an error, and $$ is a literal $.
+func expandEnvInValues(d resourceGetter, values string) (string, error) {
+	// the data sources sharing getValues do not expand the values
+	if expand, _ := d.Get("expand_env_in_values").(bool); !expand {
+		return values, nil
+	}
+
+	allowed := map[string]bool{}
+	for _, name := range expandStringSlice(d.Get("expand_env_allowlist").([]interface{})) {
+		allowed[name] = true
+	}
+
+	var err error
+	expanded := os.Expand(values, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		if !allowed[name] {
+			if err == nil {
+				err = fmt.Errorf("environment variable %q referenced in the values is not allowed, add it to expand_env_allowlist or escape the reference as $$", name)
+			}
+			return ""
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			log.Printf("[WARN] Environment variable %q referenced in the values is not set", name)
+		}
+		return value
+	})
+	return expanded, err
+}
+
+// expandEnvInSet returns a copy of the `set` or `set_sensitive` block with
+// the environment variables of its value expanded
+func expandEnvInSet(d resourceGetter, set map[string]interface{}) (map[string]interface{}, error) {
+	value, err := expandEnvInValues(d, set["value"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("failed expanding the value of key %q: %w", set["name"], err)
+	}
+
+	expanded := make(map[string]interface{}, len(set))
+	for k, v := range set {
+		expanded[k] = v
+	}
+	expanded["value"] = value
+	return expanded, nil
+}
+
+// workspaceValues returns the values of `values_by_workspace` for the
+// workspace, falling back to the `default` key
+func workspaceValues(byWorkspace map[string]interface{}, workspace string) (string, bool) {
+	for _, key := range []string{workspace, "default"} {
+		if values, ok := byWorkspace[key]; ok {
+			return values.(string), true
+		}
+	}
+	return "", false
+}
+
+// setValueEscaper escapes the characters of a value that strvals would
+// interpret, so that the values of `set_map` are taken literally
+var setValueEscaper = strings.NewReplacer(`\`, `\\`, `,`, `\,`)
+
+// getMapValues merges the values of set_map into base. The keys are dotted
+// paths expanded into nested values like the names of `set`, e.g. `a.b[0]`,
+// with `\.` escaping a literal dot.
+func getMapValues(base, setMap map[string]interface{}) error {
+	names := make([]string, 0, len(setMap))
+	for name := range setMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		err := getValue(base, map[string]interface{}{
+			"name":  name,
+			"value": setValueEscaper.Replace(setMap[name].(string)),
+			"type":  "auto",
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resourceQuantitiesSchema returns the schema of the requests and limits of a
+// resources block
+func resourceQuantitiesSchema() *schema.Resource {
+	return &schema.Resource{
+		Schema: map[string]*schema.Schema{
+			"cpu": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Amount of CPU, e.g. 250m.",
+				ValidateFunc: validateQuantity,
+			},
+			"memory": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Amount of memory, e.g. 128Mi.",
+				ValidateFunc: validateQuantity,
+			},
+		},
+	}
+}
+
+func validateQuantity(v interface{}, k string) ([]string, []error) {
+	if _, err := k8sresource.ParseQuantity(v.(string)); err != nil {
+		return nil, []error{fmt.Errorf("%s: invalid quantity %q: %v", k, v, err)}
+	}
+	return nil, nil
+}
+
+// getResourcesValues merges the requests and limits of the resources blocks
+// into base, at `path_prefix.path.requests` and `path_prefix.path.limits`.
+// The quantities are set as strings.
+func getResourcesValues(base map[string]interface{}, resources []interface{}) error {
+	for _, raw := range resources {
+		if raw == nil {
+			continue
+		}
+		r := raw.(map[string]interface{})
+
+		path := r["path"].(string)
+		if prefix := r["path_prefix"].(string); prefix != "" {
+			path = prefix + "." + path
+		}
+
+		for _, kind := range []string{"requests", "limits"} {
+			quantities, _ := r[kind].([]interface{})
+			if len(quantities) == 0 || quantities[0] == nil {
+				continue
+			}
+
+			for _, name := range []string{"cpu", "memory"} {
+				quantity := quantities[0].(map[string]interface{})[name].(string)
+				if quantity == "" {
+					continue
+				}
+
+				err := getValue(base, map[string]interface{}{
+					"name":  fmt.Sprintf("%s.%s.%s", path, kind, name),
+					"value": setValueEscaper.Replace(quantity),
+					"type":  "string",
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func getValue(base, set map[string]interface{}) error {
 	name := set["name"].(string)
 	value := set["value"].(string)
@@ -1068,7 +2489,13 @@ func getRelease(m *Meta, cfg *action.Configuration, name string) (*release.Relea
 	get := action.NewGet(cfg)
 	debug("%s getRelease post action created", name)
 
+	start := time.Now()
 	res, err := get.Run(name)
+	namespace := ""
+	if kc, ok := cfg.KubeClient.(*kube.Client); ok {
+		namespace = kc.Namespace
+	}
+	m.logHelmCall("get", namespace, name, start, err)
 	debug("%s getRelease post run", name)
 
 	if err != nil {
@@ -1101,6 +2528,293 @@ func resolveChartName(repository, name string) (string, string, error) {
 	return "", name, nil
 }
 
+// skipKubeVersionCheck removes the kubeVersion constraint from the chart
+// metadata if `skip_kube_version_check` is set, so Helm does not check it
+func skipKubeVersionCheck(d resourceGetter, ch *chart.Chart) {
+	if !d.Get("skip_kube_version_check").(bool) || ch.Metadata.KubeVersion == "" {
+		return
+	}
+
+	log.Printf("[WARN] Skipping the kubeVersion check of chart %s (requires kubeVersion %s)", ch.Metadata.Name, ch.Metadata.KubeVersion)
+	ch.Metadata.KubeVersion = ""
+}
+
+// releaseName returns the name of the release. With `name_hash_suffix`, a name
+// longer than `name_max_length` is shortened to fit, its end being replaced by
+// a hash of the whole name so that names sharing a prefix remain distinct.
+func releaseName(d resourceGetter) string {
+	name := d.Get("name").(string)
+	max := d.Get("name_max_length").(int)
+	if !d.Get("name_hash_suffix").(bool) || max == 0 || len(name) <= max {
+		return name
+	}
+
+	sum := sha256.Sum256([]byte(name))
+	suffix := hex.EncodeToString(sum[:])[:8]
+	return strings.TrimRight(name[:max-len(suffix)-1], "-.") + "-" + suffix
+}
+
+// checkReleaseNameLength returns an error if the release name is longer than
+// `name_max_length`, rather than letting Helm reject it as invalid
+func checkReleaseNameLength(d resourceGetter) error {
+	name := releaseName(d)
+	max := d.Get("name_max_length").(int)
+	if max == 0 || len(name) <= max {
+		return nil
+	}
+
+	return errors.Errorf("release name %q is %d characters long, the maximum is %d: shorten it, or set name_hash_suffix to shorten it with a hash suffix", name, len(name), max)
+}
+
+// checkValuesReuse returns an error if both `reuse_values` and `reset_values`
+// are set, since Helm would silently ignore `reuse_values`
+func checkValuesReuse(d resourceGetter) error {
+	if d.Get("reuse_values").(bool) && d.Get("reset_values").(bool) {
+		return errors.New("reuse_values and reset_values cannot both be set, set reuse_values to keep the values of the last release or reset_values to only use the values of the configuration")
+	}
+	return nil
+}
+
+// isRolledBack returns whether the last revision of the release is the
+// rollback of an upgrade, as performed by Helm when an atomic upgrade fails
+func isRolledBack(cfg *action.Configuration, name string) bool {
+	last, err := cfg.Releases.Last(name)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(last.Info.Description, "Rollback to ")
+}
+
+// recoverPendingRelease brings a release left in a pending state by an
+// interrupted operation, e.g. a killed Terraform run, back to a consistent
+// revision so that it can be upgraded, as Helm refuses to upgrade a pending
+// release. The pending revision is marked as failed and, with
+// `pending_recovery = "rollback"`, the release is rolled back to its last
+// deployed revision. A pending release is an error when `pending_recovery` is
+// "none".
+func recoverPendingRelease(d resourceGetter, cfg *action.Configuration, name string) error {
+	last, err := cfg.Releases.Last(name)
+	if err != nil || !last.Info.Status.IsPending() {
+		// a missing release is reported by the upgrade
+		return nil
+	}
+
+	mode := d.Get("pending_recovery").(string)
+	if mode == pendingRecoveryNone {
+		return errors.Errorf("release %s revision %d is in state %s, left by an interrupted or concurrent operation. Set pending_recovery to recover it, or recover it with helm rollback", name, last.Version, last.Info.Status)
+	}
+
+	log.Printf("[WARN] Release %s revision %d is in state %s, marking it as failed", name, last.Version, last.Info.Status)
+	last.SetStatus(release.StatusFailed, fmt.Sprintf("Interrupted while %s, recovered by Terraform", last.Info.Status))
+	if err := cfg.Releases.Update(last); err != nil {
+		return err
+	}
+
+	if mode == pendingRecoveryUpgrade {
+		log.Printf("[INFO] Rolling release %s forward with an upgrade", name)
+		return nil
+	}
+
+	deployed, err := cfg.Releases.Deployed(name)
+	if err != nil {
+		log.Printf("[WARN] Release %s has no deployed revision to roll back to, rolling it forward with an upgrade", name)
+		return nil
+	}
+
+	log.Printf("[INFO] Rolling release %s back to revision %d before upgrading it", name, deployed.Version)
+	rollback := action.NewRollback(cfg)
+	rollback.Version = deployed.Version
+	rollback.DisableHooks = d.Get("export_hooks").(bool)
+	return rollback.Run(name)
+}
+
+// checkPinnedVersion returns an error for a release without a version if
+// `require_pinned_version` is set on the provider. Local charts and chart URLs
+// determine their version themselves.
+func checkPinnedVersion(d resourceGetter, m *Meta) error {
+	if !m.RequirePinnedVersion || d.Get("version").(string) != "" {
+		return nil
+	}
+
+	chartName := d.Get("chart").(string)
+	if u, err := url.Parse(chartName); err == nil && u.Scheme != "" {
+		return nil
+	}
+	if _, err := os.Stat(chartName); err == nil {
+		return nil
+	}
+
+	return errors.Errorf("release %s does not set the version of chart %s, which the provider requires with require_pinned_version", d.Get("name").(string), chartName)
+}
+
+// checkChartDeprecated returns an error for a deprecated chart if
+// `fail_on_deprecated` is set, and logs a warning otherwise
+func checkChartDeprecated(d resourceGetter, ch *chart.Chart) error {
+	if !ch.Metadata.Deprecated {
+		return nil
+	}
+
+	if d.Get("fail_on_deprecated").(bool) {
+		return errors.Errorf("chart %s version %s is deprecated", ch.Metadata.Name, ch.Metadata.Version)
+	}
+
+	log.Printf("[WARN] Chart %s version %s is deprecated", ch.Metadata.Name, ch.Metadata.Version)
+	return nil
+}
+
+// checkValueTypes returns an error if `strict_value_types` is set and values
+// set on the release do not have the type of the default values of the chart,
+// such as a string set where the chart expects a map. Values without a
+// default, and null values, which remove a default, are not checked.
+func checkValueTypes(d resourceGetter, ch *chart.Chart, values map[string]interface{}) error {
+	if !d.Get("strict_value_types").(bool) {
+		return nil
+	}
+
+	defaults, err := chartutil.CoalesceValues(ch, map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+
+	mismatches := valueTypeMismatches(defaults, values, "")
+	if len(mismatches) == 0 {
+		return nil
+	}
+
+	sort.Strings(mismatches)
+	return errors.Errorf("values of chart %s do not match the types of its default values:\n  %s", ch.Metadata.Name, strings.Join(mismatches, "\n  "))
+}
+
+// releaseDescription renders the description as a template of the metadata of
+// the chart, e.g. "{{ .Chart }}-{{ .Version }} app {{ .AppVersion }}".
+// Descriptions without template actions are returned as is.
+func releaseDescription(description string, c *chart.Chart) (string, error) {
+	if !strings.Contains(description, "{{") {
+		return description, nil
+	}
+
+	t, err := template.New("description").Option("missingkey=error").Parse(description)
+	if err != nil {
+		return "", fmt.Errorf("invalid description template: %v", err)
+	}
+
+	data := struct {
+		Chart      string
+		Version    string
+		AppVersion string
+	}{
+		Chart:      c.Metadata.Name,
+		Version:    c.Metadata.Version,
+		AppVersion: c.Metadata.AppVersion,
+	}
+
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("error rendering the description template: %v", err)
+	}
+	return b.String(), nil
+}
+
+// checkStrictRendering renders the templates of the chart with the strict
+// mode of the Helm template engine if `strict` is set, returning an error for
+// the references to missing values, which are rendered empty otherwise
+func checkStrictRendering(d resourceGetter, ch *chart.Chart, name string, values map[string]interface{}) error {
+	if !d.Get("strict").(bool) {
+		return nil
+	}
+
+	if err := chartutil.ProcessDependencies(ch, values); err != nil {
+		return err
+	}
+
+	options := chartutil.ReleaseOptions{
+		Name:      name,
+		Namespace: d.Get("namespace").(string),
+		Revision:  1,
+		IsInstall: true,
+	}
+	renderValues, err := chartutil.ToRenderValues(ch, values, options, chartutil.DefaultCapabilities)
+	if err != nil {
+		return err
+	}
+
+	if _, err := (engine.Engine{Strict: true}).Render(ch, renderValues); err != nil {
+		return errors.Errorf("chart %s does not render in strict mode: %v", ch.Metadata.Name, err)
+	}
+	return nil
+}
+
+// valueTypeMismatches returns the paths of the values whose type differs from
+// the type of their default value, walking down the maps set in both
+func valueTypeMismatches(defaults, values map[string]interface{}, prefix string) []string {
+	mismatches := []string{}
+	for k, v := range values {
+		def, ok := defaults[k]
+		if !ok || def == nil || v == nil {
+			continue
+		}
+
+		path := prefix + k
+		expected, actual := valueType(def), valueType(v)
+		if expected != actual {
+			mismatches = append(mismatches, fmt.Sprintf("%s: expected a %s, got a %s", path, expected, actual))
+			continue
+		}
+
+		if expected == "map" {
+			mismatches = append(mismatches, valueTypeMismatches(def.(map[string]interface{}), v.(map[string]interface{}), path+".")...)
+		}
+	}
+	return mismatches
+}
+
+// valueType returns the YAML type of a value
+func valueType(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "map"
+	case []interface{}:
+		return "list"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case int, int32, int64, float32, float64:
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// resolvedDependencies returns the dependencies of the chart with the versions
+// they were resolved to in its lock file, or the versions of the subcharts it
+// contains when it has no lock file
+func resolvedDependencies(ch *chart.Chart) []map[string]interface{} {
+	dependencies := []map[string]interface{}{}
+	if ch.Lock != nil {
+		for _, dep := range ch.Lock.Dependencies {
+			dependencies = append(dependencies, map[string]interface{}{
+				"name":       dep.Name,
+				"version":    dep.Version,
+				"repository": dep.Repository,
+			})
+		}
+		return dependencies
+	}
+
+	repositories := map[string]string{}
+	for _, dep := range ch.Metadata.Dependencies {
+		repositories[dep.Name] = dep.Repository
+	}
+	for _, sub := range ch.Dependencies() {
+		dependencies = append(dependencies, map[string]interface{}{
+			"name":       sub.Name(),
+			"version":    sub.Metadata.Version,
+			"repository": repositories[sub.Name()],
+		})
+	}
+	return dependencies
+}
+
 func isChartInstallable(ch *chart.Chart) error {
 	switch ch.Metadata.Type {
 	case "", "application":
@@ -1118,18 +2832,35 @@ func chartPathOptions(d resourceGetter, m *Meta) (*action.ChartPathOptions, stri
 	if err != nil {
 		return nil, "", err
 	}
+
+	if err := checkChartRepository(m, repositoryURL, chartName); err != nil {
+		return nil, "", err
+	}
 	version := getVersion(d, m)
 
+	username, password, err := repositoryCredentials(d, m)
+	if err != nil {
+		return nil, "", err
+	}
+
+	keyring := d.Get("keyring").(string)
+	if keyringURL := d.Get("keyring_url").(string); keyringURL != "" && d.Get("verify").(bool) {
+		keyring, err = fetchKeyring(keyringHTTPClient, keyringURL, m.Settings.RepositoryCache)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
 	return &action.ChartPathOptions{
 		CaFile:   d.Get("repository_ca_file").(string),
 		CertFile: d.Get("repository_cert_file").(string),
 		KeyFile:  d.Get("repository_key_file").(string),
-		Keyring:  d.Get("keyring").(string),
+		Keyring:  keyring,
 		RepoURL:  repositoryURL,
 		Verify:   d.Get("verify").(bool),
 		Version:  version,
-		Username: d.Get("repository_username").(string),
-		Password: d.Get("repository_password").(string),
+		Username: username,
+		Password: password,
 	}, chartName, nil
 }
 
@@ -1147,10 +2878,17 @@ func resourceHelmReleaseImportState(ctx context.Context, d *schema.ResourceData,
 	}
 
 	r, err := getRelease(m, c, name)
+	if err == errReleaseNotFound {
+		return nil, errors.Errorf("Release %q not found in namespace %q, the import ID is namespace/name", name, namespace)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	if err := checkImportLabel(m, c, r.Name); err != nil {
+		return nil, err
+	}
+
 	err = d.Set("name", r.Name)
 	if err != nil {
 		return nil, err
@@ -1180,9 +2918,42 @@ func resourceHelmReleaseImportState(ctx context.Context, d *schema.ResourceData,
 	return schema.ImportStatePassthroughContext(ctx, d, meta)
 }
 
+// checkImportLabel returns an error if `import_required_label` is set in the
+// provider and none of the revisions of the release carry that label in the
+// Helm storage backend
+func checkImportLabel(m *Meta, cfg *action.Configuration, name string) error {
+	if m.ImportRequiredLabel == "" {
+		return nil
+	}
+
+	key, value, err := parseLabel(m.ImportRequiredLabel)
+	if err != nil {
+		return err
+	}
+
+	_, err = cfg.Releases.Driver.Query(map[string]string{
+		"name":  name,
+		"owner": "helm",
+		key:     value,
+	})
+	if errors.Is(err, driver.ErrReleaseNotFound) {
+		return errors.Errorf("release %q does not have the label %q required for import", name, m.ImportRequiredLabel)
+	}
+	return err
+}
+
+func parseLabel(label string) (string, string, error) {
+	parts := strings.SplitN(label, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", errors.Errorf("Unexpected label format (%q), expected key=value", label)
+	}
+
+	return parts[0], parts[1], nil
+}
+
 func parseImportIdentifier(id string) (string, string, error) {
 	parts := strings.Split(id, "/")
-	if len(parts) != 2 {
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
 		err := errors.Errorf("Unexpected ID format (%q), expected namespace/name", id)
 		return "", "", err
 	}
@@ -1190,6 +2961,23 @@ func parseImportIdentifier(id string) (string, string, error) {
 	return parts[0], parts[1], nil
 }
 
+// validateNamespace checks that the value is a valid namespace name, which is
+// a DNS-1123 label
+func validateNamespace(val interface{}, path cty.Path) diag.Diagnostics {
+	namespace := val.(string)
+	if errs := k8svalidation.IsDNS1123Label(namespace); len(errs) > 0 {
+		return diag.Diagnostics{
+			{
+				Severity:      diag.Error,
+				Summary:       fmt.Sprintf("Invalid namespace name %q", namespace),
+				Detail:        strings.Join(errs, "; "),
+				AttributePath: path,
+			},
+		}
+	}
+	return nil
+}
+
 func resourceReleaseValidate(d resourceGetter, meta interface{}, cpo *action.ChartPathOptions) error {
 	cpo, name, err := chartPathOptions(d, meta.(*Meta))
 	if err != nil {
@@ -1205,7 +2993,7 @@ func resourceReleaseValidate(d resourceGetter, meta interface{}, cpo *action.Cha
 }
 
 func lintChart(m *Meta, name string, cpo *action.ChartPathOptions, values map[string]interface{}) (err error) {
-	path, err := cpo.LocateChart(name, m.Settings)
+	path, err := locateChart(m, name, cpo)
 	if err != nil {
 		return err
 	}
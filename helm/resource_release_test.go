@@ -1,26 +1,46 @@
 package helm
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
 
+	"github.com/hashicorp/go-cty/cty"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/acctest"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
 	"github.com/pkg/errors"
 
 	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/cli"
 	"helm.sh/helm/v3/pkg/helmpath"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
 	"helm.sh/helm/v3/pkg/release"
 	"helm.sh/helm/v3/pkg/releaseutil"
 	"helm.sh/helm/v3/pkg/repo"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
 
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 )
@@ -55,6 +75,7 @@ func TestAccResourceRelease_basic(t *testing.T) {
 					resource.TestCheckResourceAttr("helm_release.test", "metadata.0.version", "1.2.3"),
 					resource.TestCheckResourceAttr("helm_release.test", "status", release.StatusDeployed.String()),
 					resource.TestCheckResourceAttr("helm_release.test", "description", "Test"),
+					resource.TestCheckResourceAttr("helm_release.test", "last_action", "install"),
 				),
 			},
 		},
@@ -167,6 +188,64 @@ func TestAccResourceRelease_multiple_releases(t *testing.T) {
 	})
 }
 
+func TestAccResourceRelease_sameNameDifferentNamespaces(t *testing.T) {
+	first := createRandomNamespace(t)
+	defer deleteNamespace(t, first)
+	second := createRandomNamespace(t)
+	defer deleteNamespace(t, second)
+
+	config := func(firstValue, secondValue string) string {
+		release := func(resourceName, namespace, value string) string {
+			return fmt.Sprintf(`
+			resource "helm_release" %q {
+				name        = "test-same-name"
+				namespace   = %q
+				repository  = %q
+				chart       = "test-chart"
+
+				set {
+					name  = "foo"
+					value = %q
+				}
+			}`, resourceName, namespace, testRepositoryURL, value)
+		}
+		return release("first", first, firstValue) + release("second", second, secondValue)
+	}
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:  func() { testAccPreCheck(t) },
+		Providers: testAccProviders,
+		CheckDestroy: resource.ComposeTestCheckFunc(
+			testAccCheckHelmReleaseDestroy(first),
+			testAccCheckHelmReleaseDestroy(second),
+		),
+		Steps: []resource.TestStep{
+			{
+				Config: config("one", "two"),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.first", "metadata.0.namespace", first),
+					resource.TestCheckResourceAttr("helm_release.first", "metadata.0.revision", "1"),
+					resource.TestCheckResourceAttr("helm_release.first", "metadata.0.values", `{"foo":"one"}`),
+					resource.TestCheckResourceAttr("helm_release.second", "metadata.0.namespace", second),
+					resource.TestCheckResourceAttr("helm_release.second", "metadata.0.revision", "1"),
+					resource.TestCheckResourceAttr("helm_release.second", "metadata.0.values", `{"foo":"two"}`),
+				),
+			},
+			{
+				// upgrading one release leaves the release of the same name in
+				// the other namespace untouched
+				Config: config("one", "updated"),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.first", "metadata.0.revision", "1"),
+					resource.TestCheckResourceAttr("helm_release.first", "metadata.0.values", `{"foo":"one"}`),
+					resource.TestCheckResourceAttr("helm_release.second", "metadata.0.revision", "2"),
+					resource.TestCheckResourceAttr("helm_release.second", "metadata.0.values", `{"foo":"updated"}`),
+				),
+			},
+		},
+	})
+}
+
 func TestAccResourceRelease_concurrent(t *testing.T) {
 	t.Parallel()
 
@@ -214,6 +293,7 @@ func TestAccResourceRelease_update(t *testing.T) {
 					resource.TestCheckResourceAttr("helm_release.test", "metadata.0.version", "1.2.3"),
 					resource.TestCheckResourceAttr("helm_release.test", "status", release.StatusDeployed.String()),
 					resource.TestCheckResourceAttr("helm_release.test", "version", "1.2.3"),
+					resource.TestCheckResourceAttr("helm_release.test", "last_action", "install"),
 				),
 			},
 			{
@@ -223,6 +303,7 @@ func TestAccResourceRelease_update(t *testing.T) {
 					resource.TestCheckResourceAttr("helm_release.test", "metadata.0.version", "2.0.0"),
 					resource.TestCheckResourceAttr("helm_release.test", "status", release.StatusDeployed.String()),
 					resource.TestCheckResourceAttr("helm_release.test", "version", "2.0.0"),
+					resource.TestCheckResourceAttr("helm_release.test", "last_action", "upgrade"),
 				),
 			},
 		},
@@ -253,6 +334,177 @@ func TestAccResourceRelease_emptyValuesList(t *testing.T) {
 	})
 }
 
+func TestAccResourceRelease_valuesJSON(t *testing.T) {
+	name := randName("test-values-json")
+	namespace := createRandomNamespace(t)
+	defer deleteNamespace(t, namespace)
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:     func() { testAccPreCheck(t) },
+		Providers:    testAccProviders,
+		CheckDestroy: testAccCheckHelmReleaseDestroy(namespace),
+		Steps: []resource.TestStep{
+			{
+				Config: testAccHelmReleaseConfigValues(
+					testResourceName, namespace, name, "test-chart", "1.2.3",
+					[]string{"replicaCount: 2\nimage:\n  tag: \"1.0\"\n  pullPolicy: Always\nenabled: true\nlist: [a, 1]"},
+				),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "status", release.StatusDeployed.String()),
+					resource.TestCheckResourceAttr("helm_release.test", "values_json",
+						`{"enabled":true,"image":{"pullPolicy":"Always","tag":"1.0"},"list":["a",1],"replicaCount":2}`),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceRelease_versionAvailable(t *testing.T) {
+	name := randName("version-available")
+	namespace := createRandomNamespace(t)
+	defer deleteNamespace(t, namespace)
+
+	config := func(version string, check bool) string {
+		return fmt.Sprintf(`
+		resource "helm_release" "test" {
+			name                    = %q
+			namespace               = %q
+			repository              = %q
+			chart                   = "test-chart"
+			version                 = %q
+			check_version_available = %t
+		}`, name, namespace, testRepositoryURL, version, check)
+	}
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:     func() { testAccPreCheck(t) },
+		Providers:    testAccProviders,
+		CheckDestroy: testAccCheckHelmReleaseDestroy(namespace),
+		Steps: []resource.TestStep{
+			{
+				Config: config("1.2.3", false),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "version_current", "1.2.3"),
+					resource.TestCheckResourceAttr("helm_release.test", "version_available", ""),
+				),
+			},
+			{
+				Config: config("1.2.3", true),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "version_current", "1.2.3"),
+					resource.TestCheckResourceAttr("helm_release.test", "version_available", "2.0.0"),
+				),
+			},
+			{
+				Config: config("2.0.0", true),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "version_current", "2.0.0"),
+					resource.TestCheckResourceAttr("helm_release.test", "version_available", "2.0.0"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceRelease_storage(t *testing.T) {
+	name := randName("storage")
+	namespace := createRandomNamespace(t)
+	defer deleteNamespace(t, namespace)
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:     func() { testAccPreCheck(t) },
+		Providers:    testAccProviders,
+		CheckDestroy: testAccCheckHelmReleaseDestroy(namespace),
+		Steps: []resource.TestStep{
+			{
+				Config: testAccHelmReleaseConfigBasic(testResourceName, namespace, name, "1.2.3"),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "storage.0.driver", "secret"),
+					resource.TestCheckResourceAttr("helm_release.test", "storage.0.namespace", namespace),
+					resource.TestCheckResourceAttr("helm_release.test", "storage.0.name", fmt.Sprintf("sh.helm.release.v1.%s.v1", name)),
+				),
+			},
+			{
+				Config: testAccHelmReleaseConfigBasic(testResourceName, namespace, name, "2.0.0"),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "storage.0.name", fmt.Sprintf("sh.helm.release.v1.%s.v2", name)),
+					testAccCheckHelmReleaseStorageObject(namespace, fmt.Sprintf("sh.helm.release.v1.%s.v2", name)),
+				),
+			},
+		},
+	})
+}
+
+func testAccCheckHelmReleaseStorageObject(namespace, name string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		_, err := client.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		return err
+	}
+}
+
+func TestAccResourceRelease_releaseStorageNamespace(t *testing.T) {
+	name := randName("storage-namespace")
+	namespace := createRandomNamespace(t)
+	defer deleteNamespace(t, namespace)
+	storageNamespace := createRandomNamespace(t)
+	defer deleteNamespace(t, storageNamespace)
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:     func() { testAccPreCheck(t) },
+		Providers:    testAccProviders,
+		CheckDestroy: testAccCheckHelmReleaseDestroy(storageNamespace),
+		Steps: []resource.TestStep{
+			{
+				Config: testAccHelmReleaseConfigStorageNamespace(testResourceName, namespace, storageNamespace, name),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "status", release.StatusDeployed.String()),
+					resource.TestCheckResourceAttr("helm_release.test", "namespace", namespace),
+					resource.TestCheckResourceAttr("helm_release.test", "metadata.0.namespace", namespace),
+					resource.TestCheckResourceAttr("helm_release.test", "storage.0.namespace", storageNamespace),
+					testAccCheckHelmReleaseStorageObject(storageNamespace, fmt.Sprintf("sh.helm.release.v1.%s.v1", name)),
+				),
+			},
+		},
+	})
+}
+
+func testAccHelmReleaseConfigStorageNamespace(resource, ns, storageNamespace, name string) string {
+	return fmt.Sprintf(`
+		resource "helm_release" "%s" {
+			name                      = %q
+			namespace                 = %q
+			release_storage_namespace = %q
+			repository                = %q
+			chart                     = "test-chart"
+			version                   = "1.2.3"
+		}
+	`, resource, name, ns, storageNamespace, testRepositoryURL)
+}
+
+func TestAccResourceRelease_get(t *testing.T) {
+	name := randName("get")
+	namespace := createRandomNamespace(t)
+	defer deleteNamespace(t, namespace)
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:     func() { testAccPreCheck(t) },
+		Providers:    testAccProviders,
+		CheckDestroy: testAccCheckHelmReleaseDestroy(namespace),
+		Steps: []resource.TestStep{
+			{
+				Config: testAccHelmReleaseConfigValues(
+					testResourceName, namespace, name, "test-chart", "1.2.3", []string{"foo: bar"},
+				),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "get.0.values", "foo: bar\n"),
+					resource.TestMatchResourceAttr("helm_release.test", "get.0.manifest", regexp.MustCompile("kind: Deployment")),
+					resource.TestMatchResourceAttr("helm_release.test", "get.0.hooks", regexp.MustCompile(`# Source: test-chart/templates/tests/test-connection.yaml`)),
+				),
+			},
+		},
+	})
+}
+
 func TestAccResourceRelease_updateValues(t *testing.T) {
 	name := randName("test-update-values")
 	namespace := createRandomNamespace(t)
@@ -594,6 +846,52 @@ func TestAccResourceRelease_createNamespace(t *testing.T) {
 		create_namespace = true
 	}`, name, namespace, testRepositoryURL)
 
+	namespaceExists := func(s *terraform.State) error {
+		_, err := client.CoreV1().Namespaces().Get(context.TODO(), namespace, metav1.GetOptions{})
+		return err
+	}
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:  func() { testAccPreCheck(t) },
+		Providers: testAccProviders,
+		// the created namespace is kept when the release is destroyed
+		CheckDestroy: resource.ComposeAggregateTestCheckFunc(
+			testAccCheckHelmReleaseDestroy(namespace),
+			namespaceExists,
+		),
+		Steps: []resource.TestStep{
+			{
+				Config: config,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "metadata.0.revision", "1"),
+					resource.TestCheckResourceAttr("helm_release.test", "status", release.StatusDeployed.String()),
+					namespaceExists,
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceRelease_createNamespaces(t *testing.T) {
+	name := randName("create-namespaces")
+	namespace := randName("helm-created-namespace")
+	otherNamespace := randName("helm-created-namespace")
+	defer deleteNamespace(t, namespace)
+	defer deleteNamespace(t, otherNamespace)
+
+	config := fmt.Sprintf(`
+	resource "helm_release" "test" {
+		name             = %q
+		namespace        = %q
+		chart            = "./testdata/charts/multi-namespace"
+		create_namespace = true
+
+		set {
+			name  = "otherNamespace"
+			value = %q
+		}
+	}`, name, namespace, otherNamespace)
+
 	resource.ParallelTest(t, resource.TestCase{
 		PreCheck:     func() { testAccPreCheck(t) },
 		Providers:    testAccProviders,
@@ -602,8 +900,11 @@ func TestAccResourceRelease_createNamespace(t *testing.T) {
 			{
 				Config: config,
 				Check: resource.ComposeAggregateTestCheckFunc(
-					resource.TestCheckResourceAttr("helm_release.test", "metadata.0.revision", "1"),
 					resource.TestCheckResourceAttr("helm_release.test", "status", release.StatusDeployed.String()),
+					func(s *terraform.State) error {
+						_, err := client.CoreV1().ConfigMaps(otherNamespace).Get(context.TODO(), name, metav1.GetOptions{})
+						return err
+					},
 				),
 			},
 		},
@@ -728,308 +1029,1764 @@ func TestGetValuesString(t *testing.T) {
 	}
 }
 
-func TestCloakSetValues(t *testing.T) {
+func TestGetValuesSetMap(t *testing.T) {
 	d := resourceRelease().Data(nil)
-	err := d.Set("set_sensitive", []interface{}{
-		map[string]interface{}{"name": "foo", "value": "42"},
+	err := d.Set("set_map", map[string]interface{}{
+		"image.repository":                     "nginx",
+		"image.tag":                            "1.19",
+		"replicas":                             "3",
+		"ingress.hosts[0].host":                "example.com",
+		"ingress.hosts[1].host":                "example.org",
+		`podAnnotations.prometheus\.io/scrape`: "true",
+		"args":                                 "a,b",
 	})
 	if err != nil {
-		t.Fatalf("error setting values: %v", err)
+		t.Fatalf("error setting values: %s", err)
+	}
+	err = d.Set("set", []interface{}{
+		map[string]interface{}{"name": "image.tag", "value": "1.20"},
+	})
+	if err != nil {
+		t.Fatalf("error setting values: %s", err)
 	}
 
-	values := map[string]interface{}{
-		"foo": "foo",
+	values, err := getValues(d)
+	if err != nil {
+		t.Fatalf("error getValues: %s", err)
 	}
 
-	cloakSetValues(values, d)
-	if values["foo"] != sensitiveContentValue {
-		t.Fatalf("error cloak values, expected %q, got %s", sensitiveContentValue, values["foo"])
+	expected := map[string]interface{}{
+		"image":    map[string]interface{}{"repository": "nginx", "tag": "1.20"},
+		"replicas": int64(3),
+		"ingress": map[string]interface{}{
+			"hosts": []interface{}{
+				map[string]interface{}{"host": "example.com"},
+				map[string]interface{}{"host": "example.org"},
+			},
+		},
+		"podAnnotations": map[string]interface{}{"prometheus.io/scrape": true},
+		"args":           "a,b",
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatalf("error expanding set_map, expected %#v, got %#v", expected, values)
 	}
 }
 
-func TestCloakSetValuesNested(t *testing.T) {
-	d := resourceRelease().Data(nil)
-	err := d.Set("set_sensitive", []interface{}{
-		map[string]interface{}{"name": "foo.qux.bar", "value": "42"},
+func TestGetValuesResources(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceRelease().Schema, map[string]interface{}{
+		"name":  "test",
+		"chart": "test-chart",
+		"resources": []interface{}{
+			map[string]interface{}{
+				"requests": []interface{}{map[string]interface{}{"cpu": "250m", "memory": "128Mi"}},
+				"limits":   []interface{}{map[string]interface{}{"memory": "256Mi"}},
+			},
+			map[string]interface{}{
+				"path_prefix": "metrics",
+				"path":        "sidecar.resources",
+				"limits":      []interface{}{map[string]interface{}{"cpu": "1"}},
+			},
+		},
+		"set": []interface{}{
+			map[string]interface{}{"name": "resources.limits.memory", "value": "512Mi"},
+		},
 	})
-	if err != nil {
-		t.Fatalf("error setting values: %v", err)
-	}
 
-	qux := map[string]interface{}{
-		"bar": "bar",
+	values, err := getValues(d)
+	if err != nil {
+		t.Fatalf("error getValues: %s", err)
 	}
 
-	values := map[string]interface{}{
-		"foo": map[string]interface{}{
-			"qux": qux,
+	expected := map[string]interface{}{
+		"resources": map[string]interface{}{
+			"requests": map[string]interface{}{"cpu": "250m", "memory": "128Mi"},
+			"limits":   map[string]interface{}{"memory": "512Mi"},
+		},
+		"metrics": map[string]interface{}{
+			"sidecar": map[string]interface{}{
+				"resources": map[string]interface{}{
+					"limits": map[string]interface{}{"cpu": "1"},
+				},
+			},
 		},
 	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatalf("error expanding resources, expected %#v, got %#v", expected, values)
+	}
 
-	cloakSetValues(values, d)
-	if qux["bar"] != sensitiveContentValue {
-		t.Fatalf("error cloak values, expected %q, got %s", sensitiveContentValue, qux["bar"])
+	if _, errs := validateQuantity("1.5Gb", "resources.0.limits.0.memory"); len(errs) == 0 {
+		t.Fatal("expected an invalid quantity to be rejected")
 	}
 }
 
-func TestCloakSetValuesNotMatching(t *testing.T) {
-	d := resourceRelease().Data(nil)
-	err := d.Set("set_sensitive", []interface{}{
-		map[string]interface{}{"name": "foo.qux.bar", "value": "42"},
-	})
+func TestGetValuesByWorkspace(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "terraform")
 	if err != nil {
-		t.Fatalf("error setting values: %v", err)
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	for k, v := range map[string]string{"TF_WORKSPACE": "", "TF_DATA_DIR": dataDir} {
+		old, ok := os.LookupEnv(k)
+		os.Setenv(k, v)
+		if ok {
+			defer os.Setenv(k, old)
+		} else {
+			defer os.Unsetenv(k)
+		}
 	}
 
-	values := map[string]interface{}{
-		"foo": "42",
+	d := schema.TestResourceDataRaw(t, resourceRelease().Schema, map[string]interface{}{
+		"name":   "test",
+		"chart":  "test-chart",
+		"values": []interface{}{"replicaCount: 1\nimage: nginx\n"},
+		"values_by_workspace": map[string]interface{}{
+			"prod":    "replicaCount: 3\n",
+			"default": "replicaCount: 2\n",
+		},
+	})
+
+	for workspace, replicas := range map[string]float64{"prod": 3, "staging": 2} {
+		if err := ioutil.WriteFile(filepath.Join(dataDir, "environment"), []byte(workspace), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		values, err := getValues(d)
+		if err != nil {
+			t.Fatalf("error getValues: %s", err)
+		}
+		expected := map[string]interface{}{"replicaCount": replicas, "image": "nginx"}
+		if !reflect.DeepEqual(values, expected) {
+			t.Errorf("workspace %s: expected %#v, got %#v", workspace, expected, values)
+		}
 	}
 
-	cloakSetValues(values, d)
-	if values["foo"] != "42" {
-		t.Fatalf("error cloak values, expected %q, got %s", "42", values["foo"])
+	os.Setenv("TF_WORKSPACE", "prod")
+	if ws := terraformWorkspace(); ws != "prod" {
+		t.Errorf("expected TF_WORKSPACE to take precedence, got %s", ws)
 	}
 }
 
-func testAccHelmReleaseConfigRepositoryURL(resource, ns, name string) string {
-	return fmt.Sprintf(`
-		resource "helm_release" %q {
-			name       = %q
-			namespace  = %q
-			repository = %q
-			chart      = "test-chart"
-		}
-	`, resource, name, ns, testRepositoryURL)
+func TestReleaseHooks(t *testing.T) {
+	r := &release.Release{
+		Hooks: []*release.Hook{
+			{Path: "test-chart/templates/tests/a.yaml", Manifest: "kind: Pod"},
+			{Path: "test-chart/templates/b.yaml", Manifest: "kind: Job"},
+		},
+	}
+
+	expected := "---\n# Source: test-chart/templates/tests/a.yaml\nkind: Pod\n---\n# Source: test-chart/templates/b.yaml\nkind: Job\n"
+	if actual := releaseHooks(r); actual != expected {
+		t.Fatalf("expected %q, got %q", expected, actual)
+	}
 }
 
-func testAccPreCheckHelmRepositoryDestroy(t *testing.T, name string) {
-	settings := testAccProvider.Meta().(*Meta).Settings
-
-	rc := settings.RepositoryConfig
+func TestGetValuesNull(t *testing.T) {
+	defaults := map[string]interface{}{
+		"resources": map[string]interface{}{
+			"limits": map[string]interface{}{"cpu": "100m", "memory": "128Mi"},
+		},
+		"podSecurityContext": map[string]interface{}{"runAsUser": 1000},
+		"nodeSelector":       map[string]interface{}{"disktype": "ssd"},
+		"tolerations":        []interface{}{map[string]interface{}{"key": "dedicated"}},
+		"image":              map[string]interface{}{"tag": "1.19"},
+	}
+	ch := &chart.Chart{
+		Metadata: &chart.Metadata{APIVersion: "v2", Name: "test", Version: "1.0.0"},
+		Values:   defaults,
+	}
 
-	r, err := repo.LoadFile(rc)
+	d := resourceRelease().Data(nil)
+	err := d.Set("values", []interface{}{"resources:\n  limits: null\npodSecurityContext: null\n"})
+	if err != nil {
+		t.Fatalf("error setting values: %s", err)
+	}
+	err = d.Set("set_map", map[string]interface{}{"nodeSelector": "null"})
+	if err != nil {
+		t.Fatalf("error setting values: %s", err)
+	}
+	err = d.Set("set", []interface{}{
+		map[string]interface{}{"name": "tolerations", "value": "null"},
+		map[string]interface{}{"name": "image.tag", "value": "null", "type": "string"},
+	})
+	if err != nil {
+		t.Fatalf("error setting values: %s", err)
+	}
 
-	if isNotExist(err) || len(r.Repositories) == 0 || !r.Remove(name) {
-		t.Log(fmt.Sprintf("no repo named %q found, nothing to do", name))
-		return
+	values, err := getValues(d)
+	if err != nil {
+		t.Fatalf("error getValues: %s", err)
 	}
 
-	if err := r.WriteFile(rc, 0644); err != nil {
-		t.Fatalf("Failed to write repositories file: %s", err)
+	coalesced, err := chartutil.CoalesceValues(ch, values)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	if err := removeRepoCache(settings.RepositoryCache, name); err != nil {
-		t.Fatalf("Failed to remove repository cache: %s", err)
+	// a null value deletes the default, like with the helm CLI, unless it
+	// is set as a string
+	expected := map[string]interface{}{
+		"resources": map[string]interface{}{},
+		"image":     map[string]interface{}{"tag": "null"},
+	}
+	if !reflect.DeepEqual(map[string]interface{}(coalesced), expected) {
+		t.Fatalf("expected null values to delete the defaults, expected %#v, got %#v", expected, coalesced)
 	}
+}
 
-	_, err = fmt.Fprintf(os.Stdout, "%q has been removed from your repositories\n", name)
+func TestCloakSetValues(t *testing.T) {
+	d := resourceRelease().Data(nil)
+	err := d.Set("set_sensitive", []interface{}{
+		map[string]interface{}{"name": "foo", "value": "42"},
+	})
 	if err != nil {
-		t.Fatalf("error printing stdout: %v", err)
+		t.Fatalf("error setting values: %v", err)
 	}
 
-	t.Log(fmt.Sprintf("%q has been removed from your repositories\n", name))
+	values := map[string]interface{}{
+		"foo": "foo",
+	}
+
+	cloakSetValues(values, d)
+	if values["foo"] != sensitiveContentValue {
+		t.Fatalf("error cloak values, expected %q, got %s", sensitiveContentValue, values["foo"])
+	}
 }
 
-func isNotExist(err error) bool {
-	return os.IsNotExist(errors.Cause(err))
+func TestCloakSetValuesNested(t *testing.T) {
+	d := resourceRelease().Data(nil)
+	err := d.Set("set_sensitive", []interface{}{
+		map[string]interface{}{"name": "foo.qux.bar", "value": "42"},
+	})
+	if err != nil {
+		t.Fatalf("error setting values: %v", err)
+	}
+
+	qux := map[string]interface{}{
+		"bar": "bar",
+	}
+
+	values := map[string]interface{}{
+		"foo": map[string]interface{}{
+			"qux": qux,
+		},
+	}
+
+	cloakSetValues(values, d)
+	if qux["bar"] != sensitiveContentValue {
+		t.Fatalf("error cloak values, expected %q, got %s", sensitiveContentValue, qux["bar"])
+	}
 }
 
-func removeRepoCache(root, name string) error {
-	idx := filepath.Join(root, helmpath.CacheIndexFile(name))
-	if _, err := os.Stat(idx); os.IsNotExist(err) {
-		return nil
-	} else if err != nil {
-		return errors.Wrapf(err, "can't remove index file %s", idx)
+func TestCloakSetValuesNotMatching(t *testing.T) {
+	d := resourceRelease().Data(nil)
+	err := d.Set("set_sensitive", []interface{}{
+		map[string]interface{}{"name": "foo.qux.bar", "value": "42"},
+	})
+	if err != nil {
+		t.Fatalf("error setting values: %v", err)
+	}
+
+	values := map[string]interface{}{
+		"foo": "42",
+	}
+
+	cloakSetValues(values, d)
+	if values["foo"] != "42" {
+		t.Fatalf("error cloak values, expected %q, got %s", "42", values["foo"])
 	}
-	return os.Remove(idx)
 }
 
-func testAccCheckHelmReleaseDependencyUpdate(namespace string, name string, expectedResources int) resource.TestCheckFunc {
-	// NOTE this is a regression test to check that a charts dependencies have not been
-	// deleted from the manifest on update.
+type fakeResourceChangeGetter struct {
+	values  map[string]interface{}
+	changed []string
+}
 
-	return func(s *terraform.State) error {
-		m := testAccProvider.Meta()
-		if m == nil {
-			return fmt.Errorf("provider not properly initialized")
-		}
+func (f fakeResourceChangeGetter) Get(k string) interface{} {
+	return f.values[k]
+}
 
-		actionConfig, err := m.(*Meta).GetHelmConfiguration(namespace)
-		if err != nil {
-			return err
+func (f fakeResourceChangeGetter) HasChange(k string) bool {
+	for _, c := range f.changed {
+		if c == k {
+			return true
 		}
+	}
+	return false
+}
 
-		client := action.NewGet(actionConfig)
-		res, err := client.Run(name)
+func TestIsValuesOnlyUpdate(t *testing.T) {
+	remote := map[string]interface{}{"repository": "https://charts.example.com", "chart": "test-chart"}
+	local := map[string]interface{}{"repository": "", "chart": filepath.Join(testChartsPath, "test-chart")}
+
+	tests := []struct {
+		name     string
+		d        fakeResourceChangeGetter
+		expected bool
+	}{
+		{"values changed", fakeResourceChangeGetter{remote, []string{"values", "set"}}, true},
+		{"version changed", fakeResourceChangeGetter{remote, []string{"values", "version"}}, false},
+		{"chart changed", fakeResourceChangeGetter{remote, []string{"chart"}}, false},
+		{"repository changed", fakeResourceChangeGetter{remote, []string{"repository"}}, false},
+		{"kube version check skipped", fakeResourceChangeGetter{remote, []string{"skip_kube_version_check"}}, false},
+		{"local chart", fakeResourceChangeGetter{local, []string{"values"}}, false},
+	}
 
-		if res == nil {
-			return fmt.Errorf("release %q not found", name)
+	for _, tt := range tests {
+		if actual := isValuesOnlyUpdate(tt.d); actual != tt.expected {
+			t.Errorf("%s: expected %t, got %t", tt.name, tt.expected, actual)
 		}
+	}
+}
+
+// changedResourceData reports the changed attributes of the resource data
+type changedResourceData struct {
+	*schema.ResourceData
+	changed []string
+}
+
+func (d changedResourceData) HasChange(k string) bool {
+	return fakeResourceChangeGetter{changed: d.changed}.HasChange(k)
+}
+
+func TestUpgradeChartValuesOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upgrade-chart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
 
+	for _, version := range []string{"1.0.0", "2.0.0"} {
+		_, err := chartutil.Save(&chart.Chart{
+			Metadata: &chart.Metadata{APIVersion: "v2", Name: "test-chart", Version: version},
+		}, dir)
 		if err != nil {
-			return err
+			t.Fatal(err)
 		}
+	}
 
-		resources := releaseutil.SplitManifests(res.Manifest)
-		if len(resources) != expectedResources {
-			return fmt.Errorf("expected %v resources but got %v", expectedResources, len(resources))
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		if r.URL.Path == "/index.yaml" {
+			w.Write([]byte(`apiVersion: v1
+entries:
+  test-chart:
+  - name: test-chart
+    version: 2.0.0
+    urls: [test-chart-2.0.0.tgz]
+  - name: test-chart
+    version: 1.0.0
+    urls: [test-chart-1.0.0.tgz]
+`))
+			return
 		}
+		http.ServeFile(w, r, filepath.Join(dir, strings.TrimPrefix(r.URL.Path, "/")))
+	}))
+	defer server.Close()
+
+	settings := cli.New()
+	settings.RepositoryConfig = filepath.Join(dir, "repositories.yaml")
+	settings.RepositoryCache = filepath.Join(dir, "cache")
+	m := &Meta{Settings: settings, RepositoryPlainHTTP: true}
+
+	cfg := &action.Configuration{
+		KubeClient: &kubefake.PrintingKubeClient{Out: ioutil.Discard},
+		Releases:   storage.Init(driver.NewMemory()),
+		Log:        t.Logf,
+	}
+	deployed := &chart.Chart{Metadata: &chart.Metadata{APIVersion: "v2", Name: "test-chart", Version: "1.0.0"}}
+	err = cfg.Releases.Create(&release.Release{
+		Name:      "web",
+		Namespace: "default",
+		Version:   1,
+		Chart:     deployed,
+		Info:      &release.Info{Status: release.StatusDeployed},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
 
-		return nil
+	raw := schema.TestResourceDataRaw(t, resourceRelease().Schema, map[string]interface{}{
+		"name":       "web",
+		"repository": server.URL,
+		"chart":      "test-chart",
+		"version":    "1.0.0",
+	})
+
+	// a values-only update reuses the deployed chart without any download
+	c, _, err := upgradeChart(changedResourceData{raw, []string{"values", "set"}}, m, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != deployed {
+		t.Fatal("expected the chart of the deployed release to be reused")
+	}
+	if len(requests) != 0 {
+		t.Fatalf("expected no request to the repository, got %v", requests)
+	}
+
+	// a version change resolves and downloads the chart
+	if err := raw.Set("version", "2.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	c, _, err = upgradeChart(changedResourceData{raw, []string{"version"}}, m, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Metadata.Version != "2.0.0" {
+		t.Fatalf("expected version 2.0.0 of the chart, got %s", c.Metadata.Version)
+	}
+	if !reflect.DeepEqual(requests, []string{"/index.yaml", "/test-chart-2.0.0.tgz"}) {
+		t.Fatalf("expected the index and the chart to be downloaded, got %v", requests)
 	}
 }
 
-func testAccCheckHelmReleaseDestroy(namespace string) resource.TestCheckFunc {
-	return func(s *terraform.State) error {
-		m := testAccProvider.Meta()
-		if m == nil {
-			return fmt.Errorf("provider not properly initialized")
+func TestSkipKubeVersionCheck(t *testing.T) {
+	ch := &chart.Chart{Metadata: &chart.Metadata{Name: "test-chart", KubeVersion: "<1.0.0"}}
+
+	skipKubeVersionCheck(fakeResourceChangeGetter{values: map[string]interface{}{"skip_kube_version_check": false}}, ch)
+	if ch.Metadata.KubeVersion != "<1.0.0" {
+		t.Fatalf("expected kubeVersion to be kept, got %q", ch.Metadata.KubeVersion)
+	}
+
+	skipKubeVersionCheck(fakeResourceChangeGetter{values: map[string]interface{}{"skip_kube_version_check": true}}, ch)
+	if ch.Metadata.KubeVersion != "" {
+		t.Fatalf("expected kubeVersion to be removed, got %q", ch.Metadata.KubeVersion)
+	}
+}
+
+func TestValidateNamespace(t *testing.T) {
+	for _, ns := range []string{"default", "kube-system", "team-a1", strings.Repeat("a", 63)} {
+		if diags := validateNamespace(ns, cty.GetAttrPath("namespace")); diags.HasError() {
+			t.Errorf("expected namespace %q to be valid, got %v", ns, diags)
 		}
+	}
 
-		actionConfig, err := m.(*Meta).GetHelmConfiguration(namespace)
-		if err != nil {
-			return err
+	for _, ns := range []string{"", "Default", "my_namespace", "-leading", "trailing-", "dotted.name", strings.Repeat("a", 64)} {
+		if diags := validateNamespace(ns, cty.GetAttrPath("namespace")); !diags.HasError() {
+			t.Errorf("expected namespace %q to be invalid", ns)
 		}
+	}
+}
 
-		client := action.NewList(actionConfig)
-		res, err := client.Run()
+func TestParseImportIdentifier(t *testing.T) {
+	namespace, name, err := parseImportIdentifier("team-a/web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if namespace != "team-a" || name != "web" {
+		t.Fatalf("expected team-a/web, got %s/%s", namespace, name)
+	}
 
-		if res == nil {
-			return nil
+	for _, id := range []string{"web", "team-a/", "/web", "team-a/web/extra"} {
+		if _, _, err := parseImportIdentifier(id); err == nil {
+			t.Errorf("expected import ID %q to be invalid", id)
 		}
+	}
+}
+
+func TestCheckChartDeprecated(t *testing.T) {
+	ch := &chart.Chart{Metadata: &chart.Metadata{Name: "test-chart", Version: "1.2.3", Deprecated: true}}
+
+	if err := checkChartDeprecated(fakeResourceChangeGetter{values: map[string]interface{}{"fail_on_deprecated": false}}, ch); err != nil {
+		t.Fatalf("expected a deprecated chart to be allowed, got %s", err)
+	}
+
+	err := checkChartDeprecated(fakeResourceChangeGetter{values: map[string]interface{}{"fail_on_deprecated": true}}, ch)
+	if err == nil || err.Error() != "chart test-chart version 1.2.3 is deprecated" {
+		t.Fatalf("expected the deprecated chart to be rejected, got %v", err)
+	}
+
+	ch.Metadata.Deprecated = false
+	if err := checkChartDeprecated(fakeResourceChangeGetter{values: map[string]interface{}{"fail_on_deprecated": true}}, ch); err != nil {
+		t.Fatalf("expected a chart that is not deprecated to be allowed, got %s", err)
+	}
+}
+
+func TestCheckValueTypes(t *testing.T) {
+	sub := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "subchart", Version: "1.0.0"},
+		Values:   map[string]interface{}{"ports": []interface{}{80}},
+	}
+	ch := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "test-chart", Version: "1.2.3"},
+		Values: map[string]interface{}{
+			"replicaCount": int64(1),
+			"image":        map[string]interface{}{"repository": "nginx", "tag": "1.19"},
+			"ingress":      map[string]interface{}{"enabled": false, "annotations": map[string]interface{}{}},
+		},
+	}
+	ch.AddDependency(sub)
 
+	values := map[string]interface{}{
+		"replicaCount": int64(3),
+		"image":        "nginx:1.19",
+		"ingress": map[string]interface{}{
+			"enabled":     "true",
+			"annotations": map[string]interface{}{"kubernetes.io/ingress.class": "nginx"},
+		},
+		"subchart":     map[string]interface{}{"ports": "80"},
+		"extra":        "value",
+		"nodeSelector": nil,
+	}
+
+	d := fakeResourceChangeGetter{values: map[string]interface{}{"strict_value_types": false}}
+	if err := checkValueTypes(d, ch, values); err != nil {
+		t.Fatalf("expected the types not to be checked, got %s", err)
+	}
+
+	d = fakeResourceChangeGetter{values: map[string]interface{}{"strict_value_types": true}}
+	err := checkValueTypes(d, ch, values)
+	expected := `values of chart test-chart do not match the types of its default values:
+  image: expected a map, got a string
+  ingress.enabled: expected a boolean, got a string
+  subchart.ports: expected a list, got a string`
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected the mismatching types to be reported, got %v", err)
+	}
+
+	delete(values, "image")
+	delete(values, "subchart")
+	values["ingress"].(map[string]interface{})["enabled"] = true
+	if err := checkValueTypes(d, ch, values); err != nil {
+		t.Fatalf("expected matching types to be accepted, got %s", err)
+	}
+}
+
+func TestReleaseDescription(t *testing.T) {
+	c := &chart.Chart{Metadata: &chart.Metadata{Name: "test-chart", Version: "1.2.3", AppVersion: "1.19.5"}}
+
+	tests := []struct {
+		description string
+		expected    string
+		err         bool
+	}{
+		{"Test", "Test", false},
+		{"", "", false},
+		{"{{ .Chart }}-{{ .Version }} app {{ .AppVersion }}", "test-chart-1.2.3 app 1.19.5", false},
+		{"{{ .Chart }} deployed by CI", "test-chart deployed by CI", false},
+		{"{{ .Chart", "", true},
+		{"{{ .Unknown }}", "", true},
+	}
+
+	for _, tt := range tests {
+		actual, err := releaseDescription(tt.description, c)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", tt.description, actual)
+			}
+			continue
+		}
 		if err != nil {
-			return err
+			t.Errorf("%q: unexpected error %s", tt.description, err)
+		} else if actual != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.description, tt.expected, actual)
 		}
+	}
+}
 
-		for _, r := range res {
-			if r.Name == testResourceName {
-				return fmt.Errorf("found %q release", testResourceName)
-			}
+func TestCheckStrictRendering(t *testing.T) {
+	ch := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "test-chart", Version: "1.2.3", APIVersion: chart.APIVersionV2},
+		Values:   map[string]interface{}{"image": map[string]interface{}{"repository": "nginx"}},
+		Templates: []*chart.File{{
+			Name: "templates/configmap.yaml",
+			Data: []byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}
+data:
+  image: {{ .Values.image.repository }}:{{ .Values.image.tag }}
+`),
+		}},
+	}
 
-			if r.Namespace == namespace {
-				return fmt.Errorf("%q namespace should be empty", namespace)
-			}
+	d := fakeResourceChangeGetter{values: map[string]interface{}{"strict": false, "namespace": "default"}}
+	if err := checkStrictRendering(d, ch, "test", map[string]interface{}{}); err != nil {
+		t.Fatalf("expected the chart not to be rendered, got %s", err)
+	}
+
+	d.values["strict"] = true
+	err := checkStrictRendering(d, ch, "test", map[string]interface{}{})
+	if err == nil || !strings.Contains(err.Error(), "tag") {
+		t.Fatalf("expected the reference to the missing image.tag to fail, got %v", err)
+	}
+
+	values := map[string]interface{}{"image": map[string]interface{}{"tag": "1.19"}}
+	if err := checkStrictRendering(d, ch, "test", values); err != nil {
+		t.Fatalf("expected the chart to render with all its values set, got %s", err)
+	}
+}
+
+func TestReleaseName(t *testing.T) {
+	long := "payments-api-" + strings.Repeat("eu-west-1-production-", 3)
+
+	d := schema.TestResourceDataRaw(t, resourceRelease().Schema, map[string]interface{}{"name": long})
+	if name := releaseName(d); name != long {
+		t.Fatalf("expected the name to be kept without name_hash_suffix, got %q", name)
+	}
+	err := checkReleaseNameLength(d)
+	if err == nil || !strings.Contains(err.Error(), "is 76 characters long, the maximum is 53") {
+		t.Fatalf("expected the long name to be rejected, got %v", err)
+	}
+
+	d = schema.TestResourceDataRaw(t, resourceRelease().Schema, map[string]interface{}{"name": long, "name_hash_suffix": true})
+	name := releaseName(d)
+	if len(name) > 53 || !strings.HasPrefix(name, "payments-api-eu-west-1-production-eu-west-1-") {
+		t.Fatalf("expected the name to be shortened to 53 characters, got %q", name)
+	}
+	if err := chartutil.ValidateReleaseName(name); err != nil {
+		t.Fatalf("expected the shortened name %q to be valid, got %s", name, err)
+	}
+	if err := checkReleaseNameLength(d); err != nil {
+		t.Fatalf("expected the shortened name to be accepted, got %s", err)
+	}
+
+	other := schema.TestResourceDataRaw(t, resourceRelease().Schema, map[string]interface{}{"name": long + "x", "name_hash_suffix": true})
+	if releaseName(other) == name {
+		t.Fatal("expected names sharing a prefix to be shortened differently")
+	}
+
+	d = schema.TestResourceDataRaw(t, resourceRelease().Schema, map[string]interface{}{"name": "payments-api", "name_max_length": 10})
+	if err := checkReleaseNameLength(d); err == nil {
+		t.Fatal("expected the name to be rejected with a lower maximum")
+	}
+
+	d = schema.TestResourceDataRaw(t, resourceRelease().Schema, map[string]interface{}{"name": "payments-api", "name_hash_suffix": true})
+	if name := releaseName(d); name != "payments-api" {
+		t.Fatalf("expected a short name to be kept, got %q", name)
+	}
+}
+
+func TestCheckValuesReuse(t *testing.T) {
+	for _, raw := range []map[string]interface{}{
+		{"name": "test"},
+		{"name": "test", "reuse_values": true},
+		{"name": "test", "reset_values": true},
+	} {
+		d := schema.TestResourceDataRaw(t, resourceRelease().Schema, raw)
+		if err := checkValuesReuse(d); err != nil {
+			t.Errorf("expected %v to be accepted, got %s", raw, err)
 		}
+	}
 
-		return nil
+	d := schema.TestResourceDataRaw(t, resourceRelease().Schema, map[string]interface{}{
+		"name":         "test",
+		"reuse_values": true,
+		"reset_values": true,
+	})
+	if err := checkValuesReuse(d); err == nil {
+		t.Fatal("expected reuse_values and reset_values to be rejected together")
+	}
+}
+
+func TestIsRolledBack(t *testing.T) {
+	secrets := driver.NewSecrets(fake.NewSimpleClientset().CoreV1().Secrets("default"))
+	cfg := &action.Configuration{Releases: storage.Init(secrets)}
+
+	if isRolledBack(cfg, "test") {
+		t.Fatal("expected a missing release not to be rolled back")
+	}
+
+	rel := &release.Release{Name: "test", Version: 1, Namespace: "default", Info: &release.Info{Status: release.StatusDeployed, Description: "Install complete"}}
+	if err := cfg.Releases.Create(rel); err != nil {
+		t.Fatal(err)
+	}
+	if isRolledBack(cfg, "test") {
+		t.Fatal("expected an installed release not to be rolled back")
+	}
+
+	rel = &release.Release{Name: "test", Version: 2, Namespace: "default", Info: &release.Info{Status: release.StatusDeployed, Description: "Rollback to 1"}}
+	if err := cfg.Releases.Create(rel); err != nil {
+		t.Fatal(err)
 	}
+	if !isRolledBack(cfg, "test") {
+		t.Fatal("expected the release to be rolled back")
+	}
+}
+
+func TestRecoverPendingRelease(t *testing.T) {
+	newConfig := func(t *testing.T) *action.Configuration {
+		secrets := driver.NewSecrets(fake.NewSimpleClientset().CoreV1().Secrets("default"))
+		cfg := &action.Configuration{
+			Releases:     storage.Init(secrets),
+			KubeClient:   &kubefake.PrintingKubeClient{Out: ioutil.Discard},
+			Capabilities: chartutil.DefaultCapabilities,
+			Log:          debug,
+		}
+
+		ch := &chart.Chart{Metadata: &chart.Metadata{APIVersion: "v2", Name: "test", Version: "1.0.0"}}
+		for _, rel := range []*release.Release{
+			{Name: "test", Version: 1, Namespace: "default", Chart: ch, Info: &release.Info{Status: release.StatusDeployed, Description: "Install complete"}},
+			{Name: "test", Version: 2, Namespace: "default", Chart: ch, Info: &release.Info{Status: release.StatusPendingUpgrade, Description: "Preparing upgrade"}},
+		} {
+			if err := cfg.Releases.Create(rel); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return cfg
+	}
+
+	d := &fakeResourceChangeGetter{values: map[string]interface{}{"pending_recovery": pendingRecoveryNone, "export_hooks": false}}
+	cfg := newConfig(t)
+	if err := recoverPendingRelease(d, cfg, "test"); err == nil {
+		t.Fatal("expected an error for a pending release without pending_recovery")
+	}
+	if err := recoverPendingRelease(d, cfg, "missing"); err != nil {
+		t.Fatalf("expected a missing release to be ignored, got %v", err)
+	}
+
+	d.values["pending_recovery"] = pendingRecoveryUpgrade
+	if err := recoverPendingRelease(d, cfg, "test"); err != nil {
+		t.Fatal(err)
+	}
+	last, err := cfg.Releases.Last("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Version != 2 || last.Info.Status != release.StatusFailed {
+		t.Fatalf("expected revision 2 to be marked as failed, got revision %d in state %s", last.Version, last.Info.Status)
+	}
+	upgrade := action.NewUpgrade(cfg)
+	upgrade.Namespace = "default"
+	if _, err := upgrade.Run("test", last.Chart, map[string]interface{}{}); err != nil {
+		t.Fatalf("expected the recovered release to be upgraded, got %v", err)
+	}
+
+	d.values["pending_recovery"] = pendingRecoveryRollback
+	cfg = newConfig(t)
+	if err := recoverPendingRelease(d, cfg, "test"); err != nil {
+		t.Fatal(err)
+	}
+	last, err = cfg.Releases.Last("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Version != 3 || last.Info.Status != release.StatusDeployed || last.Info.Description != "Rollback to 1" {
+		t.Fatalf("expected revision 3 to roll back to revision 1, got revision %d in state %s: %s", last.Version, last.Info.Status, last.Info.Description)
+	}
+	if !isRolledBack(cfg, "test") {
+		t.Fatal("expected the release to be rolled back")
+	}
+}
+
+func TestCoalescedValues(t *testing.T) {
+	sub := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "database", Version: "1.0.0"},
+		Values:   map[string]interface{}{"port": 5432, "user": "admin"},
+	}
+	ch := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "umbrella", Version: "1.0.0"},
+		Values:   map[string]interface{}{"replicas": 1},
+	}
+	ch.AddDependency(sub)
+
+	r := &release.Release{
+		Chart:  ch,
+		Config: map[string]interface{}{"database": map[string]interface{}{"user": "app"}},
+	}
+	coalesced, err := coalescedValues(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(coalesced), &values); err != nil {
+		t.Fatal(err)
+	}
+	if values["replicas"] != float64(1) {
+		t.Fatalf("expected the default values of the chart, got %s", coalesced)
+	}
+	database, ok := values["database"].(map[string]interface{})
+	if !ok || database["port"] != float64(5432) || database["user"] != "app" {
+		t.Fatalf("expected the default values of the subchart with the overrides of the release, got %s", coalesced)
+	}
+
+	if _, ok := r.Config["replicas"]; ok {
+		t.Fatal("expected the release config not to be modified")
+	}
+}
+
+func TestCheckPinnedVersion(t *testing.T) {
+	m := &Meta{RequirePinnedVersion: true}
+
+	tests := []struct {
+		name     string
+		values   map[string]interface{}
+		rejected bool
+	}{
+		{"unpinned repository chart", map[string]interface{}{"name": "test", "chart": "stable/nginx", "version": ""}, true},
+		{"pinned repository chart", map[string]interface{}{"name": "test", "chart": "stable/nginx", "version": "1.2.3"}, false},
+		{"local chart", map[string]interface{}{"name": "test", "chart": "./testdata/charts/test-chart", "version": ""}, false},
+		{"chart URL", map[string]interface{}{"name": "test", "chart": "https://charts.example.com/nginx-1.2.3.tgz", "version": ""}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPinnedVersion(&fakeResourceChangeGetter{values: tt.values}, m)
+			if tt.rejected != (err != nil) {
+				t.Fatalf("expected the release to be rejected: %t, got %v", tt.rejected, err)
+			}
+		})
+	}
+
+	d := &fakeResourceChangeGetter{values: tests[0].values}
+	if err := checkPinnedVersion(d, &Meta{}); err != nil {
+		t.Fatalf("expected unpinned releases to be allowed by default, got %v", err)
+	}
+}
+
+func TestResolvedDependencies(t *testing.T) {
+	sub := &chart.Chart{Metadata: &chart.Metadata{Name: "subchart", Version: "1.4.2"}}
+	ch := &chart.Chart{Metadata: &chart.Metadata{
+		Name:    "umbrella",
+		Version: "1.0.0",
+		Dependencies: []*chart.Dependency{
+			{Name: "subchart", Version: "~1.4.0", Repository: "https://charts.example.com"},
+		},
+	}}
+	ch.AddDependency(sub)
+
+	expected := []map[string]interface{}{
+		{"name": "subchart", "version": "1.4.2", "repository": "https://charts.example.com"},
+	}
+	if deps := resolvedDependencies(ch); !reflect.DeepEqual(deps, expected) {
+		t.Fatalf("expected the versions of the subcharts %v, got %v", expected, deps)
+	}
+
+	ch.Lock = &chart.Lock{Dependencies: []*chart.Dependency{
+		{Name: "subchart", Version: "1.4.3", Repository: "https://charts.example.com"},
+	}}
+	expected[0]["version"] = "1.4.3"
+	if deps := resolvedDependencies(ch); !reflect.DeepEqual(deps, expected) {
+		t.Fatalf("expected the versions of the lock file %v, got %v", expected, deps)
+	}
+
+	if deps := resolvedDependencies(sub); len(deps) != 0 {
+		t.Fatalf("expected no dependencies, got %v", deps)
+	}
+}
+
+func TestCheckImportLabel(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	secrets := driver.NewSecrets(clientset.CoreV1().Secrets("default"))
+	cfg := &action.Configuration{Releases: storage.Init(secrets)}
+
+	rel := &release.Release{Name: "test", Version: 1, Namespace: "default", Info: &release.Info{Status: release.StatusDeployed}}
+	if err := cfg.Releases.Create(rel); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Meta{}
+	if err := checkImportLabel(m, cfg, "test"); err != nil {
+		t.Fatalf("expected import without a required label to succeed, got %s", err)
+	}
+
+	m.ImportRequiredLabel = "terraform.io/managed=true"
+	if err := checkImportLabel(m, cfg, "test"); err == nil {
+		t.Fatal("expected import of a release without the label to fail")
+	}
+
+	secret, err := clientset.CoreV1().Secrets("default").Get(context.TODO(), "sh.helm.release.v1.test.v1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret.Labels["terraform.io/managed"] = "true"
+	if _, err := clientset.CoreV1().Secrets("default").Update(context.TODO(), secret, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkImportLabel(m, cfg, "test"); err != nil {
+		t.Fatalf("expected import of a labeled release to succeed, got %s", err)
+	}
+}
+
+func TestUninstallReleaseForceDestroy(t *testing.T) {
+	newConfig := func(status release.Status) *action.Configuration {
+		secrets := driver.NewSecrets(fake.NewSimpleClientset().CoreV1().Secrets("default"))
+		cfg := &action.Configuration{
+			Releases: storage.Init(secrets),
+			KubeClient: &kubefake.FailingKubeClient{
+				PrintingKubeClient:   kubefake.PrintingKubeClient{Out: ioutil.Discard},
+				WatchUntilReadyError: errors.New("timed out waiting for the condition"),
+			},
+			Capabilities: chartutil.DefaultCapabilities,
+			Log:          func(string, ...interface{}) {},
+		}
+
+		rel := &release.Release{
+			Name:      "test",
+			Version:   1,
+			Namespace: "default",
+			Info:      &release.Info{Status: status},
+			Hooks: []*release.Hook{
+				{Name: "cleanup", Kind: "Job", Path: "templates/cleanup.yaml", Events: []release.HookEvent{release.HookPreDelete}},
+			},
+		}
+		if err := cfg.Releases.Create(rel); err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+
+	d := schema.TestResourceDataRaw(t, resourceRelease().Schema, map[string]interface{}{"name": "test"})
+
+	cfg := newConfig(release.StatusDeployed)
+	if _, err := uninstallRelease(cfg, d, "test"); err == nil {
+		t.Fatal("expected the uninstall to fail on the pre-delete hook")
+	}
+	if _, err := cfg.Releases.Last("test"); err != nil {
+		t.Fatalf("expected the release to be kept after a failed uninstall, got %s", err)
+	}
+
+	d.Set("force_destroy", true)
+
+	cfg = newConfig(release.StatusDeployed)
+	if _, err := uninstallRelease(cfg, d, "test"); err != nil {
+		t.Fatalf("expected the uninstall to be retried without hooks, got %s", err)
+	}
+	if _, err := cfg.Releases.Last("test"); err == nil {
+		t.Fatal("expected the release to be uninstalled")
+	}
+
+	cfg = newConfig(release.StatusUninstalling)
+	if _, err := uninstallRelease(cfg, d, "test"); err != nil {
+		t.Fatalf("expected the stuck release to be uninstalled without hooks, got %s", err)
+	}
+	if _, err := cfg.Releases.Last("test"); err == nil {
+		t.Fatal("expected the stuck release to be uninstalled")
+	}
+}
+
+func testAccHelmReleaseConfigRepositoryURL(resource, ns, name string) string {
+	return fmt.Sprintf(`
+		resource "helm_release" %q {
+			name       = %q
+			namespace  = %q
+			repository = %q
+			chart      = "test-chart"
+		}
+	`, resource, name, ns, testRepositoryURL)
+}
+
+func testAccPreCheckHelmRepositoryDestroy(t *testing.T, name string) {
+	settings := testAccProvider.Meta().(*Meta).Settings
+
+	rc := settings.RepositoryConfig
+
+	r, err := repo.LoadFile(rc)
+
+	if isNotExist(err) || len(r.Repositories) == 0 || !r.Remove(name) {
+		t.Log(fmt.Sprintf("no repo named %q found, nothing to do", name))
+		return
+	}
+
+	if err := r.WriteFile(rc, 0644); err != nil {
+		t.Fatalf("Failed to write repositories file: %s", err)
+	}
+
+	if err := removeRepoCache(settings.RepositoryCache, name); err != nil {
+		t.Fatalf("Failed to remove repository cache: %s", err)
+	}
+
+	_, err = fmt.Fprintf(os.Stdout, "%q has been removed from your repositories\n", name)
+	if err != nil {
+		t.Fatalf("error printing stdout: %v", err)
+	}
+
+	t.Log(fmt.Sprintf("%q has been removed from your repositories\n", name))
+}
+
+func isNotExist(err error) bool {
+	return os.IsNotExist(errors.Cause(err))
+}
+
+func removeRepoCache(root, name string) error {
+	idx := filepath.Join(root, helmpath.CacheIndexFile(name))
+	if _, err := os.Stat(idx); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "can't remove index file %s", idx)
+	}
+	return os.Remove(idx)
+}
+
+func testAccCheckHelmReleaseDependencyUpdate(namespace string, name string, expectedResources int) resource.TestCheckFunc {
+	// NOTE this is a regression test to check that a charts dependencies have not been
+	// deleted from the manifest on update.
+
+	return func(s *terraform.State) error {
+		m := testAccProvider.Meta()
+		if m == nil {
+			return fmt.Errorf("provider not properly initialized")
+		}
+
+		actionConfig, err := m.(*Meta).GetHelmConfiguration(namespace)
+		if err != nil {
+			return err
+		}
+
+		client := action.NewGet(actionConfig)
+		res, err := client.Run(name)
+
+		if res == nil {
+			return fmt.Errorf("release %q not found", name)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		resources := releaseutil.SplitManifests(res.Manifest)
+		if len(resources) != expectedResources {
+			return fmt.Errorf("expected %v resources but got %v", expectedResources, len(resources))
+		}
+
+		return nil
+	}
+}
+
+func testAccCheckHelmReleaseDestroy(namespace string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		m := testAccProvider.Meta()
+		if m == nil {
+			return fmt.Errorf("provider not properly initialized")
+		}
+
+		actionConfig, err := m.(*Meta).GetHelmConfiguration(namespace)
+		if err != nil {
+			return err
+		}
+
+		client := action.NewList(actionConfig)
+		res, err := client.Run()
+
+		if res == nil {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		for _, r := range res {
+			if r.Name == testResourceName {
+				return fmt.Errorf("found %q release", testResourceName)
+			}
+
+			if r.Namespace == namespace {
+				return fmt.Errorf("%q namespace should be empty", namespace)
+			}
+		}
+
+		return nil
+	}
+}
+
+func testAccHelmReleaseConfigPostrender(resource, ns, name, binaryPath string) string {
+	return fmt.Sprintf(`
+		resource "helm_release" "%s" {
+ 			name        = %q
+			namespace   = %q
+			repository  = %q
+  			chart       = "test-chart"
+			version     = "1.2.3"
+
+			postrender {
+				binary_path = %q
+			}
+
+			set {
+				name = "serviceAccount.create"
+				value = false
+			}
+			set {
+				name = "service.port"
+				value = 1337
+			}
+		}
+	`, resource, name, ns, testRepositoryURL, binaryPath)
+}
+
+func TestAccResourceRelease_LintFailValues(t *testing.T) {
+	namespace := createRandomNamespace(t)
+	defer deleteNamespace(t, namespace)
+
+	broken := fmt.Sprintf(`
+	resource "helm_release" "test" {
+		name        = "foo"
+		namespace   = %q
+		repository  = %q
+		chart       = "test-chart"
+		lint        = true
+		values = [
+			"replicaCount:\n  - foo: qux"
+		]
+	}`, namespace, testRepositoryURL)
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:     func() { testAccPreCheck(t) },
+		Providers:    testAccProviders,
+		CheckDestroy: testAccCheckHelmReleaseDestroy(namespace),
+		Steps: []resource.TestStep{
+			{
+				Config:             broken,
+				PlanOnly:           true,
+				ExpectError:        regexp.MustCompile("malformed chart or values"),
+				ExpectNonEmptyPlan: true,
+			},
+		},
+	})
+}
+
+func TestAccResourceRelease_LintFailChart(t *testing.T) {
+	namespace := createRandomNamespace(t)
+	defer deleteNamespace(t, namespace)
+
+	broken := fmt.Sprintf(`
+	resource "helm_release" "test" {
+		name        = "foo"
+		namespace   = %q
+		chart       = "broken-chart"
+		repository  = %q
+		lint        = true
+	}`, namespace, testRepositoryURL)
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:     func() { testAccPreCheck(t) },
+		Providers:    testAccProviders,
+		CheckDestroy: testAccCheckHelmReleaseDestroy(namespace),
+		Steps: []resource.TestStep{
+			{
+				Config:             broken,
+				PlanOnly:           true,
+				ExpectError:        regexp.MustCompile(`function "BAD_FUNCTION" not defined`),
+				ExpectNonEmptyPlan: true,
+			},
+		},
+	})
+}
+
+func TestAccResourceRelease_FailedDeployFailsApply(t *testing.T) {
+	name := randName("test-failed-deploy-fails-apply")
+	namespace := createRandomNamespace(t)
+	defer deleteNamespace(t, namespace)
+
+	failed := fmt.Sprintf(`
+	resource "helm_release" "test" {
+		name        = %q
+		chart       = "failed-deploy"
+		repository  = %q
+	}`, name, testRepositoryURL)
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:     func() { testAccPreCheck(t) },
+		Providers:    testAccProviders,
+		CheckDestroy: testAccCheckHelmReleaseDestroy(namespace),
+		Steps: []resource.TestStep{
+			{
+				Config:   failed,
+				PlanOnly: false,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "status", release.StatusFailed.String()),
+				),
+				ExpectError:        regexp.MustCompile(`namespaces "doesnt-exist" not found`),
+				ExpectNonEmptyPlan: true,
+			},
+		},
+	})
+}
+
+func TestAccResourceRelease_nonFatalHooks(t *testing.T) {
+	name := randName("non-fatal-hooks")
+	namespace := createRandomNamespace(t)
+	defer deleteNamespace(t, namespace)
+
+	config := fmt.Sprintf(`
+	resource "helm_release" "test" {
+		name            = %q
+		namespace       = %q
+		chart           = "failing-hook"
+		repository      = %q
+		non_fatal_hooks = ["%s-register"]
+	}`, name, namespace, testRepositoryURL, name)
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:     func() { testAccPreCheck(t) },
+		Providers:    testAccProviders,
+		CheckDestroy: testAccCheckHelmReleaseDestroy(namespace),
+		Steps: []resource.TestStep{
+			{
+				Config: config,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "status", release.StatusDeployed.String()),
+					resource.TestCheckResourceAttr("helm_release.test", "metadata.0.revision", "1"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceRelease_disableHooks(t *testing.T) {
+	name := randName("disable-hooks")
+	namespace := createRandomNamespace(t)
+	defer deleteNamespace(t, namespace)
+
+	// without disable_hooks the destroy would hang on the pre-delete hook
+	config := fmt.Sprintf(`
+	resource "helm_release" "test" {
+		name          = %q
+		namespace     = %q
+		chart         = "hanging-hook"
+		repository    = %q
+		disable_hooks = ["pre-delete"]
+	}`, name, namespace, testRepositoryURL)
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:     func() { testAccPreCheck(t) },
+		Providers:    testAccProviders,
+		CheckDestroy: testAccCheckHelmReleaseDestroy(namespace),
+		Steps: []resource.TestStep{
+			{
+				Config: config,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "status", release.StatusDeployed.String()),
+					resource.TestCheckResourceAttr("helm_release.test", "disable_hooks.#", "1"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceRelease_hookResults(t *testing.T) {
+	name := randName("hook-results")
+	namespace := createRandomNamespace(t)
+	defer deleteNamespace(t, namespace)
+
+	config := fmt.Sprintf(`
+	resource "helm_release" "test" {
+		name       = %q
+		namespace  = %q
+		chart      = "install-hook"
+		repository = %q
+	}`, name, namespace, testRepositoryURL)
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:     func() { testAccPreCheck(t) },
+		Providers:    testAccProviders,
+		CheckDestroy: testAccCheckHelmReleaseDestroy(namespace),
+		Steps: []resource.TestStep{
+			{
+				Config: config,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "hook_results.#", "1"),
+					resource.TestCheckResourceAttr("helm_release.test", "hook_results.0.name", name+"-setup"),
+					resource.TestCheckResourceAttr("helm_release.test", "hook_results.0.kind", "Job"),
+					resource.TestCheckResourceAttr("helm_release.test", "hook_results.0.events.0", "pre-install"),
+					resource.TestCheckResourceAttr("helm_release.test", "hook_results.0.phase", "Succeeded"),
+					resource.TestCheckResourceAttrSet("helm_release.test", "hook_results.0.last_run"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceRelease_lookup(t *testing.T) {
+	name := randName("lookup")
+	namespace := createRandomNamespace(t)
+	defer deleteNamespace(t, namespace)
+
+	config := fmt.Sprintf(`
+	resource "helm_release" "test" {
+		name       = %q
+		namespace  = %q
+		chart      = "lookup-chart"
+		repository = %q
+	}`, name, namespace, testRepositoryURL)
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:     func() { testAccPreCheck(t) },
+		Providers:    testAccProviders,
+		CheckDestroy: testAccCheckHelmReleaseDestroy(namespace),
+		Steps: []resource.TestStep{
+			{
+				PreConfig: func() {
+					source := &v1.ConfigMap{
+						ObjectMeta: metav1.ObjectMeta{Name: "lookup-source"},
+						Data:       map[string]string{"greeting": "hello"},
+					}
+					if _, err := client.CoreV1().ConfigMaps(namespace).Create(context.TODO(), source, metav1.CreateOptions{}); err != nil {
+						t.Fatalf("Failed to create the lookup source: %s", err)
+					}
+				},
+				Config: config,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "status", release.StatusDeployed.String()),
+					testAccCheckHelmReleaseLookup(namespace, name, "hello"),
+				),
+			},
+		},
+	})
+}
+
+// testAccCheckHelmReleaseLookup checks the value the chart read with lookup
+// from the source ConfigMap
+func testAccCheckHelmReleaseLookup(namespace, name, expected string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		cm, err := client.CoreV1().ConfigMaps(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if cm.Data["greeting"] != expected {
+			return fmt.Errorf("expected lookup to return %q, got %q", expected, cm.Data["greeting"])
+		}
+		return nil
+	}
+}
+
+func TestAccResourceRelease_changeCause(t *testing.T) {
+	name := randName("change-cause")
+	namespace := createRandomNamespace(t)
+	defer deleteNamespace(t, namespace)
+
+	config := func(cause string) string {
+		return fmt.Sprintf(`
+		resource "helm_release" "test" {
+			name         = %q
+			namespace    = %q
+			chart        = "test-chart"
+			repository   = %q
+			change_cause = %q
+		}`, name, namespace, testRepositoryURL, cause)
+	}
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:     func() { testAccPreCheck(t) },
+		Providers:    testAccProviders,
+		CheckDestroy: testAccCheckHelmReleaseDestroy(namespace),
+		Steps: []resource.TestStep{
+			{
+				Config: config("initial install"),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "metadata.0.revision", "1"),
+					testAccCheckHelmReleaseChangeCause(namespace, name+"-test-chart", "initial install"),
+				),
+			},
+			{
+				Config: config("rotate credentials"),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "metadata.0.revision", "2"),
+					testAccCheckHelmReleaseChangeCause(namespace, name+"-test-chart", "rotate credentials"),
+				),
+			},
+		},
+	})
+}
+
+func testAccCheckHelmReleaseChangeCause(namespace, name, expected string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		deployment, err := client.AppsV1().Deployments(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if cause := deployment.Annotations[changeCauseAnnotation]; cause != expected {
+			return fmt.Errorf("expected change cause %q, got %q", expected, cause)
+		}
+		return nil
+	}
+}
+
+func TestAccResourceRelease_namespaceChange(t *testing.T) {
+	name := randName("namespace-change")
+	namespace := createRandomNamespace(t)
+	defer deleteNamespace(t, namespace)
+	newNamespace := createRandomNamespace(t)
+	defer deleteNamespace(t, newNamespace)
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:     func() { testAccPreCheck(t) },
+		Providers:    testAccProviders,
+		CheckDestroy: testAccCheckHelmReleaseDestroy(newNamespace),
+		Steps: []resource.TestStep{
+			{
+				Config: testAccHelmReleaseConfigBasic(testResourceName, namespace, name, "1.2.3"),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "metadata.0.namespace", namespace),
+					resource.TestCheckResourceAttr("helm_release.test", "metadata.0.revision", "1"),
+				),
+			},
+			{
+				Config: testAccHelmReleaseConfigBasic(testResourceName, newNamespace, name, "1.2.3"),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "metadata.0.namespace", newNamespace),
+					// the release is installed again rather than upgraded
+					resource.TestCheckResourceAttr("helm_release.test", "metadata.0.revision", "1"),
+					resource.TestCheckResourceAttr("helm_release.test", "status", release.StatusDeployed.String()),
+					testAccCheckHelmReleaseDestroy(namespace),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceRelease_failOnDeprecated(t *testing.T) {
+	name := randName("deprecated")
+	namespace := createRandomNamespace(t)
+	defer deleteNamespace(t, namespace)
+
+	config := func(failOnDeprecated bool) string {
+		return fmt.Sprintf(`
+		resource "helm_release" "test" {
+			name               = %q
+			namespace          = %q
+			chart              = "deprecated-chart"
+			repository         = %q
+			fail_on_deprecated = %t
+		}`, name, namespace, testRepositoryURL, failOnDeprecated)
+	}
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:     func() { testAccPreCheck(t) },
+		Providers:    testAccProviders,
+		CheckDestroy: testAccCheckHelmReleaseDestroy(namespace),
+		Steps: []resource.TestStep{
+			{
+				Config:      config(true),
+				ExpectError: regexp.MustCompile("chart deprecated-chart version 1.2.3 is deprecated"),
+			},
+			{
+				Config: config(false),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "status", release.StatusDeployed.String()),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceRelease_readinessPercentage(t *testing.T) {
+	name := randName("readiness-percentage")
+	namespace := createRandomNamespace(t)
+	defer deleteNamespace(t, namespace)
+
+	config := fmt.Sprintf(`
+	resource "helm_release" "test" {
+		name                 = %q
+		namespace            = %q
+		chart                = "test-chart"
+		repository           = %q
+		readiness_percentage = 50
+
+		set {
+			name  = "replicaCount"
+			value = 4
+		}
+	}`, name, namespace, testRepositoryURL)
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:     func() { testAccPreCheck(t) },
+		Providers:    testAccProviders,
+		CheckDestroy: testAccCheckHelmReleaseDestroy(namespace),
+		Steps: []resource.TestStep{
+			{
+				Config: config,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "status", release.StatusDeployed.String()),
+					resource.TestCheckResourceAttr("helm_release.test", "readiness_percentage", "50"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceRelease_pruneOrphans(t *testing.T) {
+	name := randName("prune-orphans")
+	namespace := createRandomNamespace(t)
+	defer deleteNamespace(t, namespace)
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:     func() { testAccPreCheck(t) },
+		Providers:    testAccProviders,
+		CheckDestroy: testAccCheckHelmReleaseDestroy(namespace),
+		Steps: []resource.TestStep{
+			{
+				Config: testAccHelmReleaseConfigPruneOrphans(testResourceName, namespace, name, true),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "metadata.0.revision", "1"),
+					testAccCheckServiceAccountExists(namespace, name, true),
+				),
+			},
+			{
+				Config: testAccHelmReleaseConfigPruneOrphans(testResourceName, namespace, name, false),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "metadata.0.revision", "2"),
+					resource.TestCheckResourceAttr("helm_release.test", "status", release.StatusDeployed.String()),
+					testAccCheckServiceAccountExists(namespace, name, false),
+				),
+			},
+		},
+	})
+}
+
+func testAccHelmReleaseConfigPruneOrphans(resource, ns, name string, createServiceAccount bool) string {
+	return fmt.Sprintf(`
+		resource "helm_release" "%s" {
+			name          = %q
+			namespace     = %q
+			chart         = "./testdata/charts/test-chart"
+			prune_orphans = true
+
+			set {
+				name  = "fullnameOverride"
+				value = %q
+			}
+
+			set {
+				name  = "serviceAccount.create"
+				value = %t
+			}
+		}
+	`, resource, name, ns, name, createServiceAccount)
+}
+
+func testAccCheckServiceAccountExists(namespace, name string, exists bool) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		_, err := client.CoreV1().ServiceAccounts(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if exists {
+			return err
+		}
+		if err == nil {
+			return fmt.Errorf("service account %s/%s still exists", namespace, name)
+		}
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		return nil
+	}
+}
+
+func TestAccResourceRelease_reuseValues(t *testing.T) {
+	name := randName("reuse-values")
+	namespace := createRandomNamespace(t)
+	defer deleteNamespace(t, namespace)
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:     func() { testAccPreCheck(t) },
+		Providers:    testAccProviders,
+		CheckDestroy: testAccCheckHelmReleaseDestroy(namespace),
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+				resource "helm_release" "test" {
+					name      = %q
+					namespace = %q
+					chart     = "./testdata/charts/test-chart"
+
+					set {
+						name  = "podAnnotations.team"
+						value = "payments"
+					}
+				}`, name, namespace),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "metadata.0.revision", "1"),
+					resource.TestMatchResourceAttr("helm_release.test", "get.0.values", regexp.MustCompile("team: payments")),
+				),
+			},
+			{
+				// the value set by the last apply is kept by the upgrade
+				Config: fmt.Sprintf(`
+				resource "helm_release" "test" {
+					name         = %q
+					namespace    = %q
+					chart        = "./testdata/charts/test-chart"
+					reuse_values = true
+				}`, name, namespace),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "metadata.0.revision", "2"),
+					resource.TestMatchResourceAttr("helm_release.test", "get.0.values", regexp.MustCompile("team: payments")),
+				),
+			},
+			{
+				Config: fmt.Sprintf(`
+				resource "helm_release" "test" {
+					name         = %q
+					namespace    = %q
+					chart        = "./testdata/charts/test-chart"
+					reuse_values = true
+					reset_values = true
+				}`, name, namespace),
+				ExpectError: regexp.MustCompile("reuse_values and reset_values cannot both be set"),
+			},
+		},
+	})
+}
+
+func TestAccResourceRelease_cleanupOnFail(t *testing.T) {
+	name := randName("cleanup-on-fail")
+	namespace := createRandomNamespace(t)
+	defer deleteNamespace(t, namespace)
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:     func() { testAccPreCheck(t) },
+		Providers:    testAccProviders,
+		CheckDestroy: testAccCheckHelmReleaseDestroy(namespace),
+		Steps: []resource.TestStep{
+			{
+				Config: testAccHelmReleaseConfigCleanupOnFail(testResourceName, namespace, name, false, "nginx"),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "metadata.0.revision", "1"),
+					testAccCheckServiceAccountExists(namespace, name, false),
+				),
+			},
+			{
+				// the upgrade adds a service account and times out waiting
+				// for the pods of an image that does not exist
+				Config:      testAccHelmReleaseConfigCleanupOnFail(testResourceName, namespace, name, true, "nginx-does-not-exist"),
+				ExpectError: regexp.MustCompile("timed out waiting for the condition"),
+			},
+			{
+				PreConfig: func() {
+					// the service account created by the failed upgrade was
+					// deleted
+					if err := testAccCheckServiceAccountExists(namespace, name, false)(nil); err != nil {
+						t.Fatal(err)
+					}
+				},
+				Config: testAccHelmReleaseConfigCleanupOnFail(testResourceName, namespace, name, false, "nginx"),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "status", release.StatusDeployed.String()),
+				),
+			},
+		},
+	})
 }
 
-func testAccHelmReleaseConfigPostrender(resource, ns, name, binaryPath string) string {
+func testAccHelmReleaseConfigCleanupOnFail(resource, ns, name string, createServiceAccount bool, image string) string {
 	return fmt.Sprintf(`
 		resource "helm_release" "%s" {
- 			name        = %q
-			namespace   = %q
-			repository  = %q
-  			chart       = "test-chart"
-			version     = "1.2.3"
+			name            = %q
+			namespace       = %q
+			chart           = "./testdata/charts/test-chart"
+			cleanup_on_fail = true
+			timeout         = 30
 
-			postrender {
-				binary_path = %q
+			set {
+				name  = "fullnameOverride"
+				value = %q
 			}
 
 			set {
-				name = "serviceAccount.create"
-				value = false
+				name  = "serviceAccount.create"
+				value = %t
 			}
+
 			set {
-				name = "service.port"
-				value = 1337
+				name  = "image.repository"
+				value = %q
 			}
 		}
-	`, resource, name, ns, testRepositoryURL, binaryPath)
+	`, resource, name, ns, name, createServiceAccount, image)
 }
 
-func TestAccResourceRelease_LintFailValues(t *testing.T) {
+func TestAccResourceRelease_createdResources(t *testing.T) {
+	name := randName("created-resources")
 	namespace := createRandomNamespace(t)
 	defer deleteNamespace(t, namespace)
 
-	broken := fmt.Sprintf(`
-	resource "helm_release" "test" {
-		name        = "foo"
-		namespace   = %q
-		repository  = %q
-		chart       = "test-chart"
-		lint        = true
-		values = [
-			"replicaCount:\n  - foo: qux"
-		]
-	}`, namespace, testRepositoryURL)
-
+	uid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
 	resource.ParallelTest(t, resource.TestCase{
 		PreCheck:     func() { testAccPreCheck(t) },
 		Providers:    testAccProviders,
 		CheckDestroy: testAccCheckHelmReleaseDestroy(namespace),
 		Steps: []resource.TestStep{
 			{
-				Config:             broken,
-				PlanOnly:           true,
-				ExpectError:        regexp.MustCompile("malformed chart or values"),
-				ExpectNonEmptyPlan: true,
+				Config: testAccHelmReleaseConfigCreatedResources(testResourceName, namespace, name, false),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "created_resources.#", "0"),
+				),
+			},
+			{
+				Config: testAccHelmReleaseConfigCreatedResources(testResourceName, namespace, name, true),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "metadata.0.revision", "2"),
+					resource.TestCheckResourceAttrSet("helm_release.test", "created_resources.0.kind"),
+					resource.TestCheckResourceAttr("helm_release.test", "created_resources.0.namespace", namespace),
+					resource.TestMatchResourceAttr("helm_release.test", "created_resources.0.uid", uid),
+				),
 			},
 		},
 	})
 }
 
-func TestAccResourceRelease_LintFailChart(t *testing.T) {
-	namespace := createRandomNamespace(t)
-	defer deleteNamespace(t, namespace)
-
-	broken := fmt.Sprintf(`
-	resource "helm_release" "test" {
-		name        = "foo"
-		namespace   = %q
-		chart       = "broken-chart"
-		repository  = %q
-		lint        = true
-	}`, namespace, testRepositoryURL)
+func testAccHelmReleaseConfigCreatedResources(resource, ns, name string, record bool) string {
+	return fmt.Sprintf(`
+		resource "helm_release" "%s" {
+			name        = %q
+			namespace   = %q
+			description = "record_created_resources = %t"
+			chart       = "./testdata/charts/test-chart"
 
-	resource.ParallelTest(t, resource.TestCase{
-		PreCheck:     func() { testAccPreCheck(t) },
-		Providers:    testAccProviders,
-		CheckDestroy: testAccCheckHelmReleaseDestroy(namespace),
-		Steps: []resource.TestStep{
-			{
-				Config:             broken,
-				PlanOnly:           true,
-				ExpectError:        regexp.MustCompile(`function "BAD_FUNCTION" not defined`),
-				ExpectNonEmptyPlan: true,
-			},
-		},
-	})
+			record_created_resources = %t
+		}
+	`, resource, name, ns, record, record)
 }
 
-func TestAccResourceRelease_FailedDeployFailsApply(t *testing.T) {
-	name := randName("test-failed-deploy-fails-apply")
+func TestAccResourceRelease_waitForCRDs(t *testing.T) {
+	name := randName("wait-for-crds")
 	namespace := createRandomNamespace(t)
 	defer deleteNamespace(t, namespace)
 
-	failed := fmt.Sprintf(`
-	resource "helm_release" "test" {
-		name        = %q
-		chart       = "failed-deploy"
-		repository  = %q
-	}`, name, testRepositoryURL)
-
+	// the CRD is cluster-wide, so its group is unique to the test
+	group := fmt.Sprintf("%s.example.com", acctest.RandString(10))
 	resource.ParallelTest(t, resource.TestCase{
 		PreCheck:     func() { testAccPreCheck(t) },
 		Providers:    testAccProviders,
 		CheckDestroy: testAccCheckHelmReleaseDestroy(namespace),
 		Steps: []resource.TestStep{
 			{
-				Config:   failed,
-				PlanOnly: false,
+				Config: testAccHelmReleaseConfigWaitForCRDs(namespace, name, group),
 				Check: resource.ComposeAggregateTestCheckFunc(
-					resource.TestCheckResourceAttr("helm_release.test", "status", release.StatusFailed.String()),
+					resource.TestCheckResourceAttr("helm_release.crds", "status", release.StatusDeployed.String()),
+					resource.TestCheckResourceAttr("helm_release.widgets", "status", release.StatusDeployed.String()),
 				),
-				ExpectError:        regexp.MustCompile(`namespaces "doesnt-exist" not found`),
-				ExpectNonEmptyPlan: true,
 			},
 		},
 	})
 }
 
+// testAccHelmReleaseConfigWaitForCRDs installs the CRD and its custom
+// resource in separate releases, without depends_on, so that both are
+// installed at the same time
+func testAccHelmReleaseConfigWaitForCRDs(ns, name, group string) string {
+	return fmt.Sprintf(`
+		resource "helm_release" "crds" {
+			name      = "%[2]s-crds"
+			namespace = %[1]q
+			chart     = "./testdata/charts/crd-chart"
+
+			set {
+				name  = "group"
+				value = %[3]q
+			}
+		}
+
+		resource "helm_release" "widgets" {
+			name      = "%[2]s-widgets"
+			namespace = %[1]q
+			chart     = "./testdata/charts/cr-chart"
+			timeout   = 60
+
+			set {
+				name  = "group"
+				value = %[3]q
+			}
+
+			wait_for_crds = ["widgets.%[3]s"]
+		}
+	`, ns, name, group)
+}
+
 func TestAccResourceRelease_dependency(t *testing.T) {
 	name := fmt.Sprintf("test-dependency-%s", acctest.RandString(10))
 	namespace := createRandomNamespace(t)
@@ -1055,6 +2812,12 @@ func TestAccResourceRelease_dependency(t *testing.T) {
 					resource.TestCheckResourceAttr("helm_release.test", "metadata.0.revision", "1"),
 					resource.TestCheckResourceAttr("helm_release.test", "status", release.StatusDeployed.String()),
 					resource.TestCheckResourceAttr("helm_release.test", "dependency_update", "true"),
+					resource.TestCheckResourceAttr("helm_release.test", "dependencies.#", "2"),
+					resource.TestCheckResourceAttr("helm_release.test", "dependencies.0.name", "dependency-foo"),
+					resource.TestCheckResourceAttr("helm_release.test", "dependencies.0.version", "0.1.0"),
+					resource.TestCheckResourceAttr("helm_release.test", "dependencies.0.repository", "file://../dependency-foo"),
+					resource.TestCheckResourceAttr("helm_release.test", "dependencies.1.name", "dependency-bar"),
+					resource.TestCheckResourceAttr("helm_release.test", "dependencies.1.version", "0.1.0"),
 				),
 			},
 			{
@@ -1098,6 +2861,112 @@ func TestAccResourceRelease_chartURL(t *testing.T) {
 	})
 }
 
+func TestAccResourceRelease_repositoryCredentialsSecret(t *testing.T) {
+	name := randName("repository-credentials")
+	namespace := createRandomNamespace(t)
+	defer deleteNamespace(t, namespace)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "admin" || password != "s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.FileServer(http.Dir(testRepositoryDir)).ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "repository-credentials", Namespace: namespace},
+		Data:       map[string][]byte{"username": []byte("admin"), "password": []byte("s3cr3t")},
+	}
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck: func() {
+			testAccPreCheck(t)
+			if _, err := client.CoreV1().Secrets(namespace).Create(context.TODO(), secret, metav1.CreateOptions{}); err != nil {
+				t.Fatalf("Failed to create the credentials Secret: %s", err)
+			}
+		},
+		Providers:    testAccProviders,
+		CheckDestroy: testAccCheckHelmReleaseDestroy(namespace),
+		Steps: []resource.TestStep{
+			{
+				Config: testAccHelmReleaseConfigRepositoryCredentialsSecret(testResourceName, namespace, name, server.URL),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "status", release.StatusDeployed.String()),
+					resource.TestCheckResourceAttr("helm_release.test", "metadata.0.chart", "test-chart"),
+					resource.TestCheckNoResourceAttr("helm_release.test", "repository_password"),
+				),
+			},
+		},
+	})
+}
+
+func testAccHelmReleaseConfigRepositoryCredentialsSecret(resource, ns, name, url string) string {
+	return fmt.Sprintf(`
+		resource "helm_release" "%s" {
+			name       = %q
+			namespace  = %q
+			repository = %q
+			chart      = "test-chart"
+			version    = "1.2.3"
+
+			repository_credentials_secret {
+				name      = "repository-credentials"
+				namespace = %q
+			}
+		}
+	`, resource, name, ns, url, ns)
+}
+
+func TestAccResourceRelease_policy(t *testing.T) {
+	if _, err := exec.LookPath("conftest"); err != nil {
+		t.Skip("conftest is not installed")
+	}
+
+	name := randName("policy")
+	namespace := createRandomNamespace(t)
+	defer deleteNamespace(t, namespace)
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:     func() { testAccPreCheck(t) },
+		Providers:    testAccProviders,
+		CheckDestroy: testAccCheckHelmReleaseDestroy(namespace),
+		Steps: []resource.TestStep{
+			{
+				Config:      testAccHelmReleaseConfigPolicy(testResourceName, namespace, name, 1),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile("must run at least 2 replicas"),
+			},
+			{
+				Config: testAccHelmReleaseConfigPolicy(testResourceName, namespace, name, 2),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "status", release.StatusDeployed.String()),
+				),
+			},
+		},
+	})
+}
+
+func testAccHelmReleaseConfigPolicy(resource, ns, name string, replicas int) string {
+	return fmt.Sprintf(`
+		resource "helm_release" "%s" {
+			name      = %q
+			namespace = %q
+			chart     = "./testdata/charts/test-chart"
+
+			set {
+				name  = "replicaCount"
+				value = %d
+			}
+
+			policy {
+				path = "./testdata/policy"
+			}
+		}
+	`, resource, name, ns, replicas)
+}
+
 func TestAccResourceRelease_helm_repo_add(t *testing.T) {
 	name := randName("helm-repo-add")
 	namespace := createRandomNamespace(t)
@@ -1163,6 +3032,45 @@ func TestAccResourceRelease_delete_regression(t *testing.T) {
 	})
 }
 
+func TestAccResourceRelease_descriptionTemplate(t *testing.T) {
+	name := randName("description")
+	namespace := createRandomNamespace(t)
+	defer deleteNamespace(t, namespace)
+
+	resource.ParallelTest(t, resource.TestCase{
+		PreCheck:     func() { testAccPreCheck(t) },
+		Providers:    testAccProviders,
+		CheckDestroy: testAccCheckHelmReleaseDestroy(namespace),
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+					resource "helm_release" "test" {
+						name        = %q
+						namespace   = %q
+						description = "{{ .Chart }}-{{ .Version }} app {{ .AppVersion }}"
+						repository  = %q
+						chart       = "test-chart"
+						version     = "1.2.3"
+					}
+				`, name, namespace, testRepositoryURL),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("helm_release.test", "description", "{{ .Chart }}-{{ .Version }} app {{ .AppVersion }}"),
+					func(*terraform.State) error {
+						out, err := exec.Command("helm", "history", "--namespace", namespace, name, "--output", "json").CombinedOutput()
+						if err != nil {
+							return fmt.Errorf("%s: %s", err, out)
+						}
+						if !strings.Contains(string(out), `"description":"test-chart-1.2.3 app 1.19.5"`) {
+							return fmt.Errorf("expected the rendered description in the history, got %s", out)
+						}
+						return nil
+					},
+				),
+			},
+		},
+	})
+}
+
 func getReleaseJSONManifest(namespace, name string) (string, error) {
 	cmd := exec.Command("helm", "get", "manifest", "--namespace", namespace, name)
 	manifest, err := cmd.CombinedOutput()
@@ -1287,3 +3195,161 @@ func removeSubcharts(chartName string) error {
 	}
 	return os.RemoveAll(chartsPath)
 }
+
+func TestReleaseHelmConfigurationLimits(t *testing.T) {
+	pd := schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+		"kubernetes": []interface{}{
+			map[string]interface{}{
+				"host": "https://127.0.0.1:6443",
+			},
+		},
+	})
+	m := &Meta{data: pd}
+
+	restConfig := func(values map[string]interface{}) *rest.Config {
+		values["name"] = "test"
+		values["chart"] = "test-chart"
+		d := schema.TestResourceDataRaw(t, resourceRelease().Schema, values)
+
+		cfg, err := getReleaseHelmConfiguration(m, d, "default")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := cfg.RESTClientGetter.ToRESTConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config
+	}
+
+	// the client defaults are kept without overrides
+	config := restConfig(map[string]interface{}{})
+	if config.QPS != 0 || config.Burst != 0 {
+		t.Fatalf("expected the default limits, got qps %v and burst %d", config.QPS, config.Burst)
+	}
+
+	config = restConfig(map[string]interface{}{"qps": 50.0, "burst": 100})
+	if config.QPS != 50 || config.Burst != 100 {
+		t.Fatalf("expected the limits of the release, got qps %v and burst %d", config.QPS, config.Burst)
+	}
+
+	// the limits of the provider apply to the releases not overriding them
+	pd.Set("kubernetes", []interface{}{map[string]interface{}{
+		"host":  "https://127.0.0.1:6443",
+		"qps":   20.0,
+		"burst": 40,
+	}})
+	config = restConfig(map[string]interface{}{})
+	if config.QPS != 20 || config.Burst != 40 {
+		t.Fatalf("expected the limits of the provider, got qps %v and burst %d", config.QPS, config.Burst)
+	}
+	config = restConfig(map[string]interface{}{"qps": 50.0})
+	if config.QPS != 50 || config.Burst != 40 {
+		t.Fatalf("expected the qps of the release and the burst of the provider, got qps %v and burst %d", config.QPS, config.Burst)
+	}
+	pd.Set("kubernetes", []interface{}{map[string]interface{}{"host": "https://127.0.0.1:6443"}})
+
+	// the limits of a release do not leak into the other configurations
+	other, err := m.GetHelmConfiguration("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err = other.RESTClientGetter.ToRESTConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.QPS != 0 || config.Burst != 0 {
+		t.Fatalf("expected the default limits, got qps %v and burst %d", config.QPS, config.Burst)
+	}
+}
+
+func TestGetValuesExpandEnv(t *testing.T) {
+	os.Setenv("HELM_TEST_IMAGE_TAG", "1.2.3")
+	os.Setenv("HELM_TEST_SECRET", "hunter2")
+	defer os.Unsetenv("HELM_TEST_IMAGE_TAG")
+	defer os.Unsetenv("HELM_TEST_SECRET")
+
+	newData := func(expand bool, values, set string) *schema.ResourceData {
+		d := resourceRelease().Data(nil)
+		d.Set("values", []string{values})
+		d.Set("set", []interface{}{map[string]interface{}{"name": "set", "value": set}})
+		d.Set("expand_env_in_values", expand)
+		d.Set("expand_env_allowlist", []string{"HELM_TEST_IMAGE_TAG"})
+		return d
+	}
+
+	values, err := getValues(newData(true, "tag: ${HELM_TEST_IMAGE_TAG}\nprice: $$5", "v${HELM_TEST_IMAGE_TAG}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["tag"] != "1.2.3" || values["set"] != "v1.2.3" {
+		t.Fatalf("expected the allowed variable to be expanded, got %v", values)
+	}
+	if values["price"] != "$5" {
+		t.Fatalf("expected $$ to be a literal $, got %v", values["price"])
+	}
+
+	// variables that are not allowed are rejected, in values and in set
+	for _, d := range []*schema.ResourceData{
+		newData(true, "secret: ${HELM_TEST_SECRET}", ""),
+		newData(true, "", "${HELM_TEST_SECRET}"),
+	} {
+		_, err := getValues(d)
+		if err == nil || !strings.Contains(err.Error(), `"HELM_TEST_SECRET"`) {
+			t.Fatalf("expected the variable not allowed to be rejected, got %v", err)
+		}
+		if strings.Contains(err.Error(), "hunter2") {
+			t.Fatalf("expected the error not to contain the value of the variable, got %v", err)
+		}
+	}
+
+	// the values are left as they are by default
+	values, err = getValues(newData(false, "tag: ${HELM_TEST_IMAGE_TAG}", "${HELM_TEST_SECRET}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["tag"] != "${HELM_TEST_IMAGE_TAG}" || values["set"] != "${HELM_TEST_SECRET}" {
+		t.Fatalf("expected the values not to be expanded, got %v", values)
+	}
+}
+
+func TestResourceReleaseRepositoryCredentialsRequiredTogether(t *testing.T) {
+	validate := func(credentials map[string]interface{}) diag.Diagnostics {
+		credentials["name"] = "test"
+		credentials["chart"] = "test-chart"
+		return resourceRelease().Validate(terraform.NewResourceConfigRaw(credentials))
+	}
+
+	if diags := validate(map[string]interface{}{}); diags.HasError() {
+		t.Fatalf("expected no credentials to be valid, got %v", diags)
+	}
+	if diags := validate(map[string]interface{}{"repository_username": "user", "repository_password": "secret"}); diags.HasError() {
+		t.Fatalf("expected the username and password to be valid, got %v", diags)
+	}
+
+	for _, key := range []string{"repository_username", "repository_password"} {
+		diags := validate(map[string]interface{}{key: "value"})
+		if !diags.HasError() {
+			t.Fatalf("expected %s alone to be rejected", key)
+		}
+		if detail := diags[0].Detail; !strings.Contains(detail, "repository_password,repository_username") {
+			t.Fatalf("expected the error to require both attributes, got %q", detail)
+		}
+	}
+}
+
+func TestGetValuesFilePath(t *testing.T) {
+	d := resourceRelease().Data(nil)
+	d.Set("values", []string{"base: true", "environments/prod.yaml"})
+
+	_, err := getValues(d)
+	if err == nil || !strings.Contains(err.Error(), `values entry "environments/prod.yaml"`) || !strings.Contains(err.Error(), "file(") {
+		t.Fatalf("expected a values file path to be reported, got %v", err)
+	}
+
+	// values that are not a map of values are still reported as invalid YAML
+	d.Set("values", []string{"- a\n- b"})
+	if _, err := getValues(d); err == nil || strings.Contains(err.Error(), "values entry") {
+		t.Fatalf("expected invalid values to be reported as such, got %v", err)
+	}
+}
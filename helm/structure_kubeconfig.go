@@ -2,16 +2,27 @@ package helm
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
 	"github.com/mitchellh/go-homedir"
 	"k8s.io/apimachinery/pkg/api/meta"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/disk"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/restmapper"
 	"k8s.io/client-go/tools/clientcmd"
@@ -21,21 +32,179 @@ import (
 	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 )
 
+// defaultDiscoveryTimeout is the time given to the discovery of the cluster API
+// when `discovery_timeout` is not set
+const defaultDiscoveryTimeout = 30 * time.Second
+
+// defaultDialTimeout and defaultKeepAlive are the settings of the connections
+// to the cluster API when `dial_timeout` and `keepalive` are not set, the same
+// as the client-go defaults
+const (
+	defaultDialTimeout = 30 * time.Second
+	defaultKeepAlive   = 30 * time.Second
+)
+
+// defaultDiscoveryCacheTTL is the time the discovery cached on disk is used
+// when `discovery_cache_ttl` is not set
+const defaultDiscoveryCacheTTL = 10 * time.Minute
+
+// discoveryCacheIllegalCharacters are replaced in the host of the cluster to
+// name its discovery cache directory, as kubectl does
+var discoveryCacheIllegalCharacters = regexp.MustCompile(`[^(\w/\.)]`)
+
+// inClusterConfig returns the config of the service account of the pod the
+// provider runs in
+var inClusterConfig = rest.InClusterConfig
+
+// discoveryBackoff is the backoff between attempts of the discovery of the
+// cluster API
+var discoveryBackoff = wait.Backoff{
+	Duration: 500 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    10,
+	Cap:      10 * time.Second,
+}
+
 // KubeConfig is a RESTClientGetter interface implementation
 type KubeConfig struct {
 	ClientConfig clientcmd.ClientConfig
 
+	// DiscoveryTimeout is the time after which the discovery of the cluster API
+	// is not retried anymore
+	DiscoveryTimeout time.Duration
+
+	// DialTimeout and KeepAlive configure the connections to the cluster API
+	// when set
+	DialTimeout time.Duration
+	KeepAlive   time.Duration
+
+	// DiscoveryCacheDir is the directory caching the discovery on disk across
+	// runs, the discovery is only cached in memory when empty
+	DiscoveryCacheDir string
+	DiscoveryCacheTTL time.Duration
+
+	// QPS and Burst override the rate limits of the client when set
+	QPS   float32
+	Burst int
+
+	// PreferredVersions are the group versions, keyed by kind, preferred by
+	// the RESTMapper for the kinds that resolve to several versions
+	PreferredVersions map[string]apimachineryschema.GroupVersion
+
+	// Context is the kubeconfig context in use, empty when the configuration
+	// is not loaded from kubeconfig files
+	Context string
+
+	// transport reloading the client certificate files, shared by all the
+	// REST configs returned by ToRESTConfig
+	transport http.RoundTripper
+
+	// discovery of the cluster API, shared with the other configurations of
+	// the provider
+	discovery *sharedDiscovery
+
+	sync.Mutex
+}
+
+// sharedDiscovery holds the discovery client caching the successful discovery
+// of the cluster API. The provider shares it between the configurations of its
+// operations, so that the cluster is discovered once per run rather than once
+// per operation.
+type sharedDiscovery struct {
+	client discovery.CachedDiscoveryInterface
 	sync.Mutex
 }
 
 // ToRESTConfig implemented interface method
 func (k *KubeConfig) ToRESTConfig() (*rest.Config, error) {
 	config, err := k.ToRawKubeConfigLoader().ClientConfig()
-	return config, err
+	if err != nil {
+		return nil, err
+	}
+
+	if dialer := k.dialer(); dialer != nil {
+		config.Dial = dialer.DialContext
+	}
+	if k.QPS != 0 {
+		config.QPS = k.QPS
+	}
+	if k.Burst != 0 {
+		config.Burst = k.Burst
+	}
+
+	return k.withClientCertificateReload(config)
+}
+
+// dialer returns the dialer of the connections to the cluster API, or nil to
+// keep the client-go default when neither `dial_timeout` nor `keepalive` is set
+func (k *KubeConfig) dialer() *net.Dialer {
+	if k.DialTimeout == 0 && k.KeepAlive == 0 {
+		return nil
+	}
+
+	dialer := &net.Dialer{Timeout: defaultDialTimeout, KeepAlive: defaultKeepAlive}
+	if k.DialTimeout != 0 {
+		dialer.Timeout = k.DialTimeout
+	}
+	if k.KeepAlive != 0 {
+		dialer.KeepAlive = k.KeepAlive
+	}
+	return dialer
+}
+
+// withClientCertificateReload replaces the client certificate files of the
+// config with a transport that loads them from disk on every TLS handshake,
+// so that certificates rotated during a long run are picked up without
+// reconfiguring the provider
+func (k *KubeConfig) withClientCertificateReload(config *rest.Config) (*rest.Config, error) {
+	certFile, keyFile := config.CertFile, config.KeyFile
+	if certFile == "" || keyFile == "" || config.ExecProvider != nil || config.Transport != nil {
+		return config, nil
+	}
+
+	k.Lock()
+	defer k.Unlock()
+
+	config = rest.CopyConfig(config)
+	if k.transport == nil {
+		config.CertFile, config.KeyFile = "", ""
+		tlsConfig, err := rest.TLSConfigFor(config)
+		if err != nil {
+			return nil, err
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load client certificate: %w", err)
+			}
+			return &cert, nil
+		}
+
+		k.transport = utilnet.SetTransportDefaults(&http.Transport{
+			Proxy:           config.Proxy,
+			DialContext:     config.Dial,
+			TLSClientConfig: tlsConfig,
+		})
+	}
+
+	config.TLSClientConfig = rest.TLSClientConfig{}
+	config.Transport = k.transport
+	return config, nil
 }
 
 // ToDiscoveryClient implemented interface method
 func (k *KubeConfig) ToDiscoveryClient() (discovery.CachedDiscoveryInterface, error) {
+	k.discovery.Lock()
+	defer k.discovery.Unlock()
+
+	if k.discovery.client != nil {
+		return k.discovery.client, nil
+	}
+
 	config, err := k.ToRESTConfig()
 	if err != nil {
 		return nil, err
@@ -44,9 +213,106 @@ func (k *KubeConfig) ToDiscoveryClient() (discovery.CachedDiscoveryInterface, er
 	// The more groups you have, the more discovery requests you need to make.
 	// given 25 groups (our groups + a few custom resources) with one-ish version each, discovery needs to make 50 requests
 	// double it just so we don't end up here again for a while.  This config is only used for discovery.
-	config.Burst = 100
+	if config.Burst < 100 {
+		config.Burst = 100
+	}
 
-	return memcached.NewMemCacheClient(discovery.NewDiscoveryClientForConfigOrDie(config)), nil
+	var cached discovery.CachedDiscoveryInterface
+	if k.DiscoveryCacheDir != "" {
+		cached, err = k.diskCachedDiscoveryClient(config)
+	} else {
+		var client *discovery.DiscoveryClient
+		client, err = discovery.NewDiscoveryClientForConfig(config)
+		cached = memcached.NewMemCacheClient(client)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := k.DiscoveryTimeout
+	if timeout == 0 {
+		timeout = defaultDiscoveryTimeout
+	}
+	if err := discoverWithRetry(cached, timeout); err != nil {
+		return nil, err
+	}
+
+	k.discovery.client = cached
+	return cached, nil
+}
+
+// diskCachedDiscoveryClient returns a discovery client caching the discovery
+// of the cluster in a directory of DiscoveryCacheDir named after its host, as
+// kubectl does. The cache is invalidated when the version of the cluster
+// differs from the one it was filled with, so that the API of an upgraded
+// cluster is discovered again before the TTL expires.
+func (k *KubeConfig) diskCachedDiscoveryClient(config *rest.Config) (discovery.CachedDiscoveryInterface, error) {
+	host := strings.Replace(strings.Replace(config.Host, "https://", "", 1), "http://", "", 1)
+	dir := filepath.Join(k.DiscoveryCacheDir, "discovery", discoveryCacheIllegalCharacters.ReplaceAllString(host, "_"))
+
+	ttl := k.DiscoveryCacheTTL
+	if ttl == 0 {
+		ttl = defaultDiscoveryCacheTTL
+	}
+
+	client, err := disk.NewCachedDiscoveryClientForConfig(config, dir, "", ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := client.ServerVersion()
+	if err != nil {
+		// the failure is retried with the discovery
+		log.Printf("[DEBUG] Unable to get the version of the cluster to validate the discovery cache: %s", err)
+		return client, nil
+	}
+
+	versionFile := filepath.Join(dir, "serverversion")
+	if cached, err := ioutil.ReadFile(versionFile); err != nil || string(cached) != version.String() {
+		log.Printf("[DEBUG] Invalidating the discovery cache %s of cluster version %q, the cluster runs %s", dir, cached, version)
+		client.Invalidate()
+	}
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(versionFile, []byte(version.String()), 0660); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// discoverWithRetry fills the cache of the discovery client, retrying with
+// backoff until the timeout expires. Groups that still cannot be discovered
+// then are left out, as kubectl does, and only a failure of the whole
+// discovery is returned as an error.
+func discoverWithRetry(client discovery.CachedDiscoveryInterface, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	backoff := discoveryBackoff
+
+	var err error
+	for {
+		_, _, err = client.ServerGroupsAndResources()
+		if err == nil {
+			return nil
+		}
+
+		delay := backoff.Step()
+		if time.Now().Add(delay).After(deadline) {
+			break
+		}
+
+		log.Printf("[DEBUG] Discovery of the cluster API failed, retrying in %s: %s", delay, err)
+		time.Sleep(delay)
+		client.Invalidate()
+	}
+
+	if discovery.IsGroupDiscoveryFailedError(err) {
+		log.Printf("[WARN] Continuing without the API groups that could not be discovered: %s", err)
+		return nil
+	}
+
+	return fmt.Errorf("failed to discover the API of the Kubernetes cluster within %s: %w", timeout, err)
 }
 
 // ToRESTMapper implemented interface method
@@ -58,7 +324,67 @@ func (k *KubeConfig) ToRESTMapper() (meta.RESTMapper, error) {
 
 	mapper := restmapper.NewDeferredDiscoveryRESTMapper(discoveryClient)
 	expander := restmapper.NewShortcutExpander(mapper, discoveryClient)
-	return expander, nil
+	if len(k.PreferredVersions) == 0 {
+		return expander, nil
+	}
+	return &preferredVersionsRESTMapper{RESTMapper: expander, preferred: k.PreferredVersions}, nil
+}
+
+// preferredVersionsRESTMapper is a RESTMapper resolving the kinds of
+// `preferred_versions` to their preferred group version, e.g. Ingress to
+// networking.k8s.io/v1 rather than extensions/v1beta1, when the version is not
+// given or the resource is ambiguous
+type preferredVersionsRESTMapper struct {
+	meta.RESTMapper
+	preferred map[string]apimachineryschema.GroupVersion
+}
+
+// isPreferred returns whether the kind is the preferred version of its kind
+func (p *preferredVersionsRESTMapper) isPreferred(gvk apimachineryschema.GroupVersionKind) bool {
+	gv, ok := p.preferred[gvk.Kind]
+	return ok && gv == gvk.GroupVersion()
+}
+
+func (p *preferredVersionsRESTMapper) KindFor(resource apimachineryschema.GroupVersionResource) (apimachineryschema.GroupVersionKind, error) {
+	if kinds, err := p.RESTMapper.KindsFor(resource); err == nil {
+		for _, gvk := range kinds {
+			if p.isPreferred(gvk) {
+				return gvk, nil
+			}
+		}
+	}
+	return p.RESTMapper.KindFor(resource)
+}
+
+func (p *preferredVersionsRESTMapper) ResourceFor(resource apimachineryschema.GroupVersionResource) (apimachineryschema.GroupVersionResource, error) {
+	if resources, err := p.RESTMapper.ResourcesFor(resource); err == nil {
+		for _, gvr := range resources {
+			if gvk, err := p.RESTMapper.KindFor(gvr); err == nil && p.isPreferred(gvk) {
+				return gvr, nil
+			}
+		}
+	}
+	return p.RESTMapper.ResourceFor(resource)
+}
+
+func (p *preferredVersionsRESTMapper) RESTMapping(gk apimachineryschema.GroupKind, versions ...string) (*meta.RESTMapping, error) {
+	if gv, ok := p.preferred[gk.Kind]; ok && len(versions) == 0 && gv.Group == gk.Group {
+		if mapping, err := p.RESTMapper.RESTMapping(gk, gv.Version); err == nil {
+			return mapping, nil
+		}
+	}
+	return p.RESTMapper.RESTMapping(gk, versions...)
+}
+
+func (p *preferredVersionsRESTMapper) RESTMappings(gk apimachineryschema.GroupKind, versions ...string) ([]*meta.RESTMapping, error) {
+	mappings, err := p.RESTMapper.RESTMappings(gk, versions...)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(mappings, func(i, j int) bool {
+		return p.isPreferred(mappings[i].GroupVersionKind) && !p.isPreferred(mappings[j].GroupVersionKind)
+	})
+	return mappings, nil
 }
 
 // ToRawKubeConfigLoader implemented interface method
@@ -72,6 +398,11 @@ func newKubeConfig(configData *schema.ResourceData, namespace *string) (*KubeCon
 
 	configPaths := []string{}
 
+	inCluster := false
+	if v, ok := k8sGetOk(configData, "in_cluster"); ok {
+		inCluster = v.(bool)
+	}
+
 	if v, ok := k8sGetOk(configData, "config_path"); ok && v != "" {
 		configPaths = []string{v.(string)}
 	} else if v, ok := k8sGetOk(configData, "config_paths"); ok {
@@ -84,6 +415,10 @@ func newKubeConfig(configData *schema.ResourceData, namespace *string) (*KubeCon
 		configPaths = filepath.SplitList(v)
 	}
 
+	if inCluster && len(configPaths) > 0 {
+		return nil, fmt.Errorf("in_cluster cannot be used with config_path or config_paths")
+	}
+
 	if len(configPaths) > 0 {
 		expandedPaths := []string{}
 		for _, p := range configPaths {
@@ -103,6 +438,11 @@ func newKubeConfig(configData *schema.ResourceData, namespace *string) (*KubeCon
 		}
 
 		ctx, ctxOk := k8sGetOk(configData, "config_context")
+		if ctxOk && strings.TrimSpace(ctx.(string)) == "" {
+			// a context interpolated to a blank string falls back to the current context
+			log.Printf("[DEBUG] Ignoring blank config_context")
+			ctxOk = false
+		}
 		authInfo, authInfoOk := k8sGetOk(configData, "config_context_auth_info")
 		cluster, clusterOk := k8sGetOk(configData, "config_context_cluster")
 		if ctxOk || authInfoOk || clusterOk {
@@ -129,6 +469,9 @@ func newKubeConfig(configData *schema.ResourceData, namespace *string) (*KubeCon
 	if v, ok := k8sGetOk(configData, "cluster_ca_certificate"); ok {
 		overrides.ClusterInfo.CertificateAuthorityData = bytes.NewBufferString(v.(string)).Bytes()
 	}
+	if v, ok := k8sGetOk(configData, "tls_server_name"); ok {
+		overrides.ClusterInfo.TLSServerName = v.(string)
+	}
 	if v, ok := k8sGetOk(configData, "client_certificate"); ok {
 		overrides.AuthInfo.ClientCertificateData = bytes.NewBufferString(v.(string)).Bytes()
 	}
@@ -166,6 +509,9 @@ func newKubeConfig(configData *schema.ResourceData, namespace *string) (*KubeCon
 			exec.APIVersion = spec["api_version"].(string)
 			exec.Command = spec["command"].(string)
 			exec.Args = expandStringSlice(spec["args"].([]interface{}))
+			// the cluster info is taken from the REST config, which includes the
+			// host and cluster_ca_certificate overrides
+			exec.ProvideClusterInfo = spec["provide_cluster_info"].(bool)
 			for kk, vv := range spec["env"].(map[string]interface{}) {
 				exec.Env = append(exec.Env, clientcmdapi.ExecEnvVar{Name: kk, Value: vv.(string)})
 			}
@@ -182,12 +528,130 @@ func newKubeConfig(configData *schema.ResourceData, namespace *string) (*KubeCon
 		overrides.Context.Namespace = *namespace
 	}
 
-	client := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loader, overrides)
+	var client clientcmd.ClientConfig = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loader, overrides)
+	if inCluster {
+		log.Printf("[DEBUG] Using the in-cluster configuration")
+		client = &inClusterClientConfig{overrides: overrides, loader: loader}
+	}
 	if client == nil {
 		log.Printf("[ERROR] Failed to initialize kubernetes config")
 		return nil, nil
 	}
 	log.Printf("[INFO] Successfully initialized kubernetes config")
 
-	return &KubeConfig{ClientConfig: client}, nil
+	current := ""
+	if len(configPaths) > 0 {
+		if raw, err := client.RawConfig(); err == nil {
+			current = overrides.CurrentContext
+			if current == "" {
+				current = raw.CurrentContext
+			} else if _, ok := raw.Contexts[current]; !ok {
+				return nil, fmt.Errorf("context %q does not exist in the kubeconfig, available contexts are: %s", current, strings.Join(kubeConfigContexts(raw), ", "))
+			}
+			log.Printf("[INFO] Using kubeconfig context: %q", current)
+		}
+	}
+
+	kc := &KubeConfig{ClientConfig: client, Context: current, discovery: &sharedDiscovery{}}
+	if v, ok := k8sGetOk(configData, "discovery_timeout"); ok {
+		kc.DiscoveryTimeout = time.Duration(v.(int)) * time.Second
+	}
+	if v, ok := k8sGetOk(configData, "discovery_cache_dir"); ok {
+		dir, err := homedir.Expand(v.(string))
+		if err != nil {
+			return nil, err
+		}
+		kc.DiscoveryCacheDir = dir
+	}
+	if v, ok := k8sGetOk(configData, "discovery_cache_ttl"); ok {
+		kc.DiscoveryCacheTTL = time.Duration(v.(int)) * time.Second
+	}
+	if v, ok := k8sGetOk(configData, "dial_timeout"); ok {
+		kc.DialTimeout = time.Duration(v.(int)) * time.Second
+	}
+	if v, ok := k8sGetOk(configData, "keepalive"); ok {
+		kc.KeepAlive = time.Duration(v.(int)) * time.Second
+	}
+	if v, ok := k8sGetOk(configData, "qps"); ok {
+		kc.QPS = float32(v.(float64))
+	}
+	if v, ok := k8sGetOk(configData, "burst"); ok {
+		kc.Burst = v.(int)
+	}
+	if v, ok := k8sGetOk(configData, "preferred_versions"); ok {
+		kc.PreferredVersions = map[string]apimachineryschema.GroupVersion{}
+		for kind, raw := range v.(map[string]interface{}) {
+			gv, err := apimachineryschema.ParseGroupVersion(raw.(string))
+			if err == nil && gv.Version == "" {
+				err = fmt.Errorf("no version given")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid preferred version %q of kind %s: %v", raw, kind, err)
+			}
+			kc.PreferredVersions[kind] = gv
+		}
+	}
+
+	return kc, nil
+}
+
+// inClusterClientConfig is a clientcmd.ClientConfig using the service account
+// of the pod the provider runs in, mounted in
+// /var/run/secrets/kubernetes.io/serviceaccount, with the static overrides of
+// the cluster and token applied on top
+type inClusterClientConfig struct {
+	overrides *clientcmd.ConfigOverrides
+	loader    clientcmd.ConfigAccess
+}
+
+func (c *inClusterClientConfig) RawConfig() (clientcmdapi.Config, error) {
+	return clientcmdapi.Config{}, nil
+}
+
+func (c *inClusterClientConfig) ClientConfig() (*rest.Config, error) {
+	config, err := inClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the in-cluster configuration: %w", err)
+	}
+
+	cluster := c.overrides.ClusterInfo
+	if cluster.Server != "" {
+		config.Host = cluster.Server
+	}
+	if len(cluster.CertificateAuthorityData) > 0 {
+		config.CAFile = ""
+		config.CAData = cluster.CertificateAuthorityData
+	}
+	if cluster.InsecureSkipTLSVerify {
+		// client-go refuses a root certificate with the insecure flag
+		config.Insecure = true
+		config.CAFile = ""
+		config.CAData = nil
+	}
+	if cluster.TLSServerName != "" {
+		config.ServerName = cluster.TLSServerName
+	}
+	if token := c.overrides.AuthInfo.Token; token != "" {
+		config.BearerToken = token
+		config.BearerTokenFile = ""
+	}
+	return config, nil
+}
+
+func (c *inClusterClientConfig) Namespace() (string, bool, error) {
+	return c.overrides.Context.Namespace, true, nil
+}
+
+func (c *inClusterClientConfig) ConfigAccess() clientcmd.ConfigAccess {
+	return c.loader
+}
+
+// kubeConfigContexts returns the sorted names of the contexts of the kubeconfig
+func kubeConfigContexts(config clientcmdapi.Config) []string {
+	names := make([]string, 0, len(config.Contexts))
+	for name := range config.Contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
@@ -0,0 +1,824 @@
+package helm
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/rest"
+
+	apimachineryschema "k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// generateCertificate returns a self-signed certificate and its key, PEM encoded
+func generateCertificate(t *testing.T, commonName string, dnsNames []string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              dnsNames,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeClientCertificate(t *testing.T, dir, commonName string) {
+	certPEM, keyPEM := generateCertificate(t, commonName, nil, x509.ExtKeyUsageClientAuth)
+	if err := ioutil.WriteFile(filepath.Join(dir, "client.crt"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "client.key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKubeConfigClientCertificateReload(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// force a new TLS handshake for every request
+		w.Header().Set("Connection", "close")
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "client-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeClientCertificate(t, dir, "first")
+
+	k := &KubeConfig{}
+	config, err := k.withClientCertificateReload(&rest.Config{
+		Host: server.URL,
+		TLSClientConfig: rest.TLSClientConfig{
+			Insecure: true,
+			CertFile: filepath.Join(dir, "client.crt"),
+			KeyFile:  filepath.Join(dir, "client.key"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() string {
+		rt, err := rest.TransportFor(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := (&http.Client{Transport: rt}).Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	if cn := get(); cn != "first" {
+		t.Fatalf("expected the first client certificate to be used, got %q", cn)
+	}
+
+	writeClientCertificate(t, dir, "rotated")
+
+	if cn := get(); cn != "rotated" {
+		t.Fatalf("expected the rotated client certificate to be used, got %q", cn)
+	}
+}
+
+func TestNewKubeConfigBlankContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config")
+	kubeconfig := `apiVersion: v1
+kind: Config
+current-context: current
+clusters:
+- name: current
+  cluster:
+    server: https://current.example.com
+- name: other
+  cluster:
+    server: https://other.example.com
+contexts:
+- name: current
+  context:
+    cluster: current
+- name: other
+  context:
+    cluster: other
+`
+	if err := ioutil.WriteFile(path, []byte(kubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ctx := range []string{"", " ", "other"} {
+		d := schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+			"kubernetes": []interface{}{
+				map[string]interface{}{
+					"config_path":    path,
+					"config_context": ctx,
+				},
+			},
+		})
+
+		kc, err := newKubeConfig(d, nil)
+		if err != nil {
+			t.Fatalf("context %q: %s", ctx, err)
+		}
+
+		config, err := kc.ToRESTConfig()
+		if err != nil {
+			t.Fatalf("context %q: %s", ctx, err)
+		}
+
+		expected := "https://current.example.com"
+		if ctx == "other" {
+			expected = "https://other.example.com"
+		}
+		if config.Host != expected {
+			t.Errorf("context %q: expected host %q, got %q", ctx, expected, config.Host)
+		}
+	}
+}
+
+func TestNewKubeConfigTLSServerName(t *testing.T) {
+	certPEM, keyPEM := generateCertificate(t, "kubernetes", []string{"kubernetes.example.com"}, x509.ExtKeyUsageServerAuth)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(serverName string) error {
+		d := schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+			"kubernetes": []interface{}{
+				map[string]interface{}{
+					"host":                   server.URL,
+					"cluster_ca_certificate": string(certPEM),
+					"tls_server_name":        serverName,
+				},
+			},
+		})
+
+		kc, err := newKubeConfig(d, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := kc.ToRESTConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rt, err := rest.TransportFor(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := (&http.Client{Transport: rt}).Get(server.URL)
+		if err != nil {
+			return err
+		}
+		return res.Body.Close()
+	}
+
+	if err := get(""); err == nil {
+		t.Fatal("expected the verification of the server certificate to fail without tls_server_name")
+	}
+
+	if err := get("kubernetes.example.com"); err != nil {
+		t.Fatalf("expected the server certificate to be verified with tls_server_name, got %s", err)
+	}
+}
+
+func TestKubeConfigDiscoveryRetry(t *testing.T) {
+	backoff := discoveryBackoff
+	discoveryBackoff = wait.Backoff{Duration: 10 * time.Millisecond, Factor: 1, Steps: 1}
+	defer func() { discoveryBackoff = backoff }()
+
+	var requests, failures int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fail every other request to simulate an overloaded API server
+		if atomic.AddInt32(&requests, 1)%2 == 1 && atomic.LoadInt32(&failures) < 3 {
+			atomic.AddInt32(&failures, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api":
+			w.Write([]byte(`{"kind":"APIVersions","versions":["v1"]}`))
+		case "/apis":
+			w.Write([]byte(`{"kind":"APIGroupList","groups":[]}`))
+		case "/api/v1":
+			w.Write([]byte(`{"kind":"APIResourceList","groupVersion":"v1","resources":[{"name":"pods","namespaced":true,"kind":"Pod","verbs":["get"]}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	newConfig := func() *KubeConfig {
+		d := schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+			"kubernetes": []interface{}{
+				map[string]interface{}{
+					"host":              server.URL,
+					"discovery_timeout": 5,
+				},
+			},
+		})
+		kc, err := newKubeConfig(d, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return kc
+	}
+
+	kc := newConfig()
+	client, err := kc.ToDiscoveryClient()
+	if err != nil {
+		t.Fatalf("expected discovery to succeed after retries, got %s", err)
+	}
+
+	resources, err := client.ServerResourcesForGroupVersion("v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources.APIResources) != 1 || resources.APIResources[0].Name != "pods" {
+		t.Fatalf("unexpected resources %v", resources.APIResources)
+	}
+
+	// the discovery is cached for the following calls
+	count := atomic.LoadInt32(&requests)
+	if _, err := kc.ToRESTMapper(); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&requests) != count {
+		t.Fatal("expected the discovery to be cached")
+	}
+
+	// a cluster that cannot be discovered returns an error once the timeout expires
+	server.Close()
+	kc = newConfig()
+	kc.DiscoveryTimeout = 100 * time.Millisecond
+	if _, err := kc.ToDiscoveryClient(); err == nil {
+		t.Fatal("expected discovery of an unreachable cluster to fail")
+	}
+}
+
+func TestMetaSharedDiscovery(t *testing.T) {
+	var discoveries int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api":
+			w.Write([]byte(`{"kind":"APIVersions","versions":["v1"]}`))
+		case "/apis":
+			w.Write([]byte(`{"kind":"APIGroupList","groups":[]}`))
+		case "/api/v1":
+			w.Write([]byte(`{"kind":"APIResourceList","groupVersion":"v1","resources":[{"name":"pods","namespaced":true,"kind":"Pod","verbs":["get"]}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(&discoveries, 1)
+	}))
+	defer server.Close()
+
+	m := &Meta{
+		data: schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+			"kubernetes": []interface{}{
+				map[string]interface{}{
+					"host": server.URL,
+				},
+			},
+		}),
+		discovery: &sharedDiscovery{},
+	}
+
+	// discover returns the number of discovery requests made by an operation
+	// in the namespace
+	discover := func(namespace string) int32 {
+		before := atomic.LoadInt32(&discoveries)
+		kc, err := m.newKubeConfig(&namespace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := kc.ToRESTMapper(); err != nil {
+			t.Fatal(err)
+		}
+		return atomic.LoadInt32(&discoveries) - before
+	}
+
+	if n := discover("default"); n == 0 {
+		t.Fatal("expected the first operation to discover the API")
+	}
+
+	// the following operations reuse the discovery of the provider
+	if n := discover("default"); n != 0 {
+		t.Fatalf("expected the discovery to be reused, got %d discovery requests", n)
+	}
+	if n := discover("other"); n != 0 {
+		t.Fatalf("expected the discovery to be reused in another namespace, got %d discovery requests", n)
+	}
+}
+
+func TestNewKubeConfigExecProvideClusterInfo(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer exec-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	dir, err := ioutil.TempDir("", "exec-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the plugin records the exec info it receives and returns a static token
+	plugin := filepath.Join(dir, "plugin.sh")
+	script := `#!/bin/sh
+printf '%s' "$KUBERNETES_EXEC_INFO" > "$(dirname "$0")/exec-info.json"
+echo '{"apiVersion":"client.authentication.k8s.io/v1beta1","kind":"ExecCredential","status":{"token":"exec-token"}}'
+`
+	if err := ioutil.WriteFile(plugin, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	execInfo := func(provideClusterInfo bool) map[string]interface{} {
+		d := schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+			"kubernetes": []interface{}{
+				map[string]interface{}{
+					"host":                   server.URL,
+					"cluster_ca_certificate": string(caPEM),
+					"exec": []interface{}{
+						map[string]interface{}{
+							"api_version":          "client.authentication.k8s.io/v1beta1",
+							"command":              plugin,
+							"provide_cluster_info": provideClusterInfo,
+						},
+					},
+				},
+			},
+		})
+
+		kc, err := newKubeConfig(d, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := kc.ToRESTConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rt, err := rest.TransportFor(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := (&http.Client{Transport: rt}).Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected the request to be authenticated by the exec plugin, got status %d", res.StatusCode)
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, "exec-info.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := map[string]interface{}{}
+		if err := json.Unmarshal(data, &info); err != nil {
+			t.Fatalf("invalid exec info %q: %s", data, err)
+		}
+		spec, _ := info["spec"].(map[string]interface{})
+		return spec
+	}
+
+	if spec := execInfo(false); spec["cluster"] != nil {
+		t.Errorf("expected no cluster info without provide_cluster_info, got %v", spec["cluster"])
+	}
+
+	cluster, ok := execInfo(true)["cluster"].(map[string]interface{})
+	if !ok {
+		t.Fatal("expected the cluster info to be provided to the exec plugin")
+	}
+	if cluster["server"] != server.URL {
+		t.Errorf("expected server %q, got %v", server.URL, cluster["server"])
+	}
+	if cluster["certificate-authority-data"] != base64.StdEncoding.EncodeToString(caPEM) {
+		t.Errorf("expected the cluster CA certificate to be provided, got %v", cluster["certificate-authority-data"])
+	}
+}
+
+func TestNewKubeConfigMissingContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config")
+	kubeconfig := `apiVersion: v1
+kind: Config
+current-context: prod
+clusters:
+- name: prod
+  cluster:
+    server: https://prod.example.com
+contexts:
+- name: prod
+  context:
+    cluster: prod
+- name: dev
+  context:
+    cluster: prod
+`
+	if err := ioutil.WriteFile(path, []byte(kubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+		"kubernetes": []interface{}{
+			map[string]interface{}{
+				"config_path":    path,
+				"config_context": "staging",
+			},
+		},
+	})
+
+	_, err = newKubeConfig(d, nil)
+	if err == nil {
+		t.Fatal("expected an error for a context missing from the kubeconfig")
+	}
+
+	expected := `context "staging" does not exist in the kubeconfig, available contexts are: dev, prod`
+	if err.Error() != expected {
+		t.Errorf("expected error %q, got %q", expected, err)
+	}
+}
+
+func TestKubeConfigDialer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	restConfig := func(kubernetes map[string]interface{}) (*KubeConfig, *rest.Config) {
+		kubernetes["host"] = server.URL
+		d := schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+			"kubernetes": []interface{}{kubernetes},
+		})
+
+		kc, err := newKubeConfig(d, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := kc.ToRESTConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return kc, config
+	}
+
+	if kc, config := restConfig(map[string]interface{}{}); kc.dialer() != nil || config.Dial != nil {
+		t.Error("expected the client-go dialer to be kept by default")
+	}
+
+	kc, config := restConfig(map[string]interface{}{"dial_timeout": 5, "keepalive": 10})
+	dialer := kc.dialer()
+	if dialer.Timeout != 5*time.Second || dialer.KeepAlive != 10*time.Second {
+		t.Errorf("expected a dial timeout of 5s and a keepalive of 10s, got %s and %s", dialer.Timeout, dialer.KeepAlive)
+	}
+	if config.Dial == nil {
+		t.Fatal("expected the dialer to be set on the REST config")
+	}
+
+	rt, err := rest.TransportFor(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := (&http.Client{Transport: rt}).Get(server.URL)
+	if err != nil {
+		t.Fatalf("expected the transport to connect with the dialer, got %s", err)
+	}
+	res.Body.Close()
+
+	kc, _ = restConfig(map[string]interface{}{"keepalive": 10})
+	if dialer := kc.dialer(); dialer.Timeout != defaultDialTimeout || dialer.KeepAlive != 10*time.Second {
+		t.Errorf("expected the default dial timeout with a keepalive of 10s, got %s and %s", dialer.Timeout, dialer.KeepAlive)
+	}
+}
+
+func TestKubeConfigPreferredVersions(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+		"kubernetes": []interface{}{map[string]interface{}{
+			"preferred_versions": map[string]interface{}{"Ingress": "networking.k8s.io/v1"},
+		}},
+	})
+	kc, err := newKubeConfig(d, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gv := kc.PreferredVersions["Ingress"]; gv.Group != "networking.k8s.io" || gv.Version != "v1" {
+		t.Fatalf("expected Ingress to prefer networking.k8s.io/v1, got %s", gv)
+	}
+
+	extensions := apimachineryschema.GroupVersion{Group: "extensions", Version: "v1beta1"}
+	networkingBeta := apimachineryschema.GroupVersion{Group: "networking.k8s.io", Version: "v1beta1"}
+	networking := apimachineryschema.GroupVersion{Group: "networking.k8s.io", Version: "v1"}
+	defaultMapper := meta.NewDefaultRESTMapper([]apimachineryschema.GroupVersion{extensions, networkingBeta, networking})
+	for _, gv := range []apimachineryschema.GroupVersion{extensions, networkingBeta, networking} {
+		defaultMapper.Add(gv.WithKind("Ingress"), meta.RESTScopeNamespace)
+	}
+	mapper := &preferredVersionsRESTMapper{RESTMapper: defaultMapper, preferred: kc.PreferredVersions}
+
+	ingresses := apimachineryschema.GroupVersionResource{Resource: "ingresses"}
+	if _, err := defaultMapper.KindFor(ingresses); err == nil {
+		t.Fatal("expected the ingresses resource to be ambiguous without preference")
+	}
+	gvk, err := mapper.KindFor(ingresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gvk != networking.WithKind("Ingress") {
+		t.Errorf("expected the ingresses resource to resolve to %s, got %s", networking.WithKind("Ingress"), gvk)
+	}
+	gvr, err := mapper.ResourceFor(ingresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gvr != networking.WithResource("ingresses") {
+		t.Errorf("expected the ingresses resource to resolve to %s, got %s", networking.WithResource("ingresses"), gvr)
+	}
+
+	mapping, err := mapper.RESTMapping(networking.WithKind("Ingress").GroupKind())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping.GroupVersionKind != networking.WithKind("Ingress") {
+		t.Errorf("expected the Ingress kind to map to %s, got %s", networking.WithKind("Ingress"), mapping.GroupVersionKind)
+	}
+	mapping, err = mapper.RESTMapping(networking.WithKind("Ingress").GroupKind(), "v1beta1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping.GroupVersionKind != networkingBeta.WithKind("Ingress") {
+		t.Errorf("expected an explicit version to be kept, got %s", mapping.GroupVersionKind)
+	}
+
+	mappings, err := mapper.RESTMappings(networking.WithKind("Ingress").GroupKind())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mappings) != 2 || mappings[0].GroupVersionKind != networking.WithKind("Ingress") {
+		t.Errorf("expected the preferred mapping first, got %v", mappings)
+	}
+
+	d = schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+		"kubernetes": []interface{}{map[string]interface{}{
+			"preferred_versions": map[string]interface{}{"Ingress": "networking.k8s.io/v1/beta"},
+		}},
+	})
+	if _, err := newKubeConfig(d, nil); err == nil {
+		t.Error("expected an invalid preferred version to fail")
+	}
+}
+
+func TestKubeConfigDiscoveryDiskCache(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	var discoveries int32
+	version := atomic.Value{}
+	version.Store("v1.20.2")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/version":
+			fmt.Fprintf(w, `{"major":"1","minor":"20","gitVersion":%q}`, version.Load())
+			return
+		case "/api":
+			w.Write([]byte(`{"kind":"APIVersions","versions":["v1"]}`))
+		case "/apis":
+			w.Write([]byte(`{"kind":"APIGroupList","groups":[]}`))
+		case "/api/v1":
+			w.Write([]byte(`{"kind":"APIResourceList","groupVersion":"v1","resources":[{"name":"pods","namespaced":true,"kind":"Pod","verbs":["get"]}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(&discoveries, 1)
+	}))
+	defer server.Close()
+
+	// discover returns the number of discovery requests made by a new
+	// provider initialization
+	discover := func() int32 {
+		d := schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+			"kubernetes": []interface{}{
+				map[string]interface{}{
+					"host":                server.URL,
+					"discovery_cache_dir": cacheDir,
+				},
+			},
+		})
+		kc, err := newKubeConfig(d, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		before := atomic.LoadInt32(&discoveries)
+		client, err := kc.ToDiscoveryClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resources, err := client.ServerResourcesForGroupVersion("v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resources.APIResources) != 1 || resources.APIResources[0].Name != "pods" {
+			t.Fatalf("unexpected resources %v", resources.APIResources)
+		}
+		return atomic.LoadInt32(&discoveries) - before
+	}
+
+	if n := discover(); n == 0 {
+		t.Fatal("expected the first initialization to discover the API")
+	}
+
+	// the discovery cached on disk is reused by the next initialization
+	if n := discover(); n != 0 {
+		t.Fatalf("expected the cached discovery to be reused, got %d discovery requests", n)
+	}
+
+	// an upgraded cluster is discovered again
+	version.Store("v1.21.0")
+	if n := discover(); n == 0 {
+		t.Fatal("expected the cache to be invalidated when the cluster version changes")
+	}
+	if n := discover(); n != 0 {
+		t.Fatalf("expected the refreshed discovery to be reused, got %d discovery requests", n)
+	}
+}
+
+func TestNewKubeConfigInCluster(t *testing.T) {
+	loadInCluster := inClusterConfig
+	inClusterConfig = func() (*rest.Config, error) {
+		return &rest.Config{
+			Host:            "https://10.0.0.1:443",
+			BearerTokenFile: "/var/run/secrets/kubernetes.io/serviceaccount/token",
+			TLSClientConfig: rest.TLSClientConfig{CAFile: "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"},
+		}, nil
+	}
+	defer func() { inClusterConfig = loadInCluster }()
+
+	restConfig := func(kubernetes map[string]interface{}) (*rest.Config, error) {
+		d := schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+			"kubernetes": []interface{}{kubernetes},
+		})
+		namespace := "apps"
+		kc, err := newKubeConfig(d, &namespace)
+		if err != nil {
+			return nil, err
+		}
+		if ns, _, _ := kc.ToRawKubeConfigLoader().Namespace(); ns != namespace {
+			t.Fatalf("expected the namespace %q, got %q", namespace, ns)
+		}
+		return kc.ToRESTConfig()
+	}
+
+	config, err := restConfig(map[string]interface{}{"in_cluster": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Host != "https://10.0.0.1:443" || config.BearerTokenFile == "" || config.CAFile == "" {
+		t.Fatalf("expected the service account of the pod to be used, got %+v", config)
+	}
+
+	// the static overrides apply on top of the in-cluster config
+	config, err = restConfig(map[string]interface{}{
+		"in_cluster": true,
+		"host":       "https://kubernetes.example.com",
+		"insecure":   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Host != "https://kubernetes.example.com" || !config.Insecure || config.CAFile != "" || config.BearerTokenFile == "" {
+		t.Fatalf("expected the overrides to be applied, got %+v", config)
+	}
+
+	// the in-cluster config is not used by default
+	config, err = restConfig(map[string]interface{}{"host": "https://kubernetes.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Host != "https://kubernetes.example.com" || config.BearerTokenFile != "" {
+		t.Fatalf("expected the in-cluster config not to be used, got %+v", config)
+	}
+
+	if _, err := restConfig(map[string]interface{}{"in_cluster": true, "config_path": "~/.kube/config"}); err == nil {
+		t.Fatal("expected in_cluster to be refused with config_path")
+	}
+}
+
+func TestNewKubeConfigRateLimits(t *testing.T) {
+	restConfig := func(kubernetes map[string]interface{}) *rest.Config {
+		kubernetes["host"] = "https://127.0.0.1:6443"
+		d := schema.TestResourceDataRaw(t, Provider().Schema, map[string]interface{}{
+			"kubernetes": []interface{}{kubernetes},
+		})
+		kc, err := newKubeConfig(d, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := kc.ToRESTConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config
+	}
+
+	config := restConfig(map[string]interface{}{})
+	if config.QPS != 0 || config.Burst != 0 {
+		t.Fatalf("expected the client defaults, got qps %v and burst %d", config.QPS, config.Burst)
+	}
+
+	config = restConfig(map[string]interface{}{"qps": 20.0, "burst": 40})
+	if config.QPS != 20 || config.Burst != 40 {
+		t.Fatalf("expected qps 20 and burst 40, got qps %v and burst %d", config.QPS, config.Burst)
+	}
+
+	// negative limits are rejected
+	for key, value := range map[string]interface{}{"qps": -1.0, "burst": -1} {
+		if _, errs := kubernetesResource().Schema[key].ValidateFunc(value, key); len(errs) == 0 {
+			t.Errorf("expected a negative %s to be rejected", key)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+package main
+
+deny[msg] {
+  input.kind == "Deployment"
+  input.spec.replicas < 2
+  msg := sprintf("Deployment %s must run at least 2 replicas", [input.metadata.name])
+}
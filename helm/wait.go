@@ -0,0 +1,445 @@
+package helm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/kube"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/cli-runtime/pkg/resource"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/restmapper"
+	"sigs.k8s.io/yaml"
+)
+
+// waitPollInterval is the interval between checks while waiting for resources
+var waitPollInterval = 2 * time.Second
+
+// requiredReplicas returns the number of replicas that need to be available
+// to satisfy the given readiness percentage, rounded up
+func requiredReplicas(replicas int32, percentage int) int32 {
+	return (replicas*int32(percentage) + 99) / 100
+}
+
+// revisionAnnotation is the annotation the Deployment controller sets on a
+// Deployment and on its ReplicaSets to the revision of their pod template
+const revisionAnnotation = "deployment.kubernetes.io/revision"
+
+// waitForDeploymentsAvailable waits until at least percentage of the desired
+// replicas of every Deployment in the manifest are available in the
+// ReplicaSet of its current revision, or the timeout expires. The replicas of
+// the previous revisions are not counted, so that an upgrade is not
+// considered ready before any of its pods is. Deployments without a namespace
+// are looked up in namespace.
+func waitForDeploymentsAvailable(ctx context.Context, client kubernetes.Interface, namespace, manifest string, percentage int, timeout time.Duration) error {
+	deployments := []resourceMeta{}
+	for _, m := range releaseutil.SplitManifests(manifest) {
+		r := resourceMeta{}
+		if err := yaml.Unmarshal([]byte(m), &r); err != nil {
+			return err
+		}
+		if r.Kind != "Deployment" {
+			continue
+		}
+		if r.Metadata.Namespace == "" {
+			r.Metadata.Namespace = namespace
+		}
+		deployments = append(deployments, r)
+	}
+
+	status := ""
+	err := wait.PollImmediate(waitPollInterval, timeout, func() (bool, error) {
+		for _, r := range deployments {
+			d, err := client.AppsV1().Deployments(r.Metadata.Namespace).Get(ctx, r.Metadata.Name, metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+
+			replicas := int32(1)
+			if d.Spec.Replicas != nil {
+				replicas = *d.Spec.Replicas
+			}
+			required := requiredReplicas(replicas, percentage)
+
+			available := int32(0)
+			if d.Status.ObservedGeneration >= d.Generation {
+				available, err = currentReplicaSetAvailable(ctx, client, d)
+				if err != nil {
+					return false, err
+				}
+			}
+
+			if available < required {
+				status = fmt.Sprintf("deployment %s/%s has %d available replicas of its current revision, %d of %d required",
+					d.Namespace, d.Name, available, required, replicas)
+				debug("[waitForDeploymentsAvailable] %s", status)
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+
+	if err == wait.ErrWaitTimeout {
+		return fmt.Errorf("timed out waiting for %d%% of the replicas to be available: %s", percentage, status)
+	}
+	return err
+}
+
+// currentReplicaSetAvailable returns the available replicas of the ReplicaSet
+// of the Deployment with the revision of the Deployment, 0 if it is not
+// created yet
+func currentReplicaSetAvailable(ctx context.Context, client kubernetes.Interface, d *appsv1.Deployment) (int32, error) {
+	revision := d.Annotations[revisionAnnotation]
+	if revision == "" || d.Spec.Selector == nil {
+		return 0, nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(d.Spec.Selector)
+	if err != nil {
+		return 0, err
+	}
+	replicaSets, err := client.AppsV1().ReplicaSets(d.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range replicaSets.Items {
+		rs := &replicaSets.Items[i]
+		if metav1.IsControlledBy(rs, d) && rs.Annotations[revisionAnnotation] == revision {
+			return rs.Status.AvailableReplicas, nil
+		}
+	}
+	return 0, nil
+}
+
+// skipDeploymentsWait makes Helm wait for all the resources of the release
+// except its Deployments, which are waited for by the provider with
+// `readiness_percentage`
+func skipDeploymentsWait(cfg *action.Configuration) {
+	cfg.KubeClient = &deploymentSkippingKubeClient{Interface: cfg.KubeClient}
+}
+
+// deploymentSkippingKubeClient is a kube.Interface that leaves the Deployments
+// out of the resources Helm waits for
+type deploymentSkippingKubeClient struct {
+	kube.Interface
+}
+
+func (c *deploymentSkippingKubeClient) Wait(resources kube.ResourceList, timeout time.Duration) error {
+	return c.Interface.Wait(withoutDeployments(resources), timeout)
+}
+
+func (c *deploymentSkippingKubeClient) WaitWithJobs(resources kube.ResourceList, timeout time.Duration) error {
+	return c.Interface.WaitWithJobs(withoutDeployments(resources), timeout)
+}
+
+func withoutDeployments(resources kube.ResourceList) kube.ResourceList {
+	return resources.Filter(func(info *resource.Info) bool {
+		return info.Mapping == nil || info.Mapping.GroupVersionKind.GroupKind() != appsv1.SchemeGroupVersion.WithKind("Deployment").GroupKind()
+	})
+}
+
+// unreadyWorkloads returns a description of the Deployments, StatefulSets and
+// DaemonSets of the manifest whose replicas are not all ready. Workloads
+// without a namespace are looked up in namespace, the ones not found are left
+// out.
+func unreadyWorkloads(ctx context.Context, client kubernetes.Interface, namespace, manifest string) ([]string, error) {
+	manifests := releaseutil.SplitManifests(manifest)
+	keys := make([]string, 0, len(manifests))
+	for k := range manifests {
+		keys = append(keys, k)
+	}
+	sort.Sort(releaseutil.BySplitManifestsOrder(keys))
+
+	unready := []string{}
+	for _, k := range keys {
+		r := resourceMeta{}
+		if err := yaml.Unmarshal([]byte(manifests[k]), &r); err != nil {
+			return nil, err
+		}
+		if r.Metadata.Namespace == "" {
+			r.Metadata.Namespace = namespace
+		}
+
+		var desired, ready int32
+		var err error
+		switch r.Kind {
+		case "Deployment":
+			d, getErr := client.AppsV1().Deployments(r.Metadata.Namespace).Get(ctx, r.Metadata.Name, metav1.GetOptions{})
+			if err = getErr; err == nil {
+				desired, ready = 1, d.Status.ReadyReplicas
+				if d.Spec.Replicas != nil {
+					desired = *d.Spec.Replicas
+				}
+			}
+		case "StatefulSet":
+			s, getErr := client.AppsV1().StatefulSets(r.Metadata.Namespace).Get(ctx, r.Metadata.Name, metav1.GetOptions{})
+			if err = getErr; err == nil {
+				desired, ready = 1, s.Status.ReadyReplicas
+				if s.Spec.Replicas != nil {
+					desired = *s.Spec.Replicas
+				}
+			}
+		case "DaemonSet":
+			ds, getErr := client.AppsV1().DaemonSets(r.Metadata.Namespace).Get(ctx, r.Metadata.Name, metav1.GetOptions{})
+			if err = getErr; err == nil {
+				desired, ready = ds.Status.DesiredNumberScheduled, ds.Status.NumberReady
+			}
+		default:
+			continue
+		}
+
+		if apierrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if ready < desired {
+			unready = append(unready, fmt.Sprintf("%s %s/%s (%d/%d ready)",
+				r.Kind, r.Metadata.Namespace, r.Metadata.Name, ready, desired))
+		}
+	}
+	return unready, nil
+}
+
+// describeWaitTimeout adds the workloads of the release that were not ready to
+// the error returned by an install or upgrade whose wait timed out, since Helm
+// only reports that it timed out. The error is returned as is when the release
+// was reverted by `atomic`, or the workloads cannot be read.
+func describeWaitTimeout(ctx context.Context, d resourceGetter, cfg *action.Configuration, r *release.Release, err error) error {
+	if err == nil || r == nil || !errors.Is(err, wait.ErrWaitTimeout) || d.Get("atomic").(bool) {
+		return err
+	}
+
+	client, clientErr := cfg.KubernetesClientSet()
+	if clientErr != nil {
+		return err
+	}
+
+	unready, listErr := unreadyWorkloads(ctx, client, r.Namespace, r.Manifest)
+	if listErr != nil {
+		debug("[describeWaitTimeout] unable to read the workloads of release %s: %s", r.Name, listErr)
+		return err
+	}
+	if len(unready) == 0 {
+		return err
+	}
+
+	return fmt.Errorf("%w, resources not ready: %s", err, strings.Join(unready, ", "))
+}
+
+// resourceCondition is a condition of a resource to wait for, as set in a
+// `wait_for_condition` block
+type resourceCondition struct {
+	APIVersion    string
+	Kind          string
+	Namespace     string
+	Name          string
+	ConditionType string
+	Status        string
+}
+
+func (c resourceCondition) String() string {
+	name := c.Name
+	if c.Namespace != "" {
+		name = c.Namespace + "/" + c.Name
+	}
+	return fmt.Sprintf("condition %s=%s of %s %s", c.ConditionType, c.Status, c.Kind, name)
+}
+
+// expandResourceConditions returns the conditions of the `wait_for_condition`
+// blocks, the resources without a namespace being looked up in namespace
+func expandResourceConditions(d resourceGetter, namespace string) []resourceCondition {
+	conditions := []resourceCondition{}
+	for _, raw := range d.Get("wait_for_condition").([]interface{}) {
+		c := raw.(map[string]interface{})
+		ns := c["namespace"].(string)
+		if ns == "" {
+			ns = namespace
+		}
+		conditions = append(conditions, resourceCondition{
+			APIVersion:    c["api_version"].(string),
+			Kind:          c["kind"].(string),
+			Namespace:     ns,
+			Name:          c["name"].(string),
+			ConditionType: c["condition_type"].(string),
+			Status:        c["status"].(string),
+		})
+	}
+	return conditions
+}
+
+// waitForConditions waits until every resource reports its condition in
+// status.conditions with the expected status, or the timeout expires. The
+// last observed status is returned on timeout. Resources that do not exist
+// yet, or whose kind is not served yet, are waited for.
+func waitForConditions(ctx context.Context, client dynamic.Interface, mapper meta.RESTMapper, conditions []resourceCondition, timeout time.Duration) error {
+	status := ""
+	var pending resourceCondition
+	err := wait.PollImmediate(waitPollInterval, timeout, func() (bool, error) {
+		for _, c := range conditions {
+			observed, err := observeCondition(ctx, client, mapper, c)
+			if err != nil {
+				return false, err
+			}
+			if observed != c.Status {
+				pending, status = c, observed
+				debug("[waitForConditions] %s: %s", c, status)
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+
+	if err == wait.ErrWaitTimeout {
+		return fmt.Errorf("timed out waiting for %s, last observed: %s", pending, status)
+	}
+	return err
+}
+
+// resettableRESTMapper is a RESTMapper whose discovery cache can be reset, so
+// that the kinds of CRDs installed by the release can be mapped
+type resettableRESTMapper interface {
+	meta.RESTMapper
+	Reset()
+}
+
+// observeCondition returns the status of the condition of the resource, or a
+// description of why it is not available
+func observeCondition(ctx context.Context, client dynamic.Interface, mapper meta.RESTMapper, c resourceCondition) (string, error) {
+	gv, err := schema.ParseGroupVersion(c.APIVersion)
+	if err != nil {
+		return "", err
+	}
+
+	mapping, err := mapper.RESTMapping(gv.WithKind(c.Kind).GroupKind(), gv.Version)
+	if err != nil {
+		if r, ok := mapper.(resettableRESTMapper); ok {
+			r.Reset()
+		}
+		return fmt.Sprintf("kind %s not served: %s", c.Kind, err), nil
+	}
+
+	var ri dynamic.ResourceInterface = client.Resource(mapping.Resource)
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		ri = client.Resource(mapping.Resource).Namespace(c.Namespace)
+	}
+
+	obj, err := ri.Get(ctx, c.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "resource not found", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	conditions, _, err := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	if err != nil {
+		return "", err
+	}
+
+	for _, raw := range conditions {
+		condition, ok := raw.(map[string]interface{})
+		if !ok || condition["type"] != c.ConditionType {
+			continue
+		}
+
+		status, _ := condition["status"].(string)
+		if status == c.Status {
+			return status, nil
+		}
+		if message, _ := condition["message"].(string); message != "" {
+			return fmt.Sprintf("%s (%s)", status, message), nil
+		}
+		return status, nil
+	}
+
+	return "condition not reported", nil
+}
+
+func waitForReleaseConditions(ctx context.Context, d resourceGetter, cfg *action.Configuration, r *release.Release) error {
+	conditions := expandResourceConditions(d, r.Namespace)
+	if len(conditions) == 0 {
+		return nil
+	}
+
+	config, err := cfg.RESTClientGetter.ToRESTConfig()
+	if err != nil {
+		return err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	dc, err := cfg.RESTClientGetter.ToDiscoveryClient()
+	if err != nil {
+		return err
+	}
+
+	timeout := time.Duration(d.Get("timeout").(int)) * time.Second
+	return waitForConditions(ctx, client, restmapper.NewDeferredDiscoveryRESTMapper(dc), conditions, timeout)
+}
+
+// crdEstablished returns the Established condition of the CRD
+func crdEstablished(name string) resourceCondition {
+	return resourceCondition{
+		APIVersion:    "apiextensions.k8s.io/v1",
+		Kind:          "CustomResourceDefinition",
+		Name:          name,
+		ConditionType: "Established",
+		Status:        "True",
+	}
+}
+
+// waitForCRDs waits, for at most `timeout`, until the CRDs listed in
+// `wait_for_crds` are established, e.g. by another release, and invalidates
+// the discovery of the cluster API so that their kinds can be mapped by the
+// install or upgrade
+func waitForCRDs(ctx context.Context, d resourceGetter, cfg *action.Configuration) error {
+	names := expandStringSlice(d.Get("wait_for_crds").([]interface{}))
+	if len(names) == 0 {
+		return nil
+	}
+
+	conditions := make([]resourceCondition, 0, len(names))
+	for _, name := range names {
+		conditions = append(conditions, crdEstablished(name))
+	}
+
+	config, err := cfg.RESTClientGetter.ToRESTConfig()
+	if err != nil {
+		return err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	dc, err := cfg.RESTClientGetter.ToDiscoveryClient()
+	if err != nil {
+		return err
+	}
+
+	timeout := time.Duration(d.Get("timeout").(int)) * time.Second
+	if err := waitForConditions(ctx, client, restmapper.NewDeferredDiscoveryRESTMapper(dc), conditions, timeout); err != nil {
+		return fmt.Errorf("CRDs required by the release are not established: %w", err)
+	}
+
+	dc.Invalidate()
+	return nil
+}
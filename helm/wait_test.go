@@ -0,0 +1,252 @@
+package helm
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"helm.sh/helm/v3/pkg/kube"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/cli-runtime/pkg/resource"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func TestRequiredReplicas(t *testing.T) {
+	assert.Equal(t, int32(2), requiredReplicas(4, 50))
+	assert.Equal(t, int32(2), requiredReplicas(3, 50))
+	assert.Equal(t, int32(1), requiredReplicas(1, 1))
+	assert.Equal(t, int32(4), requiredReplicas(4, 100))
+	assert.Equal(t, int32(0), requiredReplicas(0, 50))
+}
+
+func TestWaitForDeploymentsAvailable(t *testing.T) {
+	replicas := int32(4)
+	labels := map[string]string{"app": "web"}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "test",
+			UID:         "web-uid",
+			Annotations: map[string]string{revisionAnnotation: "2"},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+		},
+		// the pods of the previous revision are still available
+		Status: appsv1.DeploymentStatus{AvailableReplicas: 6, UpdatedReplicas: 2},
+	}
+	replicaSet := func(revision string, available int32) *appsv1.ReplicaSet {
+		return &appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "web-" + revision,
+				Namespace:       "test",
+				Labels:          labels,
+				Annotations:     map[string]string{revisionAnnotation: revision},
+				OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(deployment, appsv1.SchemeGroupVersion.WithKind("Deployment"))},
+			},
+			Status: appsv1.ReplicaSetStatus{AvailableReplicas: available},
+		}
+	}
+	client := fake.NewSimpleClientset(deployment, replicaSet("1", 4), replicaSet("2", 2))
+
+	manifest := `---
+# Source: test-chart/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+---
+# Source: test-chart/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+`
+	ctx := context.Background()
+
+	err := waitForDeploymentsAvailable(ctx, client, "test", manifest, 50, time.Second)
+	assert.NoError(t, err)
+
+	err = waitForDeploymentsAvailable(ctx, client, "test", manifest, 75, 100*time.Millisecond)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "deployment test/web has 2 available replicas of its current revision, 3 of 4 required")
+	}
+}
+
+func TestWithoutDeployments(t *testing.T) {
+	info := func(kind string) *resource.Info {
+		return &resource.Info{
+			Name:    strings.ToLower(kind),
+			Mapping: &meta.RESTMapping{GroupVersionKind: appsv1.SchemeGroupVersion.WithKind(kind)},
+		}
+	}
+
+	resources := withoutDeployments(kube.ResourceList{info("Deployment"), info("StatefulSet"), info("DaemonSet")})
+	names := []string{}
+	for _, r := range resources {
+		names = append(names, r.Name)
+	}
+	assert.Equal(t, []string{"statefulset", "daemonset"}, names)
+}
+
+func TestUnreadyWorkloads(t *testing.T) {
+	replicas := int32(3)
+	client := fake.NewSimpleClientset(
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test"},
+			Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+			Status:     appsv1.DeploymentStatus{ReadyReplicas: 1},
+		},
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "test"},
+			Spec:       appsv1.StatefulSetSpec{Replicas: &replicas},
+			Status:     appsv1.StatefulSetStatus{ReadyReplicas: 3},
+		},
+		&appsv1.DaemonSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "system"},
+			Status:     appsv1.DaemonSetStatus{DesiredNumberScheduled: 2},
+		},
+	)
+
+	manifest := `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+---
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: db
+---
+apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: agent
+  namespace: system
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: deleted
+`
+
+	unready, err := unreadyWorkloads(context.Background(), client, "test", manifest)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"Deployment test/web (1/3 ready)",
+		"DaemonSet system/agent (0/2 ready)",
+	}, unready)
+}
+
+func TestWaitForConditions(t *testing.T) {
+	interval := waitPollInterval
+	waitPollInterval = 10 * time.Millisecond
+	defer func() { waitPollInterval = interval }()
+
+	var pendingPolls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/example.com/v1/namespaces/test/clusters/main" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+			return
+		}
+
+		status := `"False","message":"waiting for nodes"`
+		if atomic.AddInt32(&pendingPolls, -1) < 0 {
+			status = `"True"`
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"apiVersion":"example.com/v1","kind":"Cluster","metadata":{"name":"main","namespace":"test"},` +
+			`"status":{"conditions":[{"type":"Synced","status":"True"},{"type":"Ready","status":` + status + `}]}}`))
+	}))
+	defer server.Close()
+
+	client, err := dynamic.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Cluster"}, meta.RESTScopeNamespace)
+
+	ctx := context.Background()
+	ready := func(name string) []resourceCondition {
+		return []resourceCondition{{APIVersion: "example.com/v1", Kind: "Cluster", Namespace: "test", Name: name, ConditionType: "Ready", Status: "True"}}
+	}
+
+	// the cluster becomes ready after two polls
+	atomic.StoreInt32(&pendingPolls, 2)
+	err = waitForConditions(ctx, client, mapper, ready("main"), time.Second)
+	assert.NoError(t, err)
+
+	atomic.StoreInt32(&pendingPolls, 1000)
+	err = waitForConditions(ctx, client, mapper, ready("main"), 50*time.Millisecond)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "timed out waiting for condition Ready=True of Cluster test/main, last observed: False (waiting for nodes)")
+	}
+
+	err = waitForConditions(ctx, client, mapper, ready("other"), 50*time.Millisecond)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "last observed: resource not found")
+	}
+}
+
+func TestWaitForCRDEstablished(t *testing.T) {
+	interval := waitPollInterval
+	waitPollInterval = 10 * time.Millisecond
+	defer func() { waitPollInterval = interval }()
+
+	var pendingPolls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/apiextensions.k8s.io/v1/customresourcedefinitions/widgets.example.com" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+			return
+		}
+
+		// the CRD of the other release is created after a poll, and
+		// established after another one
+		polls := atomic.AddInt32(&pendingPolls, -1)
+		if polls > 1 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+			return
+		}
+		status := `"False"`
+		if polls < 0 {
+			status = `"True"`
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"apiVersion":"apiextensions.k8s.io/v1","kind":"CustomResourceDefinition","metadata":{"name":"widgets.example.com"},` +
+			`"status":{"conditions":[{"type":"NamesAccepted","status":"True"},{"type":"Established","status":` + status + `}]}}`))
+	}))
+	defer server.Close()
+
+	client, err := dynamic.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Group: "apiextensions.k8s.io", Version: "v1", Kind: "CustomResourceDefinition"}, meta.RESTScopeRoot)
+
+	ctx := context.Background()
+	atomic.StoreInt32(&pendingPolls, 2)
+	err = waitForConditions(ctx, client, mapper, []resourceCondition{crdEstablished("widgets.example.com")}, time.Second)
+	assert.NoError(t, err)
+
+	err = waitForConditions(ctx, client, mapper, []resourceCondition{crdEstablished("gadgets.example.com")}, 50*time.Millisecond)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "timed out waiting for condition Established=True of CustomResourceDefinition gadgets.example.com, last observed: resource not found")
+	}
+}